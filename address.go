@@ -0,0 +1,212 @@
+package smtpsrv
+
+import (
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errUTF8Required = &smtp.SMTPError{
+	Code:         553,
+	EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+	Message:      "Non-ASCII addresses require SMTPUTF8",
+}
+
+// parseEnvelopeAddress parses a MAIL FROM or RCPT TO address, falling back to
+// the raw address when it is a plausible mailbox net/mail can't parse.
+func parseEnvelopeAddress(address string) (*mail.Address, error) {
+	addr, err := mail.ParseAddress(address)
+	if err == nil {
+		return addr, nil
+	}
+
+	if !utf8.ValidString(address) || strings.IndexFunc(address, unicode.IsSpace) != -1 {
+		return nil, err
+	}
+
+	ind := strings.LastIndex(address, "@")
+	if ind < 1 || ind == len(address)-1 {
+		return nil, err
+	}
+
+	return &mail.Address{Address: address}, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// headerAddressParser decodes the encoded words of the display names in any
+// charset
+var headerAddressParser = &mail.AddressParser{WordDecoder: mimeWordDecoder}
+
+// parseAddressListLenient parses an address list header value. When it is
+// malformed, e.g. with unquoted display names holding commas or bare
+// addresses with spaces, the addresses are recovered one by one and ok is
+// false.
+func parseAddressListLenient(s string) (addrs []*mail.Address, ok bool) {
+	addrs, err := headerAddressParser.ParseList(s)
+	if err == nil {
+		return addrs, true
+	}
+
+	addrs = nil
+
+	// the words without address, i.e. a display name split at its commas
+	var name []string
+	for _, item := range splitAddressList(s) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		addr, err := headerAddressParser.Parse(item)
+		if err != nil {
+			addr = recoverAddress(item)
+		}
+
+		if addr == nil {
+			name = append(name, item)
+			continue
+		}
+
+		if len(name) > 0 {
+			addr.Name = strings.TrimSpace(strings.Join(append(name, addr.Name), ", "))
+			name = nil
+		}
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, false
+}
+
+// splitAddressList splits at the commas outside of the quoted strings,
+// comments and angle addresses, dropping the group syntax
+func splitAddressList(s string) []string {
+	var items []string
+	var current strings.Builder
+	quoted, angle, depth := false, false, 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && (quoted || depth > 0) && i+1 < len(s):
+			current.WriteByte(c)
+			i++
+			c = s[i]
+		case c == '"' && depth == 0:
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth > 0:
+		case c == '<':
+			angle = true
+		case c == '>':
+			angle = false
+		case (c == ',' || c == ';') && !angle:
+			items = append(items, current.String())
+			current.Reset()
+			continue
+		case c == ':' && !angle && !strings.Contains(current.String(), "@"):
+			// the display name of a group
+			current.Reset()
+			continue
+		}
+		current.WriteByte(c)
+	}
+
+	return append(items, current.String())
+}
+
+// recoverAddress extracts the address of a malformed mailbox: its angle
+// address, or the word holding an "@", the other words being the display
+// name. It returns nil when there is none.
+func recoverAddress(s string) *mail.Address {
+	if start, end := strings.LastIndex(s, "<"), strings.LastIndex(s, ">"); start != -1 && end > start {
+		address := strings.TrimSpace(s[start+1 : end])
+		if strings.Contains(address, "@") {
+			return &mail.Address{
+				Name:    decodeMimeSentence(strings.Trim(strings.TrimSpace(s[:start]), `"`)),
+				Address: address,
+			}
+		}
+	}
+
+	words := strings.Fields(stripComments(s))
+	for i, word := range words {
+		if strings.Contains(word, "@") {
+			name := strings.Join(append(words[:i:i], words[i+1:]...), " ")
+			return &mail.Address{
+				Name:    decodeMimeSentence(strings.Trim(name, `"`)),
+				Address: strings.Trim(word, "<>"),
+			}
+		}
+	}
+
+	return nil
+}
+
+// AddressGroup is a named group of an address field (RFC 5322 section
+// 3.4), e.g. "Team: alice@example.com, bob@example.com;" or the empty
+// "undisclosed-recipients:;"
+type AddressGroup struct {
+	Name    string
+	Members []*mail.Address
+}
+
+// parseAddressGroups returns the groups of an address list header value
+func parseAddressGroups(s string) []AddressGroup {
+	var groups []AddressGroup
+
+	quoted, angle, depth := false, false, 0
+	start, group := 0, -1
+	var name string
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && (quoted || depth > 0):
+			i++
+		case c == '"' && depth == 0:
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth > 0:
+		case c == '<':
+			angle = true
+		case c == '>':
+			angle = false
+		case angle:
+		case c == ':' && group == -1 && !strings.Contains(s[start:i], "@"):
+			name = decodeMimeSentence(strings.Trim(strings.TrimSpace(stripComments(s[start:i])), `"`))
+			group = i + 1
+		case c == ';' && group != -1:
+			members, _ := parseAddressListLenient(s[group:i])
+			groups = append(groups, AddressGroup{Name: name, Members: members})
+			group, start = -1, i+1
+		case c == ',' && group == -1:
+			start = i + 1
+		}
+	}
+
+	if group != -1 && group <= len(s) {
+		// the group is not terminated
+		members, _ := parseAddressListLenient(s[group:])
+		groups = append(groups, AddressGroup{Name: name, Members: members})
+	}
+
+	return groups
+}
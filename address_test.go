@@ -0,0 +1,122 @@
+package smtpsrv
+
+import (
+	"net/mail"
+	"reflect"
+	"testing"
+)
+
+func TestParseEnvelopeAddress(t *testing.T) {
+	for _, c := range []struct {
+		address, want string
+	}{
+		{"alice@example.com", "alice@example.com"},
+		{"<alice@example.com>", "alice@example.com"},
+		// valid for the MTAs but not for net/mail
+		{"alice..dots@example.com", "alice..dots@example.com"},
+		{"alice.@example.com", "alice.@example.com"},
+		{"jöran@bücher.example", "jöran@bücher.example"},
+	} {
+		addr, err := parseEnvelopeAddress(c.address)
+		if err != nil {
+			t.Errorf("parse %q: %v", c.address, err)
+			continue
+		}
+
+		if addr.Address != c.want {
+			t.Errorf("parse %q = %q, want %q", c.address, addr.Address, c.want)
+		}
+	}
+
+	for _, address := range []string{
+		"",
+		"alice",
+		"@example.com",
+		"alice@",
+		"alice smith@example.com",
+		"alice\xff@example.com",
+	} {
+		if addr, err := parseEnvelopeAddress(address); err == nil {
+			t.Errorf("parse %q = %q, want an error", address, addr.Address)
+		}
+	}
+}
+
+// addressPairs returns the display names and addresses of addrs
+func addressPairs(addrs []*mail.Address) [][2]string {
+	var formatted [][2]string
+	for _, addr := range addrs {
+		formatted = append(formatted, [2]string{addr.Name, addr.Address})
+	}
+
+	return formatted
+}
+
+func TestParseAddressListLenient(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  [][2]string
+		ok    bool
+	}{
+		{
+			`Alice <alice@example.com>, bob@example.com`,
+			[][2]string{{"Alice", "alice@example.com"}, {"", "bob@example.com"}},
+			true,
+		},
+		{
+			`=?ISO-8859-2?Q?Kl=E1ra?= <klara@example.com>`,
+			[][2]string{{"Klára", "klara@example.com"}},
+			true,
+		},
+		{
+			// an unquoted display name holding a comma
+			`Doe, John <john@example.com>, jane@example.com`,
+			[][2]string{{"Doe, John", "john@example.com"}, {"", "jane@example.com"}},
+			false,
+		},
+		{
+			`John Doe john@example.com, "Jane" <jane@example.com`,
+			[][2]string{{"John Doe", "john@example.com"}, {"Jane", "jane@example.com"}},
+			false,
+		},
+		{
+			// the group syntax is dropped
+			`Team: Doe, John <john@example.com>, jane@example.com;`,
+			[][2]string{{"Doe, John", "john@example.com"}, {"", "jane@example.com"}},
+			false,
+		},
+	} {
+		addrs, ok := parseAddressListLenient(c.value)
+		if got := addressPairs(addrs); ok != c.ok || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parse %q = %q, %v, want %q, %v", c.value, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestParseAddressGroups(t *testing.T) {
+	groups := parseAddressGroups(`Team: Alice <alice@example.com>, bob@example.com;, carol@example.com, undisclosed-recipients:;, "Ops (on call)": dave@example.com`)
+
+	want := []struct {
+		name    string
+		members [][2]string
+	}{
+		{"Team", [][2]string{{"Alice", "alice@example.com"}, {"", "bob@example.com"}}},
+		{"undisclosed-recipients", nil},
+		// not terminated
+		{"Ops (on call)", [][2]string{{"", "dave@example.com"}}},
+	}
+
+	if len(groups) != len(want) {
+		t.Fatalf("got %d groups, want %d: %+v", len(groups), len(want), groups)
+	}
+
+	for i, group := range groups {
+		if got := addressPairs(group.Members); group.Name != want[i].name || !reflect.DeepEqual(got, want[i].members) {
+			t.Errorf("group %d = %q %q, want %q %q", i, group.Name, got, want[i].name, want[i].members)
+		}
+	}
+
+	if groups := parseAddressGroups("alice@example.com, Bob <bob@example.com>"); len(groups) != 0 {
+		t.Errorf("groups of a mailbox list = %+v, want none", groups)
+	}
+}
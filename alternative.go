@@ -0,0 +1,51 @@
+package smtpsrv
+
+import "strings"
+
+// BodyAlternative is a version of the body of a multipart/alternative
+type BodyAlternative struct {
+	// ContentType is the type of the part, e.g. "text/html", or
+	// "multipart/related" for an HTML body sent with its images
+	ContentType string
+
+	// Path is the path of the part, see Part.Path, the versions of a
+	// multipart/alternative only differ by their last number
+	Path string
+
+	// Body is the decoded body, the text of the text/enriched versions and
+	// the HTML body of the multipart/related ones
+	Body string
+}
+
+// alternative records a version of the current multipart/alternative
+func (s *parseState) alternative(contentType, body string) {
+	s.alternatives = append(s.alternatives, BodyAlternative{
+		ContentType: contentType,
+		Path:        partPath(s.path),
+		Body:        body,
+	})
+}
+
+// PreferredAlternative returns the alternative of the first content type
+// of the preference order having one, the last of that type as the senders
+// put their preferred versions last. Without preferences it returns the
+// last alternative. It is nil when none matches, e.g.
+// PreferredAlternative("text/plain", "text/enriched").
+func (e *Email) PreferredAlternative(contentTypes ...string) *BodyAlternative {
+	if len(contentTypes) == 0 {
+		if len(e.Alternatives) == 0 {
+			return nil
+		}
+		return &e.Alternatives[len(e.Alternatives)-1]
+	}
+
+	for _, contentType := range contentTypes {
+		for i := len(e.Alternatives) - 1; i >= 0; i-- {
+			if strings.EqualFold(e.Alternatives[i].ContentType, contentType) {
+				return &e.Alternatives[i]
+			}
+		}
+	}
+
+	return nil
+}
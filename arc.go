@@ -0,0 +1,615 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ARC chain validation results (RFC 8617 section 4.4)
+const (
+	ARCNone = "none"
+	ARCPass = "pass"
+	ARCFail = "fail"
+)
+
+const arcMaxInstances = 50
+
+var (
+	errARCChainFailed = errors.New("smtpsrv: the ARC chain failed, it can not be sealed")
+	errARCKey         = errors.New("smtpsrv: unsupported ARC key")
+
+	reARCSignatureValue = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+)
+
+// default signed header fields of the ARC-Message-Signature, when present
+var arcHeaderKeys = []string{
+	"From", "Sender", "Reply-To", "Subject", "Date", "Message-ID", "To", "Cc",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "DKIM-Signature",
+}
+
+// ARCResult is the outcome of an ARC chain validation
+type ARCResult struct {
+	// Result is ARCNone, ARCPass or ARCFail
+	Result string
+
+	// Instance is the number of ARC sets of the chain
+	Instance int
+
+	// Reason explains a failure
+	Reason string
+}
+
+// VerifyARC validates the ARC chain of the raw message, looking up the keys
+// with net.LookupTXT
+func VerifyARC(raw []byte) *ARCResult {
+	return verifyARC(newARCMessage(raw), net.LookupTXT)
+}
+
+// ARCSealConfig holds the ARC sealing settings
+type ARCSealConfig struct {
+	Domain   string
+	Selector string
+
+	// PrivateKey is a RSA or Ed25519 key, see ParseDKIMPrivateKey
+	PrivateKey crypto.Signer
+
+	// AuthServID identifies this server in ARC-Authentication-Results,
+	// defaults to Domain
+	AuthServID string
+
+	// LookupTXT defaults to net.LookupTXT
+	LookupTXT func(domain string) ([]string, error)
+}
+
+// ARCSealer adds an ARC set to forwarded messages, preserving the
+// authentication results seen by this server for the next hops
+type ARCSealer struct {
+	config ARCSealConfig
+}
+
+func NewARCSealer(cfg ARCSealConfig) (*ARCSealer, error) {
+	if cfg.AuthServID == "" {
+		cfg.AuthServID = cfg.Domain
+	}
+
+	if cfg.LookupTXT == nil {
+		cfg.LookupTXT = net.LookupTXT
+	}
+
+	if _, err := arcAlgorithm(cfg.PrivateKey); err != nil {
+		return nil, err
+	}
+
+	return &ARCSealer{
+		config: cfg,
+	}, nil
+}
+
+// Seal validates the ARC chain of the raw message and prepends a new ARC
+// set. results are the authentication results of this server, formatted as
+// in Authentication-Results without the authserv-id (e.g. "spf=pass
+// smtp.mailfrom=example.com; dkim=pass header.d=example.com"), the chain
+// validation result is appended to them. Messages whose chain already failed
+// can not be sealed.
+func (s *ARCSealer) Seal(raw []byte, results string) ([]byte, error) {
+	msg := newARCMessage(raw)
+
+	for _, field := range msg.fields("arc-seal") {
+		if parseARCTags(field.value())["cv"] == ARCFail {
+			return nil, errARCChainFailed
+		}
+	}
+
+	if msg.lastInstance() >= arcMaxInstances {
+		return nil, errARCChainFailed
+	}
+
+	chain := verifyARC(msg, s.config.LookupTXT)
+
+	algorithm, err := arcAlgorithm(s.config.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	instance := strconv.Itoa(msg.lastInstance() + 1)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	if results != "" {
+		results += "; "
+	}
+	results += "arc=" + chain.Result
+	aar := "ARC-Authentication-Results: i=" + instance + "; " + s.config.AuthServID + "; " + results + "\r\n"
+
+	// the message signature, over the header fields and the body
+	var keys []string
+	for _, key := range arcHeaderKeys {
+		if len(msg.fields(key)) > 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	bodyHash := sha256.Sum256(arcBodyRelaxed(msg.body))
+	ams := "ARC-Message-Signature: i=" + instance + "; a=" + algorithm + "; c=relaxed/relaxed; d=" + s.config.Domain +
+		"; s=" + s.config.Selector + "; t=" + timestamp + "; h=" + strings.Join(keys, ":") +
+		"; bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b="
+
+	hash := sha256.New()
+	for _, field := range msg.selectFields(keys) {
+		hash.Write([]byte(arcHeaderRelaxed(field)))
+	}
+	hash.Write([]byte(strings.TrimSuffix(arcHeaderRelaxed(ams), "\r\n")))
+
+	signature, err := arcSign(s.config.PrivateKey, hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	ams += foldSignature(signature) + "\r\n"
+
+	// the seal, over all the ARC sets
+	cv, sets := chain.Result, msg.arcSets()
+	as := "ARC-Seal: i=" + instance + "; a=" + algorithm + "; t=" + timestamp + "; cv=" + cv +
+		"; d=" + s.config.Domain + "; s=" + s.config.Selector + "; b="
+
+	hash = sha256.New()
+	if cv == ARCFail {
+		// a failed chain is not signed, only the new set (RFC 8617 section
+		// 5.1.2)
+		sets = nil
+	}
+	for _, set := range sets {
+		hash.Write([]byte(arcHeaderRelaxed(set.results.raw)))
+		hash.Write([]byte(arcHeaderRelaxed(set.signature.raw)))
+		hash.Write([]byte(arcHeaderRelaxed(set.seal.raw)))
+	}
+	hash.Write([]byte(arcHeaderRelaxed(aar)))
+	hash.Write([]byte(arcHeaderRelaxed(ams)))
+	hash.Write([]byte(strings.TrimSuffix(arcHeaderRelaxed(as), "\r\n")))
+
+	signature, err = arcSign(s.config.PrivateKey, hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	as += foldSignature(signature) + "\r\n"
+
+	sealed := make([]byte, 0, len(as)+len(ams)+len(aar)+len(msg.raw))
+	sealed = append(sealed, as...)
+	sealed = append(sealed, ams...)
+	sealed = append(sealed, aar...)
+	sealed = append(sealed, msg.raw...)
+
+	return sealed, nil
+}
+
+// Deliver returns a DeliverFunc sealing the messages before handing them to
+// next, their ARC-Authentication-Results only report the chain validation.
+func (s *ARCSealer) Deliver(next DeliverFunc) DeliverFunc {
+	return func(from string, to []string, msg []byte) error {
+		sealed, err := s.Seal(msg, "")
+		if err != nil {
+			return err
+		}
+
+		return next(from, to, sealed)
+	}
+}
+
+// arcMessage is a raw message split in header fields and body, with CRLF
+// line endings
+type arcMessage struct {
+	raw    []byte
+	header []arcField
+	body   []byte
+}
+
+type arcField struct {
+	name string // lowercase
+	raw  string // including the folding and the final CRLF
+	tags map[string]string
+}
+
+type arcSet struct {
+	results, signature, seal *arcField
+}
+
+func newARCMessage(raw []byte) *arcMessage {
+	raw = bytes.Replace(raw, []byte("\r\n"), []byte("\n"), -1)
+	raw = bytes.Replace(raw, []byte("\n"), []byte("\r\n"), -1)
+
+	msg := &arcMessage{raw: raw}
+
+	header := raw
+	if ind := bytes.Index(raw, []byte("\r\n\r\n")); ind != -1 {
+		header, msg.body = raw[:ind+2], raw[ind+4:]
+	}
+
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(msg.header) > 0 {
+			msg.header[len(msg.header)-1].raw += line
+			continue
+		}
+
+		name := line
+		if ind := strings.Index(line, ":"); ind != -1 {
+			name = line[:ind]
+		}
+		msg.header = append(msg.header, arcField{name: strings.ToLower(strings.TrimSpace(name)), raw: line})
+	}
+
+	return msg
+}
+
+// fields returns the fields named key, in header order
+func (msg *arcMessage) fields(key string) []*arcField {
+	key = strings.ToLower(key)
+
+	var fields []*arcField
+	for i := range msg.header {
+		if msg.header[i].name == key {
+			fields = append(fields, &msg.header[i])
+		}
+	}
+
+	return fields
+}
+
+// selectFields returns the fields signed for the h= tag keys, each key
+// selecting the last unused instance of the field (RFC 6376 section 5.4.2)
+func (msg *arcMessage) selectFields(keys []string) []string {
+	used := map[*arcField]bool{}
+
+	var selected []string
+	for _, key := range keys {
+		fields := msg.fields(strings.TrimSpace(key))
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[fields[i]] {
+				used[fields[i]] = true
+				selected = append(selected, fields[i].raw)
+				break
+			}
+		}
+	}
+
+	return selected
+}
+
+// lastInstance returns the highest instance of the ARC header fields
+func (msg *arcMessage) lastInstance() int {
+	last := 0
+	for _, kind := range []string{"arc-authentication-results", "arc-message-signature", "arc-seal"} {
+		for _, field := range msg.fields(kind) {
+			instance, _ := strconv.Atoi(parseARCTags(strings.SplitN(field.value(), ";", 2)[0])["i"])
+			if instance > last {
+				last = instance
+			}
+		}
+	}
+
+	return last
+}
+
+// arcSets returns the ARC sets ordered by instance, nil when the sets are
+// malformed
+func (msg *arcMessage) arcSets() []arcSet {
+	byInstance := map[int]*arcSet{}
+
+	for _, kind := range []string{"arc-authentication-results", "arc-message-signature", "arc-seal"} {
+		for _, field := range msg.fields(kind) {
+			field.tags = parseARCTags(field.value())
+			if kind == "arc-authentication-results" {
+				// only the instance is a tag, the results follow it
+				field.tags = parseARCTags(strings.SplitN(field.value(), ";", 2)[0])
+			}
+
+			instance, err := strconv.Atoi(field.tags["i"])
+			if err != nil || instance < 1 || instance > arcMaxInstances {
+				return nil
+			}
+
+			set, ok := byInstance[instance]
+			if !ok {
+				set = &arcSet{}
+				byInstance[instance] = set
+			}
+
+			slot := &set.results
+			if kind == "arc-message-signature" {
+				slot = &set.signature
+			} else if kind == "arc-seal" {
+				slot = &set.seal
+			}
+
+			if *slot != nil {
+				// duplicated instance
+				return nil
+			}
+			*slot = field
+		}
+	}
+
+	sets := make([]arcSet, len(byInstance))
+	for i := range sets {
+		set, ok := byInstance[i+1]
+		if !ok || set.results == nil || set.signature == nil || set.seal == nil {
+			return nil
+		}
+		sets[i] = *set
+	}
+
+	return sets
+}
+
+func (f *arcField) value() string {
+	if ind := strings.Index(f.raw, ":"); ind != -1 {
+		return f.raw[ind+1:]
+	}
+
+	return ""
+}
+
+// verifyARC validates the chain as described in RFC 8617 section 5.2
+func verifyARC(msg *arcMessage, lookupTXT func(string) ([]string, error)) *ARCResult {
+	if len(msg.fields("arc-seal"))+len(msg.fields("arc-message-signature"))+len(msg.fields("arc-authentication-results")) == 0 {
+		return &ARCResult{Result: ARCNone}
+	}
+
+	sets := msg.arcSets()
+	if sets == nil {
+		return &ARCResult{Result: ARCFail, Reason: "malformed ARC sets"}
+	}
+
+	result := &ARCResult{Result: ARCFail, Instance: len(sets)}
+
+	for i, set := range sets {
+		cv := set.seal.tags["cv"]
+		if (i == 0 && cv != ARCNone) || (i > 0 && cv != ARCPass) {
+			result.Reason = fmt.Sprintf("ARC-Seal i=%d has cv=%s", i+1, cv)
+			return result
+		}
+	}
+
+	if err := verifyARCMessageSignature(msg, sets[len(sets)-1].signature, lookupTXT); err != nil {
+		result.Reason = fmt.Sprintf("ARC-Message-Signature i=%d: %v", len(sets), err)
+		return result
+	}
+
+	for i := len(sets) - 1; i >= 0; i-- {
+		if err := verifyARCSeal(sets[:i+1], lookupTXT); err != nil {
+			result.Reason = fmt.Sprintf("ARC-Seal i=%d: %v", i+1, err)
+			return result
+		}
+	}
+
+	result.Result = ARCPass
+	return result
+}
+
+func verifyARCMessageSignature(msg *arcMessage, ams *arcField, lookupTXT func(string) ([]string, error)) error {
+	canon := strings.SplitN(ams.tags["c"], "/", 2)
+	headerCanon, bodyCanon := canon[0], "simple"
+	if len(canon) == 2 {
+		bodyCanon = canon[1]
+	}
+	if headerCanon == "" {
+		headerCanon = "simple"
+	}
+
+	body := arcBodySimple(msg.body)
+	if bodyCanon == "relaxed" {
+		body = arcBodyRelaxed(msg.body)
+	}
+
+	bodyHash := sha256.Sum256(body)
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != ams.tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+
+	canonicalize := func(field string) string {
+		if headerCanon == "relaxed" {
+			return arcHeaderRelaxed(field)
+		}
+		return field
+	}
+
+	hash := sha256.New()
+	for _, field := range msg.selectFields(strings.Split(ams.tags["h"], ":")) {
+		hash.Write([]byte(canonicalize(field)))
+	}
+	hash.Write([]byte(strings.TrimSuffix(canonicalize(arcStripSignature(ams.raw)), "\r\n")))
+
+	return arcVerify(ams.tags, hash.Sum(nil), lookupTXT)
+}
+
+// verifyARCSeal validates the seal of the last of the sets
+func verifyARCSeal(sets []arcSet, lookupTXT func(string) ([]string, error)) error {
+	hash := sha256.New()
+	for i, set := range sets {
+		hash.Write([]byte(arcHeaderRelaxed(set.results.raw)))
+		hash.Write([]byte(arcHeaderRelaxed(set.signature.raw)))
+		if i < len(sets)-1 {
+			hash.Write([]byte(arcHeaderRelaxed(set.seal.raw)))
+		}
+	}
+
+	seal := sets[len(sets)-1].seal
+	hash.Write([]byte(strings.TrimSuffix(arcHeaderRelaxed(arcStripSignature(seal.raw)), "\r\n")))
+
+	return arcVerify(seal.tags, hash.Sum(nil), lookupTXT)
+}
+
+// arcVerify checks the b= signature of the hashed header with the key
+// published for its d= and s= tags
+func arcVerify(tags map[string]string, hashed []byte, lookupTXT func(string) ([]string, error)) error {
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+
+	txts, err := lookupTXT(tags["s"] + "._domainkey." + tags["d"])
+	if err != nil {
+		return err
+	}
+
+	record := parseARCTags(strings.Join(txts, ""))
+	key, err := base64.StdEncoding.DecodeString(record["p"])
+	if err != nil || len(key) == 0 {
+		return errors.New("no key for signature")
+	}
+
+	switch tags["a"] {
+	case "rsa-sha256":
+		pub, err := x509.ParsePKIXPublicKey(key)
+		if err != nil {
+			pub, err = x509.ParsePKCS1PublicKey(key)
+			if err != nil {
+				return err
+			}
+		}
+
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errARCKey
+		}
+		return rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, hashed, signature)
+	case "ed25519-sha256":
+		if len(key) != ed25519.PublicKeySize {
+			return errARCKey
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key), hashed, signature) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %q", tags["a"])
+	}
+}
+
+func arcAlgorithm(key crypto.Signer) (string, error) {
+	if key == nil {
+		return "", errARCKey
+	}
+
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	default:
+		return "", errARCKey
+	}
+}
+
+func arcSign(key crypto.Signer, hashed []byte) (string, error) {
+	opts := crypto.SHA256
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		// RFC 8463 signs the hash itself
+		opts = crypto.Hash(0)
+	}
+
+	signature, err := key.Sign(rand.Reader, hashed, opts)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+// foldSignature wraps a base64 signature on several header lines
+func foldSignature(signature string) string {
+	var folded []string
+	for len(signature) > 72 {
+		folded = append(folded, signature[:72])
+		signature = signature[72:]
+	}
+	folded = append(folded, signature)
+
+	return strings.Join(folded, "\r\n\t")
+}
+
+// arcStripSignature empties the b= tag of a signature header field
+func arcStripSignature(field string) string {
+	ind := strings.Index(field, ":")
+	return field[:ind+1] + reARCSignatureValue.ReplaceAllString(field[ind+1:], "$1$2")
+}
+
+func parseARCTags(s string) map[string]string {
+	tags := map[string]string{}
+	for _, tag := range strings.Split(s, ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		// folding whitespace is not significant within the values
+		tags[strings.TrimSpace(kv[0])] = strings.Join(strings.Fields(kv[1]), "")
+	}
+
+	return tags
+}
+
+// arcHeaderRelaxed is the relaxed header canonicalization of RFC 6376
+// section 3.4.2
+func arcHeaderRelaxed(field string) string {
+	ind := strings.Index(field, ":")
+	if ind == -1 {
+		return field
+	}
+
+	name := strings.ToLower(strings.TrimSpace(field[:ind]))
+	value := strings.Replace(field[ind+1:], "\r\n", "", -1)
+	value = strings.Join(strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == '\t'
+	}), " ")
+
+	return name + ":" + value + "\r\n"
+}
+
+// arcBodyRelaxed is the relaxed body canonicalization of RFC 6376 section 3.4.4
+func arcBodyRelaxed(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		line = strings.Join(strings.FieldsFunc(line, func(r rune) bool {
+			return r == ' ' || r == '\t'
+		}), " ")
+		if strings.HasPrefix(lines[i], " ") || strings.HasPrefix(lines[i], "\t") {
+			line = " " + line
+		}
+		lines[i] = line
+	}
+
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// arcBodySimple is the simple body canonicalization of RFC 6376 section 3.4.3
+func arcBodySimple(body []byte) []byte {
+	for bytes.HasSuffix(body, []byte("\r\n")) {
+		body = body[:len(body)-2]
+	}
+
+	return append(append([]byte(nil), body...), '\r', '\n')
+}
@@ -0,0 +1,196 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const arcTestMessage = "From: Alice <alice@origin.example>\r\n" +
+	"To: list@forwarder.example\r\n" +
+	"Subject: Quarterly report\r\n" +
+	"Date: Mon, 12 Oct 2026 09:30:00 +0000\r\n" +
+	"Message-ID: <report@origin.example>\r\n" +
+	"\r\n" +
+	"The report is attached.\r\n"
+
+// arcTestKeys publishes the public keys of the sealers, as the DNS would
+type arcTestKeys map[string]string
+
+func (keys arcTestKeys) lookupTXT(domain string) ([]string, error) {
+	record, ok := keys[domain]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+
+	return []string{record}, nil
+}
+
+func (keys arcTestKeys) sealer(t *testing.T, domain string, key crypto.Signer) *ARCSealer {
+	t.Helper()
+
+	var record string
+	switch pub := key.Public().(type) {
+	case ed25519.PublicKey:
+		record = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	default:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatalf("marshal key: %v", err)
+		}
+		record = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	}
+	keys["arc._domainkey."+domain] = record
+
+	sealer, err := NewARCSealer(ARCSealConfig{
+		Domain:     domain,
+		Selector:   "arc",
+		PrivateKey: key,
+		LookupTXT:  keys.lookupTXT,
+	})
+	if err != nil {
+		t.Fatalf("sealer: %v", err)
+	}
+
+	return sealer
+}
+
+func newARCTestKey(t *testing.T) crypto.Signer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	return key
+}
+
+func seal(t *testing.T, sealer *ARCSealer, raw []byte, results string) []byte {
+	t.Helper()
+
+	sealed, err := sealer.Seal(raw, results)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+
+	return sealed
+}
+
+func TestARCNone(t *testing.T) {
+	result := verifyARC(newARCMessage([]byte(arcTestMessage)), arcTestKeys{}.lookupTXT)
+	if result.Result != ARCNone {
+		t.Errorf("result = %+v, want %s", result, ARCNone)
+	}
+}
+
+func TestARCChain(t *testing.T) {
+	keys := arcTestKeys{}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	first := keys.sealer(t, "forwarder.example", rsaKey)
+	second := keys.sealer(t, "list.example", newARCTestKey(t))
+
+	sealed := seal(t, first, []byte(arcTestMessage), "spf=pass smtp.mailfrom=origin.example")
+	if !bytes.HasPrefix(sealed, []byte("ARC-Seal: i=1; a=rsa-sha256; ")) || !bytes.Contains(sealed, []byte(" cv=none;")) {
+		t.Fatalf("first set:\n%s", sealed)
+	}
+
+	if result := verifyARC(newARCMessage(sealed), keys.lookupTXT); result.Result != ARCPass || result.Instance != 1 {
+		t.Fatalf("first hop: result = %+v, want %s at i=1", result, ARCPass)
+	}
+
+	sealed = seal(t, second, sealed, "")
+	if !bytes.HasPrefix(sealed, []byte("ARC-Seal: i=2; a=ed25519-sha256; ")) || !bytes.Contains(sealed, []byte(" cv=pass;")) {
+		t.Fatalf("second set:\n%s", sealed)
+	}
+
+	if !bytes.Contains(sealed, []byte("ARC-Authentication-Results: i=2; list.example; arc=pass\r\n")) {
+		t.Errorf("the second set does not report the chain validation:\n%s", sealed)
+	}
+
+	if result := verifyARC(newARCMessage(sealed), keys.lookupTXT); result.Result != ARCPass || result.Instance != 2 {
+		t.Fatalf("second hop: result = %+v, want %s at i=2", result, ARCPass)
+	}
+}
+
+func TestARCChainTampered(t *testing.T) {
+	keys := arcTestKeys{}
+	first := keys.sealer(t, "forwarder.example", newARCTestKey(t))
+	second := keys.sealer(t, "list.example", newARCTestKey(t))
+
+	sealed := seal(t, second, seal(t, first, []byte(arcTestMessage), "spf=pass smtp.mailfrom=origin.example"), "")
+
+	for _, c := range []struct {
+		name, old, new string
+	}{
+		{"body", "The report is attached.", "The report is not attached."},
+		{"signed header", "Subject: Quarterly report", "Subject: Quarterly invoice"},
+		{"first results", "forwarder.example; spf=pass", "forwarder.example; spf=fail"},
+		{"first seal", "i=1; a=ed25519-sha256; t=", "i=1; a=ed25519-sha256;  t=x"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tampered := strings.Replace(string(sealed), c.old, c.new, 1)
+			if tampered == string(sealed) {
+				t.Fatalf("%q not found in:\n%s", c.old, sealed)
+			}
+
+			if result := verifyARC(newARCMessage([]byte(tampered)), keys.lookupTXT); result.Result != ARCFail {
+				t.Errorf("result = %+v, want %s", result, ARCFail)
+			}
+		})
+	}
+
+	// the next hops can not check the chain without the keys
+	if result := verifyARC(newARCMessage(sealed), arcTestKeys{}.lookupTXT); result.Result != ARCFail {
+		t.Errorf("result without the keys = %+v, want %s", result, ARCFail)
+	}
+}
+
+func TestARCSealFailedChain(t *testing.T) {
+	keys := arcTestKeys{}
+	first := keys.sealer(t, "forwarder.example", newARCTestKey(t))
+	second := keys.sealer(t, "list.example", newARCTestKey(t))
+	third := keys.sealer(t, "relay.example", newARCTestKey(t))
+
+	sealed := seal(t, first, []byte(arcTestMessage), "")
+	tampered := bytes.Replace(sealed, []byte("attached"), []byte("missing"), 1)
+
+	// the failure is sealed once, then the chain ends
+	sealed = seal(t, second, tampered, "")
+	if !bytes.Contains(sealed, []byte(" cv=fail;")) {
+		t.Fatalf("the failed chain is not sealed with cv=fail:\n%s", sealed)
+	}
+
+	if _, err := third.Seal(sealed, ""); err != errARCChainFailed {
+		t.Errorf("seal of a failed chain: err = %v, want %v", err, errARCChainFailed)
+	}
+
+	if result := verifyARC(newARCMessage(sealed), keys.lookupTXT); result.Result != ARCFail {
+		t.Errorf("result = %+v, want %s", result, ARCFail)
+	}
+}
+
+func TestARCMalformedSets(t *testing.T) {
+	keys := arcTestKeys{}
+	sealer := keys.sealer(t, "forwarder.example", newARCTestKey(t))
+
+	sealed := seal(t, sealer, []byte(arcTestMessage), "")
+
+	// a set without its seal
+	i := bytes.Index(sealed, []byte("ARC-Message-Signature:"))
+	if result := verifyARC(newARCMessage(sealed[i:]), keys.lookupTXT); result.Result != ARCFail {
+		t.Errorf("result = %+v, want %s", result, ARCFail)
+	}
+}
@@ -0,0 +1,172 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ArchiveOpenFunc creates the archive file of the given name, a slash
+// separated path such as "2006/01/02/messages-150405.000000000.mbox.gz"
+type ArchiveOpenFunc func(name string) (io.WriteCloser, error)
+
+// ArchiverConfig holds the archiver settings
+type ArchiverConfig struct {
+	// Dir is the directory of the archive files, they are written to a
+	// sub-directory per day
+	Dir string
+
+	// Open, when set, creates the archive files instead of Dir, e.g. to
+	// upload them to an object storage
+	Open ArchiveOpenFunc
+
+	// Compress gzips the archive files
+	Compress bool
+
+	// MaxSize and MaxAge, when set, start a new archive file once the current
+	// one holds MaxSize bytes of messages or is older than MaxAge. A new file
+	// is also started every day.
+	MaxSize int64
+	MaxAge  time.Duration
+}
+
+// Archiver appends the messages to archive files in the mboxrd format, the
+// archive files are rotated by date, size and age.
+type Archiver struct {
+	config ArchiverConfig
+
+	mu      sync.Mutex
+	file    io.WriteCloser
+	gz      *gzip.Writer
+	day     string
+	opened  time.Time
+	written int64
+}
+
+func NewArchiver(cfg ArchiverConfig) *Archiver {
+	if cfg.Open == nil {
+		dir := cfg.Dir
+		cfg.Open = func(name string) (io.WriteCloser, error) {
+			path := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				return nil, err
+			}
+
+			return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		}
+	}
+
+	return &Archiver{
+		config: cfg,
+	}
+}
+
+// Archive appends the message under a From_ line naming the envelope sender,
+// it is a DeliverFunc.
+func (a *Archiver) Archive(from string, to []string, msg []byte) error {
+	now := time.Now()
+
+	var buf bytes.Buffer
+	writeMboxMessage(&buf, from, now, msg)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file != nil && a.expired(now) {
+		if err := a.closeFile(); err != nil {
+			return err
+		}
+	}
+
+	if a.file == nil {
+		if err := a.openFile(now); err != nil {
+			return err
+		}
+	}
+
+	if a.gz != nil {
+		if _, err := a.gz.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		// the archived messages are readable even if the file is never closed
+		if err := a.gz.Flush(); err != nil {
+			return err
+		}
+	} else if _, err := a.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	a.written += int64(buf.Len())
+
+	return nil
+}
+
+// Close closes the current archive file, the next message starts a new one
+func (a *Archiver) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+
+	return a.closeFile()
+}
+
+// expired reports whether the current archive file must be rotated
+func (a *Archiver) expired(now time.Time) bool {
+	return now.Format("2006/01/02") != a.day ||
+		(a.config.MaxSize > 0 && a.written >= a.config.MaxSize) ||
+		(a.config.MaxAge > 0 && now.Sub(a.opened) >= a.config.MaxAge)
+}
+
+func (a *Archiver) openFile(now time.Time) error {
+	name := now.Format("2006/01/02/messages-150405.000000000") + ".mbox"
+	if a.config.Compress {
+		name += ".gz"
+	}
+
+	file, err := a.config.Open(name)
+	if err != nil {
+		return err
+	}
+
+	a.file, a.day, a.opened, a.written = file, now.Format("2006/01/02"), now, 0
+	if a.config.Compress {
+		a.gz = gzip.NewWriter(file)
+	}
+
+	return nil
+}
+
+func (a *Archiver) closeFile() error {
+	var err error
+	if a.gz != nil {
+		err = a.gz.Close()
+	}
+
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	a.file, a.gz = nil, nil
+
+	return err
+}
+
+// archive archives the accepted message of the transaction
+func (a *Archiver) archive(c *Context) error {
+	raw, err := c.Raw()
+	if err != nil {
+		return err
+	}
+
+	from := ""
+	if c.From() != nil {
+		from = c.From().Address
+	}
+
+	return a.Archive(from, c.deliveryRecipients(), raw)
+}
@@ -0,0 +1,270 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// sniffLen is the length of the content read by http.DetectContentType
+const sniffLen = 512
+
+// the signatures http.DetectContentType does not know
+var attachmentSignatures = []struct {
+	magic       string
+	contentType string
+}{
+	{"MZ", "application/x-msdownload"},
+	{"\x7fELF", "application/x-executable"},
+	{"7z\xbc\xaf\x27\x1c", "application/x-7z-compressed"},
+	{"BZh", "application/x-bzip2"},
+	{"\xfd7zXZ\x00", "application/x-xz"},
+	{"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "application/x-ole-storage"},
+	{"{\\rtf", "application/rtf"},
+	{"\x78\x9f\x3e\x22", contentTypeMSTNEF},
+}
+
+// the containers whose type is given by the extension of the filename
+var attachmentContainers = map[string]bool{
+	"application/zip":           true,
+	"application/x-ole-storage": true,
+}
+
+// describeAttachments sets the size, hash and detected type of the
+// attachments held in memory
+func (e *Email) describeAttachments() error {
+	for i := range e.Attachments {
+		a := &e.Attachments[i]
+		if a.Data == nil {
+			continue
+		}
+
+		data, err := readRewind(a.Data)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		a.Size = int64(len(data))
+		a.SHA256 = hex.EncodeToString(sum[:])
+		a.DetectedContentType = sniffContentType(data, a.ContentType, a.Filename)
+	}
+
+	return nil
+}
+
+// sniffContentType detects the type of the content from its first bytes,
+// the declared type is kept when the content is not recognized, or is text
+// and the declared type is a text format
+func sniffContentType(head []byte, declared, filename string) string {
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+	declared = strings.ToLower(strings.TrimSpace(declared))
+
+	detected := ""
+	for _, sig := range attachmentSignatures {
+		if bytes.HasPrefix(head, []byte(sig.magic)) {
+			detected = sig.contentType
+			break
+		}
+	}
+	if detected == "" {
+		detected = strings.Split(http.DetectContentType(head), ";")[0]
+	}
+
+	byExtension := strings.Split(mime.TypeByExtension(strings.ToLower(path.Ext(filename))), ";")[0]
+
+	switch {
+	case attachmentContainers[detected] && byExtension != "":
+		// e.g. the OOXML documents are zip archives
+		if byExtension != "application/octet-stream" {
+			return byExtension
+		}
+		return detected
+	case detected == "application/octet-stream" || len(head) == 0:
+		if declared != "" && declared != "application/octet-stream" {
+			return declared
+		}
+		if byExtension != "" {
+			return byExtension
+		}
+		return "application/octet-stream"
+	case detected == "text/plain" && isTextContentType(declared):
+		return declared
+	}
+
+	return detected
+}
+
+func isTextContentType(contentType string) bool {
+	if strings.HasPrefix(contentType, "text/") {
+		return true
+	}
+
+	switch contentType {
+	case "application/json", "application/xml", "application/javascript", "application/x-sh",
+		"application/pgp-signature", "application/pgp-keys", "application/x-pem-file",
+		"message/rfc822", "message/delivery-status":
+		return true
+	}
+
+	return strings.HasSuffix(contentType, "+xml") || strings.HasSuffix(contentType, "+json")
+}
+
+// headBuffer keeps the first bytes written to it, for sniffing
+type headBuffer struct {
+	bytes.Buffer
+}
+
+func (b *headBuffer) Write(p []byte) (int, error) {
+	if room := sniffLen - b.Len(); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		b.Buffer.Write(p[:room])
+	}
+
+	return len(p), nil
+}
+
+// maxFilenameBytes is the filename length limit of the common filesystems
+const maxFilenameBytes = 255
+
+var errAttachmentStored = errors.New("smtpsrv: stored attachments can not be saved")
+
+// the device names Windows reserves in every directory
+var reservedFilenames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// SaveTo writes the attachment to a new file of dir and returns its path.
+// The filename is stripped of its directories and of the characters
+// filesystems reject, and numbered as "name (1).ext" when the file exists.
+func (a Attachment) SaveTo(dir string) (string, error) {
+	if a.Stored != nil {
+		return "", errAttachmentStored
+	}
+
+	data, err := readRewind(a.Data)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	name := SanitizeFilename(a.Filename)
+	if name == "" {
+		name = "attachment"
+		if exts, _ := mime.ExtensionsByType(a.ContentType); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			suffix := " (" + strconv.Itoa(i) + ")"
+			candidate = truncateUTF8(base, maxFilenameBytes-len(suffix)-len(ext)) + suffix + ext
+		}
+		p := filepath.Join(dir, candidate)
+
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			os.Remove(p)
+			return "", err
+		}
+
+		return p, f.Close()
+	}
+}
+
+// SaveAttachments writes the attachments to dir, see Attachment.SaveTo, and
+// returns the paths written until the first error
+func (e *Email) SaveAttachments(dir string) ([]string, error) {
+	var paths []string
+	for _, a := range e.Attachments {
+		p, err := a.SaveTo(dir)
+		if err != nil {
+			return paths, err
+		}
+		paths = append(paths, p)
+	}
+
+	return paths, nil
+}
+
+// SanitizeFilename returns a filename safe to create on the common
+// filesystems: without directories, control characters, the characters
+// Windows rejects, the leading dots and trailing dots and spaces, nor the
+// reserved device names, within 255 bytes. It is "" when nothing is left.
+func SanitizeFilename(name string) string {
+	// the directories of both separators
+	if ind := strings.LastIndexAny(name, `/\`); ind != -1 {
+		name = name[ind+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r < ' ' || r == 0x7f || r == utf8.RuneError:
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+
+	name = strings.TrimLeft(strings.TrimRight(name, ". "), ". ")
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if reservedFilenames[strings.ToLower(base)] {
+		name = "_" + name
+	}
+
+	if len(name) > maxFilenameBytes {
+		if len(ext) > 16 {
+			ext = ""
+		}
+		base = truncateUTF8(strings.TrimSuffix(name, ext), maxFilenameBytes-len(ext))
+		name = base + ext
+	}
+
+	return name
+}
+
+// truncateUTF8 truncates s to at most n bytes, between runes
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
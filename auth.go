@@ -0,0 +1,167 @@
+package smtpsrv
+
+import (
+	"errors"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// AuthMechanisms advertises PLAIN and LOGIN when an AuthFunc is configured,
+// and EXTERNAL to the clients presenting a verified certificate when a
+// CertAuthFunc is
+func (s *Session) AuthMechanisms() []string {
+	if !s.authAllowed() {
+		return nil
+	}
+
+	var mechanisms []string
+	if s.auther != nil {
+		mechanisms = append(mechanisms, sasl.Plain, sasl.Login)
+	}
+
+	if s.config.CertAuth != nil && s.verifiedChain() != nil {
+		mechanisms = append(mechanisms, sasl.External)
+	}
+
+	return mechanisms
+}
+
+// Auth returns the SASL server of the mechanism, validating the credentials with the AuthFunc
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if s.auther == nil && (mech != sasl.External || s.config.CertAuth == nil) {
+		return nil, smtp.ErrAuthUnsupported
+	}
+
+	if !s.authAllowed() {
+		return nil, smtpError(ErrEncryptionRequired)
+	}
+
+	if s.config.AuthLockout != nil && s.config.AuthLockout.Banned(addrIP(s.conn.Conn().RemoteAddr())) {
+		s.log("auth", "err", errAuthBanned)
+		return nil, errAuthBanned
+	}
+
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if identity != "" && identity != username {
+				return errors.New("identities not supported")
+			}
+			return s.traceAuth(sasl.Plain, func() error {
+				return s.authenticate(username, password)
+			})
+		}), nil
+	case sasl.Login:
+		return &loginServer{authenticate: func(username, password string) error {
+			return s.traceAuth(sasl.Login, func() error {
+				return s.authenticate(username, password)
+			})
+		}}, nil
+	case sasl.External:
+		if s.config.CertAuth == nil {
+			return nil, smtp.ErrAuthUnknownMechanism
+		}
+		return sasl.NewExternalServer(func(identity string) error {
+			return s.traceAuth(sasl.External, func() error {
+				return s.certAuthenticate(identity)
+			})
+		}), nil
+	}
+
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+// traceAuth runs an authentication attempt within an smtp.auth span, a child
+// of the transaction span for the certificates authenticated at MAIL
+func (s *Session) traceAuth(mechanism string, authenticate func() error) error {
+	_, span := s.config.tracer().Start(s.context(), "smtp.auth", map[string]string{
+		"smtp.session_id":     s.id,
+		"smtp.auth_mechanism": mechanism,
+	})
+	err := authenticate()
+	endSpan(span, err)
+
+	return err
+}
+
+func (s *Session) authenticate(username, password string) error {
+	err := s.auther(username, password)
+	s.authEvent(username, err == nil)
+
+	if err != nil {
+		s.log("auth", "username", username, "err", err)
+		return smtp.ErrAuthFailed
+	}
+
+	s.username, s.password = &username, &password
+	s.log("auth", "username", username, "err", nil)
+
+	return nil
+}
+
+// authEvent reports the attempt to the OnAuth hook and the lockout
+func (s *Session) authEvent(username string, success bool) {
+	ip := addrIP(s.conn.Conn().RemoteAddr())
+
+	if s.config.AuthLockout != nil {
+		s.config.AuthLockout.Record(ip, username, success)
+	}
+
+	if s.config.OnAuth != nil {
+		s.config.OnAuth(ip, username, success)
+	}
+
+	if success {
+		s.emit(func(info EventInfo) Event {
+			return &AuthSucceeded{EventInfo: info, Username: username}
+		})
+	} else {
+		s.emitRejected("AUTH", smtp.ErrAuthFailed)
+	}
+}
+
+// authAllowed reports whether AUTH is offered to the session, see
+// ServerConfig.DisableInsecureAuth
+func (s *Session) authAllowed() bool {
+	if !s.config.DisableInsecureAuth && !s.config.Submission {
+		return true
+	}
+
+	_, isTLS := s.tlsState()
+	return isTLS
+}
+
+func (s *Session) authenticated() bool {
+	return s.password != nil || s.certAuthenticated || s.proxyLogin() != ""
+}
+
+// proxyLogin returns the login supplied by a proxy with XCLIENT, if any
+func (s *Session) proxyLogin() string {
+	if s.proto == nil {
+		return ""
+	}
+
+	_, login := s.proto.client()
+	return login
+}
+
+// loginServer implements the server side of the obsolete but widespread LOGIN mechanism
+type loginServer struct {
+	authenticate func(username, password string) error
+	username     *string
+}
+
+func (ls *loginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if response == nil {
+		return []byte("Username:"), false, nil
+	}
+
+	if ls.username == nil {
+		username := string(response)
+		ls.username = &username
+		return []byte("Password:"), false, nil
+	}
+
+	return nil, true, ls.authenticate(*ls.username, string(response))
+}
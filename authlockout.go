@@ -0,0 +1,161 @@
+package smtpsrv
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	errAuthBannedConnection = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many failed authentication attempts, try again later",
+	}
+	errAuthBanned = &smtp.SMTPError{
+		Code:         454,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many failed authentication attempts, try again later",
+	}
+)
+
+// AuthEventFunc is invoked after every AUTH attempt, e.g. to audit them,
+// remoteIP is nil when the client address is not an IP.
+type AuthEventFunc func(remoteIP net.IP, username string, success bool)
+
+// AuthLockoutConfig holds the lockout settings
+type AuthLockoutConfig struct {
+	// MaxFailures is the number of failed attempts within Window banning the
+	// client IP, they default to 5 and 10 minutes.
+	MaxFailures int
+	Window      time.Duration
+
+	// BanDuration defaults to 30 minutes
+	BanDuration time.Duration
+}
+
+// AuthLockout temporarily bans the IPs failing to authenticate too often,
+// fail2ban-style: their connections are replied 421 and their AUTH
+// commands 454 until the ban expires.
+type AuthLockout struct {
+	config AuthLockoutConfig
+
+	mu        sync.Mutex
+	failures  map[string][]time.Time
+	bans      map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewAuthLockout(cfg AuthLockoutConfig) *AuthLockout {
+	if cfg.MaxFailures < 1 {
+		cfg.MaxFailures = 5
+	}
+
+	if cfg.Window == 0 {
+		cfg.Window = 10 * time.Minute
+	}
+
+	if cfg.BanDuration == 0 {
+		cfg.BanDuration = 30 * time.Minute
+	}
+
+	return &AuthLockout{
+		config:    cfg,
+		failures:  map[string][]time.Time{},
+		bans:      map[string]time.Time{},
+		lastSweep: time.Now(),
+	}
+}
+
+// connectionPolicy refuses the connections of the banned IPs
+func (l *AuthLockout) connectionPolicy(remoteAddr net.Addr) error {
+	if l.Banned(addrIP(remoteAddr)) {
+		return errAuthBannedConnection
+	}
+
+	return nil
+}
+
+// Record counts a failed attempt of the IP, a success clears its
+// failures. It is an AuthEventFunc.
+func (l *AuthLockout) Record(remoteIP net.IP, username string, success bool) {
+	if remoteIP == nil {
+		return
+	}
+	key := remoteIP.String()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	if success {
+		delete(l.failures, key)
+		return
+	}
+
+	failures := append(recentFailures(l.failures[key], now.Add(-l.config.Window)), now)
+	if len(failures) >= l.config.MaxFailures {
+		l.bans[key] = now.Add(l.config.BanDuration)
+		delete(l.failures, key)
+		return
+	}
+
+	l.failures[key] = failures
+}
+
+// Banned reports whether the IP is banned
+func (l *AuthLockout) Banned(remoteIP net.IP) bool {
+	if remoteIP == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until, ok := l.bans[remoteIP.String()]
+	return ok && time.Now().Before(until)
+}
+
+// Unban lifts the ban of the IP and clears its failures
+func (l *AuthLockout) Unban(remoteIP net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.bans, remoteIP.String())
+	delete(l.failures, remoteIP.String())
+}
+
+// sweep removes the expired bans and failures, at most once per minute
+func (l *AuthLockout) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, until := range l.bans {
+		if !now.Before(until) {
+			delete(l.bans, key)
+		}
+	}
+
+	for key, failures := range l.failures {
+		if failures = recentFailures(failures, now.Add(-l.config.Window)); len(failures) == 0 {
+			delete(l.failures, key)
+		} else {
+			l.failures[key] = failures
+		}
+	}
+}
+
+// recentFailures drops the failures before since, they are in time order
+func recentFailures(failures []time.Time, since time.Time) []time.Time {
+	for len(failures) > 0 && failures[0].Before(since) {
+		failures = failures[1:]
+	}
+
+	return failures
+}
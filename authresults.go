@@ -0,0 +1,226 @@
+package smtpsrv
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errAuthResultsSyntax = errors.New("smtpsrv: malformed Authentication-Results")
+
+// AuthResults is a parsed Authentication-Results header (RFC 8601), or
+// ARC-Authentication-Results header (RFC 8617 section 4.1.1) which also
+// carries the Instance of its ARC set
+type AuthResults struct {
+	AuthServID string
+	Instance   int
+	Results    []AuthResult
+}
+
+// AuthResult is the result of an authentication method, e.g. spf=pass
+// smtp.mailfrom=example.com. Method and Result are lowercased, Properties
+// are keyed by ptype.property, e.g. "smtp.mailfrom" or "header.d".
+type AuthResult struct {
+	Method     string
+	Result     string
+	Reason     string
+	Properties map[string]string
+}
+
+// ParseAuthResults parses the value of an Authentication-Results header, or
+// of an ARC-Authentication-Results one when it starts with the i= tag. The
+// comments are dropped, the malformed results skipped.
+func ParseAuthResults(value string) (*AuthResults, error) {
+	segments := splitAuthResults(stripComments(value))
+
+	res := &AuthResults{}
+	if len(segments) > 0 && strings.HasPrefix(strings.ToLower(segments[0]), "i=") {
+		instance, err := strconv.Atoi(strings.TrimSpace(segments[0][2:]))
+		if err != nil {
+			return nil, errAuthResultsSyntax
+		}
+		res.Instance = instance
+		segments = segments[1:]
+	}
+
+	if len(segments) == 0 {
+		return nil, errAuthResultsSyntax
+	}
+
+	// the authserv-id, optionally followed by a version
+	fields := strings.Fields(segments[0])
+	if len(fields) == 0 {
+		return nil, errAuthResultsSyntax
+	}
+	res.AuthServID = fields[0]
+
+	for _, segment := range segments[1:] {
+		pairs := authResultsPairs(segment)
+		if len(pairs) == 0 || pairs[0][1] == "" {
+			// "none", or malformed
+			continue
+		}
+
+		result := AuthResult{
+			Method:     strings.ToLower(strings.Split(pairs[0][0], "/")[0]),
+			Result:     strings.ToLower(pairs[0][1]),
+			Properties: map[string]string{},
+		}
+
+		for _, pair := range pairs[1:] {
+			key := strings.ToLower(pair[0])
+			if key == "reason" {
+				result.Reason = pair[1]
+				continue
+			}
+			result.Properties[key] = pair[1]
+		}
+
+		res.Results = append(res.Results, result)
+	}
+
+	return res, nil
+}
+
+// TrustedAuthResults returns the results of the Authentication-Results
+// headers added by authservID, the methods in header order. Those are only
+// trustworthy when the gateway adding them removes the headers claiming its
+// authserv-id from the incoming messages (RFC 8601 section 5).
+func (e *Email) TrustedAuthResults(authservID string) []AuthResult {
+	var results []AuthResult
+	for _, res := range e.AuthenticationResults {
+		if strings.EqualFold(res.AuthServID, authservID) {
+			results = append(results, res.Results...)
+		}
+	}
+
+	return results
+}
+
+// parseAuthResultsHeaders parses the headers, skipping the malformed ones
+func parseAuthResultsHeaders(values []string) []*AuthResults {
+	var results []*AuthResults
+	for _, value := range values {
+		res, err := ParseAuthResults(value)
+		if err != nil {
+			continue
+		}
+		results = append(results, res)
+	}
+
+	return results
+}
+
+// stripComments removes the comments of a structured header value, outside
+// of the quoted strings
+func stripComments(s string) string {
+	var sb strings.Builder
+	depth, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && (quoted || depth > 0):
+			if depth == 0 {
+				sb.WriteByte(c)
+				sb.WriteByte(s[i+1])
+			}
+			i++
+			continue
+		case c == '"' && depth == 0:
+			quoted = !quoted
+		case c == '(' && !quoted:
+			depth++
+			continue
+		case c == ')' && !quoted && depth > 0:
+			depth--
+			sb.WriteByte(' ')
+			continue
+		}
+
+		if depth == 0 {
+			sb.WriteByte(c)
+		}
+	}
+
+	return sb.String()
+}
+
+// splitAuthResults splits the value at the semicolons outside of the quoted
+// strings
+func splitAuthResults(s string) []string {
+	var segments []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				segments = append(segments, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	segments = append(segments, s[start:])
+
+	for i := range segments {
+		segments[i] = strings.TrimSpace(segments[i])
+	}
+
+	return segments
+}
+
+// authResultsPairs reads the key=value pairs of a result, the values may be
+// quoted strings. A word without value, such as "none", has an empty value.
+func authResultsPairs(s string) [][2]string {
+	var pairs [][2]string
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			break
+		}
+
+		end := strings.IndexAny(s, "= \t\r\n")
+		if end == -1 || s[end] != '=' {
+			// a word without value
+			if end == -1 {
+				end = len(s)
+			}
+			pairs = append(pairs, [2]string{s[:end], ""})
+			s = s[end:]
+			continue
+		}
+
+		key := s[:end]
+		s = strings.TrimLeft(s[end+1:], " \t\r\n")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var sb strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				sb.WriteByte(s[i])
+			}
+			value = sb.String()
+			if i < len(s) {
+				i++
+			}
+			s = s[i:]
+		} else {
+			end := strings.IndexAny(s, " \t\r\n")
+			if end == -1 {
+				end = len(s)
+			}
+			value, s = s[:end], s[end:]
+		}
+
+		pairs = append(pairs, [2]string{key, value})
+	}
+
+	return pairs
+}
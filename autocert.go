@@ -0,0 +1,60 @@
+package smtpsrv
+
+import (
+	"crypto/tls"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// AutocertSource provides the certificates obtained from Let's Encrypt, or
+// another ACME CA, by an autocert.Manager.
+//
+// The CA validates the names with the tls-alpn-01 challenge, answered on the
+// TLS handshakes (the CA connects to port 443, which must then reach an
+// implicit TLS listener of the server), or with the http-01 challenge served
+// by Manager.HTTPHandler on port 80.
+type AutocertSource struct {
+	Manager *autocert.Manager
+
+	// DefaultName is the certificate name of the handshakes without SNI, which
+	// many MTAs don't send with STARTTLS
+	DefaultName string
+}
+
+// NewAutocertSource accepts the terms of service of Let's Encrypt and obtains
+// the certificates of hosts, cached in cacheDir. The first host is the
+// DefaultName.
+func NewAutocertSource(cacheDir string, hosts ...string) *AutocertSource {
+	s := &AutocertSource{
+		Manager: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cacheDir),
+			HostPolicy: autocert.HostWhitelist(hosts...),
+		},
+	}
+
+	if len(hosts) > 0 {
+		s.DefaultName = hosts[0]
+	}
+
+	return s
+}
+
+// GetCertificate returns the certificate of the server name, or of
+// DefaultName when the client did not send one, and answers the tls-alpn-01
+// challenges.
+func (s *AutocertSource) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "" && s.DefaultName != "" {
+		sni := *hello
+		sni.ServerName = s.DefaultName
+		hello = &sni
+	}
+
+	return s.Manager.GetCertificate(hello)
+}
+
+// nextProtos returns the ALPN protocols of the tls-alpn-01 challenge
+func (s *AutocertSource) nextProtos() []string {
+	return []string{acme.ALPNProto}
+}
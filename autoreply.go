@@ -0,0 +1,71 @@
+package smtpsrv
+
+import (
+	"regexp"
+	"strings"
+)
+
+// the subjects of the vacation responders not marking their replies
+var reAutoReplySubject = regexp.MustCompile(`(?i)^\s*((auto(matic)?[ -]?(reply|response|antwort)|out of (the )?office|vacation (auto)?(reply|notice|message)|abwesenheitsnotiz|r[ée]ponse automatique|respuesta autom[áa]tica|risposta automatica|fuera de la oficina)\b|auto:)`)
+
+// IsAutoReply reports whether the email is a reply sent by a responder,
+// e.g. a vacation or out of office notice, from its Auto-Submitted (RFC
+// 3834), Precedence and X-Autoreply headers or its subject
+func (e *Email) IsAutoReply() bool {
+	if strings.EqualFold(headerToken(e.Header.Get("Auto-Submitted")), "auto-replied") {
+		return true
+	}
+
+	if strings.EqualFold(headerToken(e.Header.Get("Precedence")), "auto_reply") {
+		return true
+	}
+
+	for _, key := range []string{"X-Autoreply", "X-Autorespond", "X-Autoresponder"} {
+		if e.Header.Get(key) != "" {
+			return true
+		}
+	}
+
+	return reAutoReplySubject.MatchString(e.Subject)
+}
+
+// IsAutoGenerated reports whether the email was not sent by a person: an
+// automatic reply, a delivery status notification, a mailing list or bulk
+// message, or a message whose sender asks not to be answered automatically
+// (X-Auto-Response-Suppress). Responders must not answer such messages, to
+// avoid mail loops (RFC 3834 section 2).
+func (e *Email) IsAutoGenerated() bool {
+	if e.IsAutoReply() || e.DeliveryStatus != nil || e.MailingList != nil {
+		return true
+	}
+
+	if submitted := headerToken(e.Header.Get("Auto-Submitted")); submitted != "" && !strings.EqualFold(submitted, "no") {
+		return true
+	}
+
+	switch strings.ToLower(headerToken(e.Header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return true
+	}
+
+	for _, value := range strings.Split(e.Header.Get("X-Auto-Response-Suppress"), ",") {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "all", "oof", "autoreply":
+			return true
+		}
+	}
+
+	// the null reverse-path of the notifications
+	return strings.TrimSpace(e.Header.Get("Return-Path")) == "<>"
+}
+
+// headerToken returns the first token of a header value, without its
+// parameters and comments
+func headerToken(value string) string {
+	value = stripComments(value)
+	if ind := strings.IndexByte(value, ';'); ind != -1 {
+		value = value[:ind]
+	}
+
+	return strings.TrimSpace(value)
+}
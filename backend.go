@@ -4,16 +4,32 @@ import (
 	"github.com/emersion/go-smtp"
 )
 
-// The Backend implements SMTP server methods.
+// The Backend implements SMTP server methods. When it is served by a go-smtp
+// server directly, each STARTTLS ends the session and the next greeting starts
+// a new one, a Server keeps one session per connection.
 type Backend struct {
-	handler HandlerFunc
-	auther  AuthFunc
+	config *ServerConfig
 }
 
 func NewBackend(auther AuthFunc, handler HandlerFunc) *Backend {
+	return newBackend(&ServerConfig{
+		Handler: handler,
+		Auther:  auther,
+	})
+}
+
+// NewSessionBackend creates a backend building the handler of every session
+// with factory.
+func NewSessionBackend(auther AuthFunc, factory HandlerFactoryFunc) *Backend {
+	return newBackend(&ServerConfig{
+		HandlerFactory: factory,
+		Auther:         auther,
+	})
+}
+
+func newBackend(cfg *ServerConfig) *Backend {
 	return &Backend{
-		handler: handler,
-		auther:  auther,
+		config: cfg,
 	}
 }
 
@@ -22,5 +38,55 @@ func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 	// Note: Authentication is now handled by the Conn/Session interface
 	// We create an anonymous session here. If authentication is required,
 	// it should be handled through the session's Auth method if needed.
-	return NewSession(c, bkd.handler, bkd.auther), nil
+	s := NewSession(c, bkd.config.Handler, bkd.config.Auther)
+	s.config = bkd.config
+	s.timeouts = sessionTimeoutConn(c.Conn())
+
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+
+	if s.proto = sessionProtocolConn(c.Conn()); s.proto != nil {
+		s.proto.session = s
+	}
+	s.reportTLS()
+
+	if bkd.config.HandlerFactory != nil {
+		handler, err := bkd.config.HandlerFactory(c)
+		if err == nil && handler == nil {
+			err = ErrTemporaryFailure
+		}
+		if err != nil {
+			s.log("session refused", "err", err)
+			s.Logout()
+			return nil, smtpError(err)
+		}
+		s.handler, s.sessionHandler = handler.Handle, handler
+	}
+
+	return s, nil
+}
+
+// connect applies the connection policies and the OnConnect hook to the
+// client, again when a proxy supplied its address with XCLIENT.
+func (s *Session) connect() error {
+	remoteAddr := s.conn.Conn().RemoteAddr()
+
+	s.log("session started", "remote_addr", remoteAddr, "helo", s.helo())
+
+	if s.config.OnConnect != nil {
+		ctx := Context{session: s}
+		if err := s.config.OnConnect(&ctx); err != nil {
+			s.log("session refused", "err", err)
+			err = rejectError(err, 554, EnhancedCode{5, 7, 1})
+			s.emitRejected("CONNECT", err)
+			return err
+		}
+	}
+
+	s.emit(func(info EventInfo) Event {
+		return &ConnectionOpened{EventInfo: info, Helo: s.helo()}
+	})
+
+	return nil
 }
@@ -0,0 +1,104 @@
+package smtpsrv
+
+import (
+	"html"
+	"strings"
+)
+
+// BodyPart is a body of the message, in order: a text or HTML part of a
+// multipart/mixed, or the text and HTML versions of a multipart/alternative
+// or multipart/related
+type BodyPart struct {
+	// ContentType is the type of the part, e.g. "text/plain" or
+	// "multipart/alternative"
+	ContentType string
+
+	// Path is the path of the part, see Part.Path
+	Path string
+
+	Text string
+	HTML string
+}
+
+// bodyPiece is a body of a multipart being read, part indexes its
+// BodyPart, -1 for the merged bodies of a nested multipart
+type bodyPiece struct {
+	text, html string
+	part       int
+}
+
+// addBody records the body of the current part, see Email.BodyParts. The
+// bodies repeating one of the multipart are skipped, and a text and an
+// HTML part holding the same text, sent as independent parts instead of
+// alternatives, are merged.
+func (s *parseState) addBody(pieces []bodyPiece, contentType, text, html string) []bodyPiece {
+	if text == "" && html == "" {
+		return pieces
+	}
+
+	for i, p := range pieces {
+		if p.text == text && p.html == html {
+			return pieces
+		}
+
+		if p.part == -1 || (p.html == "") == (html == "") {
+			continue
+		}
+		if p.html == "" && text == "" && sameText(p.text, HTMLToText(html)) {
+			pieces[i].html = html
+			s.bodyParts[p.part].HTML = html
+			return pieces
+		}
+		if p.text == "" && html == "" && sameText(text, HTMLToText(p.html)) {
+			pieces[i].text = text
+			s.bodyParts[p.part].Text = text
+			return pieces
+		}
+	}
+
+	s.bodyParts = append(s.bodyParts, BodyPart{
+		ContentType: contentType,
+		Path:        partPath(s.path),
+		Text:        text,
+		HTML:        html,
+	})
+
+	return append(pieces, bodyPiece{text: text, html: html, part: len(s.bodyParts) - 1})
+}
+
+// sameText reports whether the texts only differ by their whitespace
+func sameText(a, b string) bool {
+	return strings.Join(strings.Fields(a), " ") == strings.Join(strings.Fields(b), " ")
+}
+
+// mergeBodies joins the bodies of a multipart, one per line. When some of
+// them only have a text or HTML version, e.g. the text parts between the
+// inline images sent by Apple Mail, that version is converted so that the
+// merged bodies keep them all, in order.
+func mergeBodies(pieces []bodyPiece) (textBody, htmlBody string) {
+	hasText, hasHTML := false, false
+	for _, p := range pieces {
+		hasText = hasText || p.text != ""
+		hasHTML = hasHTML || p.html != ""
+	}
+
+	var texts, htmls []string
+	for _, p := range pieces {
+		text, body := p.text, p.html
+		if text == "" && hasText {
+			text = HTMLToText(body)
+		}
+		if body == "" && hasHTML {
+			body = `<div style="white-space: pre-wrap">` + html.EscapeString(text) + `</div>`
+		}
+
+		if text != "" {
+			texts = append(texts, text)
+		}
+		if body != "" {
+			htmls = append(htmls, body)
+		}
+	}
+
+	return strings.Join(texts, "\n"), strings.Join(htmls, "\n")
+}
@@ -0,0 +1,142 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// BuildBounce renders a RFC 3464 delivery status notification to the envelope
+// sender of the original message, reporting status. The header of original
+// is returned as text/rfc822-headers, or the whole message as message/rfc822
+// when full is set (the RET=FULL DSN parameter). The fields of status are
+// written without their type, e.g. FinalRecipient "user@example.com" and
+// DiagnosticCode "550 5.1.1 unknown user", as ParseEmail reads them.
+func BuildBounce(sender string, status *DeliveryStatus, original []byte, full bool) ([]byte, error) {
+	reportingMTA := status.ReportingMTA
+	if reportingMTA == "" {
+		reportingMTA = "localhost"
+	}
+
+	delayed := len(status.Recipients) > 0
+	for _, rcpt := range status.Recipients {
+		if rcpt.Action != "delayed" {
+			delayed = false
+		}
+	}
+
+	subject := "Undelivered Mail Returned to Sender"
+	if delayed {
+		subject = "Delayed Mail (still being retried)"
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	fmt.Fprintf(&body, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", reportingMTA)
+	fmt.Fprintf(&body, "To: <%s>\r\n", sender)
+	fmt.Fprintf(&body, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "Message-ID: <%s@%s>\r\n", newSessionID(), reportingMTA)
+	fmt.Fprintf(&body, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&body, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&body, "Content-Type: %s\r\n\r\n", mime.FormatMediaType(contentTypeMultipartReport, map[string]string{
+		"report-type": "delivery-status",
+		"boundary":    mw.Boundary(),
+	}))
+
+	// human readable explanation
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if delayed {
+		fmt.Fprintf(part, "Your message could not be delivered yet to the following recipients, delivery is still being retried:\r\n\r\n")
+	} else {
+		fmt.Fprintf(part, "Your message could not be delivered to the following recipients:\r\n\r\n")
+	}
+	for _, rcpt := range status.Recipients {
+		if rcpt.DiagnosticCode != "" {
+			fmt.Fprintf(part, "<%s>: %s\r\n", rcpt.FinalRecipient, rcpt.DiagnosticCode)
+		} else {
+			fmt.Fprintf(part, "<%s>: status %s\r\n", rcpt.FinalRecipient, rcpt.Status)
+		}
+	}
+
+	// machine readable status
+	header = textproto.MIMEHeader{}
+	header.Set("Content-Type", contentTypeDeliveryStatus)
+	part, err = mw.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(part, "Reporting-MTA: dns; %s\r\n", reportingMTA)
+	if status.OriginalEnvelopeID != "" {
+		fmt.Fprintf(part, "Original-Envelope-Id: %s\r\n", status.OriginalEnvelopeID)
+	}
+	if !status.ArrivalDate.IsZero() {
+		fmt.Fprintf(part, "Arrival-Date: %s\r\n", status.ArrivalDate.Format(time.RFC1123Z))
+	}
+
+	for _, rcpt := range status.Recipients {
+		fmt.Fprintf(part, "\r\n")
+		if rcpt.OriginalRecipient != "" {
+			fmt.Fprintf(part, "Original-Recipient: rfc822; %s\r\n", rcpt.OriginalRecipient)
+		}
+		fmt.Fprintf(part, "Final-Recipient: rfc822; %s\r\n", rcpt.FinalRecipient)
+		fmt.Fprintf(part, "Action: %s\r\n", rcpt.Action)
+		fmt.Fprintf(part, "Status: %s\r\n", rcpt.Status)
+		if rcpt.RemoteMTA != "" {
+			fmt.Fprintf(part, "Remote-MTA: dns; %s\r\n", rcpt.RemoteMTA)
+		}
+		if rcpt.DiagnosticCode != "" {
+			fmt.Fprintf(part, "Diagnostic-Code: smtp; %s\r\n", strings.Replace(rcpt.DiagnosticCode, "\n", " ", -1))
+		}
+		if !rcpt.LastAttemptDate.IsZero() {
+			fmt.Fprintf(part, "Last-Attempt-Date: %s\r\n", rcpt.LastAttemptDate.Format(time.RFC1123Z))
+		}
+	}
+
+	// returned message or header
+	if original != nil {
+		header = textproto.MIMEHeader{}
+		returned := original
+		if full {
+			header.Set("Content-Type", "message/rfc822")
+		} else {
+			header.Set("Content-Type", "text/rfc822-headers")
+			returned = originalHeader(original)
+		}
+
+		part, err = mw.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		part.Write(returned)
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	return body.Bytes(), nil
+}
+
+// originalHeader returns the header section of the raw message
+func originalHeader(raw []byte) []byte {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if ind := bytes.Index(raw, []byte(sep)); ind != -1 {
+			return raw[:ind+len(sep)/2]
+		}
+	}
+
+	return raw
+}
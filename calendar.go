@@ -0,0 +1,82 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"io"
+	"net/textproto"
+	"strings"
+)
+
+// Calendar is a text/calendar part of a message (RFC 5545), such as an
+// iTIP meeting invitation or reply (RFC 5546)
+type Calendar struct {
+	// Method is the iTIP method, e.g. "REQUEST", "REPLY" or "CANCEL", from
+	// the Content-Type method parameter or else the METHOD property
+	Method string
+
+	// Filename is set for the calendars sent as .ics attachments, which are
+	// also listed in Email.Attachments
+	Filename string
+
+	// Data is the iCalendar object, converted to UTF-8
+	Data string
+}
+
+// decodeCalendar adds the text/calendar part to the calendars of the email
+// and returns it
+func (s *parseState) decodeCalendar(content io.Reader, header textproto.MIMEHeader) (string, error) {
+	data, err := s.decodeText(content, header)
+	if err != nil {
+		return "", err
+	}
+
+	_, params, _ := parseContentType(header.Get("Content-Type"))
+	s.calendars = append(s.calendars, newCalendar(data, params["method"], ""))
+
+	return data, nil
+}
+
+// attachedCalendars adds the .ics attachments to the calendars, those sent
+// to the attachment store are not read back
+func (e *Email) attachedCalendars() error {
+	for _, a := range e.Attachments {
+		if a.Data == nil || !strings.EqualFold(a.ContentType, contentTypeTextCalendar) {
+			continue
+		}
+
+		data, err := readRewind(a.Data)
+		if err != nil {
+			return err
+		}
+
+		e.Calendars = append(e.Calendars, newCalendar(string(data), "", a.Filename))
+	}
+
+	return nil
+}
+
+func newCalendar(data, method, filename string) Calendar {
+	calendar := Calendar{
+		Method:   strings.ToUpper(method),
+		Filename: filename,
+		Data:     data,
+	}
+	if calendar.Method == "" {
+		calendar.Method = calendarMethod(calendar.Data)
+	}
+
+	return calendar
+}
+
+// calendarMethod returns the METHOD property of the VCALENDAR
+func calendarMethod(data string) string {
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) > 7 && strings.EqualFold(line[:7], "METHOD:") {
+			return strings.ToUpper(strings.TrimSpace(line[7:]))
+		}
+	}
+
+	return ""
+}
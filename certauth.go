@@ -0,0 +1,117 @@
+package smtpsrv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// CertAuthFunc authenticates a client by its verified TLS certificate,
+// chain is the verified chain starting with cert. It returns the username
+// of the client, as Context.User reports it.
+type CertAuthFunc func(cert *x509.Certificate, chain []*x509.Certificate) (username string, err error)
+
+var errCertIdentity = errors.New("authorization identity does not match the certificate")
+
+// clientTLSConfig returns the TLS configuration verifying the client
+// certificates against the ClientCAs of cfg
+func clientTLSConfig(config *tls.Config, cfg *ServerConfig) *tls.Config {
+	if config == nil || cfg.ClientCAs == nil {
+		return config
+	}
+
+	config = config.Clone()
+	config.ClientCAs = cfg.ClientCAs
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if cfg.RequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config
+}
+
+// verifiedChain returns the verified certificate chain of the client, nil
+// when it presented none or the TLS configuration did not verify it
+func (s *Session) verifiedChain() []*x509.Certificate {
+	state, ok := s.tlsState()
+	if !ok || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	return state.VerifiedChains[0]
+}
+
+// certAuthenticate authenticates the client by its certificate, identity
+// is the authorization identity it requested, "" for the certificate one
+func (s *Session) certAuthenticate(identity string) error {
+	chain := s.verifiedChain()
+	if s.config.CertAuth == nil || chain == nil {
+		return smtp.ErrAuthFailed
+	}
+
+	username, err := s.config.CertAuth(chain[0], chain)
+	if err == nil && identity != "" && identity != username {
+		err = errCertIdentity
+	}
+	s.authEvent(username, err == nil)
+
+	if err != nil {
+		s.log("auth", "mechanism", sasl.External, "subject", chain[0].Subject.String(), "err", err)
+		return smtp.ErrAuthFailed
+	}
+
+	s.username, s.certAuthenticated = &username, true
+	s.log("auth", "mechanism", sasl.External, "username", username, "err", nil)
+
+	return nil
+}
+
+// implicitCertAuthenticate authenticates the client by its certificate at
+// its first MAIL when it did not use AUTH. Unlike AUTH EXTERNAL a refused
+// certificate is not a failure: MX peers present certificates unknown to
+// CertAuth, their session simply stays unauthenticated.
+func (s *Session) implicitCertAuthenticate() {
+	if s.certAuthTried || s.config.CertAuth == nil || s.authenticated() {
+		return
+	}
+	s.certAuthTried = true
+
+	chain := s.verifiedChain()
+	if chain == nil {
+		return
+	}
+
+	var username string
+	err := s.traceAuth(sasl.External, func() (err error) {
+		username, err = s.config.CertAuth(chain[0], chain)
+		return err
+	})
+	if err != nil {
+		s.log("implicit auth", "mechanism", sasl.External, "subject", chain[0].Subject.String(), "err", err)
+		return
+	}
+	s.authEvent(username, true)
+
+	s.username, s.certAuthenticated = &username, true
+	s.log("auth", "mechanism", sasl.External, "username", username, "err", nil)
+}
+
+// ClientCertificate returns the verified TLS certificate of the client, nil
+// when it presented none, see ServerConfig.ClientCAs
+func (c Context) ClientCertificate() *x509.Certificate {
+	chain := c.session.verifiedChain()
+	if chain == nil {
+		return nil
+	}
+
+	return chain[0]
+}
+
+// ClientCertChain returns the verified chain of the client certificate,
+// from the certificate to its root authority
+func (c Context) ClientCertChain() []*x509.Certificate {
+	return c.session.verifiedChain()
+}
@@ -0,0 +1,170 @@
+package smtpsrv
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertificateSource provides the server certificate of every TLS handshake,
+// so a renewed certificate is used by the next connections without restarting
+// the server.
+type CertificateSource interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// FileCertificateSource serves a certificate and key pair from PEM files, and
+// reloads them once they changed on disk, e.g. renewed by certbot.
+type FileCertificateSource struct {
+	// CheckInterval is how often the files are checked for changes, on the
+	// handshakes, defaults to a minute.
+	CheckInterval time.Duration
+
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewFileCertificateSource loads the certificate and key pair of the files.
+func NewFileCertificateSource(certFile, keyFile string) (*FileCertificateSource, error) {
+	s := &FileCertificateSource{
+		CheckInterval: time.Minute,
+		certFile:      certFile,
+		keyFile:       keyFile,
+	}
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// GetCertificate returns the current certificate, it can be used as
+// tls.Config.GetCertificate.
+func (s *FileCertificateSource) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.Lock()
+	check := time.Since(s.lastCheck) >= s.CheckInterval
+	if check {
+		s.lastCheck = time.Now()
+	}
+	s.mu.Unlock()
+
+	if check {
+		if modTime, err := s.filesModTime(); err == nil && s.changed(modTime) {
+			// a pair being replaced may not match yet, the current
+			// certificate is kept until it does
+			s.Reload()
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.cert, nil
+}
+
+// Reload loads the files again, e.g. on SIGHUP, the current certificate is
+// kept when they are invalid.
+func (s *FileCertificateSource) Reload() error {
+	modTime, err := s.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cert, s.modTime, s.lastCheck = &cert, modTime, time.Now()
+
+	return nil
+}
+
+func (s *FileCertificateSource) changed(modTime time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return !modTime.Equal(s.modTime)
+}
+
+// filesModTime returns the latest modification time of the files
+func (s *FileCertificateSource) filesModTime() (time.Time, error) {
+	var modTime time.Time
+	for _, name := range []string{s.certFile, s.keyFile} {
+		// os.Stat follows the symlinks certbot maintains in its live directory
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	return modTime, nil
+}
+
+// serverTLSConfig returns the TLS configuration of the server, with the
+// certificates of ServerConfig.Certificates and the client certificate
+// verification of ServerConfig.ClientCAs
+func serverTLSConfig(cfg *ServerConfig) *tls.Config {
+	config := cfg.TLSConfig
+	if cfg.Certificates == nil {
+		return clientTLSConfig(config, cfg)
+	}
+
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	// the static certificates would be preferred without SNI
+	config.Certificates = nil
+	config.GetCertificate = cfg.Certificates.GetCertificate
+
+	config = clientTLSConfig(config, cfg)
+	if source, ok := cfg.Certificates.(interface{ nextProtos() []string }); ok {
+		config = challengeTLSConfig(config, source.nextProtos())
+	}
+
+	return config
+}
+
+// challengeTLSConfig answers the ALPN protocols of a certificate challenge
+// only to the handshakes offering them: crypto/tls aborts the handshakes of
+// the clients offering only other protocols, e.g. "smtp", once the server
+// has NextProtos.
+func challengeTLSConfig(config *tls.Config, protos []string) *tls.Config {
+	challenge := config.Clone()
+	challenge.NextProtos = append(challenge.NextProtos, protos...)
+
+	getConfigForClient := config.GetConfigForClient
+	config = config.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, offered := range hello.SupportedProtos {
+			for _, proto := range protos {
+				if offered == proto {
+					return challenge, nil
+				}
+			}
+		}
+
+		if getConfigForClient != nil {
+			return getConfigForClient(hello)
+		}
+		return nil, nil
+	}
+
+	return config
+}
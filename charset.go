@@ -0,0 +1,71 @@
+package smtpsrv
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/saintfish/chardet"
+)
+
+// CharsetDetector guesses the charset of the text parts declaring none,
+// confidence ranges from 0 to 100
+type CharsetDetector interface {
+	DetectCharset(text []byte) (charset string, confidence int, err error)
+}
+
+// CharsetDetectorFunc is a CharsetDetector function
+type CharsetDetectorFunc func(text []byte) (charset string, confidence int, err error)
+
+func (f CharsetDetectorFunc) DetectCharset(text []byte) (string, int, error) {
+	return f(text)
+}
+
+// CharsetReaderFunc returns a reader converting input from charset to UTF-8,
+// as mime.WordDecoder.CharsetReader
+type CharsetReaderFunc func(charset string, input io.Reader) (io.Reader, error)
+
+// chardetDetector is the default CharsetDetector
+type chardetDetector struct{}
+
+func (chardetDetector) DetectCharset(text []byte) (string, int, error) {
+	result, err := chardet.NewTextDetector().DetectBest(text)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return result.Charset, result.Confidence, nil
+}
+
+var (
+	charsetAliasesMu sync.RWMutex
+	charsetAliases   = map[string]string{
+		// decoded as their superset
+		"gb-18030": "gbk",
+		"gb18030":  "gbk",
+		"gb2312":   "gbk",
+	}
+)
+
+// RegisterCharsetAlias makes the charset alias, e.g. a misspelled or vendor
+// specific name, decoded as charset, a name known to the IANA index. It
+// applies to the bodies as well as to the encoded words of the header.
+func RegisterCharsetAlias(alias, charset string) {
+	charsetAliasesMu.Lock()
+	defer charsetAliasesMu.Unlock()
+
+	charsetAliases[strings.ToLower(alias)] = strings.ToLower(charset)
+}
+
+func resolveCharsetAlias(charset string) string {
+	charset = strings.ToLower(charset)
+
+	charsetAliasesMu.RLock()
+	defer charsetAliasesMu.RUnlock()
+
+	if resolved, ok := charsetAliases[charset]; ok {
+		return resolved
+	}
+
+	return charset
+}
@@ -0,0 +1,89 @@
+package smtpsrv
+
+import (
+	"encoding/base64"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// the cid URLs (RFC 2392) of the attributes and CSS of an HTML body
+var reCIDURL = regexp.MustCompile(`(?i)(["'(=]\s*)cid:([^"'()\s>]+)`)
+
+// ResolveCIDs rewrites the cid: URLs of body, usually HTMLBody or
+// SafeHTMLBody, referencing the embedded files or inline attachments of the
+// email. When template is empty they become data URIs, otherwise "{cid}" in
+// template is replaced by the query escaped Content-ID, e.g.
+// "/messages/42/parts?cid={cid}". The unknown references are kept as is.
+func (e *Email) ResolveCIDs(body, template string) (string, error) {
+	type inline struct {
+		contentType string
+		data        func() ([]byte, error)
+	}
+
+	files := map[string]inline{}
+	for _, ef := range e.EmbeddedFiles {
+		ef := ef
+		files[ef.CID] = inline{ef.ContentType, func() ([]byte, error) { return readRewind(ef.Data) }}
+	}
+	for _, a := range e.Attachments {
+		a := a
+		if _, ok := files[a.ContentID]; ok || a.ContentID == "" {
+			continue
+		}
+		files[a.ContentID] = inline{a.ContentType, func() ([]byte, error) { return readRewind(a.Data) }}
+	}
+
+	// each file is encoded once
+	uris := map[string]string{}
+
+	var err error
+	resolved := reCIDURL.ReplaceAllStringFunc(body, func(ref string) string {
+		match := reCIDURL.FindStringSubmatch(ref)
+		cid, unescapeErr := url.PathUnescape(match[2])
+		if unescapeErr != nil {
+			cid = match[2]
+		}
+		cid = strings.Trim(cid, "<>")
+
+		file, ok := files[cid]
+		if !ok {
+			for key, f := range files {
+				if strings.EqualFold(key, cid) {
+					cid, file, ok = key, f, true
+					break
+				}
+			}
+		}
+		if !ok || err != nil {
+			return ref
+		}
+
+		if template != "" {
+			return match[1] + strings.Replace(template, "{cid}", url.QueryEscape(cid), -1)
+		}
+
+		uri, ok := uris[cid]
+		if !ok {
+			data, readErr := file.data()
+			if readErr != nil {
+				err = readErr
+				return ref
+			}
+
+			contentType := file.contentType
+			if contentType == "" {
+				contentType = "application/octet-stream"
+			}
+			uri = "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+			uris[cid] = uri
+		}
+
+		return match[1] + uri
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,228 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// the Context value holding the ClamAVResult of the message
+const clamAVKey = "smtpsrv.clamav"
+
+// the size of the INSTREAM chunks sent to clamd
+const clamAVChunkSize = 32 * 1024
+
+var errClamAVInfected = &Error{
+	Code:         554,
+	EnhancedCode: EnhancedCode{5, 7, 1},
+	Message:      "Message rejected, virus found",
+}
+
+// ClamAVConfig holds the clamd settings
+type ClamAVConfig struct {
+	// Network and Address of clamd, "tcp" and a host:port or "unix" and the
+	// path of its socket, default to "tcp" and "localhost:3310"
+	Network string
+	Address string
+
+	// Timeout of a scan, defaults to a minute
+	Timeout time.Duration
+
+	// ScanAttachments scans the decoded attachments and embedded files one by
+	// one instead of the raw message, the messages which can not be parsed
+	// are scanned whole
+	ScanAttachments bool
+
+	// Quarantine, when set, is passed the infected messages, which are then
+	// accepted without invoking the handler instead of being rejected. The
+	// message is available with Context.Raw.
+	Quarantine func(c *Context, result *ClamAVResult) error
+
+	// AcceptOnError accepts the messages clamd could not scan, they are
+	// replied as a temporary failure otherwise
+	AcceptOnError bool
+}
+
+// ClamAVResult is the verdict of clamd on a message
+type ClamAVResult struct {
+	Infected bool
+
+	// Virus is the name of the signature found
+	Virus string
+
+	// Filename is the name of the infected attachment or embedded file, when
+	// they were scanned one by one
+	Filename string
+}
+
+// ClamAV scans the messages with clamd
+type ClamAV struct {
+	config ClamAVConfig
+}
+
+func NewClamAV(cfg ClamAVConfig) *ClamAV {
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+
+	if cfg.Address == "" {
+		cfg.Address = "localhost:3310"
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = time.Minute
+	}
+
+	return &ClamAV{
+		config: cfg,
+	}
+}
+
+// Policy returns a DataPolicy scanning every message, the result is available
+// to the handler with Context.ClamAV. The infected messages are rejected with
+// a 554 5.7.1 reply, or quarantined.
+func (a *ClamAV) Policy() DataPolicyFunc {
+	return func(c *Context, body io.Reader) error {
+		result, err := a.scanMessage(c, body)
+		c.Set(clamAVKey, result)
+		if err != nil {
+			if a.config.AcceptOnError {
+				return nil
+			}
+			return ErrTemporaryFailure
+		}
+
+		if !result.Infected {
+			return nil
+		}
+
+		if a.config.Quarantine != nil {
+			if err := a.config.Quarantine(c, result); err == nil {
+				return ErrQuarantined
+			}
+		}
+
+		return errClamAVInfected
+	}
+}
+
+// scanMessage scans the message, or its attachments and embedded files
+func (a *ClamAV) scanMessage(c *Context, body io.Reader) (*ClamAVResult, error) {
+	if !a.config.ScanAttachments {
+		return a.scan(body, "")
+	}
+
+	// the attachments are only read here, the handler parses the message again
+	opts := c.session.config.ParseOptions
+	opts.AttachmentStore = nil
+	opts.Lenient = true
+
+	email, err := ParseEmailWithOptionsContext(c.Context(), body, opts)
+	if err != nil {
+		raw, err := c.Raw()
+		if err != nil {
+			return nil, err
+		}
+		return a.scan(bytes.NewReader(raw), "")
+	}
+
+	for _, attachment := range email.Attachments {
+		if attachment.Data == nil {
+			continue
+		}
+		if result, err := a.scan(attachment.Data, attachment.Filename); err != nil || result.Infected {
+			return result, err
+		}
+	}
+
+	for _, embedded := range email.EmbeddedFiles {
+		if result, err := a.scan(embedded.Data, embedded.CID); err != nil || result.Infected {
+			return result, err
+		}
+	}
+
+	return &ClamAVResult{}, nil
+}
+
+func (a *ClamAV) scan(r io.Reader, filename string) (*ClamAVResult, error) {
+	virus, err := a.Scan(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if virus == "" {
+		return &ClamAVResult{}, nil
+	}
+
+	return &ClamAVResult{Infected: true, Virus: virus, Filename: filename}, nil
+}
+
+// Scan streams r to clamd with the INSTREAM command, and returns the name of
+// the virus found, if any
+func (a *ClamAV) Scan(r io.Reader) (string, error) {
+	conn, err := net.DialTimeout(a.config.Network, a.config.Address, a.config.Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(a.config.Timeout))
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+
+	// every chunk is prefixed with its size, a zero size ends the stream
+	chunk := make([]byte, 4+clamAVChunkSize)
+	for {
+		n, err := io.ReadFull(r, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				// clamd closes the stream exceeding its StreamMaxLength
+				return clamAVReply(conn)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	return clamAVReply(conn)
+}
+
+// clamAVReply reads the verdict of clamd, "stream: OK" or
+// "stream: <virus> FOUND"
+func clamAVReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	reply = strings.TrimSuffix(reply, "\x00")
+
+	switch {
+	case reply == "stream: OK":
+		return "", nil
+	case strings.HasPrefix(reply, "stream: ") && strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND"), nil
+	}
+
+	return "", fmt.Errorf("smtpsrv: clamd replied %q", reply)
+}
+
+// ClamAV returns the verdict of clamd on the message, nil when it was not
+// scanned
+func (c Context) ClamAV() *ClamAVResult {
+	result, _ := c.Get(clamAVKey).(*ClamAVResult)
+	return result
+}
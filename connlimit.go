@@ -0,0 +1,89 @@
+package smtpsrv
+
+import (
+	"net"
+	"sync"
+)
+
+// connLimitListener enforces the maximum number of concurrent connections,
+// overall and per client IP, at accept time.
+type connLimitListener struct {
+	net.Listener
+	config *ServerConfig
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newConnLimitListener(l net.Listener, cfg *ServerConfig) *connLimitListener {
+	return &connLimitListener{
+		Listener: l,
+		config:   cfg,
+		perIP:    map[string]int{},
+	}
+}
+
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := ""
+		if addr := addrIP(conn.RemoteAddr()); addr != nil {
+			ip = addr.String()
+		}
+
+		if !l.acquire(ip) {
+			l.config.metrics().IncCounter("smtp_connections_rejected_total", map[string]string{"reason": "limit"})
+			go rejectConn(l.config, conn, ErrTooManyConnections)
+			continue
+		}
+
+		return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+	}
+}
+
+func (l *connLimitListener) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if max := l.config.MaxConnections; max > 0 && l.total >= max {
+		return false
+	}
+
+	if max := l.config.MaxConnectionsPerIP; max > 0 && l.perIP[ip] >= max {
+		return false
+	}
+
+	l.total++
+	l.perIP[ip]++
+	l.config.metrics().SetGauge("smtp_connections", float64(l.total), nil)
+
+	return true
+}
+
+func (l *connLimitListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+	l.config.metrics().SetGauge("smtp_connections", float64(l.total), nil)
+}
+
+// limitedConn releases its connection slot once closed
+type limitedConn struct {
+	net.Conn
+	release   func()
+	closeOnce sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.closeOnce.Do(c.release)
+	return c.Conn.Close()
+}
@@ -1,7 +1,11 @@
 package smtpsrv
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/mail"
 
@@ -12,6 +16,38 @@ type Context struct {
 	session *Session
 }
 
+// Set stores a value for the rest of the session, making results computed by
+// earlier hooks (e.g. a DNSBL lookup in OnConnect) available to the handler.
+func (c Context) Set(key string, value interface{}) {
+	if c.session.values == nil {
+		c.session.values = map[string]interface{}{}
+	}
+
+	c.session.values[key] = value
+}
+
+// Get returns the value stored with Set, or nil
+func (c Context) Get(key string) interface{} {
+	return c.session.values[key]
+}
+
+// SessionID returns the ID tagging the log entries of the session
+func (c Context) SessionID() string {
+	return c.session.id
+}
+
+// TransactionID returns the ID of the current mail transaction, the session ID
+// followed by the transaction sequence number.
+func (c Context) TransactionID() string {
+	return c.session.transactionID()
+}
+
+// Context returns the context.Context of the current transaction, carrying its
+// trace span when ServerConfig.Tracer is set.
+func (c Context) Context() context.Context {
+	return c.session.context()
+}
+
 func (c Context) From() *mail.Address {
 	return c.session.From
 }
@@ -20,7 +56,63 @@ func (c Context) To() *mail.Address {
 	return c.session.To
 }
 
+// Recipients returns all the accepted recipients of the transaction, in LMTP
+// mode To is the recipient the handler is currently invoked for.
+func (c Context) Recipients() []*mail.Address {
+	return c.session.rcpts
+}
+
+// deliveryRecipients returns the addresses the message is delivered to: LMTP
+// calls the handler once per recipient, the message is then delivered to
+// those it accepted
+func (c Context) deliveryRecipients() []string {
+	if c.session.lmtpRcpt {
+		return []string{c.To().Address}
+	}
+
+	var to []string
+	for i, rcpt := range c.Recipients() {
+		if i < len(c.session.rcptErrs) && c.session.rcptErrs[i] != nil {
+			continue
+		}
+		to = append(to, rcpt.Address)
+	}
+
+	return to
+}
+
+// Mailbox returns the recipient address without its sub-address tag
+func (c Context) Mailbox() string {
+	if c.To() == nil {
+		return ""
+	}
+
+	mailbox, _ := SplitSubaddress(c.To().Address, c.session.config.SubaddressSeparator)
+	return mailbox
+}
+
+// Tag returns the sub-address tag of the recipient, e.g. "tag" for user+tag@example.com
+func (c Context) Tag() string {
+	if c.To() == nil {
+		return ""
+	}
+
+	_, tag := SplitSubaddress(c.To().Address, c.session.config.SubaddressSeparator)
+	return tag
+}
+
+// User returns the credentials the client authenticated with, the password
+// is empty for the clients authenticated by their certificate or by a proxy
+// with XCLIENT
 func (c Context) User() (string, string, error) {
+	if login := c.session.proxyLogin(); login != "" {
+		return login, "", nil
+	}
+
+	if c.session.certAuthenticated {
+		return *c.session.username, "", nil
+	}
+
 	if c.session.username == nil || c.session.password == nil {
 		return "", "", ErrAuthDisabled
 	}
@@ -28,24 +120,160 @@ func (c Context) User() (string, string, error) {
 	return *c.session.username, *c.session.password, nil
 }
 
+// DSN returns the delivery status notification parameters of the MAIL FROM
+// and RCPT TO commands, only sent by clients when ServerConfig.EnableDSN is set.
+func (c Context) DSN() DSNParams {
+	return newDSNParams(c.session.mailOpts, c.session.rcpts, c.session.rcptOpts)
+}
+
+// UTF8 reports whether the client declared the transaction as SMTPUTF8 (RFC 6531)
+func (c Context) UTF8() bool {
+	return c.session.utf8
+}
+
+// Authenticated reports whether the client successfully authenticated with AUTH
+func (c Context) Authenticated() bool {
+	return c.session.authenticated()
+}
+
+// Helo returns the HELO or EHLO name of the client
+func (c Context) Helo() string {
+	return c.session.helo()
+}
+
 func (c Context) RemoteAddr() net.Addr {
 	return c.session.conn.Conn().RemoteAddr()
 }
 
 func (c Context) TLS() *tls.ConnectionState {
-	state, ok := c.session.conn.TLSConnectionState()
+	state, ok := c.session.tlsState()
 	if !ok {
 		return nil
 	}
 	return &state
 }
 
+// TLSInfo returns the negotiated TLS parameters, or nil for plaintext sessions
+func (c Context) TLSInfo() *TLSInfo {
+	return newTLSInfo(c.TLS())
+}
+
+// DMARC returns the DMARC evaluation of the email, the result computed before
+// the handler is returned when ServerConfig.EnforceDMARC is enabled.
+func (c Context) DMARC(email *Email) (*DMARCResult, error) {
+	if c.session.dmarc != nil {
+		return c.session.dmarc, nil
+	}
+
+	if len(email.From) == 0 {
+		return nil, errNoSender
+	}
+
+	result, err := c.evaluateDMARC(email.From[0], email.DKIMResults)
+	if err != nil {
+		return result, err
+	}
+	c.session.dmarc = result
+
+	return result, nil
+}
+
+func (c Context) evaluateDMARC(from *mail.Address, dkimResults []DKIMResult) (*DMARCResult, error) {
+	_, fromDomain, err := SplitAddress(from.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	spfResult, spfDomain := SPFNone, ""
+	if c.From() != nil {
+		_, spfDomain, _ = SplitAddress(c.From().Address)
+		spfResult, _, _ = c.SPF()
+	}
+
+	return EvaluateDMARC(fromDomain, spfResult, spfDomain, dkimResults)
+}
+
+// AddHeader prepends a header field to the message, as the handler sees it
+// through Read, Raw and Parse. It is meant for the DataPolicy, e.g. to add a
+// spam score, the value is folded by the caller.
+func (c Context) AddHeader(name, value string) {
+	c.session.addedHeaders = append(c.session.addedHeaders, name+": "+value+"\r\n")
+}
+
 func (c Context) Read(p []byte) (int, error) {
+	c.session.consumeBody()
 	return c.session.body.Read(p)
 }
 
-func (c Context) Parse() (*Email, error) {
-	return ParseEmail(c.session.body)
+// Parse parses the message, it may be followed by Raw with
+// ServerConfig.KeepRaw or VerifyDKIM.
+func (c Context) Parse() (email *Email, err error) {
+	_, span := c.session.config.tracer().Start(c.Context(), "smtp.parse", nil)
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if !c.session.config.VerifyDKIM && !c.session.rawComplete {
+		c.session.consumeBody()
+		return ParseEmailWithOptionsContext(c.Context(), c.session.body, c.session.config.ParseOptions)
+	}
+
+	raw, err := c.Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	email, err = ParseEmailWithOptionsContext(c.Context(), bytes.NewReader(raw), c.session.config.ParseOptions)
+	if err != nil || !c.session.config.VerifyDKIM {
+		return email, err
+	}
+
+	email.DKIMResults, err = VerifyDKIM(raw)
+
+	return email, err
+}
+
+// Raw returns the complete raw message, it is read entirely and kept. Once
+// the handler read some of it with Read or Parse, Raw fails unless
+// ServerConfig.KeepRaw is set.
+func (c Context) Raw() ([]byte, error) {
+	s := c.session
+	if s.body == nil {
+		return nil, errNoData
+	}
+
+	if s.rawComplete {
+		return s.raw.Bytes(), nil
+	}
+
+	if s.raw != nil {
+		if _, err := io.Copy(ioutil.Discard, s.body); err != nil {
+			return nil, err
+		}
+		s.rawComplete = true
+
+		return s.raw.Bytes(), nil
+	}
+
+	if s.bodyConsumed {
+		return nil, errRawConsumed
+	}
+
+	raw, err := ioutil.ReadAll(s.body)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.policyRead != nil {
+		// the DataPolicy read the message from the start, it is handed to the
+		// handler once it returned
+		raw = s.policyRead.Bytes()
+	} else {
+		s.body = bytes.NewReader(raw)
+	}
+	s.raw, s.rawComplete = bytes.NewBuffer(raw), true
+
+	return raw, nil
 }
 
 func (c Context) Mailable() (bool, error) {
@@ -61,11 +289,17 @@ func (c Context) Mailable() (bool, error) {
 
 	return len(mxhosts) > 0, nil
 }
+
+// SPF evaluates the sender domain's SPF record against the client IP, the result
+// computed during MAIL FROM is returned when ServerConfig.CheckSPF is enabled.
 func (c Context) SPF() (SPFResult, string, error) {
-	_, host, err := SplitAddress(c.From().Address)
-	if err != nil {
-		return spf.None, "", err
+	if c.session.spf == nil {
+		if c.From() == nil {
+			return spf.None, "", errNoSender
+		}
+
+		c.session.spf = checkSPF(addrIP(c.RemoteAddr()), c.From().Address)
 	}
 
-	return spf.CheckHost(net.ParseIP(c.RemoteAddr().String()), host, c.From().Address)
+	return c.session.spf.result, c.session.spf.explanation, c.session.spf.err
 }
@@ -0,0 +1,179 @@
+package smtpsrv
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the zones of RFC 5322 section 4.3, the military ones are treated as
+// unknown as their sign is commonly inverted
+var dateZones = map[string]int{
+	"UT": 0, "UTC": 0, "GMT": 0, "Z": 0,
+	"EST": -5, "EDT": -4,
+	"CST": -6, "CDT": -5,
+	"MST": -7, "MDT": -6,
+	"PST": -8, "PDT": -7,
+}
+
+// the other layouts seen in Date headers, e.g. written by scripts
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+}
+
+// ParseDate parses a Date header value: RFC 5322 dates, including the
+// obsolete syntax (two and three digit years, zone names, comments), the
+// missing seconds or zone, the misplaced day of week and extra whitespace,
+// as well as ctime and ISO 8601 dates. The dates without zone are UTC.
+func ParseDate(value string) (time.Time, error) {
+	s := strings.TrimSpace(value)
+
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	var (
+		day, year, hour, minute, second = -1, -1, -1, 0, 0
+		month                           time.Month
+		offset                          int
+		zoneSet                         bool
+	)
+
+	fields := strings.Fields(strings.Replace(stripComments(s), ",", " ", -1))
+	for _, field := range fields {
+		switch {
+		case strings.Contains(field, ":") && hour == -1:
+			parts := strings.Split(field, ":")
+			if len(parts) < 2 || len(parts) > 3 {
+				return time.Time{}, ErrMalformedDate
+			}
+
+			var err error
+			if hour, err = dateNumber(parts[0], 0, 23); err != nil {
+				return time.Time{}, err
+			}
+			if minute, err = dateNumber(parts[1], 0, 59); err != nil {
+				return time.Time{}, err
+			}
+			if len(parts) == 3 {
+				// 60 is a leap second, which time.Date would carry over to
+				// the next minute
+				if second, err = dateNumber(parts[2], 0, 60); err != nil {
+					return time.Time{}, err
+				}
+				if second == 60 {
+					second = 59
+				}
+			}
+		case (field[0] == '+' || field[0] == '-') && len(field) > 1 && !zoneSet:
+			zone := strings.Replace(field[1:], ":", "", 1)
+			if len(zone) <= 2 {
+				zone += "00"
+			}
+			n, err := strconv.Atoi(zone)
+			if err != nil || len(zone) != 4 || n%100 > 59 {
+				return time.Time{}, ErrMalformedDate
+			}
+
+			offset = (n/100*60 + n%100) * 60
+			if field[0] == '-' {
+				offset = -offset
+			}
+			zoneSet = true
+		case isDigits(field):
+			n, _ := strconv.Atoi(field)
+			if day == -1 && len(field) <= 2 && n >= 1 && n <= 31 {
+				day = n
+			} else if year == -1 {
+				year = normalizeYear(n, len(field))
+			} else {
+				return time.Time{}, ErrMalformedDate
+			}
+		default:
+			if m, ok := dateMonth(field); ok && month == 0 {
+				month = m
+				continue
+			}
+
+			if hours, ok := dateZones[strings.ToUpper(field)]; ok && hour != -1 && !zoneSet {
+				offset = hours * 3600
+				zoneSet = true
+			}
+			// the day of week, which is not checked, and the unknown zones
+		}
+	}
+
+	if day == -1 || month == 0 || year == -1 {
+		return time.Time{}, ErrMalformedDate
+	}
+	if hour == -1 {
+		hour = 0
+	}
+
+	loc := time.UTC
+	if offset != 0 {
+		loc = time.FixedZone("", offset)
+	}
+
+	t := time.Date(year, month, day, hour, minute, second, 0, loc)
+	if t.Day() != day {
+		// e.g. February 30
+		return time.Time{}, ErrMalformedDate
+	}
+
+	return t, nil
+}
+
+// normalizeYear applies RFC 5322 section 4.3: two digit years below 50 are
+// in the 2000s, the others and the three digit ones are after 1900
+func normalizeYear(year, digits int) int {
+	switch {
+	case digits == 2 && year < 50:
+		return year + 2000
+	case digits <= 3:
+		return year + 1900
+	}
+
+	return year
+}
+
+func dateNumber(s string, lo, hi int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < lo || n > hi {
+		return 0, ErrMalformedDate
+	}
+
+	return n, nil
+}
+
+// dateMonth accepts the full and abbreviated English month names
+func dateMonth(s string) (time.Month, bool) {
+	if len(s) < 3 {
+		return 0, false
+	}
+
+	prefix := strings.ToLower(s[:3])
+	for m := time.January; m <= time.December; m++ {
+		name := strings.ToLower(m.String())
+		if prefix == name[:3] && strings.HasPrefix(name, strings.ToLower(strings.TrimSuffix(s, "."))) {
+			return m, true
+		}
+	}
+
+	return 0, false
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	return s != ""
+}
@@ -0,0 +1,67 @@
+package smtpsrv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	zone := func(hours, minutes int) *time.Location {
+		return time.FixedZone("", (hours*60+minutes)*60)
+	}
+
+	for _, c := range []struct {
+		value string
+		want  time.Time
+	}{
+		{"Mon, 12 Oct 2026 09:30:00 +0000", time.Date(2026, 10, 12, 9, 30, 0, 0, time.UTC)},
+		{"Mon, 12 Oct 2026 09:30:00 +0200 (CEST)", time.Date(2026, 10, 12, 9, 30, 0, 0, zone(2, 0))},
+		{"12 Oct 2026 09:30:00 -0530", time.Date(2026, 10, 12, 9, 30, 0, 0, zone(-5, -30))},
+		{"  Mon,   12  Oct  2026   09:30:00  +0000  ", time.Date(2026, 10, 12, 9, 30, 0, 0, time.UTC)},
+		{"Mon,12 Oct 2026 09:30:00 GMT", time.Date(2026, 10, 12, 9, 30, 0, 0, time.UTC)},
+		{"Sat, 31 Dec 2016 23:59:60 +0000", time.Date(2016, 12, 31, 23, 59, 59, 0, time.UTC)},
+
+		// obsolete years and zones
+		{"12 Oct 26 09:30 EST", time.Date(2026, 10, 12, 9, 30, 0, 0, zone(-5, 0))},
+		{"Tue, 12 Oct 99 09:30:00 PDT", time.Date(1999, 10, 12, 9, 30, 0, 0, zone(-7, 0))},
+		{"12 Oct 126 09:30:00 +0000", time.Date(2026, 10, 12, 9, 30, 0, 0, time.UTC)},
+		{"12 Oct 2026 09:30:00 A", time.Date(2026, 10, 12, 9, 30, 0, 0, time.UTC)},
+
+		// malformed
+		{"12 October 2026 09:30", time.Date(2026, 10, 12, 9, 30, 0, 0, time.UTC)},
+		{"12 Oct. 2026 09:30:00 +02", time.Date(2026, 10, 12, 9, 30, 0, 0, zone(2, 0))},
+		{"12 Oct 2026 09:30:00 +02:00", time.Date(2026, 10, 12, 9, 30, 0, 0, zone(2, 0))},
+		{"12 Oct 2026 Mon 09:30:00 +0000", time.Date(2026, 10, 12, 9, 30, 0, 0, time.UTC)},
+		{"12 Oct 2026", time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)},
+
+		// ctime and ISO 8601
+		{"Mon Oct 12 09:30:00 2026", time.Date(2026, 10, 12, 9, 30, 0, 0, time.UTC)},
+		{"2026-10-12T09:30:00+02:00", time.Date(2026, 10, 12, 9, 30, 0, 0, zone(2, 0))},
+		{"2026-10-12 09:30:00", time.Date(2026, 10, 12, 9, 30, 0, 0, time.UTC)},
+	} {
+		got, err := ParseDate(c.value)
+		if err != nil {
+			t.Errorf("parse %q: %v", c.value, err)
+			continue
+		}
+
+		if !got.Equal(c.want) {
+			t.Errorf("parse %q = %v, want %v", c.value, got, c.want)
+		}
+	}
+
+	for _, value := range []string{
+		"",
+		"yesterday",
+		"Oct 2026 09:30:00 +0000",
+		"30 Feb 2026 09:30:00 +0000",
+		"12 Oct 2026 25:30:00 +0000",
+		"12 Oct 2026 09:30:00 +0260",
+		"12 Oct 2026 09:30:00:00 +0000",
+		"12 13 Oct 2026 09:30:00",
+	} {
+		if got, err := ParseDate(value); err != ErrMalformedDate {
+			t.Errorf("parse %q = %v, %v, want %v", value, got, err, ErrMalformedDate)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+)
+
+// lenientBase64Reader decodes base64 ignoring the characters outside of the
+// alphabet, such as stray whitespace, and the missing or misplaced padding:
+// a "=" ends the current group, so that concatenated encodings are decoded.
+type lenientBase64Reader struct {
+	r       io.Reader
+	in      []byte
+	group   []byte
+	out     []byte
+	err     error
+	decoded [3]byte
+}
+
+func newLenientBase64Reader(r io.Reader) io.Reader {
+	return &lenientBase64Reader{r: r, in: make([]byte, 4096), group: make([]byte, 0, 4)}
+}
+
+func (r *lenientBase64Reader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		n, err := r.r.Read(r.in)
+		for _, c := range r.in[:n] {
+			switch {
+			case c == '=':
+				r.flush()
+			case isBase64Char(c):
+				r.group = append(r.group, c)
+				if len(r.group) == 4 {
+					r.flush()
+				}
+			}
+		}
+
+		if err != nil {
+			r.flush()
+			r.err = err
+		}
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// flush decodes the pending group, a group of a single character carries no
+// complete byte and is dropped
+func (r *lenientBase64Reader) flush() {
+	if len(r.group) > 1 {
+		n, _ := base64.RawStdEncoding.Decode(r.decoded[:], r.group)
+		r.out = append(r.out, r.decoded[:n]...)
+	}
+
+	r.group = r.group[:0]
+}
+
+func isBase64Char(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '+' || c == '/'
+}
+
+// lenientQPReader decodes quoted-printable keeping the "=" not followed by
+// two hexadecimal digits or a line break as they are, as RFC 2045 section
+// 6.7 suggests
+type lenientQPReader struct {
+	r   *bufio.Reader
+	out []byte
+	err error
+}
+
+func newLenientQPReader(r io.Reader) io.Reader {
+	return &lenientQPReader{r: bufio.NewReader(r)}
+}
+
+func (r *lenientQPReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		line, err := r.r.ReadBytes('\n')
+		r.out = decodeQPLine(line)
+		r.err = err
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func decodeQPLine(line []byte) []byte {
+	eol := []byte(nil)
+	if bytes.HasSuffix(line, []byte("\n")) {
+		line, eol = line[:len(line)-1], []byte("\n")
+		if bytes.HasSuffix(line, []byte("\r")) {
+			line, eol = line[:len(line)-1], []byte("\r\n")
+		}
+	}
+
+	// the trailing whitespace is added by transports
+	line = bytes.TrimRight(line, " \t")
+
+	if bytes.HasSuffix(line, []byte("=")) {
+		// soft line break
+		line, eol = line[:len(line)-1], nil
+	}
+
+	out := make([]byte, 0, len(line)+len(eol))
+	for i := 0; i < len(line); i++ {
+		if line[i] == '=' && i+2 < len(line) {
+			if b, ok := unhex(line[i+1], line[i+2]); ok {
+				out = append(out, b)
+				i += 2
+				continue
+			}
+		}
+		out = append(out, line[i])
+	}
+
+	return append(out, eol...)
+}
+
+func unhex(hi, lo byte) (byte, bool) {
+	h, ok1 := hexValue(hi)
+	l, ok2 := hexValue(lo)
+	return h<<4 | l, ok1 && ok2
+}
+
+func hexValue(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	case c >= 'a' && c <= 'f':
+		// lowercase digits are not allowed, but common
+		return c - 'a' + 10, true
+	}
+
+	return 0, false
+}
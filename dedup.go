@@ -0,0 +1,225 @@
+package smtpsrv
+
+import (
+	"container/list"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long a delivery in progress holds its message, in case the process
+// stops before it ends
+const dedupPendingTimeout = 10 * time.Minute
+
+var errDuplicate = &Error{
+	Code:         550,
+	EnhancedCode: EnhancedCode{5, 7, 1},
+	Message:      "Duplicate message",
+}
+
+var errDeliveryInProgress = &Error{
+	Code:         451,
+	EnhancedCode: EnhancedCode{4, 7, 1},
+	Message:      "Message already being delivered, try again later",
+}
+
+// SeenStore records the messages already accepted, implementations backed by
+// a shared store (e.g. redis EXISTS, SET PX, SET NX PX and DEL) detect the
+// duplicates across instances.
+type SeenStore interface {
+	// Seen reports whether the key was added and did not expire yet
+	Seen(key string) (bool, error)
+
+	// Add records the key, which expires window after
+	Add(key string, window time.Duration) error
+
+	// AddIfAbsent atomically records the key unless it was added and did not
+	// expire yet, and reports whether it was recorded
+	AddIfAbsent(key string, window time.Duration) (bool, error)
+
+	// Delete removes the key, deleting an unknown key is not an error
+	Delete(key string) error
+}
+
+// DedupConfig holds the duplicate suppression settings
+type DedupConfig struct {
+	// Window is how long an accepted message is remembered, defaults to a day
+	Window time.Duration
+
+	// Reject rejects the duplicates with a 550 5.7.1 reply, they are accepted
+	// without invoking the handler otherwise. Either way they are neither
+	// recorded by ServerConfig.Usage nor archived.
+	Reject bool
+
+	// Store defaults to an in-memory store
+	Store SeenStore
+}
+
+// Dedup suppresses the messages delivered again with the same Message-ID to
+// the same recipients, e.g. by an upstream retrying after a lost reply. The
+// messages without a Message-ID are never suppressed. A message is held by
+// its delivery until it ends, the same message delivered concurrently by
+// another session is replied a temporary failure.
+type Dedup struct {
+	config DedupConfig
+}
+
+// NewDedup creates the duplicate suppression of ServerConfig.Dedup, the
+// zero DedupConfig remembers the messages of the last day in memory.
+func NewDedup(cfg DedupConfig) *Dedup {
+	if cfg.Window == 0 {
+		cfg.Window = 24 * time.Hour
+	}
+
+	if cfg.Store == nil {
+		cfg.Store = NewMemorySeenStore(0)
+	}
+
+	return &Dedup{
+		config: cfg,
+	}
+}
+
+// key returns the key of the message, empty when it has no Message-ID
+func (d *Dedup) key(c *Context) string {
+	id := c.session.messageID()
+	if id == "" {
+		return ""
+	}
+
+	rcpts := c.deliveryRecipients()
+	sort.Strings(rcpts)
+
+	return "dedup:" + id + " " + strings.ToLower(strings.Join(rcpts, ","))
+}
+
+// reserve holds the message of the key for the delivery and reports whether
+// it was already accepted, release ends the delivery once it was recorded.
+// It fails with errDeliveryInProgress while another delivery holds it.
+func (d *Dedup) reserve(key string) (release func(), seen bool, err error) {
+	release = func() {}
+	if key == "" {
+		return release, false, nil
+	}
+
+	pending := "pending:" + key
+	reserved, err := d.config.Store.AddIfAbsent(pending, dedupPendingTimeout)
+	if err != nil {
+		return release, false, err
+	} else if !reserved {
+		return release, false, errDeliveryInProgress
+	}
+
+	// the pending keys left by a store failure expire
+	release = func() {
+		d.config.Store.Delete(pending)
+	}
+
+	// checked once held, the deliveries record the message before releasing it
+	seen, err = d.config.Store.Seen(key)
+
+	return release, seen, err
+}
+
+// record remembers the accepted message of the key
+func (d *Dedup) record(key string) error {
+	if key == "" {
+		return nil
+	}
+
+	return d.config.Store.Add(key, d.config.Window)
+}
+
+type seenEntry struct {
+	key     string
+	expires time.Time
+}
+
+// MemorySeenStore is a SeenStore local to the process, the least recently
+// added keys are evicted once it holds its maximum.
+type MemorySeenStore struct {
+	max int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// NewMemorySeenStore creates a store holding up to max keys, defaults to
+// 100000.
+func NewMemorySeenStore(max int) *MemorySeenStore {
+	if max < 1 {
+		max = 100000
+	}
+
+	return &MemorySeenStore{
+		max:     max,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (s *MemorySeenStore) Seen(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return false, nil
+	}
+
+	if time.Now().After(e.Value.(*seenEntry).expires) {
+		s.order.Remove(e)
+		delete(s.entries, key)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (s *MemorySeenStore) Add(key string, window time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.add(key, window)
+
+	return nil
+}
+
+func (s *MemorySeenStore) AddIfAbsent(key string, window time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok && !time.Now().After(e.Value.(*seenEntry).expires) {
+		return false, nil
+	}
+	s.add(key, window)
+
+	return true, nil
+}
+
+func (s *MemorySeenStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		s.order.Remove(e)
+		delete(s.entries, key)
+	}
+
+	return nil
+}
+
+func (s *MemorySeenStore) add(key string, window time.Duration) {
+	if e, ok := s.entries[key]; ok {
+		s.order.Remove(e)
+	}
+	s.entries[key] = s.order.PushFront(&seenEntry{key: key, expires: time.Now().Add(window)})
+
+	for s.order.Len() > s.max {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*seenEntry).key)
+	}
+}
@@ -0,0 +1,81 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// DKIMResult is the verification outcome of a single DKIM-Signature header
+type DKIMResult struct {
+	Domain     string
+	Selector   string
+	Identifier string
+	Pass       bool
+	// TempFail is set when the verification failed because of a temporary error (e.g. DNS)
+	TempFail bool
+	Reason   string
+}
+
+// VerifyDKIM validates all the DKIM-Signature headers of the raw message,
+// returning one result per signature in header order.
+func VerifyDKIM(raw []byte) ([]DKIMResult, error) {
+	verifications, err := dkim.Verify(bytes.NewReader(raw))
+	if err != nil && err != dkim.ErrTooManySignatures {
+		return nil, err
+	}
+
+	tags := dkimSignatureTags(raw)
+
+	results := make([]DKIMResult, 0, len(verifications))
+	for i, v := range verifications {
+		result := DKIMResult{
+			Domain:     v.Domain,
+			Identifier: v.Identifier,
+			Pass:       v.Err == nil,
+		}
+
+		if i < len(tags) {
+			result.Selector = tags[i]["s"]
+			if result.Domain == "" {
+				result.Domain = tags[i]["d"]
+			}
+		}
+
+		if v.Err != nil {
+			result.TempFail = dkim.IsTempFail(v.Err)
+			result.Reason = strings.TrimPrefix(v.Err.Error(), "dkim: ")
+		}
+
+		results = append(results, result)
+	}
+
+	return results, err
+}
+
+// dkimSignatureTags returns the tag=value lists of the DKIM-Signature headers
+func dkimSignatureTags(raw []byte) []map[string]string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+
+	result := []map[string]string{}
+	for _, value := range msg.Header["Dkim-Signature"] {
+		tags := map[string]string{}
+		for _, tag := range strings.Split(value, ";") {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+
+			tags[strings.TrimSpace(kv[0])] = strings.Join(strings.Fields(kv[1]), "")
+		}
+
+		result = append(result, tags)
+	}
+
+	return result
+}
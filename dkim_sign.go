@@ -0,0 +1,146 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+var errDKIMKey = errors.New("smtpsrv: no RSA or Ed25519 private key found")
+
+// DKIMCanonicalization is "simple" or "relaxed" (RFC 6376 section 3.4)
+type DKIMCanonicalization = dkim.Canonicalization
+
+const (
+	DKIMCanonicalizationSimple  = dkim.CanonicalizationSimple
+	DKIMCanonicalizationRelaxed = dkim.CanonicalizationRelaxed
+)
+
+// DKIMSignConfig holds the DKIM signing settings
+type DKIMSignConfig struct {
+	Domain   string
+	Selector string
+
+	// PrivateKey is a RSA or Ed25519 key, see ParseDKIMPrivateKey
+	PrivateKey crypto.Signer
+
+	// HeaderCanonicalization and BodyCanonicalization default to relaxed
+	// and simple
+	HeaderCanonicalization DKIMCanonicalization
+	BodyCanonicalization   DKIMCanonicalization
+
+	// HeaderKeys lists the signed header fields, defaults to those
+	// recommended by RFC 6376 section 5.4.1
+	HeaderKeys []string
+
+	// Expiration, when set, limits the validity of the signatures
+	Expiration time.Duration
+}
+
+// DKIMSigner adds a DKIM-Signature header to messages
+type DKIMSigner struct {
+	config DKIMSignConfig
+}
+
+func NewDKIMSigner(cfg DKIMSignConfig) (*DKIMSigner, error) {
+	if cfg.HeaderCanonicalization == "" {
+		cfg.HeaderCanonicalization = DKIMCanonicalizationRelaxed
+	}
+
+	// validates the settings ahead of the first message
+	if _, err := dkim.NewSigner(cfg.options()); err != nil {
+		return nil, err
+	}
+
+	return &DKIMSigner{
+		config: cfg,
+	}, nil
+}
+
+func (cfg DKIMSignConfig) options() *dkim.SignOptions {
+	opts := &dkim.SignOptions{
+		Domain:                 cfg.Domain,
+		Selector:               cfg.Selector,
+		Signer:                 cfg.PrivateKey,
+		HeaderCanonicalization: cfg.HeaderCanonicalization,
+		BodyCanonicalization:   cfg.BodyCanonicalization,
+		HeaderKeys:             cfg.HeaderKeys,
+	}
+
+	if cfg.Expiration > 0 {
+		opts.Expiration = time.Now().Add(cfg.Expiration)
+	}
+
+	return opts
+}
+
+// SignTo copies the message read from r to w with its signature prepended
+func (s *DKIMSigner) SignTo(w io.Writer, r io.Reader) error {
+	return dkim.Sign(w, r, s.config.options())
+}
+
+// Sign returns the raw message with its signature prepended
+func (s *DKIMSigner) Sign(raw []byte) ([]byte, error) {
+	var signed bytes.Buffer
+	if err := s.SignTo(&signed, bytes.NewReader(raw)); err != nil {
+		return nil, err
+	}
+
+	return signed.Bytes(), nil
+}
+
+// SignEmail renders the email, see Email.WriteTo, and signs it
+func (s *DKIMSigner) SignEmail(e *Email) ([]byte, error) {
+	var raw bytes.Buffer
+	if _, err := e.WriteTo(&raw); err != nil {
+		return nil, err
+	}
+
+	return s.Sign(raw.Bytes())
+}
+
+// Deliver returns a DeliverFunc signing the messages before handing them to
+// next, e.g. (*Relay).Send.
+func (s *DKIMSigner) Deliver(next DeliverFunc) DeliverFunc {
+	return func(from string, to []string, msg []byte) error {
+		signed, err := s.Sign(msg)
+		if err != nil {
+			return err
+		}
+
+		return next(from, to, signed)
+	}
+}
+
+// ParseDKIMPrivateKey parses a PEM encoded RSA (PKCS #1 or PKCS #8) or
+// Ed25519 (PKCS #8) private key
+func ParseDKIMPrivateKey(data []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errDKIMKey
+		}
+
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+
+			if signer, ok := key.(crypto.Signer); ok {
+				return signer, nil
+			}
+			return nil, errDKIMKey
+		}
+	}
+}
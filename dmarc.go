@@ -0,0 +1,125 @@
+package smtpsrv
+
+import (
+	"math/rand"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/emersion/go-smtp"
+	"golang.org/x/net/publicsuffix"
+)
+
+// DMARCPolicy is the disposition requested by a domain owner for failing messages
+type DMARCPolicy string
+
+const (
+	DMARCPolicyNone       DMARCPolicy = "none"
+	DMARCPolicyQuarantine DMARCPolicy = "quarantine"
+	DMARCPolicyReject     DMARCPolicy = "reject"
+)
+
+var errDMARCReject = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Message rejected due to DMARC policy",
+}
+
+// DMARCResult is the outcome of evaluating the DMARC policy of the From domain
+type DMARCResult struct {
+	// Domain is the RFC5322.From domain the policy was evaluated for
+	Domain string
+	// HasPolicy is false when the domain doesn't publish a DMARC record
+	HasPolicy bool
+
+	Pass        bool
+	SPFAligned  bool
+	DKIMAligned bool
+
+	// Policy is the published policy that applies to Domain
+	Policy DMARCPolicy
+	// Disposition is the action requested for this message, none when it passed
+	Disposition DMARCPolicy
+}
+
+// EvaluateDMARC looks up the DMARC record of fromDomain, checks the SPF (of the
+// MAIL FROM domain) and DKIM results for alignment and returns the requested disposition.
+func EvaluateDMARC(fromDomain string, spfResult SPFResult, spfDomain string, dkimResults []DKIMResult) (*DMARCResult, error) {
+	fromDomain = strings.ToLower(strings.TrimSuffix(fromDomain, "."))
+	orgDomain := organizationalDomain(fromDomain)
+
+	result := &DMARCResult{
+		Domain:      fromDomain,
+		Policy:      DMARCPolicyNone,
+		Disposition: DMARCPolicyNone,
+	}
+
+	record, err := dmarc.Lookup(fromDomain)
+	isSubdomain := false
+	if err == dmarc.ErrNoPolicy && orgDomain != fromDomain {
+		record, err = dmarc.Lookup(orgDomain)
+		isSubdomain = true
+	}
+
+	if err == dmarc.ErrNoPolicy {
+		return result, nil
+	} else if err != nil {
+		return result, err
+	}
+
+	result.HasPolicy = true
+	result.Policy = DMARCPolicy(record.Policy)
+	if isSubdomain && record.SubdomainPolicy != "" {
+		result.Policy = DMARCPolicy(record.SubdomainPolicy)
+	}
+
+	if spfResult == SPFPass {
+		result.SPFAligned = domainsAligned(fromDomain, spfDomain, record.SPFAlignment)
+	}
+
+	for _, dkimResult := range dkimResults {
+		if dkimResult.Pass && domainsAligned(fromDomain, dkimResult.Domain, record.DKIMAlignment) {
+			result.DKIMAligned = true
+			break
+		}
+	}
+
+	result.Pass = result.SPFAligned || result.DKIMAligned
+	if result.Pass {
+		return result, nil
+	}
+
+	result.Disposition = result.Policy
+	if record.Percent != nil && rand.Intn(100) >= *record.Percent {
+		// the message is outside of the sampled percentage, apply the next less strict policy
+		switch result.Policy {
+		case DMARCPolicyReject:
+			result.Disposition = DMARCPolicyQuarantine
+		case DMARCPolicyQuarantine:
+			result.Disposition = DMARCPolicyNone
+		}
+	}
+
+	return result, nil
+}
+
+func domainsAligned(fromDomain, domain string, mode dmarc.AlignmentMode) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == "" {
+		return false
+	}
+
+	if mode == dmarc.AlignmentStrict {
+		return domain == fromDomain
+	}
+
+	return organizationalDomain(domain) == organizationalDomain(fromDomain)
+}
+
+func organizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+
+	return org
+}
@@ -0,0 +1,189 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"io"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const contentTypeMultipartReport = "multipart/report"
+const contentTypeDeliveryStatus = "message/delivery-status"
+
+// DeliveryStatus holds the machine readable part of a RFC 3464 delivery status notification
+type DeliveryStatus struct {
+	ReportingMTA       string
+	OriginalEnvelopeID string
+	ArrivalDate        time.Time
+	Recipients         []RecipientStatus
+}
+
+// RecipientStatus holds the per-recipient fields of a delivery status notification
+type RecipientStatus struct {
+	FinalRecipient    string
+	OriginalRecipient string
+	Action            string
+	Status            string
+	RemoteMTA         string
+	DiagnosticCode    string
+	LastAttemptDate   time.Time
+}
+
+// IsBounce reports whether the email is a delivery status notification with at least one failed recipient
+func (e *Email) IsBounce() bool {
+	if e.DeliveryStatus == nil {
+		return false
+	}
+
+	for _, rcpt := range e.DeliveryStatus.Recipients {
+		if rcpt.Action == "failed" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseMultipartReport(msg io.Reader, boundary string, opts *parseState) (textBody, htmlBody string, attachments []Attachment, status *DeliveryStatus, err error) {
+	opts.enter()
+	defer opts.leave()
+
+	var pieces []bodyPiece
+
+	mr := multipart.NewReader(msg, boundary)
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if err := opts.failBoundary(err); err != nil {
+				return textBody, htmlBody, attachments, status, err
+			}
+			break
+		}
+
+		opts.next()
+
+		contentType, params, err := parseContentType(part.Header.Get("Content-Type"))
+		if err != nil {
+			if err = opts.fail(err); err != nil {
+				return textBody, htmlBody, attachments, status, err
+			}
+			continue
+		}
+
+		switch contentType {
+		case contentTypeDeliveryStatus:
+			newPart, err := opts.decodeContent(part, part.Header.Get("Content-Transfer-Encoding"))
+			if err != nil {
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, status, err
+				}
+				continue
+			}
+
+			status, err = parseDeliveryStatus(newPart)
+			if err != nil {
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, status, err
+				}
+				continue
+			}
+		case contentTypeMultipartAlternative:
+			tb, hb, _, err := parseMultipartAlternative(part, params["boundary"], opts)
+			if err != nil {
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, status, err
+				}
+				continue
+			}
+
+			pieces = opts.addBody(pieces, contentType, tb, hb)
+		case contentTypeTextPlain:
+			text, err := opts.decodeText(part, part.Header)
+			if err != nil {
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, status, err
+				}
+				continue
+			}
+
+			pieces = opts.addBody(pieces, contentType, strings.TrimSuffix(text, "\n"), "")
+		default:
+			// the returned message or its headers (message/rfc822, text/rfc822-headers)
+			at, err := decodeAttachment(part, opts)
+			if err != nil {
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, status, err
+				}
+				continue
+			}
+
+			at.ContentType = contentType
+			attachments = append(attachments, at)
+		}
+	}
+
+	textBody, htmlBody = mergeBodies(pieces)
+	return textBody, htmlBody, attachments, status, err
+}
+
+func parseDeliveryStatus(r io.Reader) (*DeliveryStatus, error) {
+	tp := textproto.NewReader(bufio.NewReader(r))
+
+	perMessage, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	status := &DeliveryStatus{
+		ReportingMTA:       stripTypeField(perMessage.Get("Reporting-MTA")),
+		OriginalEnvelopeID: perMessage.Get("Original-Envelope-Id"),
+		ArrivalDate:        parseStatusDate(perMessage.Get("Arrival-Date")),
+	}
+
+	for err == nil {
+		var perRecipient textproto.MIMEHeader
+		perRecipient, err = tp.ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return status, err
+		}
+
+		if len(perRecipient) == 0 {
+			continue
+		}
+
+		status.Recipients = append(status.Recipients, RecipientStatus{
+			FinalRecipient:    stripTypeField(perRecipient.Get("Final-Recipient")),
+			OriginalRecipient: stripTypeField(perRecipient.Get("Original-Recipient")),
+			Action:            strings.ToLower(strings.TrimSpace(perRecipient.Get("Action"))),
+			Status:            strings.TrimSpace(perRecipient.Get("Status")),
+			RemoteMTA:         stripTypeField(perRecipient.Get("Remote-MTA")),
+			DiagnosticCode:    stripTypeField(perRecipient.Get("Diagnostic-Code")),
+			LastAttemptDate:   parseStatusDate(perRecipient.Get("Last-Attempt-Date")),
+		})
+	}
+
+	return status, nil
+}
+
+// stripTypeField removes the "type;" prefix of fields like "rfc822; user@example.com"
+func stripTypeField(s string) string {
+	if ind := strings.Index(s, ";"); ind != -1 {
+		s = s[ind+1:]
+	}
+
+	return strings.TrimSpace(s)
+}
+
+func parseStatusDate(s string) time.Time {
+	t, err := mail.ParseDate(strings.TrimSpace(s))
+	if err != nil {
+		return time.Time{}
+	}
+
+	return t
+}
@@ -0,0 +1,49 @@
+package smtpsrv
+
+import (
+	"net/mail"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DSNParams holds the delivery status notification parameters (RFC 3461) of a transaction
+type DSNParams struct {
+	// Return is FULL or HDRS, empty when not requested
+	Return     string
+	EnvelopeID string
+	Recipients []DSNRecipient
+}
+
+// DSNRecipient holds the DSN parameters of a single RCPT TO
+type DSNRecipient struct {
+	Address *mail.Address
+	// Notify is either NEVER or a combination of SUCCESS, FAILURE, DELAY,
+	// empty when not requested
+	Notify                []string
+	OriginalRecipientType string
+	OriginalRecipient     string
+}
+
+func newDSNParams(mailOpts *smtp.MailOptions, rcpts []*mail.Address, rcptOpts []*smtp.RcptOptions) DSNParams {
+	params := DSNParams{}
+	if mailOpts != nil {
+		params.Return = string(mailOpts.Return)
+		params.EnvelopeID = mailOpts.EnvelopeID
+	}
+
+	for i, addr := range rcpts {
+		rcpt := DSNRecipient{Address: addr}
+
+		if i < len(rcptOpts) && rcptOpts[i] != nil {
+			for _, notify := range rcptOpts[i].Notify {
+				rcpt.Notify = append(rcpt.Notify, string(notify))
+			}
+			rcpt.OriginalRecipientType = string(rcptOpts[i].OriginalRecipientType)
+			rcpt.OriginalRecipient = rcptOpts[i].OriginalRecipient
+		}
+
+		params.Recipients = append(params.Recipients, rcpt)
+	}
+
+	return params
+}
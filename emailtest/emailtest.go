@@ -0,0 +1,111 @@
+// Package emailtest provides assertion helpers for tests that consume parsed emails.
+package emailtest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/alash3al/go-smtpsrv/v3"
+)
+
+// AssertSubject fails the test if the email subject isn't want
+func AssertSubject(t testing.TB, e *smtpsrv.Email, want string) {
+	t.Helper()
+
+	if e.Subject != want {
+		t.Errorf("subject mismatch:\n\twant: %q\n\tgot:  %q", want, e.Subject)
+	}
+}
+
+// AssertTextContains fails the test if the text body doesn't contain substr
+func AssertTextContains(t testing.TB, e *smtpsrv.Email, substr string) {
+	t.Helper()
+
+	if !strings.Contains(e.TextBody, substr) {
+		t.Errorf("text body doesn't contain %q:\n%s", substr, indent(e.TextBody))
+	}
+}
+
+// AssertHTMLContains fails the test if the html body doesn't contain substr
+func AssertHTMLContains(t testing.TB, e *smtpsrv.Email, substr string) {
+	t.Helper()
+
+	if !strings.Contains(e.HTMLBody, substr) {
+		t.Errorf("html body doesn't contain %q:\n%s", substr, indent(e.HTMLBody))
+	}
+}
+
+// AssertHasAttachment fails the test if there is no attachment named name whose
+// content has the hex encoded sha256 digest, an empty digest matches any content.
+// The attachments data is buffered so it can still be read after the assertion.
+func AssertHasAttachment(t testing.TB, e *smtpsrv.Email, name, sha256sum string) {
+	t.Helper()
+
+	found := []string{}
+	for i := range e.Attachments {
+		at := &e.Attachments[i]
+
+		sum, err := digest(at)
+		if err != nil {
+			t.Errorf("reading attachment %q: %v", at.Filename, err)
+			return
+		}
+
+		if at.Filename == name && (sha256sum == "" || strings.EqualFold(sum, sha256sum)) {
+			return
+		}
+
+		found = append(found, at.Filename+" sha256:"+sum)
+	}
+
+	t.Errorf("attachment %q (sha256:%s) not found, got:\n%s", name, sha256sum, indent(strings.Join(found, "\n")))
+}
+
+// AssertAddressIn fails the test if address isn't one of addrs, e.g. AssertAddressIn(t, e.To, "bob@example.com")
+func AssertAddressIn(t testing.TB, addrs []*mail.Address, address string) {
+	t.Helper()
+
+	found := []string{}
+	for _, addr := range addrs {
+		if addr == nil {
+			continue
+		}
+
+		if strings.EqualFold(addr.Address, address) {
+			return
+		}
+
+		found = append(found, addr.String())
+	}
+
+	t.Errorf("address %q not found, got:\n%s", address, indent(strings.Join(found, "\n")))
+}
+
+func digest(at *smtpsrv.Attachment) (string, error) {
+	if at.Data == nil {
+		at.Data = bytes.NewReader(nil)
+	}
+
+	data, err := ioutil.ReadAll(at.Data)
+	if err != nil {
+		return "", err
+	}
+
+	at.Data = bytes.NewReader(data)
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func indent(s string) string {
+	if s == "" {
+		return "\t(empty)"
+	}
+
+	return "\t" + strings.Replace(s, "\n", "\n\t", -1)
+}
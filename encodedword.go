@@ -0,0 +1,212 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// mimeWordDecoder decodes the encoded words in any charset, it is safe for
+// concurrent use
+var mimeWordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		return convertToUtf8(input, charset)
+	},
+}
+
+// decodeMimeSentence decodes the encoded words (RFC 2047) of an unstructured
+// header value. The folding is removed, the whitespace between two adjacent
+// encoded words is dropped, and the adjacent words of the same charset are
+// decoded together, as a character may be split between them. The malformed
+// words and those of unknown charsets are kept as they are.
+func decodeMimeSentence(s string) string {
+	s = unfoldHeader(s)
+	if !strings.Contains(s, "=?") {
+		return s
+	}
+
+	var out strings.Builder
+	var run encodedRun
+	// the whitespace dropped before the word, kept with the undecodable words
+	sep := ""
+
+	for i := 0; i < len(s); {
+		if word, n, ok := parseEncodedWord(s[i:]); ok {
+			if !run.empty() && !strings.EqualFold(run.charset, word.charset) {
+				if !run.flush(&out) {
+					out.WriteString(sep)
+				}
+				sep = ""
+			}
+			run.add(word, sep+s[i:i+n])
+			sep = ""
+			i += n
+
+			// the whitespace up to the next encoded word is dropped
+			j := i
+			for j < len(s) && (s[j] == ' ' || s[j] == '\t') {
+				j++
+			}
+			if j > i && j < len(s) {
+				if _, _, next := parseEncodedWord(s[j:]); next {
+					sep = s[i:j]
+					i = j
+					continue
+				}
+			}
+			continue
+		}
+
+		run.flush(&out)
+
+		next := strings.Index(s[i+1:], "=?")
+		if next == -1 {
+			out.WriteString(s[i:])
+			break
+		}
+		out.WriteString(s[i : i+1+next])
+		i += 1 + next
+	}
+	run.flush(&out)
+
+	return out.String()
+}
+
+// unfoldHeader removes the line breaks of a folded header value
+func unfoldHeader(s string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+
+	return strings.NewReplacer("\r\n", "", "\n", "", "\r", "").Replace(s)
+}
+
+type encodedWord struct {
+	charset string
+	text    []byte
+}
+
+// parseEncodedWord parses "=?charset?encoding?text?=" at the start of s and
+// returns its decoded bytes and its length
+func parseEncodedWord(s string) (encodedWord, int, bool) {
+	if !strings.HasPrefix(s, "=?") {
+		return encodedWord{}, 0, false
+	}
+
+	charsetEnd := strings.IndexByte(s[2:], '?')
+	if charsetEnd < 1 || len(s) < 2+charsetEnd+3 || s[2+charsetEnd+2] != '?' {
+		return encodedWord{}, 0, false
+	}
+	charset := s[2 : 2+charsetEnd]
+	encoding := s[2+charsetEnd+1]
+	start := 2 + charsetEnd + 3
+
+	end := strings.Index(s[start:], "?=")
+	if end == -1 || strings.ContainsAny(s[start:start+end], " \t") || strings.ContainsAny(charset, " \t") {
+		return encodedWord{}, 0, false
+	}
+	text := s[start : start+end]
+
+	// the language of RFC 2231, e.g. "utf-8*en"
+	if ind := strings.IndexByte(charset, '*'); ind != -1 {
+		charset = charset[:ind]
+	}
+
+	var decoded []byte
+	switch encoding {
+	case 'b', 'B':
+		var err error
+		decoded, err = base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			// the padding is often missing
+			decoded, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(text, "="))
+			if err != nil {
+				return encodedWord{}, 0, false
+			}
+		}
+	case 'q', 'Q':
+		decoded = decodeQWord(text)
+	default:
+		return encodedWord{}, 0, false
+	}
+
+	return encodedWord{charset: charset, text: decoded}, start + end + 2, true
+}
+
+// decodeQWord decodes the "Q" encoding, the invalid escapes are kept as
+// they are
+func decodeQWord(text string) []byte {
+	decoded := make([]byte, 0, len(text))
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '_':
+			decoded = append(decoded, ' ')
+		case c == '=' && i+2 < len(text):
+			if b, ok := unhex(text[i+1], text[i+2]); ok {
+				decoded = append(decoded, b)
+				i += 2
+				continue
+			}
+			decoded = append(decoded, c)
+		default:
+			decoded = append(decoded, c)
+		}
+	}
+
+	return decoded
+}
+
+// encodedRun gathers the adjacent encoded words of a charset
+type encodedRun struct {
+	charset string
+	text    bytes.Buffer
+	raw     strings.Builder
+}
+
+func (r *encodedRun) empty() bool {
+	return r.raw.Len() == 0
+}
+
+func (r *encodedRun) add(word encodedWord, raw string) {
+	r.charset = word.charset
+	r.text.Write(word.text)
+	r.raw.WriteString(raw)
+}
+
+// flush writes the run converted to UTF-8, or as it was encoded when the
+// charset is unknown, and reports whether it was decoded
+func (r *encodedRun) flush(out *strings.Builder) bool {
+	if r.empty() {
+		return true
+	}
+	defer func() {
+		r.text.Reset()
+		r.raw.Reset()
+	}()
+
+	switch strings.ToLower(r.charset) {
+	case "utf-8", "utf8", "us-ascii":
+		if utf8.Valid(r.text.Bytes()) {
+			out.Write(r.text.Bytes())
+			return true
+		}
+	}
+
+	converter, err := convertToUtf8(&r.text, r.charset)
+	if err != nil {
+		out.WriteString(r.raw.String())
+		return false
+	}
+	converted, err := ioutil.ReadAll(converter)
+	if err != nil {
+		out.WriteString(r.raw.String())
+		return false
+	}
+
+	out.WriteString(strings.ToValidUTF8(string(converted), "\uFFFD"))
+	return true
+}
@@ -0,0 +1,21 @@
+package smtpsrv
+
+import "testing"
+
+func BenchmarkDecodeMimeSentence(b *testing.B) {
+	for _, bench := range []struct {
+		name, header string
+	}{
+		{"plain", "Re: the quarterly report"},
+		{"utf-8", "=?UTF-8?B?w4lsw6ltZW50cyBkdSByYXBwb3J0?= =?UTF-8?Q?trimestriel_=E2=80=94_r=C3=A9vis=C3=A9?="},
+		{"iso-8859-1", "=?ISO-8859-1?Q?Andr=E9?= Pirard <PIRARD@vm1.ulg.ac.be>"},
+		{"folded", "=?UTF-8?B?w4lsw6ltZW50cw==?=\r\n =?UTF-8?B?IGR1IHJhcHBvcnQ=?="},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				decodeMimeSentence(bench.header)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package smtpsrv
+
+import (
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"strings"
+)
+
+const contentTypeTextEnriched = "text/enriched"
+const contentTypeTextRTF = "text/rtf"
+const contentTypeApplicationRTF = "application/rtf"
+
+func isRTFContentType(contentType string) bool {
+	return contentType == contentTypeTextRTF || contentType == contentTypeApplicationRTF
+}
+
+// EnrichedToText returns the text of a text/enriched body (RFC 1896): the
+// formatting commands and their parameters are removed, and the lines are
+// filled as the format requires, a single line break being a space, but in
+// the nofill sections
+func EnrichedToText(body string) string {
+	body = strings.Replace(body, "\r\n", "\n", -1)
+
+	var sb strings.Builder
+	param, nofill := 0, 0
+
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c == '<' && i+1 < len(body) && body[i+1] == '<':
+			if param == 0 {
+				sb.WriteByte('<')
+			}
+			i++
+		case c == '<':
+			end := strings.IndexByte(body[i:], '>')
+			if end == -1 {
+				// an unterminated command, kept as text
+				sb.WriteString(body[i:])
+				return sb.String()
+			}
+
+			closing := strings.HasPrefix(body[i+1:], "/")
+			name := strings.ToLower(strings.TrimPrefix(body[i+1:i+end], "/"))
+			delta := 1
+			if closing {
+				delta = -1
+			}
+
+			switch name {
+			case "param":
+				param += delta
+			case "nofill":
+				nofill += delta
+			}
+			if param < 0 {
+				param = 0
+			}
+			if nofill < 0 {
+				nofill = 0
+			}
+
+			i += end
+		case param > 0:
+			// the parameters of the commands are not text
+		case c == '\n' && nofill == 0:
+			// n line breaks are n-1 lines, a single one is a space
+			n := 1
+			for i+n < len(body) && body[i+n] == '\n' {
+				n++
+			}
+			if n == 1 {
+				sb.WriteByte(' ')
+			} else {
+				sb.WriteString(strings.Repeat("\n", n-1))
+			}
+			i += n - 1
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	// the line break ending the body
+	return strings.TrimSuffix(sb.String(), " ")
+}
+
+// decodeEnriched decodes a text/enriched part to its text
+func (s *parseState) decodeEnriched(content io.Reader, header textproto.MIMEHeader) (string, error) {
+	text, err := s.decodeText(content, header)
+	if err != nil {
+		return "", err
+	}
+
+	return EnrichedToText(text), nil
+}
+
+// decodeRTF adds the content of an RTF body part to the RTF body of the
+// email and returns it, it is kept as is, the RTF escapes its non ASCII
+// characters
+func (s *parseState) decodeRTF(content io.Reader, header textproto.MIMEHeader) (string, error) {
+	decoded, err := s.decodeContent(content, header.Get("Content-Transfer-Encoding"))
+	if err != nil {
+		return "", err
+	}
+
+	rtf, err := ioutil.ReadAll(decoded)
+	if err != nil {
+		return "", err
+	}
+
+	s.rtfBody += string(rtf)
+	return string(rtf), nil
+}
@@ -0,0 +1,60 @@
+package smtpsrv
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// the header fields recording the envelope of the delivery, as added by the
+// delivery agents
+const (
+	headerReturnPath        = "Return-Path"
+	headerDeliveredTo       = "Delivered-To"
+	headerOriginalTo        = "X-Original-To"
+	headerOriginalRecipient = "Original-Recipient"
+)
+
+// envelopeAddress returns the address of a Return-Path or Delivered-To
+// like value, without its angle brackets and comments
+func envelopeAddress(value string) string {
+	value = strings.TrimSpace(stripComments(value))
+
+	if start := strings.LastIndexByte(value, '<'); start != -1 {
+		value = value[start+1:]
+		if end := strings.IndexByte(value, '>'); end != -1 {
+			value = value[:end]
+		}
+	}
+
+	return strings.TrimSpace(value)
+}
+
+// envelopeAddresses returns the addresses of the fields, in header order,
+// the fields may hold several comma separated addresses
+func envelopeAddresses(values []string) []string {
+	var addrs []string
+	for _, value := range values {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = envelopeAddress(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	return addrs
+}
+
+// parseEnvelope sets the envelope fields of the email from the header
+func (e *Email) parseEnvelope(header mail.Header) {
+	if values := header[headerReturnPath]; len(values) > 0 {
+		// the most recent delivery
+		e.ReturnPath = envelopeAddress(values[0])
+	}
+
+	e.DeliveredTo = envelopeAddresses(header[headerDeliveredTo])
+	e.OriginalTo = envelopeAddresses(header[headerOriginalTo])
+
+	if value := header.Get(headerOriginalRecipient); value != "" {
+		e.OriginalRecipient = envelopeAddress(stripTypeField(value))
+	}
+}
@@ -3,5 +3,43 @@ package smtpsrv
 import "errors"
 
 var (
-	ErrAuthDisabled = errors.New("auth is disabled")
+	ErrAuthDisabled      = errors.New("auth is disabled")
+	ErrConnectionRefused = errors.New("connection refused by policy")
+
+	// ErrTooManyConnections refuses the clients over the connection limits
+	// or the connection rate limit
+	ErrTooManyConnections = &Error{
+		Code:         421,
+		EnhancedCode: EnhancedCode{4, 7, 0},
+		Message:      "Too many connections, try again later",
+	}
+
+	// ErrQuarantined is returned by a DataPolicy which kept the message
+	// aside, it is then accepted without invoking the handler
+	ErrQuarantined = errors.New("message quarantined")
+
+	// ErrNotQuarantined is returned for the unknown quarantined message IDs
+	ErrNotQuarantined = errors.New("message not in quarantine")
+
+	// parsing errors, wrapped in a *PartError
+	ErrUnknownEncoding     = errors.New("unknown content transfer encoding")
+	ErrUnsupportedPartType = errors.New("unsupported part type")
+	ErrMalformedBoundary   = errors.New("malformed multipart boundary")
+	ErrTooLarge            = errors.New("part too large")
+
+	// header errors, wrapped in a *HeaderError
+	ErrMalformedDate    = errors.New("malformed date")
+	ErrMalformedAddress = errors.New("malformed address")
+	ErrTooManyHeaders   = errors.New("too many header fields")
+	ErrHeaderTooLong    = errors.New("header field too long")
+	ErrHeaderTooLarge   = errors.New("header too large")
+
+	// message/partial reassembly errors
+	ErrNotPartial       = errors.New("not a message/partial fragment")
+	ErrMalformedPartial = errors.New("malformed message/partial parameters")
+
+	errNoSender = errors.New("no sender")
+	errNoData   = errors.New("no message data")
+
+	errRawConsumed = errors.New("message data already read, see ServerConfig.KeepRaw")
 )
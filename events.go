@@ -0,0 +1,174 @@
+package smtpsrv
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Event is emitted by the sessions to the subscribers of an EventBus, it is
+// one of *ConnectionOpened, *AuthSucceeded, *MailAccepted, *MessageQueued,
+// *ConnectionClosed or *Rejected.
+type Event interface {
+	Info() EventInfo
+}
+
+// EventInfo holds the fields common to all the events
+type EventInfo struct {
+	Time          time.Time
+	SessionID     string
+	TransactionID string
+	RemoteAddr    net.Addr
+}
+
+func (e EventInfo) Info() EventInfo {
+	return e
+}
+
+// ConnectionOpened is emitted once a client was accepted
+type ConnectionOpened struct {
+	EventInfo
+	Helo string
+}
+
+// AuthSucceeded is emitted when a client authenticated
+type AuthSucceeded struct {
+	EventInfo
+	Username string
+}
+
+// MailAccepted is emitted when a transaction started with MAIL FROM
+type MailAccepted struct {
+	EventInfo
+	From string
+}
+
+// MessageQueued is emitted once a message was accepted
+type MessageQueued struct {
+	EventInfo
+	From  string
+	To    []string
+	Bytes int64
+}
+
+// ConnectionClosed is emitted when a session ends
+type ConnectionClosed struct {
+	EventInfo
+}
+
+// Rejected is emitted when a connection, an authentication, a sender, a
+// recipient or a message was refused
+type Rejected struct {
+	EventInfo
+
+	// Command is CONNECT, AUTH, MAIL, RCPT or DATA. The connections refused
+	// at accept time have no session, their CONNECT event has no SessionID.
+	Command string
+
+	// Code and EnhancedCode are those replied to the client, Reason the
+	// message of the reply
+	Code         int
+	EnhancedCode EnhancedCode
+	Reason       string
+}
+
+// EventBus delivers the session events to its subscribers, in the order
+// they subscribed.
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers []subscriber
+	next        int
+}
+
+type subscriber struct {
+	id int
+	fn func(Event)
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe invokes fn with every event, until the returned function is
+// called. fn runs on the goroutine of the session, it must not block: slow
+// consumers should hand the events over to a buffered channel.
+func (b *EventBus) Subscribe(fn func(Event)) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.next
+	b.next++
+	b.subscribers = append(b.subscribers, subscriber{id: id, fn: fn})
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		for i, sub := range b.subscribers {
+			if sub.id == id {
+				b.subscribers = append(b.subscribers[:i:i], b.subscribers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Publish delivers the event to the subscribers
+func (b *EventBus) Publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, sub := range b.subscribers {
+		sub.fn(e)
+	}
+}
+
+// eventInfo returns the common fields of the events of the session
+func (s *Session) eventInfo() EventInfo {
+	return EventInfo{
+		Time:          time.Now(),
+		SessionID:     s.id,
+		TransactionID: s.transactionID(),
+		RemoteAddr:    s.conn.Conn().RemoteAddr(),
+	}
+}
+
+// emit publishes the event built by fn, only when ServerConfig.Events is set
+func (s *Session) emit(fn func(info EventInfo) Event) {
+	if s.config.Events != nil {
+		s.config.Events.Publish(fn(s.eventInfo()))
+	}
+}
+
+// emitRejected publishes the refusal of the command, if err is not nil
+func (s *Session) emitRejected(command string, err error) {
+	if err == nil {
+		return
+	}
+
+	s.emit(func(info EventInfo) Event {
+		e := &Rejected{EventInfo: info, Command: command, Code: 554, Reason: err.Error()}
+		if smtpErr, ok := smtpError(err).(*smtp.SMTPError); ok {
+			e.Code, e.EnhancedCode, e.Reason = smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message
+		}
+		return e
+	})
+}
+
+// emitRejectedConn publishes the refusal of a connection by the listeners or
+// the XCLIENT policies, which happens outside of any session
+func (cfg *ServerConfig) emitRejectedConn(addr net.Addr, err *smtp.SMTPError) {
+	if cfg.Events == nil {
+		return
+	}
+
+	cfg.Events.Publish(&Rejected{
+		EventInfo:    EventInfo{Time: time.Now(), RemoteAddr: addr},
+		Command:      "CONNECT",
+		Code:         err.Code,
+		EnhancedCode: err.EnhancedCode,
+		Reason:       err.Message,
+	})
+}
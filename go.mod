@@ -1,12 +1,19 @@
 module github.com/alash3al/go-smtpsrv/v3
 
 require (
+	github.com/emersion/go-msgauth v0.6.8
+	github.com/emersion/go-sasl v0.0.0-20241020182733-b788ff22d5a6
 	github.com/emersion/go-smtp v0.24.0
-	github.com/miekg/dns v1.1.43 // indirect
 	github.com/saintfish/chardet v0.0.0-20120816061221-3af4cd4741ca
 	github.com/zaccone/spf v0.0.0-20170817004109-76747b8658d9
-	golang.org/x/net v0.0.0-20211019232329-c6ed85c7a12d // indirect
-	golang.org/x/text v0.3.6
+	golang.org/x/crypto v0.15.0
+	golang.org/x/net v0.10.0
+	golang.org/x/text v0.14.0
+)
+
+require (
+	github.com/miekg/dns v1.1.43 // indirect
+	golang.org/x/sys v0.14.0 // indirect
 )
 
-go 1.13
+go 1.18
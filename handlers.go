@@ -1,4 +1,67 @@
 package smtpsrv
 
+import (
+	"io"
+	"net/mail"
+
+	"github.com/emersion/go-smtp"
+)
+
+// HandlerFunc processes a received message, returning an *Error controls the
+// reply sent to the client.
 type HandlerFunc func(*Context) error
+
+// Handle calls f(c), HandlerFunc is a SessionHandler.
+func (f HandlerFunc) Handle(c *Context) error {
+	return f(c)
+}
+
+// SessionHandler processes the messages received by a single session, it may
+// hold per-connection state such as buffers, a database transaction or
+// counters. When it implements io.Closer it is closed once the session ends.
+type SessionHandler interface {
+	Handle(c *Context) error
+}
+
+// HandlerFactoryFunc builds the SessionHandler of every new session, a
+// non-nil error or a nil handler refuses the session with a 451 reply unless
+// the error is an *Error.
+type HandlerFactoryFunc func(conn *smtp.Conn) (SessionHandler, error)
+
 type AuthFunc func(username, password string) error
+
+// RcptValidatorFunc is invoked for every RCPT TO, a non-nil error rejects the
+// recipient with a 550 reply unless it is an *Error.
+type RcptValidatorFunc func(ctx *Context, to *mail.Address) error
+
+// MailValidatorFunc is invoked for every MAIL FROM, the null sender is passed as
+// an empty address. A non-nil error rejects the sender with a 550 reply unless
+// it is an *Error.
+type MailValidatorFunc func(ctx *Context, from *mail.Address, opts *smtp.MailOptions) error
+
+// ConnectFunc is invoked once per session, when the client introduces itself,
+// a non-nil error refuses the session with a 554 reply unless it is an *Error.
+type ConnectFunc func(ctx *Context) error
+
+// ResetFunc is invoked when a mail transaction ends, aborted reports whether
+// it ended before its message data was transferred: on RSET, a new EHLO or
+// the disconnection of the client.
+type ResetFunc func(ctx *Context, aborted bool)
+
+// DisconnectFunc is invoked once per session, when it ends.
+type DisconnectFunc func(ctx *Context)
+
+// DataPolicyFunc reads the message of every transaction before the handler,
+// which then reads it from the start. A non-nil error rejects the message
+// with a 550 reply unless it is an *Error, ErrQuarantined accepts it without
+// invoking the handler.
+type DataPolicyFunc func(ctx *Context, r io.Reader) error
+
+// VerifyFunc answers VRFY with the mailbox of the user name or address
+// queried. A nil mailbox replies 252 (cannot verify), a non-nil error rejects
+// the query with a 550 reply unless it is an *Error.
+type VerifyFunc func(ctx *Context, query string) (*mail.Address, error)
+
+// ExpandFunc answers EXPN with the members of the mailing list queried, a
+// non-nil error rejects the query with a 550 reply unless it is an *Error.
+type ExpandFunc func(ctx *Context, list string) ([]*mail.Address, error)
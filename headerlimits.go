@@ -0,0 +1,80 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/mail"
+)
+
+// readMessage reads the message and returns the header section as it was
+// received, see Email.RawHeader. The header is first read within the limits
+// of opts so that mail.ReadMessage never holds more.
+func readMessage(r io.Reader, opts ParseOptions) (*mail.Message, []byte, error) {
+	br := bufio.NewReader(r)
+	header, err := readHeaderBlock(br, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg, err := mail.ReadMessage(io.MultiReader(bytes.NewReader(header), br))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return msg, header, nil
+}
+
+// readHeaderBlock reads the header up to the empty line ending it, the lines
+// are read in chunks so that a long line is rejected before being buffered
+func readHeaderBlock(br *bufio.Reader, opts ParseOptions) ([]byte, error) {
+	var buf bytes.Buffer
+	var field []byte
+	count, fieldLen := 0, 0
+	lineStart := true
+
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			return nil, err
+		}
+
+		if lineStart && (bytes.Equal(chunk, []byte("\r\n")) || bytes.Equal(chunk, []byte("\n"))) {
+			buf.Write(chunk)
+			return buf.Bytes(), nil
+		}
+
+		buf.Write(chunk)
+		if opts.MaxHeaderBytes > 0 && buf.Len() > opts.MaxHeaderBytes {
+			return nil, &HeaderError{Err: ErrHeaderTooLarge}
+		}
+
+		switch {
+		case !lineStart, len(chunk) > 0 && (chunk[0] == ' ' || chunk[0] == '\t'):
+			// the same line, or a folded one
+			fieldLen += len(chunk)
+		case len(chunk) > 0:
+			count++
+			if opts.MaxHeaderCount > 0 && count > opts.MaxHeaderCount {
+				return nil, &HeaderError{Err: ErrTooManyHeaders}
+			}
+
+			fieldLen = len(chunk)
+			field = chunk
+			if ind := bytes.IndexByte(field, ':'); ind != -1 {
+				field = field[:ind]
+			}
+			field = append([]byte(nil), field...)
+		}
+
+		if opts.MaxHeaderLength > 0 && fieldLen > opts.MaxHeaderLength {
+			return nil, &HeaderError{Field: string(field), Err: ErrHeaderTooLong}
+		}
+
+		if err == io.EOF {
+			// a message without body
+			return buf.Bytes(), nil
+		}
+		lineStart = err == nil
+	}
+}
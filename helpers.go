@@ -6,6 +6,36 @@ import (
 	"time"
 )
 
+// joinedError holds several errors, like errors.Join of go 1.20
+type joinedError struct {
+	errs []error
+}
+
+// joinErrors returns nil without errors, the error itself for a single one
+func joinErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+
+	return &joinedError{errs: errs}
+}
+
+func (e *joinedError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+func (e *joinedError) Unwrap() []error {
+	return e.errs
+}
+
 // SplitAddress split the email@addre.ss to <user>@<domain>
 func SplitAddress(address string) (string, string, error) {
 	sepInd := strings.LastIndex(address, "@")
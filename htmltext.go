@@ -0,0 +1,175 @@
+package smtpsrv
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLToText renders an HTML body as plain text: the tags are dropped, the
+// blocks and line breaks kept as lines, the list items and quotes marked,
+// and the targets of the links written after their text.
+func HTMLToText(body string) string {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	w := &textWriter{}
+	w.node(doc)
+
+	lines := strings.Split(w.sb.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// Text returns the text body of the email, rendered from the HTML body
+// when there is none, see HTMLToText
+func (e *Email) Text() string {
+	if e.TextBody != "" || e.HTMLBody == "" {
+		return e.TextBody
+	}
+
+	return HTMLToText(e.HTMLBody)
+}
+
+// textWriter writes the text of the nodes, the line breaks and spaces are
+// delayed until the next text so that they are not repeated
+type textWriter struct {
+	sb       strings.Builder
+	newlines int
+	space    bool
+	quote    int
+	pre      int
+}
+
+func (w *textWriter) text(s string) {
+	if w.pre == 0 {
+		if strings.TrimLeft(s, " \t\r\n\f") != s {
+			w.space = true
+		}
+		trailing := strings.TrimRight(s, " \t\r\n\f") != s
+		s = strings.Join(strings.Fields(s), " ")
+		if s == "" {
+			return
+		}
+		defer func() { w.space = trailing }()
+	}
+
+	if w.sb.Len() > 0 {
+		if w.newlines > 0 {
+			w.sb.WriteString(strings.Repeat("\n", w.newlines))
+		} else if w.space {
+			w.sb.WriteByte(' ')
+		}
+	}
+	if w.newlines > 0 || w.sb.Len() == 0 {
+		w.sb.WriteString(strings.Repeat("> ", w.quote))
+	}
+	w.newlines, w.space = 0, false
+
+	if w.pre > 0 && w.quote > 0 {
+		s = strings.Replace(s, "\n", "\n"+strings.Repeat("> ", w.quote), -1)
+	}
+	w.sb.WriteString(s)
+}
+
+// lines breaks the line, n is 2 for the blocks separated by an empty line
+func (w *textWriter) lines(n int) {
+	if n > w.newlines {
+		w.newlines = n
+	}
+	w.space = false
+}
+
+func (w *textWriter) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.node(c)
+	}
+}
+
+func (w *textWriter) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.DocumentNode:
+		w.children(n)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Head, atom.Title, atom.Noscript, atom.Template:
+	case atom.Br:
+		w.newlines++
+		w.space = false
+	case atom.Hr:
+		w.lines(2)
+		w.text("----")
+		w.lines(2)
+	case atom.Img:
+		if alt := htmlAttr(n, "alt"); alt != "" {
+			w.text(alt)
+		}
+	case atom.A:
+		before := w.sb.Len()
+		w.children(n)
+		href := strings.TrimSpace(htmlAttr(n, "href"))
+		text := strings.TrimSpace(w.sb.String()[before:])
+		if href != "" && !strings.HasPrefix(href, "#") && !strings.HasPrefix(strings.ToLower(href), "javascript:") &&
+			href != text && strings.TrimPrefix(href, "mailto:") != text {
+			w.space = true
+			w.text("<" + href + ">")
+		}
+	case atom.Li:
+		w.lines(1)
+		w.text("*")
+		w.space = true
+		w.children(n)
+		w.lines(1)
+	case atom.Blockquote:
+		w.lines(2)
+		w.quote++
+		w.children(n)
+		w.quote--
+		w.lines(2)
+	case atom.Pre:
+		w.lines(2)
+		w.pre++
+		w.children(n)
+		w.pre--
+		w.lines(2)
+	case atom.Td, atom.Th:
+		w.space = true
+		w.children(n)
+		w.space = true
+	case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Table, atom.Ul, atom.Ol, atom.Dl:
+		w.lines(2)
+		w.children(n)
+		w.lines(2)
+	case atom.Div, atom.Tr, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Nav, atom.Aside,
+		atom.Main, atom.Center, atom.Address, atom.Dt, atom.Dd, atom.Form, atom.Fieldset, atom.Figure, atom.Caption:
+		w.lines(1)
+		w.children(n)
+		w.lines(1)
+	default:
+		w.children(n)
+	}
+}
+
+func htmlAttr(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,139 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+)
+
+// The readers of Email, Attachment and EmbeddedFile are encoded as base64
+// strings, and omitted when nil. Readers implementing io.Seeker, such as the
+// ones returned by ParseEmail, are rewound after encoding so the value stays
+// usable, others are consumed.
+
+type emailFields Email
+
+func (e Email) MarshalJSON() ([]byte, error) {
+	content, err := readRewind(e.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(struct {
+		emailFields
+		Content []byte `json:",omitempty"`
+	}{emailFields(e), content})
+}
+
+func (e *Email) UnmarshalJSON(data []byte) error {
+	var v struct {
+		*emailFields
+		Content []byte
+	}
+	v.emailFields = (*emailFields)(e)
+
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	e.Content = bytesReader(v.Content)
+
+	return nil
+}
+
+type attachmentFields Attachment
+
+func (a Attachment) MarshalJSON() ([]byte, error) {
+	data, err := readRewind(a.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(struct {
+		attachmentFields
+		Data []byte `json:",omitempty"`
+	}{attachmentFields(a), data})
+}
+
+func (a *Attachment) UnmarshalJSON(data []byte) error {
+	var v struct {
+		*attachmentFields
+		Data []byte
+	}
+	v.attachmentFields = (*attachmentFields)(a)
+
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	a.Data = bytesReader(v.Data)
+
+	return nil
+}
+
+type embeddedFileFields EmbeddedFile
+
+func (f EmbeddedFile) MarshalJSON() ([]byte, error) {
+	data, err := readRewind(f.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(struct {
+		embeddedFileFields
+		Data []byte `json:",omitempty"`
+	}{embeddedFileFields(f), data})
+}
+
+func (f *EmbeddedFile) UnmarshalJSON(data []byte) error {
+	var v struct {
+		*embeddedFileFields
+		Data []byte
+	}
+	v.embeddedFileFields = (*embeddedFileFields)(f)
+
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	f.Data = bytesReader(v.Data)
+
+	return nil
+}
+
+// readRewind reads the rest of r, seeking back to its offset when possible
+func readRewind(r io.Reader) ([]byte, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return ioutil.ReadAll(r)
+	}
+
+	offset, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func bytesReader(data []byte) io.Reader {
+	if data == nil {
+		return nil
+	}
+
+	return bytes.NewReader(data)
+}
@@ -0,0 +1,118 @@
+package smtpsrv
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// MailingList holds the mailing list headers of a message (RFC 2369, RFC
+// 2919 and RFC 8058), the URLs are in header order
+type MailingList struct {
+	// ID is the List-Id identifier, e.g. "users.example.com", and Name its
+	// description
+	ID   string
+	Name string
+
+	Unsubscribe []string
+	Subscribe   []string
+	Help        []string
+	Owner       []string
+	Archive     []string
+	Post        []string
+
+	// PostingDisabled is set when List-Post is "NO"
+	PostingDisabled bool
+
+	// OneClick is set when List-Unsubscribe-Post allows the one-click
+	// unsubscription of RFC 8058
+	OneClick bool
+}
+
+// OneClickUnsubscribeURL returns the HTTPS URL to POST
+// "List-Unsubscribe=One-Click" to, "" when the list does not support it
+func (l *MailingList) OneClickUnsubscribeURL() string {
+	if !l.OneClick {
+		return ""
+	}
+
+	for _, u := range l.Unsubscribe {
+		if strings.HasPrefix(strings.ToLower(u), "https:") {
+			return u
+		}
+	}
+
+	return ""
+}
+
+// UnsubscribeMailto returns the first mailto URL of List-Unsubscribe, ""
+// when there is none
+func (l *MailingList) UnsubscribeMailto() string {
+	for _, u := range l.Unsubscribe {
+		if strings.HasPrefix(strings.ToLower(u), "mailto:") {
+			return u
+		}
+	}
+
+	return ""
+}
+
+// parseMailingList returns nil for the messages without list headers
+func parseMailingList(header mail.Header) *MailingList {
+	l := &MailingList{
+		Unsubscribe: listURLs(header.Get("List-Unsubscribe")),
+		Subscribe:   listURLs(header.Get("List-Subscribe")),
+		Help:        listURLs(header.Get("List-Help")),
+		Owner:       listURLs(header.Get("List-Owner")),
+		Archive:     listURLs(header.Get("List-Archive")),
+		Post:        listURLs(header.Get("List-Post")),
+	}
+
+	if id := header.Get("List-Id"); id != "" {
+		start, end := strings.LastIndex(id, "<"), strings.LastIndex(id, ">")
+		if start != -1 && end > start {
+			l.ID = strings.TrimSpace(id[start+1 : end])
+			l.Name = strings.Trim(decodeMimeSentence(strings.TrimSpace(id[:start])), `"`)
+		} else {
+			l.ID = strings.TrimSpace(id)
+		}
+	}
+
+	post := strings.TrimSpace(stripComments(header.Get("List-Post")))
+	l.PostingDisabled = strings.EqualFold(post, "NO")
+
+	oneClick := strings.Replace(header.Get("List-Unsubscribe-Post"), " ", "", -1)
+	l.OneClick = strings.EqualFold(oneClick, "List-Unsubscribe=One-Click")
+
+	if l.ID == "" && len(l.Unsubscribe) == 0 && len(l.Subscribe) == 0 && len(l.Help) == 0 &&
+		len(l.Owner) == 0 && len(l.Archive) == 0 && len(l.Post) == 0 && !l.PostingDisabled {
+		return nil
+	}
+
+	return l
+}
+
+// listURLs returns the URLs between angle brackets, the comments and the
+// whitespace of folded URLs are dropped
+func listURLs(value string) []string {
+	value = stripComments(value)
+
+	var urls []string
+	for {
+		start := strings.Index(value, "<")
+		if start == -1 {
+			break
+		}
+		end := strings.Index(value[start:], ">")
+		if end == -1 {
+			break
+		}
+
+		u := strings.Join(strings.Fields(value[start+1:start+end]), "")
+		if u != "" {
+			urls = append(urls, u)
+		}
+		value = value[start+end+1:]
+	}
+
+	return urls
+}
@@ -0,0 +1,63 @@
+package smtpsrv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger receives structured log entries, keyvals alternate keys and values
+// and always start with the session and transaction IDs.
+type Logger interface {
+	Log(msg string, keyvals ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(string, ...interface{}) {}
+
+// stdLogger formats the entries as "msg key=value ..." lines
+type stdLogger struct {
+	l *log.Logger
+}
+
+// NewStdLogger adapts a standard library logger to Logger
+func NewStdLogger(l *log.Logger) Logger {
+	return stdLogger{l: l}
+}
+
+func (sl stdLogger) Log(msg string, keyvals ...interface{}) {
+	var sb strings.Builder
+	sb.WriteString(msg)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		var value interface{} = "(missing)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+
+		fmt.Fprintf(&sb, " %v=%q", keyvals[i], fmt.Sprint(value))
+	}
+
+	sl.l.Println(sb.String())
+}
+
+func (cfg *ServerConfig) logger() Logger {
+	if cfg.Logger == nil {
+		return nopLogger{}
+	}
+
+	return cfg.Logger
+}
+
+// newSessionID generates a random ID identifying a session in the logs
+func newSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,89 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"sync"
+	"time"
+)
+
+// Mbox appends the accepted messages to a single mbox file, lines starting
+// with "From " are escaped following the mboxrd format.
+type Mbox struct {
+	path string
+
+	// serializes the writers of this process, the file lock those of others
+	mu sync.Mutex
+}
+
+func NewMbox(path string) *Mbox {
+	return &Mbox{
+		path: path,
+	}
+}
+
+// Deliver appends the message under a From_ line naming the envelope sender,
+// it is a DeliverFunc.
+func (m *Mbox) Deliver(from string, to []string, msg []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+
+	var buf bytes.Buffer
+	writeMboxMessage(&buf, from, time.Now(), msg)
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+// Handler returns a handler appending each accepted message to the mbox
+func (m *Mbox) Handler() HandlerFunc {
+	return func(c *Context) error {
+		raw, err := c.Raw()
+		if err != nil {
+			return err
+		}
+
+		if err := m.Deliver(c.From().Address, c.deliveryRecipients(), raw); err != nil {
+			return ErrTemporaryFailure
+		}
+
+		return nil
+	}
+}
+
+func writeMboxMessage(buf *bytes.Buffer, from string, date time.Time, msg []byte) {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+
+	buf.WriteString("From " + from + " " + date.UTC().Format(time.ANSIC) + "\n")
+
+	scanner := bufio.NewScanner(bytes.NewReader(msg))
+	scanner.Buffer(nil, len(msg)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\r"))
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			buf.WriteByte('>')
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	// messages are separated by an empty line
+	buf.WriteByte('\n')
+}
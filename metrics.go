@@ -0,0 +1,23 @@
+package smtpsrv
+
+// Metrics receives the server measurements, implementations usually forward
+// them to prometheus, statsd or similar systems.
+type Metrics interface {
+	// IncCounter increments the counter name with the given labels by one
+	IncCounter(name string, labels map[string]string)
+	// SetGauge sets the gauge name with the given labels to value
+	SetGauge(name string, value float64, labels map[string]string)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) IncCounter(string, map[string]string)        {}
+func (nopMetrics) SetGauge(string, float64, map[string]string) {}
+
+func (cfg *ServerConfig) metrics() Metrics {
+	if cfg.Metrics == nil {
+		return nopMetrics{}
+	}
+
+	return cfg.Metrics
+}
@@ -0,0 +1,80 @@
+package smtpsrv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ObjectStore stores objects by bucket and key, e.g. an S3 compatible
+// storage. Put must consume r entirely before returning.
+type ObjectStore interface {
+	Put(bucket, key, contentType string, r io.Reader) error
+}
+
+// StoredObject references an object of an ObjectStore
+type StoredObject struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// DirObjectStore is an ObjectStore writing the objects to files, buckets
+// are sub-directories of the root directory.
+type DirObjectStore string
+
+func (dir DirObjectStore) Put(bucket, key, contentType string, r io.Reader) error {
+	path := filepath.Join(string(dir), filepath.FromSlash(bucket), filepath.FromSlash(key))
+	if !strings.HasPrefix(path, filepath.Clean(string(dir))+string(filepath.Separator)) {
+		return os.ErrPermission
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+
+	return f.Close()
+}
+
+// storeAttachment streams the decoded part to the attachment store, it is
+// never held in memory entirely. The first bytes are returned for sniffing.
+func storeAttachment(part *multipart.Part, contentType string, opts *parseState) (*StoredObject, []byte, error) {
+	decoded, err := decodingReader(part, part.Header.Get("Content-Transfer-Encoding"), opts.StrictDecoding)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hash := sha256.New()
+	head := &headBuffer{}
+	counter := &countingReader{r: io.TeeReader(decoded, io.MultiWriter(hash, head))}
+
+	obj := &StoredObject{
+		Bucket: opts.AttachmentBucket,
+		Key:    newSessionID() + newSessionID(),
+	}
+
+	if err := opts.AttachmentStore.Put(obj.Bucket, obj.Key, contentType, counter); err != nil {
+		return nil, nil, err
+	}
+
+	obj.Size = counter.n
+	obj.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	return obj, head.Bytes(), nil
+}
@@ -2,7 +2,9 @@ package smtpsrv
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,11 +12,13 @@ import (
 	"mime/multipart"
 	"mime/quotedprintable"
 	"net/mail"
+	"net/textproto"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
-	"github.com/saintfish/chardet"
 	"golang.org/x/text/encoding/ianaindex"
 	"golang.org/x/text/transform"
 )
@@ -22,12 +26,381 @@ import (
 const contentTypeMultipartMixed = "multipart/mixed"
 const contentTypeMultipartAlternative = "multipart/alternative"
 const contentTypeMultipartRelated = "multipart/related"
+const contentTypeMultipartDigest = "multipart/digest"
+const contentTypeMessageRFC822 = "message/rfc822"
+const contentTypeMessagePartial = "message/partial"
 const contentTypeTextHtml = "text/html"
 const contentTypeTextPlain = "text/plain"
+const contentTypeTextCalendar = "text/calendar"
+const contentTypeTextAMPHTML = "text/x-amp-html"
+
+const dispositionAttachment = "attachment"
+const dispositionInline = "inline"
+
+// ParseOptions tunes the parsing of ParseEmailWithOptions
+type ParseOptions struct {
+	// AttachmentStore, when set, receives the decoded attachments as they are
+	// parsed. Their Data is then nil and Stored references the object.
+	AttachmentStore ObjectStore
+
+	// AttachmentBucket is the bucket the attachments are stored in
+	AttachmentBucket string
+
+	// Lenient skips the parts which can not be parsed, and keeps the content
+	// of those which can not be decoded as is, instead of failing. Each
+	// problem is recorded in Email.ParseErrors.
+	Lenient bool
+
+	// MaxPartBytes, when set, limits the decoded size of each part, larger
+	// parts fail with ErrTooLarge (or are truncated in lenient mode)
+	MaxPartBytes int64
+
+	// MaxHeaderCount, MaxHeaderLength and MaxHeaderBytes, when set, limit
+	// the number of header fields, the length of a field including its
+	// folded lines and the size of the header. The messages exceeding them
+	// fail with a *HeaderError wrapping ErrTooManyHeaders, ErrHeaderTooLong
+	// or ErrHeaderTooLarge, even in lenient mode.
+	MaxHeaderCount  int
+	MaxHeaderLength int
+	MaxHeaderBytes  int
+
+	// CharsetDetector guesses the charset of the text parts declaring none,
+	// defaults to chardet. The guesses below MinCharsetConfidence (0 to 100)
+	// are ignored, as is detection when DisableCharsetDetection is set: such
+	// bodies are kept as is.
+	CharsetDetector         CharsetDetector
+	MinCharsetConfidence    int
+	DisableCharsetDetection bool
+
+	// CharsetReader, when set, converts the text parts to UTF-8 instead of
+	// the IANA index, see RegisterCharsetAlias
+	CharsetReader CharsetReaderFunc
+
+	// StrictDecoding rejects the malformed base64 and quoted-printable
+	// contents, by default the invalid characters and padding of base64 are
+	// skipped and the invalid escapes of quoted-printable are kept as is
+	StrictDecoding bool
+
+	// TextFromHTML fills TextBody from HTMLBody for the HTML only messages,
+	// see HTMLToText
+	TextFromHTML bool
+
+	// Sanitizer, when set, fills Email.SafeHTMLBody
+	Sanitizer *Sanitizer
+
+	// Parts fills Email.Parts, the message is then held in memory entirely
+	// including its attachments, even with an AttachmentStore
+	Parts bool
+}
+
+// PartError reports a malformed message, it is permanent: parsing the same
+// message again fails the same way. The other errors of ParseEmail come from
+// reading the message. Err wraps ErrUnknownEncoding, ErrUnsupportedPartType,
+// ErrMalformedBoundary, ErrTooLarge or the error of the decoder.
+type PartError struct {
+	// Path is the path of the part as in Part.Path, "" for the message body
+	Path string
+	Err  error
+}
+
+func (e *PartError) Error() string {
+	if e.Path == "" {
+		return "smtpsrv: message body: " + e.Err.Error()
+	}
+
+	return "smtpsrv: part " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *PartError) Unwrap() error {
+	return e.Err
+}
+
+// HeaderError reports a header field which could not be parsed, it is
+// recorded in Email.ParseErrors. The field is left empty, or holds what could
+// be recovered from the raw Value.
+type HeaderError struct {
+	Field string
+	Value string
+	Err   error
+}
+
+func (e *HeaderError) Error() string {
+	if e.Field == "" {
+		return "smtpsrv: header: " + e.Err.Error()
+	}
+
+	return "smtpsrv: header " + e.Field + ": " + e.Err.Error()
+}
+
+func (e *HeaderError) Unwrap() error {
+	return e.Err
+}
+
+// parseState is the state of a single parsing
+type parseState struct {
+	ParseOptions
+
+	// ctx bounds the reading of the contents
+	ctx context.Context
+
+	errors []error
+
+	// the attachments found in the text parts
+	attachments []Attachment
+
+	// the RTF and AMP body parts, see Email.RTFBody and Email.AMPBody
+	rtfBody string
+	ampBody string
+
+	// the versions of the multipart/alternative bodies, see
+	// Email.Alternatives
+	alternatives []BodyAlternative
+
+	// the bodies of the message, see Email.BodyParts
+	bodyParts []BodyPart
+
+	// the text/calendar parts, see Email.Calendars
+	calendars []Calendar
+
+	// the index of the current part at each multipart level
+	path []int
+}
+
+// reader bounds r by the context of the parsing
+func (s *parseState) reader(r io.Reader) io.Reader {
+	if s.ctx == nil {
+		return r
+	}
+
+	return &contextReader{ctx: s.ctx, r: r}
+}
+
+// contextReader fails with the error of ctx once it is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
+
+// enter starts reading the parts of a multipart, until leave
+func (s *parseState) enter() {
+	s.path = append(s.path, 0)
+}
+
+func (s *parseState) leave() {
+	s.path = s.path[:len(s.path)-1]
+}
+
+// next moves to the next part of the current multipart
+func (s *parseState) next() {
+	s.path[len(s.path)-1]++
+}
+
+func partPath(levels []int) string {
+	path := make([]string, len(levels))
+	for i, index := range levels {
+		path[i] = strconv.Itoa(index)
+	}
+
+	return strings.Join(path, ".")
+}
+
+// fail wraps err in a *PartError for the current part, it is recorded in
+// lenient mode and returned otherwise
+func (s *parseState) fail(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// not a problem of the message
+		return err
+	}
+
+	var partErr *PartError
+	if !errors.As(err, &partErr) {
+		err = &PartError{Path: partPath(s.path), Err: err}
+	}
+
+	if !s.Lenient {
+		return err
+	}
+
+	s.errors = append(s.errors, err)
+	return nil
+}
+
+// failBoundary fails the current multipart, whose next part can't be read
+func (s *parseState) failBoundary(err error) error {
+	return s.fail(&PartError{
+		Path: partPath(s.path[:len(s.path)-1]),
+		Err:  fmt.Errorf("%w: %v", ErrMalformedBoundary, err),
+	})
+}
+
+// decodeContent decodes the content, in lenient mode an unknown encoding
+// leaves it as is and a decoding error keeps what was decoded
+func (s *parseState) decodeContent(content io.Reader, encoding string) (io.Reader, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if err := s.decodeInto(buf, content, encoding); err != nil {
+		return nil, err
+	}
+
+	// the pooled buffer is reused, the part keeps a copy of the exact size
+	return bytes.NewReader(append([]byte(nil), buf.Bytes()...)), nil
+}
+
+// decodeInto decodes the content into buf, see decodeContent
+func (s *parseState) decodeInto(buf *bytes.Buffer, content io.Reader, encoding string) error {
+	decoded, err := decodingReader(content, encoding, s.StrictDecoding)
+	if err != nil {
+		if err = s.fail(err); err != nil {
+			return err
+		}
+		decoded = content
+	}
+	decoded = s.reader(decoded)
+
+	if s.MaxPartBytes > 0 {
+		decoded = io.LimitReader(decoded, s.MaxPartBytes+1)
+	}
+
+	if _, err := buf.ReadFrom(decoded); err != nil {
+		if err = s.fail(err); err != nil {
+			return err
+		}
+	}
+
+	if s.MaxPartBytes > 0 && int64(buf.Len()) > s.MaxPartBytes {
+		if err := s.fail(ErrTooLarge); err != nil {
+			return err
+		}
+		buf.Truncate(int(s.MaxPartBytes))
+	}
+
+	return nil
+}
+
+// decodeText decodes a text part and converts it to UTF-8 from the charset
+// of its Content-Type
+func (s *parseState) decodeText(content io.Reader, header textproto.MIMEHeader) (string, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if err := s.decodeInto(buf, content, header.Get("Content-Transfer-Encoding")); err != nil {
+		return "", err
+	}
+	text := buf.String()
+
+	contentType, params, _ := parseContentType(header.Get("Content-Type"))
+
+	converted, err := s.convertBody(text, params["charset"])
+	if err != nil || contentType != contentTypeTextPlain {
+		return converted, err
+	}
+
+	// the attachments of the clients predating MIME
+	converted, attachments := extractUUEncoded(converted)
+	s.attachments = append(s.attachments, attachments...)
+
+	return converted, nil
+}
+
+// decodeAMP adds the AMP body part to the AMP body of the email and
+// returns it
+func (s *parseState) decodeAMP(content io.Reader, header textproto.MIMEHeader) (string, error) {
+	text, err := s.decodeText(content, header)
+	if err != nil {
+		return "", err
+	}
+
+	text = strings.TrimSuffix(text, "\n")
+	s.ampBody += text
+	return text, nil
+}
+
+// convertBody converts the body from its charset, detected when unknown, to
+// UTF-8. The body is kept as is when it can't be converted.
+func (s *parseState) convertBody(body, charset string) (string, error) {
+	if body == "" {
+		return body, nil
+	}
+
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8", "us-ascii":
+		if utf8.ValidString(body) {
+			return body, nil
+		}
+		// mislabeled 8-bit text
+		charset = ""
+	}
+
+	if charset == "" {
+		if s.DisableCharsetDetection {
+			return body, nil
+		}
+
+		detector := s.CharsetDetector
+		if detector == nil {
+			detector = chardetDetector{}
+		}
+
+		detected, confidence, err := detector.DetectCharset([]byte(body))
+		if err != nil || detected == "" || confidence < s.MinCharsetConfidence {
+			return body, nil
+		}
+		charset = detected
+	}
+
+	var output io.Reader
+	var err error
+	if s.CharsetReader != nil {
+		output, err = s.CharsetReader(charset, strings.NewReader(body))
+	} else {
+		output, err = convertToUtf8(strings.NewReader(body), charset)
+	}
+	if err != nil {
+		return body, s.fail(err)
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if _, err := buf.ReadFrom(s.reader(output)); err != nil {
+		return body, s.fail(err)
+	}
+
+	return buf.String(), nil
+}
 
 // Parse an email message read from io.Reader into parsemail.Email struct
 func ParseEmail(r io.Reader) (email *Email, err error) {
-	msg, err := mail.ReadMessage(r)
+	return ParseEmailWithOptions(r, ParseOptions{})
+}
+
+// ParseEmailWithOptions parses an email message like ParseEmail, tuned by opts
+func ParseEmailWithOptions(r io.Reader, opts ParseOptions) (email *Email, err error) {
+	return ParseEmailWithOptionsContext(context.Background(), r, opts)
+}
+
+// ParseEmailContext parses an email message like ParseEmail, until ctx is
+// done: the reading, decoding and charset conversion then stop and its error
+// is returned
+func ParseEmailContext(ctx context.Context, r io.Reader) (*Email, error) {
+	return ParseEmailWithOptionsContext(ctx, r, ParseOptions{})
+}
+
+// ParseEmailWithOptionsContext parses an email message like
+// ParseEmailContext, tuned by opts
+func ParseEmailWithOptionsContext(ctx context.Context, r io.Reader, opts ParseOptions) (email *Email, err error) {
+	state := &parseState{ParseOptions: opts, ctx: ctx}
+
+	msg, rawHeader, err := readMessage(&contextReader{ctx: ctx, r: r}, opts)
 	if err != nil {
 		return
 	}
@@ -36,83 +409,120 @@ func ParseEmail(r io.Reader) (email *Email, err error) {
 	if err != nil {
 		return
 	}
+	email.RawHeader = rawHeader
+
+	if opts.Parts {
+		// the body is read twice, for the tree and the flattened fields
+		body, err := ioutil.ReadAll(msg.Body)
+		if err != nil {
+			return email, err
+		}
+		msg.Body = bytes.NewReader(body)
+		email.Parts = newPart(textproto.MIMEHeader(msg.Header), body, "", 0)
+	}
 
 	email.ContentType = msg.Header.Get("Content-Type")
 	contentType, params, err := parseContentType(email.ContentType)
 	if err != nil {
-		return
+		if err = state.fail(err); err != nil {
+			return
+		}
+		// read as opaque content
 	}
 
 	switch contentType {
 	case contentTypeMultipartMixed:
-		email.TextBody, email.HTMLBody, email.Attachments, email.EmbeddedFiles, err = parseMultipartMixed(msg.Body, params["boundary"])
+		email.TextBody, email.HTMLBody, email.Attachments, email.EmbeddedFiles, err = parseMultipartMixed(msg.Body, params["boundary"], state)
 	case contentTypeMultipartAlternative:
-		email.TextBody, email.HTMLBody, email.EmbeddedFiles, err = parseMultipartAlternative(msg.Body, params["boundary"])
+		email.TextBody, email.HTMLBody, email.EmbeddedFiles, err = parseMultipartAlternative(msg.Body, params["boundary"], state)
 	case contentTypeMultipartRelated:
-		email.TextBody, email.HTMLBody, email.EmbeddedFiles, err = parseMultipartRelated(msg.Body, params["boundary"])
+		email.TextBody, email.HTMLBody, email.EmbeddedFiles, err = parseMultipartRelated(msg.Body, params["boundary"], state)
+	case contentTypeMultipartReport:
+		email.TextBody, email.HTMLBody, email.Attachments, email.DeliveryStatus, err = parseMultipartReport(msg.Body, params["boundary"], state)
+	case contentTypeMultipartDigest:
+		email.TextBody, email.HTMLBody, email.Attachments, email.EmbeddedFiles, err = parseMultipartParts(msg.Body, params["boundary"], contentTypeMessageRFC822, state)
 	case contentTypeTextPlain:
-		newPart, err := decodeContent(msg.Body, msg.Header.Get("Content-Transfer-Encoding"))
+		text, err := state.decodeText(msg.Body, textproto.MIMEHeader(msg.Header))
 		if err != nil {
 			return email, err
 		}
 
-		message, _ := ioutil.ReadAll(newPart)
-		email.TextBody = strings.TrimSuffix(string(message[:]), "\n")
+		email.TextBody = strings.TrimSuffix(text, "\n")
 	case contentTypeTextHtml:
-		newPart, err := decodeContent(msg.Body, msg.Header.Get("Content-Transfer-Encoding"))
+		text, err := state.decodeText(msg.Body, textproto.MIMEHeader(msg.Header))
 		if err != nil {
 			return email, err
 		}
 
-		message, err := ioutil.ReadAll(newPart)
+		email.HTMLBody = strings.TrimSuffix(text, "\n")
+	case contentTypeTextEnriched:
+		text, err := state.decodeEnriched(msg.Body, textproto.MIMEHeader(msg.Header))
+		if err != nil {
+			return email, err
+		}
+
+		email.TextBody = strings.TrimSuffix(text, "\n")
+	case contentTypeTextRTF, contentTypeApplicationRTF:
+		if _, err := state.decodeRTF(msg.Body, textproto.MIMEHeader(msg.Header)); err != nil {
+			return email, err
+		}
+	case contentTypeTextAMPHTML:
+		if _, err := state.decodeAMP(msg.Body, textproto.MIMEHeader(msg.Header)); err != nil {
+			return email, err
+		}
+	case contentTypeTextCalendar:
+		calendar, err := state.decodeCalendar(msg.Body, textproto.MIMEHeader(msg.Header))
 		if err != nil {
 			return email, err
 		}
 
-		email.HTMLBody = strings.TrimSuffix(string(message[:]), "\n")
+		email.Content = strings.NewReader(calendar)
 	default:
-		email.Content, err = decodeContent(msg.Body, msg.Header.Get("Content-Transfer-Encoding"))
-	}
-	detector := chardet.NewTextDetector()
-	if email.TextBody != "" {
-		if email.OriginalCharset != "" {
-			email.TextBody, err = convertToUtf8String(email.TextBody, email.OriginalCharset)
-		} else {
-			result, errDet := detector.DetectBest([]byte(email.TextBody))
-			if errDet == nil {
-				email.TextBody, err = convertToUtf8String(email.TextBody, result.Charset)
-			}
+		if strings.HasPrefix(contentType, "multipart/") {
+			// e.g. multipart/signed or multipart/parallel, read as mixed
+			email.TextBody, email.HTMLBody, email.Attachments, email.EmbeddedFiles, err = parseMultipartMixed(msg.Body, params["boundary"], state)
+			break
 		}
+
+		email.Content, err = state.decodeContent(msg.Body, msg.Header.Get("Content-Transfer-Encoding"))
 	}
-	if email.HTMLBody != "" {
-		if email.OriginalCharset != "" {
-			email.HTMLBody, err = convertToUtf8String(email.HTMLBody, email.OriginalCharset)
-		} else {
-			result, errDet := detector.DetectBest([]byte(email.HTMLBody))
-			if errDet == nil {
-				email.HTMLBody, err = convertToUtf8String(email.HTMLBody, result.Charset)
-			}
-		}
+	if err != nil {
+		return
 	}
-	return
-}
 
-func convertToUtf8String(s string, charset string) (string, error) {
-	input := strings.NewReader(s)
-	output, err := convertToUtf8(input, charset)
-	if err != nil {
-		return "", err
+	email.Attachments = append(email.Attachments, state.attachments...)
+	email.RTFBody = state.rtfBody
+	email.AMPBody = state.ampBody
+	email.Alternatives = state.alternatives
+	email.BodyParts = state.bodyParts
+	email.Calendars = state.calendars
+	if len(email.BodyParts) == 0 && (email.TextBody != "" || email.HTMLBody != "") {
+		// a single body, or the versions of a multipart/alternative
+		email.BodyParts = []BodyPart{{ContentType: contentType, Text: email.TextBody, HTML: email.HTMLBody}}
+	}
+	email.expandTNEF()
+	if err = email.describeAttachments(); err != nil {
+		return
+	}
+	if err = email.attachedCalendars(); err != nil {
+		return
+	}
+
+	if opts.TextFromHTML {
+		email.TextBody = email.Text()
+	}
+
+	if opts.Sanitizer != nil && email.HTMLBody != "" {
+		email.SafeHTMLBody = opts.Sanitizer.Sanitize(email.HTMLBody)
 	}
-	outputBytes, err2 := ioutil.ReadAll(output)
-	return string(outputBytes), err2
+
+	email.ParseErrors = append(email.ParseErrors, state.errors...)
+
+	return
 }
 
 func convertToUtf8(input io.Reader, charset string) (io.Reader, error) {
-	charset = strings.ToLower(charset)
-	if charset == `gb-18030` || charset == `gb18030` || charset == `gb2312` {
-		charset = `gbk`
-	}
-	e, err := ianaindex.MIME.Encoding(charset)
+	e, err := ianaindex.MIME.Encoding(resolveCharsetAlias(charset))
 	if err != nil {
 		return nil, err
 	}
@@ -129,28 +539,36 @@ func createEmailFromHeader(header mail.Header) (email *Email, err error) {
 		email.OriginalCharset = charsetMatch[1]
 	}
 	email.Subject = decodeMimeSentence(header.Get("Subject"))
-	email.From = hp.parseAddressList(header.Get("From"))
-	email.Sender = hp.parseAddress(header.Get("Sender"))
-	email.ReplyTo = hp.parseAddressList(header.Get("Reply-To"))
-	email.To = hp.parseAddressList(header.Get("To"))
-	email.Cc = hp.parseAddressList(header.Get("Cc"))
-	email.Bcc = hp.parseAddressList(header.Get("Bcc"))
-	email.Date = hp.parseTime(header.Get("Date"))
-	email.ResentFrom = hp.parseAddressList(header.Get("Resent-From"))
-	email.ResentSender = hp.parseAddress(header.Get("Resent-Sender"))
-	email.ResentTo = hp.parseAddressList(header.Get("Resent-To"))
-	email.ResentCc = hp.parseAddressList(header.Get("Resent-Cc"))
-	email.ResentBcc = hp.parseAddressList(header.Get("Resent-Bcc"))
+	email.From = hp.parseAddressList("From")
+	email.Sender = hp.parseAddress("Sender")
+	email.ReplyTo = hp.parseAddressList("Reply-To")
+	email.To = hp.parseAddressList("To")
+	email.Cc = hp.parseAddressList("Cc")
+	email.Bcc = hp.parseAddressList("Bcc")
+	email.Date = hp.parseTime("Date")
+	email.ResentFrom = hp.parseAddressList("Resent-From")
+	email.ResentSender = hp.parseAddress("Resent-Sender")
+	email.ResentTo = hp.parseAddressList("Resent-To")
+	email.ResentCc = hp.parseAddressList("Resent-Cc")
+	email.ResentBcc = hp.parseAddressList("Resent-Bcc")
 	email.ResentMessageID = hp.parseMessageId(header.Get("Resent-Message-ID"))
 	email.MessageID = hp.parseMessageId(header.Get("Message-ID"))
 	email.InReplyTo = hp.parseMessageIdList(header.Get("In-Reply-To"))
 	email.References = hp.parseMessageIdList(header.Get("References"))
-	email.ResentDate = hp.parseTime(header.Get("Resent-Date"))
+	email.ResentDate = hp.parseTime("Resent-Date")
+	email.ReceivedChain = parseReceivedChain(header["Received"])
+	email.AuthenticationResults = parseAuthResultsHeaders(header["Authentication-Results"])
+	email.ARCAuthenticationResults = parseAuthResultsHeaders(header["Arc-Authentication-Results"])
+	email.MailingList = parseMailingList(header)
+	email.parseEnvelope(header)
+	email.Priority = parsePriority(header)
 
 	if hp.err != nil {
 		err = hp.err
 		return
 	}
+	email.ParseErrors = hp.warnings
+	email.Groups = hp.groups
 
 	//decode whole header for easier access to extra fields
 	//todo: should we decode? aren't only standard fields mime encoded?
@@ -171,56 +589,103 @@ func parseContentType(contentTypeHeader string) (contentType string, params map[
 	return mime.ParseMediaType(contentTypeHeader)
 }
 
-func parseMultipartRelated(msg io.Reader, boundary string) (textBody, htmlBody string, embeddedFiles []EmbeddedFile, err error) {
+func parseMultipartRelated(msg io.Reader, boundary string, opts *parseState) (textBody, htmlBody string, embeddedFiles []EmbeddedFile, err error) {
+	opts.enter()
+	defer opts.leave()
+
 	pmr := multipart.NewReader(msg, boundary)
 	for {
-		part, err := pmr.NextPart()
+		part, err := pmr.NextRawPart()
 
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
+			if err := opts.failBoundary(err); err != nil {
+				return textBody, htmlBody, embeddedFiles, err
+			}
+			break
 		}
 
+		opts.next()
+
 		contentType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
 		if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
+			if err = opts.fail(err); err != nil {
+				return textBody, htmlBody, embeddedFiles, err
+			}
+			continue
 		}
 
 		switch contentType {
 		case contentTypeTextPlain:
-			ppContent, err := ioutil.ReadAll(part)
+			text, err := opts.decodeText(part, part.Header)
 			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, embeddedFiles, err
+				}
+				continue
 			}
 
-			textBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+			textBody += strings.TrimSuffix(text, "\n")
 		case contentTypeTextHtml:
-			ppContent, err := ioutil.ReadAll(part)
+			text, err := opts.decodeText(part, part.Header)
 			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, embeddedFiles, err
+				}
+				continue
 			}
 
-			htmlBody += strings.TrimSuffix(string(ppContent[:]), "\n")
+			htmlBody += strings.TrimSuffix(text, "\n")
 		case contentTypeMultipartAlternative:
-			tb, hb, ef, err := parseMultipartAlternative(part, params["boundary"])
+			tb, hb, ef, err := parseMultipartAlternative(part, params["boundary"], opts)
 			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, embeddedFiles, err
+				}
+				continue
 			}
 
 			htmlBody += hb
 			textBody += tb
 			embeddedFiles = append(embeddedFiles, ef...)
+		case contentTypeTextEnriched:
+			text, err := opts.decodeEnriched(part, part.Header)
+			if err != nil {
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, embeddedFiles, err
+				}
+				continue
+			}
+
+			textBody += strings.TrimSuffix(text, "\n")
+		case contentTypeTextRTF, contentTypeApplicationRTF:
+			if _, err := opts.decodeRTF(part, part.Header); err != nil {
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, embeddedFiles, err
+				}
+			}
+		case contentTypeTextCalendar:
+			if _, err := opts.decodeCalendar(part, part.Header); err != nil {
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, embeddedFiles, err
+				}
+			}
 		default:
 			if isEmbeddedFile(part) {
-				ef, err := decodeEmbeddedFile(part)
+				ef, err := decodeEmbeddedFile(part, opts)
 				if err != nil {
-					return textBody, htmlBody, embeddedFiles, err
+					if err = opts.fail(err); err != nil {
+						return textBody, htmlBody, embeddedFiles, err
+					}
+					continue
 				}
 
 				embeddedFiles = append(embeddedFiles, ef)
 			} else {
-				return textBody, htmlBody, embeddedFiles, fmt.Errorf("Can't process multipart/related inner mime type: %s", contentType)
+				if err := opts.fail(fmt.Errorf("%w: %s in multipart/related", ErrUnsupportedPartType, contentType)); err != nil {
+					return textBody, htmlBody, embeddedFiles, err
+				}
 			}
 		}
 	}
@@ -228,66 +693,134 @@ func parseMultipartRelated(msg io.Reader, boundary string) (textBody, htmlBody s
 	return textBody, htmlBody, embeddedFiles, err
 }
 
-func parseMultipartAlternative(msg io.Reader, boundary string) (textBody, htmlBody string, embeddedFiles []EmbeddedFile, err error) {
+func parseMultipartAlternative(msg io.Reader, boundary string, opts *parseState) (textBody, htmlBody string, embeddedFiles []EmbeddedFile, err error) {
+	opts.enter()
+	defer opts.leave()
+
 	pmr := multipart.NewReader(msg, boundary)
 	for {
-		part, err := pmr.NextPart()
+		part, err := pmr.NextRawPart()
 
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
+			if err := opts.failBoundary(err); err != nil {
+				return textBody, htmlBody, embeddedFiles, err
+			}
+			break
 		}
 
+		opts.next()
+
 		contentType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
 		if err != nil {
-			return textBody, htmlBody, embeddedFiles, err
+			if err = opts.fail(err); err != nil {
+				return textBody, htmlBody, embeddedFiles, err
+			}
+			continue
 		}
 
 		switch contentType {
 		case contentTypeTextPlain:
-			newPart, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"))
+			text, err := opts.decodeText(part, part.Header)
 			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, embeddedFiles, err
+				}
+				continue
 			}
 
-			ppContent, err := ioutil.ReadAll(newPart)
+			// the alternatives are versions of the same body, the last one
+			// is the preferred one
+			textBody = strings.TrimSuffix(text, "\n")
+			opts.alternative(contentType, textBody)
+		case contentTypeTextHtml:
+			text, err := opts.decodeText(part, part.Header)
 			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, embeddedFiles, err
+				}
+				continue
 			}
 
-			textBody += strings.TrimSuffix(string(ppContent[:]), "\n")
-		case contentTypeTextHtml:
-			newPart, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"))
+			htmlBody = strings.TrimSuffix(text, "\n")
+			opts.alternative(contentType, htmlBody)
+		case contentTypeMultipartRelated:
+			tb, hb, ef, err := parseMultipartRelated(part, params["boundary"], opts)
 			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, embeddedFiles, err
+				}
+				continue
 			}
 
-			ppContent, err := ioutil.ReadAll(newPart)
+			if hb != "" {
+				htmlBody = hb
+				opts.alternative(contentType, hb)
+			}
+			if tb != "" {
+				textBody = tb
+				if hb == "" {
+					opts.alternative(contentType, tb)
+				}
+			}
+			embeddedFiles = append(embeddedFiles, ef...)
+		case contentTypeTextEnriched:
+			text, err := opts.decodeEnriched(part, part.Header)
 			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, embeddedFiles, err
+				}
+				continue
 			}
 
-			htmlBody += strings.TrimSuffix(string(ppContent[:]), "\n")
-		case contentTypeMultipartRelated:
-			tb, hb, ef, err := parseMultipartRelated(part, params["boundary"])
+			text = strings.TrimSuffix(text, "\n")
+			if textBody == "" {
+				// the alternative of a text/plain part, usually following it
+				textBody = text
+			}
+			opts.alternative(contentType, text)
+		case contentTypeTextRTF, contentTypeApplicationRTF:
+			rtf, err := opts.decodeRTF(part, part.Header)
 			if err != nil {
-				return textBody, htmlBody, embeddedFiles, err
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, embeddedFiles, err
+				}
+				continue
 			}
 
-			htmlBody += hb
-			textBody += tb
-			embeddedFiles = append(embeddedFiles, ef...)
+			opts.alternative(contentType, rtf)
+		case contentTypeTextAMPHTML:
+			amp, err := opts.decodeAMP(part, part.Header)
+			if err != nil {
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, embeddedFiles, err
+				}
+				continue
+			}
+
+			opts.alternative(contentType, amp)
+		case contentTypeTextCalendar:
+			if _, err := opts.decodeCalendar(part, part.Header); err != nil {
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, embeddedFiles, err
+				}
+			}
 		default:
 			if isEmbeddedFile(part) {
-				ef, err := decodeEmbeddedFile(part)
+				ef, err := decodeEmbeddedFile(part, opts)
 				if err != nil {
-					return textBody, htmlBody, embeddedFiles, err
+					if err = opts.fail(err); err != nil {
+						return textBody, htmlBody, embeddedFiles, err
+					}
+					continue
 				}
 
 				embeddedFiles = append(embeddedFiles, ef)
 			} else {
-				return textBody, htmlBody, embeddedFiles, fmt.Errorf("Can't process multipart/alternative inner mime type: %s", contentType)
+				if err := opts.fail(fmt.Errorf("%w: %s in multipart/alternative", ErrUnsupportedPartType, contentType)); err != nil {
+					return textBody, htmlBody, embeddedFiles, err
+				}
 			}
 		}
 	}
@@ -295,92 +828,177 @@ func parseMultipartAlternative(msg io.Reader, boundary string) (textBody, htmlBo
 	return textBody, htmlBody, embeddedFiles, err
 }
 
-func parseMultipartMixed(msg io.Reader, boundary string) (textBody, htmlBody string, attachments []Attachment, embeddedFiles []EmbeddedFile, err error) {
+func parseMultipartMixed(msg io.Reader, boundary string, opts *parseState) (textBody, htmlBody string, attachments []Attachment, embeddedFiles []EmbeddedFile, err error) {
+	return parseMultipartParts(msg, boundary, contentTypeTextPlain, opts)
+}
+
+// parseMultipartParts reads the parts of a multipart/mixed, or of any
+// multipart whose parts are independent, the parts without Content-Type are
+// of defaultType: text/plain, or message/rfc822 in a multipart/digest (RFC
+// 2046 section 5.1.5). Embedded messages are returned as attachments.
+func parseMultipartParts(msg io.Reader, boundary, defaultType string, opts *parseState) (textBody, htmlBody string, attachments []Attachment, embeddedFiles []EmbeddedFile, err error) {
+	opts.enter()
+	defer opts.leave()
+
+	var pieces []bodyPiece
+
 	mr := multipart.NewReader(msg, boundary)
 	for {
-		part, err := mr.NextPart()
+		part, err := mr.NextRawPart()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return textBody, htmlBody, attachments, embeddedFiles, err
+			if err := opts.failBoundary(err); err != nil {
+				return textBody, htmlBody, attachments, embeddedFiles, err
+			}
+			break
+		}
+
+		opts.next()
+
+		if part.Header.Get("Content-Type") == "" {
+			part.Header.Set("Content-Type", defaultType)
 		}
 
 		contentType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
 		if err != nil {
-			return textBody, htmlBody, attachments, embeddedFiles, err
+			if err = opts.fail(err); err != nil {
+				return textBody, htmlBody, attachments, embeddedFiles, err
+			}
+			continue
 		}
 
-		if contentType == contentTypeMultipartAlternative {
-			textBody, htmlBody, embeddedFiles, err = parseMultipartAlternative(part, params["boundary"])
+		if partDisposition(part.Header) == dispositionAttachment {
+			// whatever its type, e.g. an attached text or html file
+			at, err := decodeAttachment(part, opts)
 			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, embeddedFiles, err
+				}
+				continue
+			}
+
+			attachments = append(attachments, at)
+		} else if contentType == contentTypeMultipartAlternative {
+			tb, hb, ef, err := parseMultipartAlternative(part, params["boundary"], opts)
+			if err != nil {
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, embeddedFiles, err
+				}
+				continue
 			}
+
+			pieces = opts.addBody(pieces, contentType, tb, hb)
+			embeddedFiles = append(embeddedFiles, ef...)
 		} else if contentType == contentTypeMultipartRelated {
-			textBody, htmlBody, embeddedFiles, err = parseMultipartRelated(part, params["boundary"])
+			tb, hb, ef, err := parseMultipartRelated(part, params["boundary"], opts)
 			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, embeddedFiles, err
+				}
+				continue
 			}
+
+			pieces = opts.addBody(pieces, contentType, tb, hb)
+			embeddedFiles = append(embeddedFiles, ef...)
 		} else if contentType == contentTypeTextPlain {
-			newPart, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"))
+			text, err := opts.decodeText(part, part.Header)
 			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, embeddedFiles, err
+				}
+				continue
 			}
 
-			ppContent, err := ioutil.ReadAll(newPart)
+			pieces = opts.addBody(pieces, contentType, strings.TrimSuffix(text, "\n"), "")
+		} else if contentType == contentTypeTextHtml {
+			text, err := opts.decodeText(part, part.Header)
 			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, embeddedFiles, err
+				}
+				continue
 			}
 
-			textBody += strings.TrimSuffix(string(ppContent[:]), "\n")
-		} else if contentType == contentTypeTextHtml {
-			newPart, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"))
+			pieces = opts.addBody(pieces, contentType, "", strings.TrimSuffix(text, "\n"))
+		} else if contentType == contentTypeTextEnriched {
+			text, err := opts.decodeEnriched(part, part.Header)
 			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, embeddedFiles, err
+				}
+				continue
+			}
+
+			pieces = opts.addBody(pieces, contentType, strings.TrimSuffix(text, "\n"), "")
+		} else if isRTFContentType(contentType) && !isAttachment(part) {
+			if _, err := opts.decodeRTF(part, part.Header); err != nil {
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, embeddedFiles, err
+				}
+			}
+		} else if contentType == contentTypeTextAMPHTML && !isAttachment(part) {
+			if _, err := opts.decodeAMP(part, part.Header); err != nil {
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, embeddedFiles, err
+				}
+			}
+		} else if strings.HasPrefix(contentType, "multipart/") {
+			// nested mixed, digest or unknown multiparts
+			nestedType := contentTypeTextPlain
+			if contentType == contentTypeMultipartDigest {
+				nestedType = contentTypeMessageRFC822
 			}
 
-			ppContent, err := ioutil.ReadAll(newPart)
+			tb, hb, at, ef, err := parseMultipartParts(part, params["boundary"], nestedType, opts)
 			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, embeddedFiles, err
+				}
+				continue
 			}
 
-			htmlBody += strings.TrimSuffix(string(ppContent[:]), "\n")
-		} else if isAttachment(part) {
-			at, err := decodeAttachment(part)
+			// its bodies were recorded as they were read
+			if tb != "" || hb != "" {
+				pieces = append(pieces, bodyPiece{text: tb, html: hb, part: -1})
+			}
+			attachments = append(attachments, at...)
+			embeddedFiles = append(embeddedFiles, ef...)
+		} else if isAttachment(part) || contentType == contentTypeMessageRFC822 {
+			at, err := decodeAttachment(part, opts)
 			if err != nil {
-				return textBody, htmlBody, attachments, embeddedFiles, err
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, embeddedFiles, err
+				}
+				continue
 			}
 
 			attachments = append(attachments, at)
-		} else {
-			return textBody, htmlBody, attachments, embeddedFiles, fmt.Errorf("Unknown multipart/mixed nested mime type: %s", contentType)
-		}
-	}
-
-	return textBody, htmlBody, attachments, embeddedFiles, err
-}
-
-func decodeMimeSentence(s string) string {
-	result := []string{}
-	ss := strings.Split(s, " ")
+		} else if contentType == contentTypeTextCalendar {
+			if _, err := opts.decodeCalendar(part, part.Header); err != nil {
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, embeddedFiles, err
+				}
+			}
+		} else if part.Header.Get("Content-Id") != "" {
+			ef, err := decodeEmbeddedFile(part, opts)
+			if err != nil {
+				if err = opts.fail(err); err != nil {
+					return textBody, htmlBody, attachments, embeddedFiles, err
+				}
+				continue
+			}
 
-	for _, word := range ss {
-		dec := new(mime.WordDecoder)
-		dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
-			return convertToUtf8(input, charset)
-		}
-		w, err := dec.Decode(word)
-		if err != nil {
-			if len(result) == 0 {
-				w = word
-			} else {
-				w = " " + word
+			embeddedFiles = append(embeddedFiles, ef)
+		} else {
+			if err := opts.fail(fmt.Errorf("%w: %s in multipart/mixed", ErrUnsupportedPartType, contentType)); err != nil {
+				return textBody, htmlBody, attachments, embeddedFiles, err
 			}
 		}
-
-		result = append(result, w)
 	}
 
-	return strings.Join(result, "")
+	textBody, htmlBody = mergeBodies(pieces)
+	return textBody, htmlBody, attachments, embeddedFiles, err
 }
 
 func decodeHeaderMime(header mail.Header) (mail.Header, error) {
@@ -400,12 +1018,12 @@ func decodeHeaderMime(header mail.Header) (mail.Header, error) {
 }
 
 func isEmbeddedFile(part *multipart.Part) bool {
-	return part.Header.Get("Content-Transfer-Encoding") != ""
+	return part.Header.Get("Content-Id") != "" || part.Header.Get("Content-Transfer-Encoding") != ""
 }
 
-func decodeEmbeddedFile(part *multipart.Part) (ef EmbeddedFile, err error) {
+func decodeEmbeddedFile(part *multipart.Part, opts *parseState) (ef EmbeddedFile, err error) {
 	cid := decodeMimeSentence(part.Header.Get("Content-Id"))
-	decoded, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"))
+	decoded, err := opts.decodeContent(part, part.Header.Get("Content-Transfer-Encoding"))
 	if err != nil {
 		return
 	}
@@ -413,115 +1031,144 @@ func decodeEmbeddedFile(part *multipart.Part) (ef EmbeddedFile, err error) {
 	ef.CID = strings.Trim(cid, "<>")
 	ef.Data = decoded
 	ef.ContentType = part.Header.Get("Content-Type")
+	ef.Disposition = partDisposition(part.Header)
 
 	return
 }
 
+// isAttachment reports whether the part is an attachment: its disposition is
+// attachment, it is an inline part without Content-ID, such as an image
+// displayed after the body, or it has a filename.
 func isAttachment(part *multipart.Part) bool {
-	return part.FileName() != ""
+	switch partDisposition(part.Header) {
+	case dispositionAttachment:
+		return true
+	case dispositionInline:
+		if part.Header.Get("Content-Id") == "" {
+			return true
+		}
+	}
+
+	return attachmentFilename(part.Header) != ""
 }
 
-func decodeAttachment(part *multipart.Part) (at Attachment, err error) {
-	filename := decodeMimeSentence(part.FileName())
-	decoded, err := decodeContent(part, part.Header.Get("Content-Transfer-Encoding"))
+// partDisposition returns the lowercased Content-Disposition type of the
+// part, or "" when it has none
+func partDisposition(header textproto.MIMEHeader) string {
+	value := header.Get("Content-Disposition")
+
+	disposition, _, err := mime.ParseMediaType(value)
 	if err != nil {
-		return
+		// malformed parameters
+		disposition = strings.ToLower(strings.TrimSpace(strings.Split(value, ";")[0]))
 	}
 
-	at.Filename = filename
-	at.Data = decoded
+	return disposition
+}
+
+func decodeAttachment(part *multipart.Part, opts *parseState) (at Attachment, err error) {
+	at.Filename = attachmentFilename(part.Header)
 	at.ContentType = strings.Split(part.Header.Get("Content-Type"), ";")[0]
+	at.Disposition = partDisposition(part.Header)
+	at.ContentID = strings.Trim(decodeMimeSentence(part.Header.Get("Content-Id")), "<>")
+
+	if opts.AttachmentStore != nil {
+		var head []byte
+		at.Stored, head, err = storeAttachment(part, at.ContentType, opts)
+		if err == nil {
+			at.Size, at.SHA256 = at.Stored.Size, at.Stored.SHA256
+			at.DetectedContentType = sniffContentType(head, at.ContentType, at.Filename)
+		}
+		return
+	}
+
+	at.Data, err = opts.decodeContent(part, part.Header.Get("Content-Transfer-Encoding"))
 
 	return
 }
 
-func decodeContent(content io.Reader, encoding string) (io.Reader, error) {
+// decodingReader decodes the content transfer encoding as the content is read,
+// the malformed base64 and quoted-printable are only rejected when strict
+func decodingReader(content io.Reader, encoding string, strict bool) (io.Reader, error) {
 	enc := strings.ToLower(strings.TrimSpace(encoding))
 
 	switch enc {
 	case "base64":
-		decoded := base64.NewDecoder(base64.StdEncoding, content)
-		b, err := ioutil.ReadAll(decoded)
-		if err != nil {
-			return nil, err
+		if !strict {
+			return newLenientBase64Reader(content), nil
 		}
-		return bytes.NewReader(b), nil
+		return base64.NewDecoder(base64.StdEncoding, content), nil
 
 	// 把 7bit / 8bit / binary 都当作直接透传读取（与原来的 7bit 行为一致）
-	case "7bit", "8bit", "binary":
-		dd, err := ioutil.ReadAll(content)
-		if err != nil {
-			return nil, err
-		}
-		return bytes.NewReader(dd), nil
+	case "", "7bit", "8bit", "binary":
+		return content, nil
 
 	// 接受带或不带连字符的 quoted-printable 形式
 	case "quoted-printable", "quotedprintable":
-		decoded := quotedprintable.NewReader(content)
-		b, err := ioutil.ReadAll(decoded)
-		if err != nil {
-			return nil, err
+		if !strict {
+			return newLenientQPReader(content), nil
 		}
-		return bytes.NewReader(b), nil
+		return quotedprintable.NewReader(content), nil
 
-	// 空编码就直接返回原流
-	case "":
-		return content, nil
+	case "x-uuencode", "uuencode", "x-uue", "uue":
+		return uudecodingReader(content)
 
 	default:
-		return nil, fmt.Errorf("unknown encoding: %s", encoding)
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEncoding, encoding)
 	}
 }
 
 type headerParser struct {
-	header *mail.Header
-	err    error
+	header   *mail.Header
+	err      error
+	warnings []error
+	groups   map[string][]AddressGroup
 }
 
-func (hp headerParser) parseAddress(s string) (ma *mail.Address) {
-	if hp.err != nil {
+// parseAddress parses the mailbox of the field, see parseAddressList
+func (hp *headerParser) parseAddress(key string) *mail.Address {
+	addrs := hp.parseAddressList(key)
+	if len(addrs) == 0 {
 		return nil
 	}
 
-	if strings.Trim(s, " \n") != "" {
-		ma, hp.err = mail.ParseAddress(s)
+	return addrs[0]
+}
 
-		return ma
+// parseAddressList parses the addresses of the field, the malformed lists
+// keep the addresses which could be recovered and are recorded as a warning
+func (hp *headerParser) parseAddressList(key string) []*mail.Address {
+	s := (*hp.header).Get(key)
+	if hp.err != nil || strings.Trim(s, " \n") == "" {
+		return nil
 	}
 
-	return nil
-}
-
-func (hp headerParser) parseAddressList(s string) (ma []*mail.Address) {
-	if hp.err != nil {
-		return
+	addrs, ok := parseAddressListLenient(s)
+	if !ok {
+		hp.warnings = append(hp.warnings, &HeaderError{Field: key, Value: s, Err: ErrMalformedAddress})
 	}
 
-	if strings.Trim(s, " \n") != "" {
-		ma, hp.err = mail.ParseAddressList(s)
-		return
+	if groups := parseAddressGroups(s); len(groups) > 0 {
+		if hp.groups == nil {
+			hp.groups = map[string][]AddressGroup{}
+		}
+		hp.groups[key] = groups
 	}
 
-	return
+	return addrs
 }
 
-func (hp headerParser) parseTime(s string) (t time.Time) {
+// parseTime parses the date of the field, the malformed dates are zero and
+// recorded as a warning
+func (hp *headerParser) parseTime(key string) (t time.Time) {
+	s := (*hp.header).Get(key)
 	if hp.err != nil || s == "" {
 		return
 	}
 
-	formats := []string{
-		time.RFC1123Z,
-		"Mon, 2 Jan 2006 15:04:05 -0700",
-		time.RFC1123Z + " (MST)",
-		"Mon, 2 Jan 2006 15:04:05 -0700 (MST)",
-	}
-
-	for _, format := range formats {
-		t, hp.err = time.Parse(format, s)
-		if hp.err == nil {
-			return
-		}
+	t, err := ParseDate(s)
+	if err != nil {
+		hp.warnings = append(hp.warnings, &HeaderError{Field: key, Err: err})
 	}
 
 	return
@@ -540,13 +1187,7 @@ func (hp headerParser) parseMessageIdList(s string) (result []string) {
 		return
 	}
 
-	for _, p := range strings.Split(s, " ") {
-		if strings.Trim(p, " \n") != "" {
-			result = append(result, hp.parseMessageId(p))
-		}
-	}
-
-	return
+	return splitMessageIDs(s)
 }
 
 // Attachment with filename, content type and data (as a io.Reader)
@@ -554,6 +1195,26 @@ type Attachment struct {
 	Filename    string
 	ContentType string
 	Data        io.Reader
+
+	// Disposition is the Content-Disposition type, "attachment", "inline"
+	// or "" when the part had none
+	Disposition string
+
+	// ContentID is set for the attachments which also carry a Content-ID
+	ContentID string
+
+	// Stored is set instead of Data when the attachment was offloaded to
+	// ParseOptions.AttachmentStore
+	Stored *StoredObject
+
+	// Size and SHA256 (hex encoded) describe the decoded content
+	Size   int64
+	SHA256 string
+
+	// DetectedContentType is the type sniffed from the content, compared to
+	// ContentType it reveals the generic (application/octet-stream) and
+	// wrong declared types
+	DetectedContentType string
 }
 
 // EmbeddedFile with content id, content type and data (as a io.Reader)
@@ -561,12 +1222,26 @@ type EmbeddedFile struct {
 	CID         string
 	ContentType string
 	Data        io.Reader
+
+	// Disposition is the Content-Disposition type, usually "inline" or ""
+	Disposition string
+}
+
+// IsInline reports whether the attachment is meant to be displayed within
+// the message rather than offered for download
+func (a Attachment) IsInline() bool {
+	return a.Disposition == dispositionInline
 }
 
 // Email with fields for all the headers defined in RFC5322 with it's attachments and
 type Email struct {
+	// Header holds the header fields, their encoded words decoded
 	Header mail.Header
 
+	// RawHeader is the header section as it was received, with its folding
+	// and the empty line ending it, see RawHeaderFields
+	RawHeader []byte `json:"-"`
+
 	Subject    string
 	Sender     *mail.Address
 	From       []*mail.Address
@@ -587,14 +1262,90 @@ type Email struct {
 	ResentBcc       []*mail.Address
 	ResentMessageID string
 
+	// Groups are the named groups of the address fields, keyed by field,
+	// e.g. Groups["To"]. Their members are also in the fields above.
+	Groups map[string][]AddressGroup
+
+	// ReceivedChain are the Received headers, the most recent hop first
+	ReceivedChain []ReceivedHop
+
+	// AuthenticationResults and ARCAuthenticationResults are the results
+	// reported by the previous hops, in header order, see TrustedAuthResults
+	AuthenticationResults    []*AuthResults
+	ARCAuthenticationResults []*AuthResults
+
+	// MailingList is set for the messages carrying List-* headers
+	MailingList *MailingList
+
+	// ReturnPath is the reverse path recorded by the final delivery, ""
+	// for the null reverse path of the bounces
+	ReturnPath string
+
+	// DeliveredTo are the Delivered-To addresses, the most recent delivery
+	// first, and OriginalTo the X-Original-To ones, the recipients before
+	// the aliases were expanded
+	DeliveredTo []string
+	OriginalTo  []string
+
+	// OriginalRecipient is the Original-Recipient address (RFC 3798),
+	// without its address type
+	OriginalRecipient string
+
+	// Priority is the priority of the X-Priority, Importance or Priority
+	// field, PriorityNone when they are missing
+	Priority Priority
+
 	ContentType string
 	Content     io.Reader
 
 	HTMLBody string
 	TextBody string
 
+	// SafeHTMLBody is the sanitized HTMLBody, see ParseOptions.Sanitizer
+	SafeHTMLBody string
+
+	// AMPBody is the AMP for Email body, the text/x-amp-html alternative
+	// sent along the HTML one. It is not sanitized.
+	AMPBody string
+
+	// BodyParts are the bodies of the message, in order, TextBody and
+	// HTMLBody being their merged view: the bodies of a multipart/mixed are
+	// joined, e.g. the text parts between the inline images of Apple Mail
+	BodyParts []BodyPart
+
+	// Alternatives are the versions of the multipart/alternative bodies, in
+	// message order, see PreferredAlternative. TextBody and HTMLBody hold
+	// the last text/plain and text/html versions.
+	Alternatives []BodyAlternative
+
+	// RTFBody is the RTF body of the text/rtf or application/rtf body
+	// parts, or of the messages sent by Outlook with a TNEF (winmail.dat)
+	// attachment, which is replaced by the attachments it holds
+	RTFBody string
+
 	Attachments   []Attachment
 	EmbeddedFiles []EmbeddedFile
 
+	// OriginalCharset is the charset of the encoded words of the Subject,
+	// the bodies are converted from the charset of their own part
 	OriginalCharset string
+
+	// DeliveryStatus is set for multipart/report delivery status notifications
+	DeliveryStatus *DeliveryStatus
+
+	// DKIMResults is set when the message was parsed with DKIM verification enabled
+	DKIMResults []DKIMResult
+
+	// Calendars are the text/calendar parts, e.g. meeting invitations
+	Calendars []Calendar
+
+	// ParseErrors lists the malformed header fields which were left empty,
+	// see HeaderError, and the problems skipped by a lenient parsing, see
+	// ParseOptions.Lenient
+	ParseErrors []error `json:"-"`
+
+	// Parts is the root of the MIME tree of the message, the fields above
+	// are a flattened view of it. It is only set with ParseOptions.Parts, and
+	// is not JSON encoded.
+	Parts *Part `json:"-"`
 }
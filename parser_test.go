@@ -0,0 +1,45 @@
+package smtpsrv
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+	"testing"
+)
+
+func benchmarkDecodeContent(b *testing.B, content, encoding string) {
+	state := &parseState{}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r, err := state.decodeContent(strings.NewReader(content), encoding)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, r)
+	}
+}
+
+func BenchmarkDecodeContent(b *testing.B) {
+	data := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 1500)
+
+	var qp strings.Builder
+	w := quotedprintable.NewWriter(&qp)
+	io.WriteString(w, data)
+	w.Close()
+
+	b.Run("7bit", func(b *testing.B) {
+		benchmarkDecodeContent(b, data, "7bit")
+	})
+	b.Run("base64", func(b *testing.B) {
+		benchmarkDecodeContent(b, base64.StdEncoding.EncodeToString([]byte(data)), "base64")
+	})
+	b.Run("quoted-printable", func(b *testing.B) {
+		benchmarkDecodeContent(b, qp.String(), "quoted-printable")
+	})
+}
@@ -0,0 +1,272 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PartialFragment is a fragment of a message/partial series (RFC 2046
+// section 5.2.2)
+type PartialFragment struct {
+	// ID identifies the series, Number is the fragment number from 1, and
+	// Total the number of fragments, 0 when the fragment does not state it,
+	// as only the last one has to
+	ID     string
+	Number int
+	Total  int
+
+	// Header is the header section of the message holding the fragment,
+	// only the one of the first fragment is used
+	Header []byte
+
+	// Data is the content of the fragment
+	Data []byte
+}
+
+// FragmentStore keeps the fragments of the series until they are all
+// received, implementations backed by a shared store reassemble the series
+// whose fragments are received by several instances.
+type FragmentStore interface {
+	// Put stores the fragment, replacing the one of the same ID and number
+	Put(f *PartialFragment) error
+
+	// Fragments returns the fragments of the series received so far, in any
+	// order
+	Fragments(id string) ([]*PartialFragment, error)
+
+	// Delete removes the fragments of the series, deleting an unknown ID is
+	// not an error
+	Delete(id string) error
+}
+
+// ReassemblerConfig holds the message/partial reassembly settings
+type ReassemblerConfig struct {
+	// Store defaults to an in-memory store
+	Store FragmentStore
+
+	// Options tune the parsing of the reassembled messages
+	Options ParseOptions
+}
+
+// Reassembler reassembles the messages split in message/partial fragments
+type Reassembler struct {
+	config ReassemblerConfig
+}
+
+func NewReassembler(cfg ReassemblerConfig) *Reassembler {
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryFragmentStore()
+	}
+
+	return &Reassembler{
+		config: cfg,
+	}
+}
+
+// the header fields of the first fragment replaced by the ones of the
+// enclosed message
+func isEnclosedField(name string) bool {
+	name = strings.ToLower(name)
+
+	switch name {
+	case "subject", "message-id", "encrypted", "mime-version":
+		return true
+	}
+
+	return strings.HasPrefix(name, "content-")
+}
+
+// PartialFragmentOf returns the fragment carried by the message/partial
+// email
+func PartialFragmentOf(email *Email) (*PartialFragment, error) {
+	contentType, params, err := parseContentType(email.ContentType)
+	if err != nil || contentType != contentTypeMessagePartial {
+		return nil, ErrNotPartial
+	}
+
+	f := &PartialFragment{ID: params["id"], Header: email.RawHeader}
+
+	f.Number, err = strconv.Atoi(params["number"])
+	if err != nil || f.ID == "" || f.Number < 1 {
+		return nil, ErrMalformedPartial
+	}
+
+	if total, ok := params["total"]; ok {
+		f.Total, err = strconv.Atoi(total)
+		if err != nil || f.Total < f.Number {
+			return nil, ErrMalformedPartial
+		}
+	}
+
+	f.Data, err = readRewind(email.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Add stores the fragment carried by the message/partial email, and
+// returns the reassembled message once all the fragments of its series
+// were received, nil before. The fragments of a reassembled series are
+// deleted from the store.
+func (r *Reassembler) Add(email *Email) (*Email, error) {
+	f, err := PartialFragmentOf(email)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.config.Store.Put(f); err != nil {
+		return nil, err
+	}
+
+	fragments, err := r.config.Store.Fragments(f.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	ordered := completeSeries(fragments)
+	if ordered == nil {
+		return nil, nil
+	}
+
+	whole, err := ParseEmailWithOptions(bytes.NewReader(reassemble(ordered)), r.config.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	return whole, r.config.Store.Delete(f.ID)
+}
+
+// Discard deletes the fragments received for the series, e.g. once it
+// expired without being completed
+func (r *Reassembler) Discard(id string) error {
+	return r.config.Store.Delete(id)
+}
+
+// completeSeries returns the fragments ordered by number, nil while some
+// fragments are missing
+func completeSeries(fragments []*PartialFragment) []*PartialFragment {
+	total := 0
+	for _, f := range fragments {
+		if f.Total > total {
+			total = f.Total
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	ordered := make([]*PartialFragment, total)
+	for _, f := range fragments {
+		if f.Number <= total {
+			ordered[f.Number-1] = f
+		}
+	}
+
+	for _, f := range ordered {
+		if f == nil {
+			return nil
+		}
+	}
+
+	return ordered
+}
+
+// reassemble joins the fragments: the header of the first fragment but its
+// Content-* and Subject, Message-ID, Encrypted and MIME-Version fields,
+// followed by these fields of the enclosed message, and its content
+func reassemble(fragments []*PartialFragment) []byte {
+	var buf bytes.Buffer
+
+	for _, field := range (&Email{RawHeader: fragments[0].Header}).RawHeaderFields() {
+		if !isEnclosedField(field.Name) {
+			buf.WriteString(field.Name + ":" + field.Value + "\r\n")
+		}
+	}
+
+	enclosedHeader, body := splitHeaderSection(fragments[0].Data)
+	for _, line := range splitRawHeader(enclosedHeader) {
+		if ind := strings.IndexByte(line, ':'); ind > 0 && isEnclosedField(strings.TrimSpace(line[:ind])) {
+			buf.WriteString(line)
+		}
+	}
+	buf.WriteString("\r\n")
+
+	buf.Write(body)
+	for _, f := range fragments[1:] {
+		buf.Write(f.Data)
+	}
+
+	return buf.Bytes()
+}
+
+// splitHeaderSection splits a message on the empty line ending its header
+func splitHeaderSection(raw []byte) (header, body []byte) {
+	for pos := 0; pos < len(raw); {
+		end := bytes.IndexByte(raw[pos:], '\n')
+		if end == -1 {
+			break
+		}
+		end += pos + 1
+
+		if len(bytes.TrimRight(raw[pos:end], "\r\n")) == 0 {
+			return raw[:pos], raw[end:]
+		}
+		pos = end
+	}
+
+	return raw, nil
+}
+
+// MemoryFragmentStore is a FragmentStore keeping the fragments in memory
+type MemoryFragmentStore struct {
+	mu     sync.Mutex
+	series map[string]map[int]*PartialFragment
+}
+
+func NewMemoryFragmentStore() *MemoryFragmentStore {
+	return &MemoryFragmentStore{
+		series: map[string]map[int]*PartialFragment{},
+	}
+}
+
+func (s *MemoryFragmentStore) Put(f *PartialFragment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fragments, ok := s.series[f.ID]
+	if !ok {
+		fragments = map[int]*PartialFragment{}
+		s.series[f.ID] = fragments
+	}
+
+	stored := *f
+	fragments[f.Number] = &stored
+
+	return nil
+}
+
+func (s *MemoryFragmentStore) Fragments(id string) ([]*PartialFragment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var fragments []*PartialFragment
+	for _, f := range s.series[id] {
+		copied := *f
+		fragments = append(fragments, &copied)
+	}
+
+	return fragments, nil
+}
+
+func (s *MemoryFragmentStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.series, id)
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// maxPartDepth bounds the nesting of the MIME tree
+const maxPartDepth = 64
+
+// Part is a node of the MIME tree of a message, see Email.Parts
+type Part struct {
+	Header textproto.MIMEHeader
+
+	// ContentType is the lowercased media type, Params its parameters
+	ContentType string
+	Params      map[string]string
+
+	// Disposition is the Content-Disposition type, Filename the decoded
+	// filename, if any
+	Disposition string
+	Filename    string
+
+	// Path numbers the part as IMAP does, e.g. "2.1" for the first child of
+	// the second part of the message. The root is "", the message of a
+	// message/rfc822 part shares the path of that part.
+	Path string
+
+	// Children are the parts of a multipart, or the message of a
+	// message/rfc822 part
+	Children []*Part
+
+	body []byte
+}
+
+// Reader returns a new reader of the content of the part, leniently decoded
+// from its Content-Transfer-Encoding. The content of a multipart is its raw
+// body.
+func (p *Part) Reader() (io.Reader, error) {
+	return decodingReader(bytes.NewReader(p.body), p.Header.Get("Content-Transfer-Encoding"), false)
+}
+
+// Walk calls fn for the part and its descendants, depth first, until fn
+// returns false
+func (p *Part) Walk(fn func(*Part) bool) bool {
+	if !fn(p) {
+		return false
+	}
+
+	for _, child := range p.Children {
+		if !child.Walk(fn) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newPart builds the tree of a part from its header and raw body, the
+// children share the body of their parent. The malformed multiparts keep the
+// children read until their error.
+func newPart(header textproto.MIMEHeader, body []byte, path string, depth int) *Part {
+	p := &Part{
+		Header:      header,
+		Disposition: partDisposition(header),
+		Filename:    attachmentFilename(header),
+		Path:        path,
+		body:        body,
+	}
+
+	var err error
+	p.ContentType, p.Params, err = parseContentType(header.Get("Content-Type"))
+	if err != nil {
+		// treated as opaque data
+		p.ContentType = "application/octet-stream"
+	}
+
+	if depth >= maxPartDepth {
+		return p
+	}
+
+	switch {
+	case strings.HasPrefix(p.ContentType, "multipart/") && p.Params["boundary"] != "":
+		prefix := path
+		if prefix != "" {
+			prefix += "."
+		}
+
+		for _, raw := range splitMultipart(body, p.Params["boundary"]) {
+			partHeader, partBody, err := splitHeader(raw)
+			if err != nil {
+				break
+			}
+
+			if p.ContentType == contentTypeMultipartDigest && partHeader.Get("Content-Type") == "" {
+				partHeader.Set("Content-Type", contentTypeMessageRFC822)
+			}
+
+			child := newPart(partHeader, partBody, prefix+strconv.Itoa(len(p.Children)+1), depth+1)
+			p.Children = append(p.Children, child)
+		}
+	case p.ContentType == contentTypeMessageRFC822:
+		msg := body
+		switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+		case "", "7bit", "8bit", "binary":
+		default:
+			// not allowed by RFC 2046, the message is decoded
+			r, err := p.Reader()
+			if err != nil {
+				return p
+			}
+			if msg, err = ioutil.ReadAll(r); err != nil {
+				return p
+			}
+		}
+
+		msgHeader, msgBody, err := splitHeader(msg)
+		if err != nil && len(msgHeader) == 0 {
+			return p
+		}
+
+		p.Children = []*Part{newPart(msgHeader, msgBody, path, depth+1)}
+	}
+
+	return p
+}
+
+// splitMultipart returns the raw parts of a multipart body, as slices of it,
+// until its close delimiter. A part left unterminated is dropped.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delimiter := []byte("--" + boundary)
+
+	var parts [][]byte
+	start := -1
+	for i := 0; i < len(body); {
+		end := len(body)
+		if n := bytes.IndexByte(body[i:], '\n'); n >= 0 {
+			end = i + n + 1
+		}
+
+		line := bytes.TrimRight(body[i:end], " \t\r\n")
+		if bytes.HasPrefix(line, delimiter) {
+			rest := line[len(delimiter):]
+			closing := string(rest) == "--"
+			if len(rest) == 0 || closing {
+				if start >= 0 {
+					// the line break before the delimiter belongs to it
+					part := bytes.TrimSuffix(body[start:i], []byte("\n"))
+					parts = append(parts, bytes.TrimSuffix(part, []byte("\r")))
+				}
+				if closing {
+					return parts
+				}
+				start = end
+			}
+		}
+
+		i = end
+	}
+
+	return parts
+}
+
+// splitHeader parses the header of a raw part, the body is the slice
+// following it
+func splitHeader(raw []byte) (textproto.MIMEHeader, []byte, error) {
+	bodyStart := len(raw)
+	for i := 0; i < len(raw); {
+		if raw[i] == '\n' {
+			bodyStart = i + 1
+			break
+		}
+		if raw[i] == '\r' && i+1 < len(raw) && raw[i+1] == '\n' {
+			bodyStart = i + 2
+			break
+		}
+
+		n := bytes.IndexByte(raw[i:], '\n')
+		if n < 0 {
+			break
+		}
+		i += n + 1
+	}
+
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw[:bodyStart]))).ReadMIMEHeader()
+	if err != nil && (err != io.EOF || len(header) == 0) {
+		return header, nil, err
+	}
+
+	return header, raw[bodyStart:], nil
+}
@@ -0,0 +1,146 @@
+package smtpsrv
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// ConnectionPolicyFunc decides whether a new connection is served, it is invoked
+// before the SMTP banner and a non-nil error rejects the connection.
+type ConnectionPolicyFunc func(remoteAddr net.Addr) error
+
+// IPFilter implements allow/deny lists of networks in CIDR notation (or plain IPs),
+// its Check method can be used as a ConnectionPolicyFunc.
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewIPFilter creates a filter, when allow isn't empty only the listed networks
+// are accepted, deny always takes precedence.
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	f := &IPFilter{}
+
+	var err error
+	if f.allow, err = parseNetworks(allow); err != nil {
+		return nil, err
+	}
+
+	if f.deny, err = parseNetworks(deny); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network: %s", cidr)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// Check returns ErrConnectionRefused if remoteAddr isn't allowed
+func (f *IPFilter) Check(remoteAddr net.Addr) error {
+	ip := addrIP(remoteAddr)
+	if ip == nil {
+		return ErrConnectionRefused
+	}
+
+	if containsIP(f.deny, ip) {
+		return ErrConnectionRefused
+	}
+
+	if len(f.allow) > 0 && !containsIP(f.allow, ip) {
+		return ErrConnectionRefused
+	}
+
+	return nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addrIP extracts the IP of a network address
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+
+	return net.ParseIP(host)
+}
+
+// policyListener rejects the connections refused by the policy before they
+// reach the SMTP server.
+type policyListener struct {
+	net.Listener
+	policy ConnectionPolicyFunc
+	config *ServerConfig
+}
+
+func (l *policyListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := l.policy(conn.RemoteAddr()); err != nil {
+			l.config.logger().Log("session refused", "remote_addr", conn.RemoteAddr(), "err", err)
+			go rejectConn(l.config, conn, err)
+			continue
+		}
+
+		return conn, nil
+	}
+}
+
+// rejectConn replies err to a connection refused by a listener, before any
+// session started, and closes it
+func rejectConn(cfg *ServerConfig, conn net.Conn, err error) {
+	defer conn.Close()
+
+	smtpErr := rejectError(err, 554, EnhancedCode{5, 7, 1}).(*smtp.SMTPError)
+	cfg.emitRejectedConn(conn.RemoteAddr(), smtpErr)
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "%d %d.%d.%d %s\r\n", smtpErr.Code, smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2], smtpErr.Message)
+}
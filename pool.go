@@ -0,0 +1,29 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBuffer bounds the buffers kept by bufferPool, so that a large
+// part does not keep its memory allocated
+const maxPooledBuffer = 4 << 20
+
+// bufferPool holds the buffers the parts are decoded into
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
@@ -0,0 +1,74 @@
+package smtpsrv
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// Priority is the urgency of a message, on the 1 to 5 scale of X-Priority
+type Priority int
+
+const (
+	// PriorityNone is set when the message does not state its priority
+	PriorityNone Priority = iota
+	PriorityHighest
+	PriorityHigh
+	PriorityNormal
+	PriorityLow
+	PriorityLowest
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityHighest:
+		return "highest"
+	case PriorityHigh:
+		return "high"
+	case PriorityNormal:
+		return "normal"
+	case PriorityLow:
+		return "low"
+	case PriorityLowest:
+		return "lowest"
+	}
+
+	return "none"
+}
+
+// IsUrgent reports whether the priority is high or highest
+func (p Priority) IsUrgent() bool {
+	return p == PriorityHighest || p == PriorityHigh
+}
+
+// parsePriority returns the priority of the first field found among
+// X-Priority, X-MSMail-Priority, and the Importance and Priority fields of
+// RFC 2156
+func parsePriority(header mail.Header) Priority {
+	for _, key := range []string{"X-Priority", "X-Msmail-Priority", "Importance"} {
+		// e.g. "1 (Highest)"
+		value := strings.ToLower(headerToken(header.Get(key)))
+		switch {
+		case value == "":
+			continue
+		case value[0] >= '1' && value[0] <= '5':
+			return Priority(value[0] - '0')
+		case value == "high":
+			return PriorityHigh
+		case value == "normal":
+			return PriorityNormal
+		case value == "low":
+			return PriorityLow
+		}
+	}
+
+	switch strings.ToLower(headerToken(header.Get("Priority"))) {
+	case "urgent":
+		return PriorityHigh
+	case "normal":
+		return PriorityNormal
+	case "non-urgent":
+		return PriorityLow
+	}
+
+	return PriorityNone
+}
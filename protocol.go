@@ -0,0 +1,478 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// the commands refused when their extension is disabled
+var extensionCommands = map[string]string{
+	"AUTH":     "AUTH",
+	"CHUNKING": "BDAT",
+	"STARTTLS": "STARTTLS",
+	"XCLIENT":  "XCLIENT",
+}
+
+// interceptsCommands reports whether the connections need a protocolConn
+func (cfg *ServerConfig) interceptsCommands() bool {
+	return cfg.XCLIENTProxies != nil || cfg.Banner != "" || len(cfg.DisableExtensions) > 0 ||
+		cfg.Verify != nil || cfg.Expand != nil
+}
+
+// extensionDisabled reports whether the extension is in DisableExtensions
+func (cfg *ServerConfig) extensionDisabled(keyword string) bool {
+	for _, ext := range cfg.DisableExtensions {
+		if strings.EqualFold(ext, keyword) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// protocolListener wraps the connections with a protocolConn, serving
+// implicit TLS itself when useTLS is set.
+type protocolListener struct {
+	net.Listener
+	config    *ServerConfig
+	tlsConfig *tls.Config
+	useTLS    bool
+}
+
+func (l *protocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &protocolConn{raw: conn, conn: conn, config: l.config, tlsConfig: l.tlsConfig}
+	c.r = bufio.NewReader(conn)
+	c.xclientTrusted = l.config.XCLIENTProxies != nil && l.config.XCLIENTProxies.Check(conn.RemoteAddr()) == nil
+	if l.useTLS {
+		c.startTLS()
+	}
+
+	return c, nil
+}
+
+// protocolConn sits between the client and go-smtp, which has no hooks for
+// them: it answers STARTTLS, XCLIENT, VRFY and EXPN itself, rewrites the greeting and the
+// EHLO replies, and passes the other commands and the message data through.
+// It owns the TLS layer so that it sees the commands of the TLS sessions too,
+// go-smtp then only sees plaintext and the session asks it for the TLS state.
+type protocolConn struct {
+	raw            net.Conn
+	conn           net.Conn
+	r              *bufio.Reader
+	config         *ServerConfig
+	tlsConfig      *tls.Config
+	xclientTrusted bool
+
+	// session is set once go-smtp created the session of the connection
+	session *Session
+
+	// pending holds the client bytes read but not yet returned to go-smtp
+	pending []byte
+
+	greeted       bool
+	ehlo          bool
+	ehloReply     []string
+	data          bool
+	transaction   bool
+	authenticated bool
+	bdat          int64
+	discard       bool
+
+	// command is the verb of the last command passed to go-smtp, its replies
+	// are told apart with it
+	command string
+
+	// partial is set while the rest of an overlong line is read, which is
+	// not a command
+	partial bool
+
+	// authResponse is set when the next line answers an AUTH challenge
+	authResponse bool
+
+	// heloRequired is set once STARTTLS or XCLIENT succeeded, go-smtp keeps
+	// the HELO name until the client greets again
+	heloRequired bool
+
+	mu      sync.Mutex
+	tlsConn *tls.Conn
+	addr    net.Addr
+	helo    string
+	login   string
+}
+
+func (c *protocolConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.bdat > 0 {
+			if c.discard {
+				n, err := io.CopyN(ioutil.Discard, c.r, c.bdat)
+				if c.bdat -= n; err != nil {
+					return 0, err
+				}
+				continue
+			}
+
+			if int64(len(b)) > c.bdat {
+				b = b[:c.bdat]
+			}
+			n, err := c.r.Read(b)
+			c.bdat -= int64(n)
+			return n, err
+		}
+
+		line, err := c.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull || (err != nil && len(line) > 0) {
+			// overlong and unterminated lines are go-smtp's to reject
+			c.pending = append(c.pending, line...)
+			c.partial = true
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		if c.partial || c.authResponse {
+			c.partial, c.authResponse = false, false
+			c.pending = append(c.pending, line...)
+			continue
+		}
+
+		handled, err := c.intercept(strings.TrimRight(string(line), "\r\n"))
+		if err != nil {
+			return 0, err
+		}
+		if !handled {
+			c.pending = append(c.pending, line...)
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+// intercept tracks the protocol state from the client lines, it reports
+// whether the line was a command handled here, not passed to go-smtp.
+func (c *protocolConn) intercept(line string) (bool, error) {
+	if c.data {
+		if line == "." {
+			c.data, c.transaction = false, false
+		}
+		return false, nil
+	}
+
+	verb, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		verb, arg = line[:i], line[i+1:]
+	}
+	verb = strings.ToUpper(verb)
+
+	for ext, cmd := range extensionCommands {
+		if verb == cmd && c.config.extensionDisabled(ext) {
+			if verb == "BDAT" {
+				c.bdat, c.discard = bdatSize(arg), true
+			}
+			c.reply(502, EnhancedCode{5, 5, 1}, fmt.Sprintf("%s command not implemented", verb))
+			return true, nil
+		}
+	}
+
+	if c.heloRequired {
+		switch verb {
+		case "EHLO", "HELO", "LHLO":
+			c.heloRequired = false
+		case "RSET", "NOOP", "QUIT":
+		default:
+			if verb == "BDAT" {
+				c.bdat, c.discard = bdatSize(arg), true
+			}
+			c.reply(503, EnhancedCode{5, 5, 1}, "Please introduce yourself first")
+			return true, nil
+		}
+	}
+
+	c.ehlo = false
+	c.command = verb
+	switch verb {
+	case "EHLO", "LHLO":
+		c.ehlo = true
+		c.transaction = false
+	case "HELO", "RSET":
+		c.transaction = false
+	case "BDAT":
+		c.bdat, c.discard = bdatSize(arg), false
+		if fields := strings.Fields(arg); len(fields) > 1 && strings.EqualFold(fields[1], "LAST") {
+			c.transaction = false
+		}
+	case "STARTTLS":
+		return true, c.handleStartTLS()
+	case "VRFY":
+		if c.config.Verify != nil {
+			c.handleVerify(arg)
+			return true, nil
+		}
+	case "EXPN":
+		if c.config.Expand != nil {
+			c.handleExpand(arg)
+			return true, nil
+		}
+	case "XCLIENT":
+		if c.xclientTrusted {
+			return true, c.handleXCLIENT(arg)
+		}
+	}
+
+	return false, nil
+}
+
+func bdatSize(arg string) int64 {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return 0
+	}
+
+	size, _ := strconv.ParseInt(fields[0], 10, 64)
+	return size
+}
+
+func (c *protocolConn) handleStartTLS() error {
+	if c.tlsConfig == nil {
+		c.reply(502, EnhancedCode{5, 5, 1}, "TLS not supported")
+		return nil
+	}
+
+	if _, isTLS := c.tlsState(); isTLS {
+		c.reply(502, EnhancedCode{5, 5, 1}, "Already running in TLS")
+		return nil
+	}
+
+	// go-smtp refuses a second AUTH, the session would not be reset
+	if c.authenticated {
+		c.reply(503, EnhancedCode{5, 5, 1}, "STARTTLS not permitted after AUTH")
+		return nil
+	}
+
+	// go-smtp can not be made to forget an envelope, the transaction must
+	// not span the upgrade
+	if c.transaction {
+		c.reply(503, EnhancedCode{5, 5, 1}, "STARTTLS not permitted during a mail transaction")
+		return nil
+	}
+
+	c.reply(220, EnhancedCode{2, 0, 0}, "Ready to start TLS")
+	c.startTLS()
+	if err := c.tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	// the client must greet again, go-smtp then resets its state and takes
+	// the new HELO name
+	c.heloRequired = true
+	if c.session != nil {
+		c.session.startTLS()
+	}
+
+	return nil
+}
+
+// startTLS layers TLS over the connection, the commands the client pipelined
+// after STARTTLS are dropped
+func (c *protocolConn) startTLS() {
+	tlsConn := tls.Server(c.raw, c.tlsConfig)
+
+	c.mu.Lock()
+	c.tlsConn, c.conn = tlsConn, tlsConn
+	c.mu.Unlock()
+
+	c.r = bufio.NewReader(tlsConn)
+}
+
+// Write rewrites the greeting and the EHLO replies, and detects from the
+// replies to the commands the start of the transactions and of the message
+// data, and the authentication of the client. go-smtp writes its replies one
+// line at a time, and reads the next command once it replied.
+func (c *protocolConn) Write(b []byte) (int, error) {
+	switch {
+	case !c.greeted:
+		c.greeted = true
+		if bytes.HasPrefix(b, []byte("220 ")) {
+			return len(b), c.greet()
+		}
+	case c.ehlo:
+		line := strings.TrimRight(string(b), "\r\n")
+		c.ehloReply = append(c.ehloReply, line)
+		if strings.HasPrefix(line, "250-") {
+			return len(b), nil
+		}
+		c.ehlo = false
+		return len(b), c.writeEHLO()
+	case c.command == "MAIL" && bytes.HasPrefix(b, []byte("250 ")):
+		c.transaction = true
+	case c.command == "DATA" && bytes.HasPrefix(b, []byte("354 ")):
+		c.data = true
+	case c.command == "AUTH" && bytes.HasPrefix(b, []byte("334 ")):
+		c.authResponse = true
+	case c.command == "AUTH" && bytes.HasPrefix(b, []byte("235 ")):
+		c.authenticated = true
+	}
+
+	return c.current().Write(b)
+}
+
+// greet writes the greeting, with ServerConfig.Banner
+func (c *protocolConn) greet() error {
+	banner := c.config.Banner
+	if banner == "" {
+		banner = "ESMTP Service Ready"
+		if c.config.LMTP {
+			banner = "LMTP Service Ready"
+		}
+	}
+
+	_, err := fmt.Fprintf(c.current(), "220 %s %s\r\n", c.config.BannerDomain, banner)
+	return err
+}
+
+// writeEHLO writes the EHLO reply of go-smtp with the announced hostname,
+// without the disabled extensions and with those handled here
+func (c *protocolConn) writeEHLO() error {
+	lines := c.ehloReply
+	c.ehloReply = nil
+
+	if !strings.HasPrefix(lines[0], "250") {
+		_, err := io.WriteString(c.current(), strings.Join(lines, "\r\n")+"\r\n")
+		return err
+	}
+
+	_, isTLS := c.tlsState()
+	exts := []string{}
+	for _, line := range lines[1:] {
+		ext := line[4:]
+		keyword := strings.ToUpper(strings.Fields(ext)[0])
+		if c.config.extensionDisabled(keyword) || (keyword == "STARTTLS" && isTLS) {
+			continue
+		}
+		exts = append(exts, ext)
+	}
+
+	if c.xclientTrusted && !c.config.extensionDisabled("XCLIENT") {
+		exts = append(exts, "XCLIENT "+xclientAttrs)
+	}
+
+	var sb strings.Builder
+	reply := append([]string{c.config.BannerDomain + " " + lines[0][4:]}, exts...)
+	for i, line := range reply {
+		sep := "-"
+		if i == len(reply)-1 {
+			sep = " "
+		}
+		sb.WriteString("250" + sep + line + "\r\n")
+	}
+
+	_, err := io.WriteString(c.current(), sb.String())
+	return err
+}
+
+func (c *protocolConn) reply(code int, enhancedCode EnhancedCode, msg string) {
+	fmt.Fprintf(c.current(), "%d %d.%d.%d %s\r\n", code, enhancedCode[0], enhancedCode[1], enhancedCode[2], msg)
+}
+
+func (c *protocolConn) replyError(err error) {
+	code, enhancedCode, msg := 554, smtp.EnhancedCode{5, 0, 0}, err.Error()
+	if smtpErr, ok := err.(*smtp.SMTPError); ok {
+		code, enhancedCode, msg = smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message
+	}
+
+	c.reply(code, enhancedCode, msg)
+}
+
+// current returns the TLS connection once started, the raw one otherwise
+func (c *protocolConn) current() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.conn
+}
+
+// tlsState returns the state of the TLS connection, if started
+func (c *protocolConn) tlsState() (tls.ConnectionState, bool) {
+	c.mu.Lock()
+	tlsConn := c.tlsConn
+	c.mu.Unlock()
+
+	if tlsConn == nil {
+		return tls.ConnectionState{}, false
+	}
+
+	return tlsConn.ConnectionState(), true
+}
+
+func (c *protocolConn) Close() error {
+	return c.current().Close()
+}
+
+func (c *protocolConn) LocalAddr() net.Addr {
+	return c.raw.LocalAddr()
+}
+
+// RemoteAddr returns the client address supplied by a proxy with XCLIENT,
+// if any
+func (c *protocolConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.addr != nil {
+		return c.addr
+	}
+
+	return c.raw.RemoteAddr()
+}
+
+// the deadlines of the TLS connection are those of the raw one
+
+func (c *protocolConn) SetDeadline(t time.Time) error {
+	return c.raw.SetDeadline(t)
+}
+
+func (c *protocolConn) SetReadDeadline(t time.Time) error {
+	return c.raw.SetReadDeadline(t)
+}
+
+func (c *protocolConn) SetWriteDeadline(t time.Time) error {
+	return c.raw.SetWriteDeadline(t)
+}
+
+// rawConn returns the connection below the TLS and protocol layers
+func rawConn(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *protocolConn:
+			conn = c.raw
+		default:
+			return conn
+		}
+	}
+}
+
+// sessionProtocolConn returns the protocolConn of a session connection, if any
+func sessionProtocolConn(conn net.Conn) *protocolConn {
+	c, _ := conn.(*protocolConn)
+	return c
+}
@@ -0,0 +1,245 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scriptConn replays the client bytes and records the bytes written to the
+// client
+type scriptConn struct {
+	net.Conn
+	in  *strings.Reader
+	out bytes.Buffer
+}
+
+func (c *scriptConn) Read(b []byte) (int, error)  { return c.in.Read(b) }
+func (c *scriptConn) Write(b []byte) (int, error) { return c.out.Write(b) }
+func (c *scriptConn) Close() error                { return nil }
+
+func newScriptProtocolConn(client string) (*protocolConn, *scriptConn) {
+	conn := &scriptConn{in: strings.NewReader(client)}
+	cfg := &ServerConfig{
+		BannerDomain: "mx.example.com",
+		Verify: func(c *Context, addr string) (*mail.Address, error) {
+			return nil, nil
+		},
+	}
+
+	c := &protocolConn{raw: conn, conn: conn, config: cfg, greeted: true}
+	c.r = bufio.NewReader(conn)
+
+	return c, conn
+}
+
+func readLine(t *testing.T, c *protocolConn) string {
+	t.Helper()
+
+	line, err := readOneLine(c)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	return line
+}
+
+func TestProtocolConnOverlongLine(t *testing.T) {
+	// the rest of the line starts a new read of the buffer
+	long := "NOOP " + strings.Repeat("a", 4096-len("NOOP ")) + "VRFY postmaster\r\n"
+	c, conn := newScriptProtocolConn(long + "VRFY postmaster\r\n")
+
+	if line := readLine(t, c); line != long {
+		t.Fatalf("the overlong line was split: %q", line)
+	}
+	if conn.out.Len() != 0 {
+		t.Fatalf("the rest of the overlong line was intercepted: %q", conn.out.String())
+	}
+
+	// the next line is a command again
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read: %v", err)
+	}
+	if !strings.HasPrefix(conn.out.String(), "503 ") {
+		t.Fatalf("VRFY was not intercepted: %q", conn.out.String())
+	}
+}
+
+func TestProtocolConnDataMode(t *testing.T) {
+	c, conn := newScriptProtocolConn("NOOP\r\nVRFY postmaster\r\n.\r\nDATA\r\nVRFY postmaster\r\n.\r\n")
+
+	// a 354 reply to another command does not start the message data
+	readLine(t, c)
+	c.Write([]byte("354 not data\r\n"))
+	if c.data {
+		t.Fatal("data mode entered without DATA")
+	}
+	conn.out.Reset()
+
+	// the VRFY is answered, "." is a command
+	if line := readLine(t, c); line != ".\r\n" {
+		t.Fatalf("line = %q", line)
+	}
+	if !strings.HasPrefix(conn.out.String(), "503 ") {
+		t.Fatalf("VRFY was not intercepted: %q", conn.out.String())
+	}
+	conn.out.Reset()
+
+	readLine(t, c)
+	c.Write([]byte("354 Go ahead\r\n"))
+	if !c.data {
+		t.Fatal("data mode not entered after DATA")
+	}
+	conn.out.Reset()
+
+	if line := readLine(t, c); line != "VRFY postmaster\r\n" {
+		t.Fatalf("the message data was intercepted: %q", line)
+	}
+	if line := readLine(t, c); line != ".\r\n" || c.data {
+		t.Fatalf("the message data did not end: %q", line)
+	}
+	if conn.out.Len() != 0 {
+		t.Fatalf("replied during the message data: %q", conn.out.String())
+	}
+}
+
+func TestProtocolConnAuthResponse(t *testing.T) {
+	c, conn := newScriptProtocolConn("AUTH LOGIN\r\nVRFY\r\n")
+
+	readLine(t, c)
+	c.Write([]byte("334 VXNlcm5hbWU6\r\n"))
+	conn.out.Reset()
+
+	if line := readLine(t, c); line != "VRFY\r\n" {
+		t.Fatalf("line = %q", line)
+	}
+	if conn.out.Len() != 0 {
+		t.Fatalf("the AUTH response was intercepted: %q", conn.out.String())
+	}
+}
+
+func TestProtocolConnStartTLSDuringTransaction(t *testing.T) {
+	c, conn := newScriptProtocolConn("MAIL FROM:<a@example.com>\r\nSTARTTLS\r\n")
+	c.tlsConfig = &tls.Config{}
+
+	readLine(t, c)
+	c.Write([]byte("250 2.0.0 Roger\r\n"))
+	conn.out.Reset()
+
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read: %v", err)
+	}
+	if !strings.HasPrefix(conn.out.String(), "503 ") {
+		t.Fatalf("STARTTLS was not refused: %q", conn.out.String())
+	}
+}
+
+func TestProtocolConnStartTLSRequiresHelo(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	c := &protocolConn{
+		raw:       server,
+		conn:      server,
+		config:    &ServerConfig{BannerDomain: "mx.example.com"},
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}},
+		greeted:   true,
+	}
+	c.r = bufio.NewReader(server)
+
+	lines := make(chan string, 10)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			line, err := readOneLine(c)
+			if err != nil {
+				errs <- err
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	io.WriteString(client, "EHLO client.example.com\r\n")
+	if line := <-lines; line != "EHLO client.example.com\r\n" {
+		t.Fatalf("line = %q", line)
+	}
+
+	r := bufio.NewReader(client)
+	io.WriteString(client, "STARTTLS\r\n")
+	if reply, _ := r.ReadString('\n'); !strings.HasPrefix(reply, "220 ") {
+		t.Fatalf("STARTTLS reply = %q", reply)
+	}
+
+	tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	tlsReader := bufio.NewReader(tlsClient)
+
+	// the envelope needs a new greeting
+	io.WriteString(tlsClient, "MAIL FROM:<a@example.com>\r\n")
+	if reply, _ := tlsReader.ReadString('\n'); !strings.HasPrefix(reply, "503 ") {
+		t.Fatalf("MAIL reply = %q", reply)
+	}
+
+	io.WriteString(tlsClient, "EHLO client.example.com\r\nMAIL FROM:<a@example.com>\r\n")
+	for _, want := range []string{"EHLO client.example.com\r\n", "MAIL FROM:<a@example.com>\r\n"} {
+		select {
+		case line := <-lines:
+			if line != want {
+				t.Fatalf("line = %q, want %q", line, want)
+			}
+		case err := <-errs:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+// readOneLine returns the next line passed to go-smtp
+func readOneLine(c *protocolConn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\n")) {
+		if _, err := c.Read(b); err != nil {
+			return "", err
+		}
+		line = append(line, b[0])
+	}
+
+	return string(line), nil
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,166 @@
+package smtpsrv
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// PublishFormat selects the body of the published messages
+type PublishFormat int
+
+const (
+	// PublishRaw publishes the message as received
+	PublishRaw PublishFormat = iota
+
+	// PublishJSON publishes the parsed message as a WebhookPayload document,
+	// attachments inlined
+	PublishJSON
+)
+
+// PublishMessage is a message handed to a Publisher
+type PublishMessage struct {
+	// Key is the transaction ID, brokers partitioning by key keep the
+	// messages of a transaction together
+	Key     string
+	Headers map[string]string
+	Body    []byte
+}
+
+// Publisher pushes messages to a broker topic, Publish must only return once
+// the broker acknowledged the message.
+type Publisher interface {
+	Publish(ctx context.Context, topic string, msg *PublishMessage) error
+}
+
+// PublisherFunc adapts a function to a Publisher. Only NATS has an adapter,
+// see NATSPublisher, the Kafka and RabbitMQ clients are plugged with a
+// PublisherFunc as their APIs take their own message types, e.g. with a
+// kafka-go writer whose RequiredAcks is not RequireNone:
+//
+//	smtpsrv.PublisherFunc(func(ctx context.Context, topic string, msg *smtpsrv.PublishMessage) error {
+//		return writer.WriteMessages(ctx, kafka.Message{Topic: topic, Key: []byte(msg.Key), Value: msg.Body})
+//	})
+//
+// or with an amqp091-go channel in confirm mode, waiting for the broker
+// confirmation:
+//
+//	smtpsrv.PublisherFunc(func(ctx context.Context, topic string, msg *smtpsrv.PublishMessage) error {
+//		confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, "", topic, true, false, amqp.Publishing{Body: msg.Body})
+//		if err != nil {
+//			return err
+//		}
+//		if ok, err := confirm.WaitContext(ctx); err != nil || !ok {
+//			return fmt.Errorf("not confirmed: %v", err)
+//		}
+//		return nil
+//	})
+type PublisherFunc func(ctx context.Context, topic string, msg *PublishMessage) error
+
+func (f PublisherFunc) Publish(ctx context.Context, topic string, msg *PublishMessage) error {
+	return f(ctx, topic, msg)
+}
+
+// NATSConn is the part of *nats.Conn used by NATSPublisher
+type NATSConn interface {
+	Publish(subject string, data []byte) error
+	FlushWithContext(ctx context.Context) error
+}
+
+// NATSPublisher publishes to the NATS subject named by the topic, flushing
+// after every message so it reached the server. nats requires a deadline on
+// the context of the flush, which PublishHandler sets. Core NATS has no
+// headers in this API, only the body is published.
+func NATSPublisher(conn NATSConn) Publisher {
+	return PublisherFunc(func(ctx context.Context, topic string, msg *PublishMessage) error {
+		if err := conn.Publish(topic, msg.Body); err != nil {
+			return err
+		}
+
+		return conn.FlushWithContext(ctx)
+	})
+}
+
+// PublishConfig holds the publishing settings
+type PublishConfig struct {
+	Publisher Publisher
+
+	// Topic the messages are published to, TopicFunc overrides it per message
+	Topic     string
+	TopicFunc func(c *Context) string
+
+	Format PublishFormat
+
+	// Timeout of a single publish, defaults to 10 seconds
+	Timeout time.Duration
+}
+
+// PublishHandler returns a handler publishing each accepted message. The
+// message is only accepted once published, a failure is replied as a
+// temporary error so the client retries: delivery is at least once.
+func PublishHandler(cfg PublishConfig) HandlerFunc {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	return func(c *Context) error {
+		msg, err := newPublishMessage(c, cfg.Format)
+		if err != nil {
+			return err
+		}
+
+		topic := cfg.Topic
+		if cfg.TopicFunc != nil {
+			topic = cfg.TopicFunc(c)
+		}
+
+		ctx, cancel := context.WithTimeout(c.Context(), cfg.Timeout)
+		defer cancel()
+
+		if err := cfg.Publisher.Publish(ctx, topic, msg); err != nil {
+			c.session.log("publish failed", "topic", topic, "err", err)
+			return ErrTemporaryFailure
+		}
+
+		return nil
+	}
+}
+
+func newPublishMessage(c *Context, format PublishFormat) (*PublishMessage, error) {
+	msg := &PublishMessage{
+		Key: c.TransactionID(),
+		Headers: map[string]string{
+			"smtp-session-id":  c.SessionID(),
+			"smtp-remote-addr": c.RemoteAddr().String(),
+			"smtp-mail-from":   c.From().Address,
+			"smtp-rcpt-to":     strings.Join(c.deliveryRecipients(), ","),
+		},
+	}
+
+	if format == PublishJSON {
+		email, err := c.Parse()
+		if err != nil {
+			return nil, err
+		}
+
+		payload, _, err := newWebhookPayload(c, email, false)
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Headers["content-type"] = "application/json"
+		msg.Body, err = json.Marshal(payload)
+		return msg, err
+	}
+
+	raw, err := c.Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Headers["content-type"] = "message/rfc822"
+	msg.Body = raw
+
+	return msg, nil
+}
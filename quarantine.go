@@ -0,0 +1,301 @@
+package smtpsrv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errNoRelease = errors.New("smtpsrv: quarantine has no Release function")
+
+// QuarantinedMessage is a message kept aside for review
+type QuarantinedMessage struct {
+	ID            string
+	SessionID     string
+	TransactionID string
+	RemoteAddr    string
+	Helo          string
+	From          string
+	To            []string
+	Data          []byte
+
+	// Reason tells why the message was quarantined, e.g. the virus found
+	Reason string
+
+	// Reply is the rejection replied to the client, empty when the message
+	// was accepted
+	Reply string
+
+	Created time.Time
+}
+
+// QuarantineStore persists the quarantined messages, implementations backed
+// by a database or an object storage keep them across restarts.
+type QuarantineStore interface {
+	// Put inserts the message
+	Put(m *QuarantinedMessage) error
+
+	// Get returns the message, or ErrNotQuarantined
+	Get(id string) (*QuarantinedMessage, error)
+
+	// List returns the messages, oldest first
+	List() ([]*QuarantinedMessage, error)
+
+	// Delete removes the message, deleting an unknown ID is not an error
+	Delete(id string) error
+}
+
+// QuarantineConfig holds the quarantine settings
+type QuarantineConfig struct {
+	// Store defaults to an in-memory store
+	Store QuarantineStore
+
+	// MaxAge, MaxMessages and MaxBytes, when set, limit the retention: the
+	// oldest messages are deleted once they are exceeded, on every addition
+	// and on Prune.
+	MaxAge      time.Duration
+	MaxMessages int
+	MaxBytes    int64
+
+	// Release delivers the released messages to their recipients, e.g.
+	// (*Relay).Send or a function queueing them
+	Release DeliverFunc
+}
+
+// Quarantine keeps the rejected or suspicious messages for review, they can
+// then be released to their recipients or deleted.
+type Quarantine struct {
+	config QuarantineConfig
+
+	mu sync.Mutex
+}
+
+func NewQuarantine(cfg QuarantineConfig) *Quarantine {
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryQuarantineStore()
+	}
+
+	return &Quarantine{
+		config: cfg,
+	}
+}
+
+// Add quarantines the message of the transaction, with the reason and the
+// rejection replied to the client, if any. The message is read entirely.
+func (q *Quarantine) Add(c *Context, reason string, reply error) (*QuarantinedMessage, error) {
+	raw, err := c.Raw()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &QuarantinedMessage{
+		ID:            newSessionID(),
+		SessionID:     c.SessionID(),
+		TransactionID: c.TransactionID(),
+		RemoteAddr:    c.RemoteAddr().String(),
+		Helo:          c.Helo(),
+		To:            c.deliveryRecipients(),
+		Data:          raw,
+		Reason:        reason,
+		Created:       time.Now(),
+	}
+	if from := c.From(); from != nil {
+		m.From = from.Address
+	}
+	if reply, ok := smtpError(reply).(*smtp.SMTPError); ok {
+		code := reply.EnhancedCode
+		m.Reply = fmt.Sprintf("%d %d.%d.%d %s", reply.Code, code[0], code[1], code[2], reply.Message)
+	}
+
+	if err := q.Put(m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Put stores the message and applies the retention limits
+func (q *Quarantine) Put(m *QuarantinedMessage) error {
+	if err := q.config.Store.Put(m); err != nil {
+		return err
+	}
+
+	return q.Prune()
+}
+
+// List returns the quarantined messages, oldest first
+func (q *Quarantine) List() ([]*QuarantinedMessage, error) {
+	return q.config.Store.List()
+}
+
+// Get returns the quarantined message, or ErrNotQuarantined
+func (q *Quarantine) Get(id string) (*QuarantinedMessage, error) {
+	return q.config.Store.Get(id)
+}
+
+// Release delivers the message to its recipients with the Release function,
+// and removes it from the quarantine
+func (q *Quarantine) Release(id string) error {
+	if q.config.Release == nil {
+		return errNoRelease
+	}
+
+	m, err := q.config.Store.Get(id)
+	if err != nil {
+		return err
+	}
+
+	if err := q.config.Release(m.From, m.To, m.Data); err != nil {
+		return err
+	}
+
+	return q.config.Store.Delete(id)
+}
+
+// Delete removes the message from the quarantine
+func (q *Quarantine) Delete(id string) error {
+	return q.config.Store.Delete(id)
+}
+
+// Prune deletes the messages exceeding the retention limits
+func (q *Quarantine) Prune() error {
+	if q.config.MaxAge == 0 && q.config.MaxMessages == 0 && q.config.MaxBytes == 0 {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages, err := q.config.Store.List()
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for _, m := range messages {
+		size += int64(len(m.Data))
+	}
+
+	now := time.Now()
+	for i, m := range messages {
+		expired := q.config.MaxAge > 0 && now.Sub(m.Created) > q.config.MaxAge
+		tooMany := q.config.MaxMessages > 0 && len(messages)-i > q.config.MaxMessages
+		tooLarge := q.config.MaxBytes > 0 && size > q.config.MaxBytes
+		if !expired && !tooMany && !tooLarge {
+			break
+		}
+
+		if err := q.config.Store.Delete(m.ID); err != nil {
+			return err
+		}
+		size -= int64(len(m.Data))
+	}
+
+	return nil
+}
+
+// Policy wraps a DataPolicy, quarantining the messages it rejects
+// permanently, which are still rejected. The temporary failures are retried
+// by the clients and not kept.
+func (q *Quarantine) Policy(policy DataPolicyFunc) DataPolicyFunc {
+	return func(c *Context, body io.Reader) error {
+		err := policy(c, body)
+		if err == nil || err == ErrQuarantined {
+			return err
+		}
+
+		reply := rejectError(err, 550, EnhancedCode{5, 7, 1}).(*smtp.SMTPError)
+		if reply.Code/100 == 4 {
+			return err
+		}
+
+		// Add fails for the messages exceeding the size limit, which are not kept
+		q.Add(c, err.Error(), reply)
+
+		return err
+	}
+}
+
+// ClamAV returns a ClamAVConfig.Quarantine function keeping the infected
+// messages aside
+func (q *Quarantine) ClamAV() func(c *Context, result *ClamAVResult) error {
+	return func(c *Context, result *ClamAVResult) error {
+		reason := "virus " + result.Virus
+		if result.Filename != "" {
+			reason += fmt.Sprintf(" in %q", result.Filename)
+		}
+
+		_, err := q.Add(c, reason, nil)
+		return err
+	}
+}
+
+// MemoryQuarantineStore is a QuarantineStore keeping the messages in memory
+type MemoryQuarantineStore struct {
+	mu       sync.Mutex
+	messages map[string]*QuarantinedMessage
+}
+
+func NewMemoryQuarantineStore() *MemoryQuarantineStore {
+	return &MemoryQuarantineStore{
+		messages: map[string]*QuarantinedMessage{},
+	}
+}
+
+func (s *MemoryQuarantineStore) Put(m *QuarantinedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *m
+	stored.To = append([]string(nil), m.To...)
+	s.messages[m.ID] = &stored
+
+	return nil
+}
+
+func (s *MemoryQuarantineStore) Get(id string) (*QuarantinedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.messages[id]
+	if !ok {
+		return nil, ErrNotQuarantined
+	}
+
+	copied := *m
+	copied.To = append([]string(nil), m.To...)
+
+	return &copied, nil
+}
+
+func (s *MemoryQuarantineStore) List() ([]*QuarantinedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]*QuarantinedMessage, 0, len(s.messages))
+	for _, m := range s.messages {
+		copied := *m
+		copied.To = append([]string(nil), m.To...)
+		messages = append(messages, &copied)
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Created.Before(messages[j].Created)
+	})
+
+	return messages, nil
+}
+
+func (s *MemoryQuarantineStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.messages, id)
+
+	return nil
+}
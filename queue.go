@@ -0,0 +1,394 @@
+package smtpsrv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// QueuedMessage is a message waiting for delivery
+type QueuedMessage struct {
+	ID   string
+	From string
+	To   []string
+	Data []byte
+
+	Attempts    int
+	Created     time.Time
+	NextAttempt time.Time
+	LastError   string
+}
+
+// QueueStore persists the queued messages, only MemoryQueueStore is
+// provided: the implementations backed by a database keep them across
+// restarts.
+type QueueStore interface {
+	// Put inserts the message or replaces the one with the same ID
+	Put(m *QueuedMessage) error
+
+	// Due returns the messages whose next attempt is not after now
+	Due(now time.Time) ([]*QueuedMessage, error)
+
+	// Delete removes the message, deleting an unknown ID is not an error
+	Delete(id string) error
+}
+
+// DeliverFunc delivers a message, it may return a *RelayError to report
+// per-recipient failures. (*Relay).Send is a DeliverFunc.
+type DeliverFunc func(from string, to []string, msg []byte) error
+
+// QueueConfig holds the queue settings
+type QueueConfig struct {
+	// Deliver is called for every attempt
+	Deliver DeliverFunc
+
+	// Store defaults to an in-memory store
+	Store QueueStore
+
+	// Interval between two runs over the due messages, defaults to 30 seconds
+	Interval time.Duration
+
+	// MinBackoff is the delay before the first retry, doubled after every
+	// failed attempt up to MaxBackoff. They default to 1 minute and 4 hours.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Expire is how long a message is retried before bouncing, defaults to 5 days
+	Expire time.Duration
+
+	// Hostname names the reporting MTA in bounces, defaults to os.Hostname
+	Hostname string
+
+	// DisableBounces drops undeliverable messages instead of queueing a bounce
+	// to their sender
+	DisableBounces bool
+
+	// Logger, when set, receives the failures of the periodic runs
+	Logger Logger
+}
+
+// Queue retries the delivery of messages with an exponential backoff, and
+// bounces them to their sender once they failed permanently or expired.
+type Queue struct {
+	config QueueConfig
+
+	flushMu sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewQueue(cfg QueueConfig) *Queue {
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryQueueStore()
+	}
+
+	if cfg.Interval == 0 {
+		cfg.Interval = 30 * time.Second
+	}
+
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = time.Minute
+	}
+
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = 4 * time.Hour
+	}
+
+	if cfg.Expire == 0 {
+		cfg.Expire = 5 * 24 * time.Hour
+	}
+
+	if cfg.Hostname == "" {
+		cfg.Hostname, _ = os.Hostname()
+	}
+
+	q := &Queue{
+		config: cfg,
+		done:   make(chan struct{}),
+	}
+
+	go q.loop()
+
+	return q
+}
+
+func (q *Queue) loop() {
+	ticker := time.NewTicker(q.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// the failures were logged
+			q.Flush()
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// Enqueue stores the message for delivery on the next run and returns its ID
+func (q *Queue) Enqueue(from string, to []string, msg []byte) (string, error) {
+	now := time.Now()
+	m := &QueuedMessage{
+		ID:          newSessionID(),
+		From:        from,
+		To:          to,
+		Data:        msg,
+		Created:     now,
+		NextAttempt: now,
+	}
+
+	if err := q.config.Store.Put(m); err != nil {
+		return "", err
+	}
+
+	return m.ID, nil
+}
+
+// Handler returns a handler queueing each accepted message for its
+// recipients, the message is only accepted once it is stored.
+func (q *Queue) Handler() HandlerFunc {
+	return func(c *Context) error {
+		raw, err := c.Raw()
+		if err != nil {
+			return err
+		}
+
+		if _, err := q.Enqueue(c.From().Address, c.deliveryRecipients(), raw); err != nil {
+			return ErrTemporaryFailure
+		}
+
+		return nil
+	}
+}
+
+// Flush attempts the delivery of the due messages now. A message whose
+// attempt could not be stored does not stop the others, the errors of the
+// run are returned together.
+func (q *Queue) Flush() error {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	due, err := q.config.Store.Due(time.Now())
+	if err != nil {
+		q.logger().Log("queue run failed", "err", err)
+		return err
+	}
+
+	var errs []error
+	for _, m := range due {
+		if err := q.attempt(m); err != nil {
+			q.logger().Log("queue attempt failed", "id", m.ID, "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", m.ID, err))
+		}
+	}
+
+	return joinErrors(errs)
+}
+
+func (q *Queue) logger() Logger {
+	if q.config.Logger == nil {
+		return nopLogger{}
+	}
+
+	return q.config.Logger
+}
+
+// Close stops the periodic runs, the messages remain in the store
+func (q *Queue) Close() error {
+	q.closeOnce.Do(func() {
+		close(q.done)
+	})
+
+	return nil
+}
+
+// attempt delivers the message, requeueing the recipients that failed
+// temporarily and bouncing the others
+func (q *Queue) attempt(m *QueuedMessage) error {
+	err := q.config.Deliver(m.From, m.To, m.Data)
+	if err == nil {
+		return q.config.Store.Delete(m.ID)
+	}
+
+	failed := map[string]error{}
+	var relayErr *RelayError
+	if errors.As(err, &relayErr) {
+		failed = relayErr.Failed
+	} else {
+		for _, rcpt := range m.To {
+			failed[rcpt] = err
+		}
+	}
+
+	now := time.Now()
+	expired := now.Sub(m.Created) >= q.config.Expire
+
+	var retry []string
+	permanent := map[string]error{}
+	for _, rcpt := range m.To {
+		rcptErr, ok := failed[rcpt]
+		if !ok {
+			continue
+		}
+
+		if relayTemporary(rcptErr) && !expired {
+			retry = append(retry, rcpt)
+		} else {
+			permanent[rcpt] = rcptErr
+		}
+	}
+
+	if len(permanent) > 0 {
+		if err := q.bounce(m, permanent); err != nil {
+			return err
+		}
+	}
+
+	if len(retry) == 0 {
+		return q.config.Store.Delete(m.ID)
+	}
+
+	m.To = retry
+	m.Attempts++
+	m.LastError = err.Error()
+	m.NextAttempt = now.Add(q.backoff(m.Attempts))
+
+	return q.config.Store.Put(m)
+}
+
+// backoff returns the delay following the nth failed attempt
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := q.config.MinBackoff
+	for i := 1; i < attempts && delay < q.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > q.config.MaxBackoff {
+		delay = q.config.MaxBackoff
+	}
+
+	return delay
+}
+
+// bounce queues a delivery status notification to the sender, bounces
+// themselves are never bounced since they have a null sender
+func (q *Queue) bounce(m *QueuedMessage, failed map[string]error) error {
+	if q.config.DisableBounces || m.From == "" {
+		return nil
+	}
+
+	bounce, err := BuildBounce(m.From, failureStatus(q.config.Hostname, m, failed), m.Data, false)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Enqueue("", []string{m.From}, bounce)
+	return err
+}
+
+// failureStatus reports the failed recipients of the message
+func failureStatus(hostname string, m *QueuedMessage, failed map[string]error) *DeliveryStatus {
+	status := &DeliveryStatus{
+		ReportingMTA: hostname,
+		ArrivalDate:  m.Created,
+	}
+
+	for _, rcpt := range m.To {
+		if err, ok := failed[rcpt]; ok {
+			status.Recipients = append(status.Recipients, bounceRecipientStatus(rcpt, err))
+		}
+	}
+
+	return status
+}
+
+// bounceRecipientStatus reports a failed delivery, temporary failures are
+// only bounced once the message expired
+func bounceRecipientStatus(rcpt string, err error) RecipientStatus {
+	status := RecipientStatus{
+		FinalRecipient:  rcpt,
+		Action:          "failed",
+		Status:          "4.4.7",
+		LastAttemptDate: time.Now(),
+	}
+
+	// connection failures have no diagnostic
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return status
+	}
+
+	status.DiagnosticCode = fmt.Sprintf("%d %s", smtpErr.Code, smtpErr.Message)
+	if smtpErr.Code/100 != 5 {
+		return status
+	}
+
+	status.Status = fmt.Sprintf("%d.0.0", smtpErr.Code/100)
+	if smtpErr.EnhancedCode != (smtp.EnhancedCode{}) && smtpErr.EnhancedCode != smtp.NoEnhancedCode {
+		code := smtpErr.EnhancedCode
+		status.Status = fmt.Sprintf("%d.%d.%d", code[0], code[1], code[2])
+		status.DiagnosticCode = fmt.Sprintf("%d %s %s", smtpErr.Code, status.Status, smtpErr.Message)
+	}
+
+	return status
+}
+
+// MemoryQueueStore is a QueueStore keeping the messages in memory
+type MemoryQueueStore struct {
+	mu       sync.Mutex
+	messages map[string]*QueuedMessage
+}
+
+func NewMemoryQueueStore() *MemoryQueueStore {
+	return &MemoryQueueStore{
+		messages: map[string]*QueuedMessage{},
+	}
+}
+
+func (s *MemoryQueueStore) Put(m *QueuedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *m
+	stored.To = append([]string(nil), m.To...)
+	s.messages[m.ID] = &stored
+
+	return nil
+}
+
+func (s *MemoryQueueStore) Due(now time.Time) ([]*QueuedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*QueuedMessage
+	for _, m := range s.messages {
+		if !m.NextAttempt.After(now) {
+			copied := *m
+			copied.To = append([]string(nil), m.To...)
+			due = append(due, &copied)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttempt.Before(due[j].NextAttempt)
+	})
+
+	return due, nil
+}
+
+func (s *MemoryQueueStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.messages, id)
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package smtpsrv
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errTooManyMessages = &Error{
+		Code:         450,
+		EnhancedCode: EnhancedCode{4, 7, 1},
+		Message:      "Too many messages, try again later",
+	}
+	errTooManyRecipients = &Error{
+		Code:         452,
+		EnhancedCode: EnhancedCode{4, 5, 3},
+		Message:      "Too many recipients",
+	}
+)
+
+// RateLimitStore counts events within fixed windows, implementations backed by
+// a shared store (e.g. redis INCR + EXPIRE) enforce the limits across instances.
+type RateLimitStore interface {
+	// Incr increments the counter key, which expires window after its first
+	// increment, and returns its new value.
+	Incr(key string, window time.Duration) (int64, error)
+}
+
+// RateLimitConfig holds the per-IP limits, a zero limit is disabled.
+type RateLimitConfig struct {
+	ConnectionsPerMinute int
+	MessagesPerHour      int
+	RecipientsPerMessage int
+
+	// Store defaults to an in-memory store
+	Store RateLimitStore
+}
+
+// RateLimiter enforces per-IP limits on connections, messages and recipients
+type RateLimiter struct {
+	config RateLimitConfig
+}
+
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryRateLimitStore()
+	}
+
+	return &RateLimiter{
+		config: cfg,
+	}
+}
+
+func (rl *RateLimiter) allowConnection(addr net.Addr) error {
+	return rl.incr("conn:", addr, time.Minute, rl.config.ConnectionsPerMinute, ErrTooManyConnections)
+}
+
+// connectionPolicy charges the connections to the rate limit of their client
+// at accept time. The trusted XCLIENT proxies are not charged, the clients
+// they forward are once their address is supplied.
+func (rl *RateLimiter) connectionPolicy(proxies *IPFilter) ConnectionPolicyFunc {
+	return func(addr net.Addr) error {
+		if proxies != nil && proxies.Check(addr) == nil {
+			return nil
+		}
+
+		return rl.allowConnection(addr)
+	}
+}
+
+func (rl *RateLimiter) allowMessage(addr net.Addr) error {
+	return rl.incr("msg:", addr, time.Hour, rl.config.MessagesPerHour, errTooManyMessages)
+}
+
+func (rl *RateLimiter) allowRecipient(count int) error {
+	if rl.config.RecipientsPerMessage > 0 && count > rl.config.RecipientsPerMessage {
+		return errTooManyRecipients
+	}
+
+	return nil
+}
+
+func (rl *RateLimiter) incr(prefix string, addr net.Addr, window time.Duration, limit int, limitErr error) error {
+	if limit < 1 {
+		return nil
+	}
+
+	ip := addrIP(addr)
+	if ip == nil {
+		return nil
+	}
+
+	n, err := rl.config.Store.Incr(prefix+ip.String(), window)
+	if err != nil {
+		return err
+	}
+
+	if n > int64(limit) {
+		return limitErr
+	}
+
+	return nil
+}
+
+type memoryRateCounter struct {
+	count   int64
+	expires time.Time
+}
+
+// MemoryRateLimitStore is a RateLimitStore local to the process
+type MemoryRateLimitStore struct {
+	mu         sync.Mutex
+	counters   map[string]*memoryRateCounter
+	lastSweep  time.Time
+	sweepEvery time.Duration
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		counters:   map[string]*memoryRateCounter{},
+		lastSweep:  time.Now(),
+		sweepEvery: time.Minute,
+	}
+}
+
+func (s *MemoryRateLimitStore) Incr(key string, window time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > s.sweepEvery {
+		for k, c := range s.counters {
+			if now.After(c.expires) {
+				delete(s.counters, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	// the window is part of the key so limits with different windows don't collide
+	key += "/" + strconv.FormatInt(int64(window), 10)
+
+	c, ok := s.counters[key]
+	if !ok || now.After(c.expires) {
+		c = &memoryRateCounter{expires: now.Add(window)}
+		s.counters[key] = c
+	}
+	c.count++
+
+	return c.count, nil
+}
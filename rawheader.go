@@ -0,0 +1,68 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"strings"
+)
+
+// RawHeaderField is a header field as it was received
+type RawHeaderField struct {
+	// Name is the field name in its original case
+	Name string
+
+	// Value follows the colon, with its leading whitespace and folding,
+	// without the line break ending it. Its encoded words are not decoded.
+	Value string
+}
+
+// RawHeaderFields splits RawHeader into its fields, in order, e.g. for the
+// DKIM verification or to serialize the header again. The lines which are
+// not fields are skipped.
+func (e *Email) RawHeaderFields() []RawHeaderField {
+	var fields []RawHeaderField
+
+	for _, line := range splitRawHeader(e.RawHeader) {
+		ind := strings.IndexByte(line, ':')
+		if ind < 1 {
+			continue
+		}
+
+		fields = append(fields, RawHeaderField{
+			Name:  strings.TrimRight(line[:ind], " \t"),
+			Value: strings.TrimRight(line[ind+1:], "\r\n"),
+		})
+	}
+
+	return fields
+}
+
+// splitRawHeader returns the fields of a header section, with their folded
+// lines
+func splitRawHeader(raw []byte) []string {
+	var fields []string
+
+	for len(raw) > 0 {
+		end := 0
+		for {
+			ind := bytes.IndexByte(raw[end:], '\n')
+			if ind == -1 {
+				end = len(raw)
+				break
+			}
+			end += ind + 1
+			if end == len(raw) || (raw[end] != ' ' && raw[end] != '\t') {
+				break
+			}
+		}
+
+		line := string(raw[:end])
+		raw = raw[end:]
+		if strings.TrimRight(line, "\r\n") == "" {
+			// the end of the header
+			break
+		}
+		fields = append(fields, line)
+	}
+
+	return fields
+}
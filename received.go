@@ -0,0 +1,252 @@
+package smtpsrv
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ReceivedHeader builds the Received trace header (RFC 5321 section 4.4) of
+// the current transaction, folded and terminated by CRLF: the HELO name and
+// IP of the client, the protocol, the TLS version and cipher, the
+// authenticated user, the recipient and the time. Handlers relaying raw
+// messages prepend it unless ServerConfig.AddReceived already did.
+func (c Context) ReceivedHeader() string {
+	cfg := c.session.config
+
+	var sb strings.Builder
+
+	helo := c.session.helo()
+	if helo == "" {
+		helo = "unknown"
+	}
+	fmt.Fprintf(&sb, "Received: from %s", helo)
+
+	if ip := addrIP(c.RemoteAddr()); ip != nil {
+		fmt.Fprintf(&sb, " ([%s])", ip)
+	}
+
+	protocol := "ESMTP"
+	if cfg.LMTP {
+		protocol = "LMTP"
+	}
+	info := c.TLSInfo()
+	if info != nil {
+		protocol += "S"
+	}
+	if c.session.authenticated() {
+		protocol += "A"
+	}
+
+	fmt.Fprintf(&sb, "\r\n\tby %s with %s id %s", cfg.BannerDomain, protocol, c.TransactionID())
+
+	if info != nil {
+		fmt.Fprintf(&sb, "\r\n\t(version=%s cipher=%s)", info.Version, info.CipherSuite)
+	}
+
+	if c.session.authenticated() {
+		fmt.Fprintf(&sb, "\r\n\t(authenticated as %s)", *c.session.username)
+	}
+
+	if rcpts := c.Recipients(); len(rcpts) == 1 {
+		fmt.Fprintf(&sb, "\r\n\tfor <%s>", rcpts[0].Address)
+	}
+
+	fmt.Fprintf(&sb, ";\r\n\t%s\r\n", time.Now().Format(time.RFC1123Z))
+
+	return sb.String()
+}
+
+// ReceivedHop is a parsed Received header, the hop of the message from the
+// From host to the By host
+type ReceivedHop struct {
+	// From is the HELO name of the client, FromHost and FromIP its name and
+	// address as seen by the server, from the comment following From
+	From     string
+	FromHost string
+	FromIP   net.IP
+
+	By   string
+	Via  string
+	With string
+	ID   string
+	For  string
+
+	// Date is the time the message was received, zero when unparsable.
+	// Delay is the time spent since the previous hop, zero when unknown.
+	Date  time.Time
+	Delay time.Duration
+
+	Raw string
+}
+
+// ParseReceived parses the value of a Received header (RFC 5321 section
+// 4.4), the unknown clauses are ignored
+func ParseReceived(value string) ReceivedHop {
+	hop := ReceivedHop{Raw: value}
+
+	clauses := value
+	if ind := strings.LastIndex(value, ";"); ind != -1 {
+		clauses = value[:ind]
+		if date, err := ParseDate(value[ind+1:]); err == nil {
+			hop.Date = date
+		}
+	}
+
+	var keyword string
+	for _, token := range receivedTokens(clauses) {
+		if strings.HasPrefix(token, "(") {
+			if keyword == "from" && hop.FromIP == nil {
+				hop.FromHost, hop.FromIP = parseReceivedComment(token)
+			}
+			continue
+		}
+
+		switch lower := strings.ToLower(token); lower {
+		case "from", "by", "via", "with", "id", "for":
+			keyword = lower
+			continue
+		}
+
+		switch keyword {
+		case "from":
+			if hop.From == "" {
+				hop.From = token
+			}
+		case "by":
+			if hop.By == "" {
+				hop.By = token
+			}
+		case "via":
+			if hop.Via == "" {
+				hop.Via = token
+			}
+		case "with":
+			if hop.With == "" {
+				hop.With = token
+			}
+		case "id":
+			if hop.ID == "" {
+				hop.ID = token
+			}
+		case "for":
+			if hop.For == "" {
+				hop.For = strings.Trim(token, "<>")
+			}
+		}
+	}
+
+	if hop.FromIP == nil {
+		// an address literal HELO
+		hop.FromIP = parseAddressLiteral(hop.From)
+	}
+
+	return hop
+}
+
+// parseReceivedChain parses the Received headers, the most recent hop first
+// as they are prepended
+func parseReceivedChain(values []string) []ReceivedHop {
+	if len(values) == 0 {
+		return nil
+	}
+
+	chain := make([]ReceivedHop, len(values))
+	for i, value := range values {
+		chain[i] = ParseReceived(value)
+	}
+
+	for i := 0; i+1 < len(chain); i++ {
+		if !chain[i].Date.IsZero() && !chain[i+1].Date.IsZero() {
+			chain[i].Delay = chain[i].Date.Sub(chain[i+1].Date)
+		}
+	}
+
+	return chain
+}
+
+// receivedTokens splits the clauses into words, comments and angle
+// addresses
+func receivedTokens(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(':
+			depth, j := 0, i
+			for ; j < len(s); j++ {
+				if s[j] == '\\' {
+					j++
+				} else if s[j] == '(' {
+					depth++
+				} else if s[j] == ')' {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			if j >= len(s) {
+				j = len(s) - 1
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		case c == '<':
+			j := strings.IndexByte(s[i:], '>')
+			if j == -1 {
+				j = len(s) - i - 1
+			}
+			tokens = append(tokens, s[i:i+j+1])
+			i += j + 1
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\r\n(", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+
+	return tokens
+}
+
+// parseReceivedComment reads the name and address of the client from the
+// TCP-info comment, e.g. "(mail.example.com [192.0.2.1])" or Exim
+// "([192.0.2.1] helo=example.com)"
+func parseReceivedComment(comment string) (host string, ip net.IP) {
+	for _, word := range strings.Fields(strings.Trim(comment, "()")) {
+		if addr := parseAddressLiteral(word); addr != nil {
+			if ip == nil {
+				ip = addr
+			}
+			continue
+		}
+
+		if host == "" && !strings.Contains(word, "=") && word != "unknown" {
+			host = strings.Trim(word, ",;")
+		}
+	}
+
+	return
+}
+
+// parseAddressLiteral parses "[192.0.2.1]", "[IPv6:2001:db8::1]" and bare
+// addresses
+func parseAddressLiteral(s string) net.IP {
+	s = strings.Trim(s, ",;")
+
+	// the source port of some servers, e.g. "[192.0.2.1]:25"
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if len(s) > 5 && strings.EqualFold(s[:5], "ipv6:") {
+		s = s[5:]
+	}
+
+	return net.ParseIP(s)
+}
@@ -0,0 +1,425 @@
+package smtpsrv
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	errRelayNullMX = &smtp.SMTPError{
+		Code:         556,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 10},
+		Message:      "Recipient domain does not accept mail",
+	}
+	errRelayNoTLS = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 4},
+		Message:      "Destination does not support STARTTLS",
+	}
+	errRelayUnreachable = &Error{
+		Code:         451,
+		EnhancedCode: EnhancedCode{4, 4, 1},
+		Message:      "Unable to reach the destination mail server, try again later",
+	}
+)
+
+// RelayConfig holds the outbound delivery settings
+type RelayConfig struct {
+	// Hostname is sent in EHLO, defaults to os.Hostname
+	Hostname string
+
+	// TLSConfig is used for STARTTLS, its ServerName is set to each MX host
+	TLSConfig *tls.Config
+
+	// RequireTLS fails the delivery to MX hosts not offering STARTTLS instead
+	// of falling back to plain text
+	RequireTLS bool
+
+	// Port defaults to 25
+	Port string
+
+	// Timeout applies to dialing and to each command, defaults to 30 seconds
+	Timeout time.Duration
+
+	// LookupMX defaults to net.LookupMX
+	LookupMX func(domain string) ([]*net.MX, error)
+
+	// DKIMSigner, when set, signs the messages before their delivery
+	DKIMSigner *DKIMSigner
+
+	// SRS, when set, rewrites the envelope sender of the messages
+	SRS *SRS
+
+	// Queue, when set, retries the recipients the Handler failed to deliver
+	// to temporarily while it delivered to the others. They are otherwise
+	// bounced to the sender at once, like the permanent failures.
+	Queue *Queue
+}
+
+// Relay delivers messages to the MX hosts of their recipients domains
+type Relay struct {
+	config RelayConfig
+}
+
+func NewRelay(cfg RelayConfig) *Relay {
+	if cfg.Hostname == "" {
+		cfg.Hostname, _ = os.Hostname()
+	}
+
+	if cfg.Port == "" {
+		cfg.Port = "25"
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+
+	if cfg.LookupMX == nil {
+		cfg.LookupMX = net.LookupMX
+	}
+
+	return &Relay{
+		config: cfg,
+	}
+}
+
+// RelayError reports the recipients a message could not be delivered to
+type RelayError struct {
+	// Failed maps each undelivered recipient to the error of its domain
+	Failed map[string]error
+}
+
+func (e *RelayError) Error() string {
+	rcpts := make([]string, 0, len(e.Failed))
+	for rcpt := range e.Failed {
+		rcpts = append(rcpts, rcpt)
+	}
+	sort.Strings(rcpts)
+
+	msgs := make([]string, len(rcpts))
+	for i, rcpt := range rcpts {
+		msgs[i] = rcpt + ": " + e.Failed[rcpt].Error()
+	}
+
+	return "relay: " + strings.Join(msgs, "; ")
+}
+
+// Temporary reports whether every failure may succeed on a later attempt
+func (e *RelayError) Temporary() bool {
+	for _, err := range e.Failed {
+		if !relayTemporary(err) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Send delivers msg from the envelope sender to each recipient, grouped by
+// domain, trying the MX hosts of each domain in preference order. It returns
+// a *RelayError listing the recipients that were not delivered.
+func (r *Relay) Send(from string, to []string, msg []byte) error {
+	if r.config.DKIMSigner != nil {
+		signed, err := r.config.DKIMSigner.Sign(msg)
+		if err != nil {
+			return err
+		}
+		msg = signed
+	}
+
+	if r.config.SRS != nil {
+		rewritten, err := r.config.SRS.Forward(from)
+		if err != nil {
+			return err
+		}
+		from = rewritten
+	}
+
+	domains := map[string][]string{}
+	var order []string
+	for _, rcpt := range to {
+		domain := strings.ToLower(rcpt[strings.LastIndex(rcpt, "@")+1:])
+		if _, ok := domains[domain]; !ok {
+			order = append(order, domain)
+		}
+		domains[domain] = append(domains[domain], rcpt)
+	}
+
+	failed := map[string]error{}
+	for _, domain := range order {
+		rcpts := domains[domain]
+		if err := r.sendDomain(domain, from, rcpts, msg); err != nil {
+			for _, rcpt := range rcpts {
+				failed[rcpt] = err
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return &RelayError{Failed: failed}
+	}
+
+	return nil
+}
+
+// Handler returns a handler forwarding each accepted message to its
+// recipients, the remote reply is relayed to the client when nothing could
+// be delivered. A partially delivered message is accepted, its undelivered
+// recipients are handed over to RelayConfig.Queue or bounced. In LMTP mode
+// only the current recipient is delivered per call.
+//
+// The handler delivers to any recipient: a server using it without
+// RequireAuth (or Submission) or a policy restricting the senders and
+// recipients is an open relay.
+func (r *Relay) Handler() HandlerFunc {
+	return func(c *Context) error {
+		raw, err := c.Raw()
+		if err != nil {
+			return err
+		}
+
+		to := c.deliveryRecipients()
+		err = r.Send(c.From().Address, to, raw)
+
+		var relayErr *RelayError
+		if !errors.As(err, &relayErr) {
+			return err
+		}
+
+		if len(relayErr.Failed) < len(to) {
+			// partially delivered messages are accepted, replying an error
+			// would make the client deliver them again
+			if err := r.undelivered(c.From().Address, to, raw, relayErr.Failed); err != nil {
+				c.session.log("relay", "err", err)
+			}
+			return nil
+		}
+
+		return relayReply(relayErr.Failed[to[0]])
+	}
+}
+
+// undelivered queues the recipients of a partially delivered message which
+// failed temporarily, with a RelayConfig.Queue, and bounces the others
+func (r *Relay) undelivered(from string, to []string, msg []byte, failed map[string]error) error {
+	var retry []string
+	permanent := map[string]error{}
+	for _, rcpt := range to {
+		err, ok := failed[rcpt]
+		switch {
+		case !ok:
+		case r.config.Queue != nil && relayTemporary(err):
+			retry = append(retry, rcpt)
+		default:
+			permanent[rcpt] = err
+		}
+	}
+
+	if len(retry) > 0 {
+		if _, err := r.config.Queue.Enqueue(from, retry, msg); err != nil {
+			return err
+		}
+	}
+
+	if len(permanent) == 0 {
+		return nil
+	}
+
+	m := &QueuedMessage{From: from, To: to, Data: msg, Created: time.Now()}
+	if r.config.Queue != nil {
+		return r.config.Queue.bounce(m, permanent)
+	}
+
+	// bounces themselves are never bounced since they have a null sender
+	if from == "" {
+		return nil
+	}
+
+	bounce, err := BuildBounce(from, failureStatus(r.config.Hostname, m, permanent), msg, false)
+	if err != nil {
+		return err
+	}
+
+	return r.Send("", []string{from}, bounce)
+}
+
+// sendDomain delivers to the first MX host of the domain accepting the message
+func (r *Relay) sendDomain(domain, from string, to []string, msg []byte) error {
+	hosts, err := r.lookupHosts(domain)
+	if err != nil {
+		return err
+	}
+
+	for _, host := range hosts {
+		err = r.sendHost(host, from, to, msg)
+		if err == nil || !relayTemporary(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// lookupHosts returns the MX hosts of the domain, falling back to the domain
+// itself when it has no MX records (RFC 5321 section 5.1)
+func (r *Relay) lookupHosts(domain string) ([]string, error) {
+	mxs, err := r.config.LookupMX(domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return []string{domain}, nil
+		}
+		return nil, err
+	}
+
+	if len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// null MX (RFC 7505)
+			return nil, errRelayNullMX
+		}
+		hosts = append(hosts, host)
+	}
+
+	return hosts, nil
+}
+
+func (r *Relay) sendHost(host, from string, to []string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, r.config.Port), r.config.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// go-smtp clients do not expose STARTTLS after a custom EHLO, net/smtp does
+	step := func() {
+		conn.SetDeadline(time.Now().Add(r.config.Timeout))
+	}
+
+	step()
+	c, err := netsmtp.NewClient(conn, host)
+	if err != nil {
+		return relayError(err)
+	}
+	defer c.Close()
+
+	step()
+	if err := c.Hello(r.config.Hostname); err != nil {
+		return relayError(err)
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		tlsConfig := &tls.Config{}
+		if r.config.TLSConfig != nil {
+			tlsConfig = r.config.TLSConfig.Clone()
+		}
+		tlsConfig.ServerName = host
+
+		step()
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return relayError(err)
+		}
+	} else if r.config.RequireTLS {
+		return errRelayNoTLS
+	}
+
+	step()
+	if err := c.Mail(from); err != nil {
+		return relayError(err)
+	}
+
+	for _, rcpt := range to {
+		step()
+		if err := c.Rcpt(rcpt); err != nil {
+			return relayError(err)
+		}
+	}
+
+	step()
+	w, err := c.Data()
+	if err != nil {
+		return relayError(err)
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return relayError(err)
+	}
+
+	if err := w.Close(); err != nil {
+		return relayError(err)
+	}
+
+	// the message is delivered at this point, a failing QUIT does not matter
+	step()
+	c.Quit()
+	return nil
+}
+
+// relayError converts the remote replies to *smtp.SMTPError, splitting their
+// enhanced status code
+func relayError(err error) error {
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) {
+		return err
+	}
+
+	smtpErr := &smtp.SMTPError{
+		Code:    protoErr.Code,
+		Message: protoErr.Msg,
+	}
+
+	parts := strings.SplitN(protoErr.Msg, " ", 2)
+	if len(parts) == 2 {
+		var code smtp.EnhancedCode
+		if n, _ := fmt.Sscanf(parts[0], "%d.%d.%d", &code[0], &code[1], &code[2]); n == 3 && code[0] == protoErr.Code/100 {
+			smtpErr.EnhancedCode = code
+			smtpErr.Message = parts[1]
+		}
+	}
+
+	return smtpErr
+}
+
+// relayTemporary reports whether a delivery error is worth retrying, only
+// permanent SMTP replies are not
+func relayTemporary(err error) bool {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code/100 != 5
+	}
+
+	return true
+}
+
+// relayReply converts a delivery error to the reply sent to the client
+func relayReply(err error) error {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return &Error{
+			Code:         smtpErr.Code,
+			EnhancedCode: smtpErr.EnhancedCode,
+			Message:      fmt.Sprintf("Relay: %s", smtpErr.Message),
+		}
+	}
+
+	return errRelayUnreachable
+}
@@ -0,0 +1,312 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errStoredAttachment = errors.New("smtpsrv: stored attachments can not be rendered")
+
+// headers written from the Email fields, or by the MIME structure
+var renderedHeaders = map[string]bool{
+	"Date":                      true,
+	"From":                      true,
+	"Sender":                    true,
+	"Reply-To":                  true,
+	"To":                        true,
+	"Cc":                        true,
+	"Bcc":                       true,
+	"Subject":                   true,
+	"Message-Id":                true,
+	"In-Reply-To":               true,
+	"References":                true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+}
+
+// WriteTo renders the email as a MIME message: the header fields override
+// the matching entries of Header, the other entries are kept. Bodies are
+// written as UTF-8 quoted-printable, within multipart/alternative,
+// multipart/related and multipart/mixed parts as needed by the embedded
+// files and attachments. Bcc is never written. It implements io.WriterTo.
+func (e *Email) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+
+	if err := e.writeHeader(cw); err != nil {
+		return cw.n, err
+	}
+
+	if err := e.writeBody(cw); err != nil {
+		return cw.n, err
+	}
+
+	return cw.n, bw.Flush()
+}
+
+func (e *Email) writeHeader(w io.Writer) error {
+	h := &headerWriter{w: w}
+
+	if !e.Date.IsZero() {
+		h.write("Date", e.Date.Format(time.RFC1123Z))
+	}
+	h.addresses("From", e.From)
+	if e.Sender != nil {
+		h.addresses("Sender", []*mail.Address{e.Sender})
+	}
+	h.addresses("Reply-To", e.ReplyTo)
+	h.addresses("To", e.To)
+	h.addresses("Cc", e.Cc)
+	if e.Subject != "" {
+		h.write("Subject", mime.QEncoding.Encode("utf-8", e.Subject))
+	}
+	if e.MessageID != "" {
+		h.write("Message-ID", "<"+e.MessageID+">")
+	}
+	h.messageIDs("In-Reply-To", e.InReplyTo)
+	h.messageIDs("References", e.References)
+
+	keys := make([]string, 0, len(e.Header))
+	for key := range e.Header {
+		if !renderedHeaders[textproto.CanonicalMIMEHeaderKey(key)] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, value := range e.Header[key] {
+			h.write(key, mime.QEncoding.Encode("utf-8", value))
+		}
+	}
+
+	h.write("MIME-Version", "1.0")
+
+	return h.err
+}
+
+func (e *Email) writeBody(w io.Writer) error {
+	var top renderPart
+
+	if e.TextBody == "" && e.HTMLBody == "" && len(e.Attachments) == 0 && len(e.EmbeddedFiles) == 0 && e.Content != nil {
+		// a single part message which is neither text nor html
+		top = renderPart{header: textproto.MIMEHeader{}, reader: e.Content}
+		top.header.Set("Content-Type", e.ContentType)
+	} else if len(e.Attachments) > 0 {
+		top = renderPart{contentType: "multipart/mixed", children: []renderPart{e.relatedPart()}}
+		for _, a := range e.Attachments {
+			if a.Stored != nil {
+				return errStoredAttachment
+			}
+
+			header := textproto.MIMEHeader{}
+			header.Set("Content-Type", a.ContentType)
+			disposition := dispositionAttachment
+			if a.IsInline() {
+				disposition = dispositionInline
+			}
+			header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+			if a.ContentID != "" {
+				header.Set("Content-Id", "<"+a.ContentID+">")
+			}
+			top.children = append(top.children, renderPart{header: header, reader: a.Data})
+		}
+	} else {
+		top = e.relatedPart()
+	}
+
+	header, body, err := top.render()
+	if err != nil {
+		return err
+	}
+
+	if err := writeMIMEHeader(w, header); err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+	return err
+}
+
+// relatedPart returns the bodies, along with their embedded files
+func (e *Email) relatedPart() renderPart {
+	var bodies []renderPart
+	if e.TextBody != "" || e.HTMLBody == "" {
+		bodies = append(bodies, textPart("text/plain", e.TextBody))
+	}
+	if e.HTMLBody != "" {
+		bodies = append(bodies, textPart("text/html", e.HTMLBody))
+	}
+
+	body := bodies[0]
+	if len(bodies) > 1 {
+		body = renderPart{contentType: "multipart/alternative", children: bodies}
+	}
+
+	if len(e.EmbeddedFiles) == 0 {
+		return body
+	}
+
+	related := renderPart{contentType: "multipart/related", children: []renderPart{body}}
+	for _, f := range e.EmbeddedFiles {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", f.ContentType)
+		header.Set("Content-Id", "<"+f.CID+">")
+		header.Set("Content-Disposition", "inline")
+		related.children = append(related.children, renderPart{header: header, reader: f.Data})
+	}
+
+	return related
+}
+
+// renderPart is a leaf part with its header and content, or a multipart
+type renderPart struct {
+	header textproto.MIMEHeader
+	reader io.Reader
+	text   string
+
+	contentType string
+	children    []renderPart
+}
+
+func textPart(contentType, body string) renderPart {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	return renderPart{header: header, text: body}
+}
+
+// render returns the header of the part and its encoded body, text is
+// quoted-printable encoded and other content base64 encoded.
+func (p renderPart) render() (textproto.MIMEHeader, []byte, error) {
+	var body bytes.Buffer
+
+	if p.children != nil {
+		mw := multipart.NewWriter(&body)
+		for _, child := range p.children {
+			header, data, err := child.render()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			pw, err := mw.CreatePart(header)
+			if err != nil {
+				return nil, nil, err
+			}
+			pw.Write(data)
+		}
+
+		if err := mw.Close(); err != nil {
+			return nil, nil, err
+		}
+
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", mime.FormatMediaType(p.contentType, map[string]string{"boundary": mw.Boundary()}))
+		return header, body.Bytes(), nil
+	}
+
+	if p.reader == nil {
+		p.header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+		qw := quotedprintable.NewWriter(&body)
+		// line breaks are written as CRLF
+		qw.Write([]byte(p.text))
+		qw.Close()
+
+		return p.header, body.Bytes(), nil
+	}
+
+	data, err := readRewind(p.reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.header.Set("Content-Transfer-Encoding", "base64")
+
+	// lines of at most 76 characters
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		body.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	body.WriteString(encoded)
+
+	return p.header, body.Bytes(), nil
+}
+
+func writeMIMEHeader(w io.Writer, header textproto.MIMEHeader) error {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, value := range header[key] {
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", key, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// headerWriter writes header fields, keeping the first error
+type headerWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (h *headerWriter) write(key, value string) {
+	if h.err != nil {
+		return
+	}
+
+	_, h.err = fmt.Fprintf(h.w, "%s: %s\r\n", key, value)
+}
+
+func (h *headerWriter) addresses(key string, addrs []*mail.Address) {
+	if len(addrs) == 0 {
+		return
+	}
+
+	values := make([]string, len(addrs))
+	for i, addr := range addrs {
+		values[i] = addr.String()
+	}
+
+	h.write(key, strings.Join(values, ",\r\n "))
+}
+
+func (h *headerWriter) messageIDs(key string, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+
+	h.write(key, "<"+strings.Join(ids, ">\r\n <")+">")
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
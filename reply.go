@@ -0,0 +1,193 @@
+package smtpsrv
+
+import (
+	"html"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	reReplySubject   = regexp.MustCompile(`(?i)^\s*re\s*:`)
+	reForwardSubject = regexp.MustCompile(`(?i)^\s*fwd?\s*:`)
+)
+
+// Reply returns a reply to the email, addressed to its Reply-To or From and
+// threaded to it through In-Reply-To and References. Its bodies quote the
+// original ones, the caller sets From and writes its text above the quote.
+func (e *Email) Reply() *Email {
+	reply := &Email{
+		Header:     mail.Header{},
+		Subject:    e.Subject,
+		To:         copyAddresses(e.ReplyTo),
+		Date:       time.Now(),
+		References: e.threadReferences(),
+	}
+
+	if !reReplySubject.MatchString(reply.Subject) {
+		reply.Subject = "Re: " + reply.Subject
+	}
+
+	if len(reply.To) == 0 {
+		reply.To = copyAddresses(e.From)
+	}
+
+	if e.MessageID != "" {
+		reply.InReplyTo = []string{e.MessageID}
+	}
+
+	attribution := "On " + e.Date.Format("Mon, 2 Jan 2006 at 15:04") + ", " + formatAddresses(e.From) + " wrote:"
+
+	if e.TextBody != "" || e.HTMLBody == "" {
+		reply.TextBody = "\n\n" + attribution + "\n" + quoteText(e.TextBody)
+	}
+
+	if e.HTMLBody != "" {
+		reply.HTMLBody = "<br><br><div>" + html.EscapeString(attribution) + "</div>" +
+			`<blockquote style="margin:0 0 0 .8ex;border-left:1px solid #ccc;padding-left:1ex">` + e.HTMLBody + "</blockquote>"
+		// the quoted html may refer to them
+		reply.EmbeddedFiles = copyEmbeddedFiles(e.EmbeddedFiles)
+	}
+
+	return reply
+}
+
+// Forward returns a forward of the email carrying its attachments, its
+// bodies hold the original ones under a summary of the original header. The
+// caller sets From and To.
+func (e *Email) Forward() *Email {
+	fwd := &Email{
+		Header:        mail.Header{},
+		Subject:       e.Subject,
+		Date:          time.Now(),
+		References:    e.threadReferences(),
+		Attachments:   copyAttachments(e.Attachments),
+		EmbeddedFiles: copyEmbeddedFiles(e.EmbeddedFiles),
+	}
+
+	if !reForwardSubject.MatchString(fwd.Subject) {
+		fwd.Subject = "Fwd: " + fwd.Subject
+	}
+
+	summary := [][2]string{
+		{"From", formatAddresses(e.From)},
+		{"Date", e.Date.Format(time.RFC1123Z)},
+		{"Subject", e.Subject},
+		{"To", formatAddresses(e.To)},
+	}
+	if len(e.Cc) > 0 {
+		summary = append(summary, [2]string{"Cc", formatAddresses(e.Cc)})
+	}
+
+	const separator = "---------- Forwarded message ---------"
+
+	if e.TextBody != "" || e.HTMLBody == "" {
+		var text strings.Builder
+		text.WriteString("\n\n" + separator + "\n")
+		for _, field := range summary {
+			text.WriteString(field[0] + ": " + field[1] + "\n")
+		}
+		text.WriteString("\n" + e.TextBody)
+		fwd.TextBody = text.String()
+	}
+
+	if e.HTMLBody != "" {
+		var body strings.Builder
+		body.WriteString("<br><br><div>" + separator + "<br>")
+		for _, field := range summary {
+			body.WriteString(field[0] + ": " + html.EscapeString(field[1]) + "<br>")
+		}
+		body.WriteString("</div><br>" + e.HTMLBody)
+		fwd.HTMLBody = body.String()
+	}
+
+	return fwd
+}
+
+// threadReferences returns the References of a message following this one,
+// RFC 5322 section 3.6.4
+func (e *Email) threadReferences() []string {
+	refs := append([]string(nil), e.References...)
+	if len(refs) == 0 && len(e.InReplyTo) == 1 {
+		refs = append(refs, e.InReplyTo[0])
+	}
+
+	if e.MessageID != "" {
+		refs = append(refs, e.MessageID)
+	}
+
+	return refs
+}
+
+func quoteText(text string) string {
+	lines := strings.Split(strings.TrimRight(strings.Replace(text, "\r\n", "\n", -1), "\n"), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ">") {
+			lines[i] = ">" + line
+		} else {
+			lines[i] = "> " + line
+		}
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func formatAddresses(addrs []*mail.Address) string {
+	values := make([]string, len(addrs))
+	for i, addr := range addrs {
+		if addr.Name == "" {
+			values[i] = "<" + addr.Address + ">"
+		} else {
+			values[i] = addr.Name + " <" + addr.Address + ">"
+		}
+	}
+
+	return strings.Join(values, ", ")
+}
+
+func copyAddresses(addrs []*mail.Address) []*mail.Address {
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	copied := make([]*mail.Address, len(addrs))
+	for i, addr := range addrs {
+		a := *addr
+		copied[i] = &a
+	}
+
+	return copied
+}
+
+// copyAttachments copies the attachments with readers of their own, the
+// original readers are rewound when possible
+func copyAttachments(attachments []Attachment) []Attachment {
+	var copied []Attachment
+	for _, a := range attachments {
+		data, err := readRewind(a.Data)
+		if err != nil {
+			continue
+		}
+
+		a.Data = bytesReader(data)
+		copied = append(copied, a)
+	}
+
+	return copied
+}
+
+func copyEmbeddedFiles(files []EmbeddedFile) []EmbeddedFile {
+	var copied []EmbeddedFile
+	for _, f := range files {
+		data, err := readRewind(f.Data)
+		if err != nil {
+			continue
+		}
+
+		f.Data = bytesReader(data)
+		copied = append(copied, f)
+	}
+
+	return copied
+}
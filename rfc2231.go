@@ -0,0 +1,204 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// attachmentFilename returns the UTF-8 filename of a part, from the filename
+// parameter of Content-Disposition or else the name parameter of
+// Content-Type, decoding RFC 2231 continuations and charsets as well as RFC
+// 2047 encoded words.
+func attachmentFilename(header textproto.MIMEHeader) string {
+	if filename := decodeHeaderParam(header.Get("Content-Disposition"), "filename"); filename != "" {
+		return filename
+	}
+
+	return decodeHeaderParam(header.Get("Content-Type"), "name")
+}
+
+// decodeHeaderParam returns the decoded value of the parameter key of a
+// header value, joining the RFC 2231 continuations (filename*0*, filename*1)
+// and decoding their charset'language'value encoding. Unlike
+// mime.ParseMediaType, it accepts every charset known to convertToUtf8 and
+// malformed parameters elsewhere in the value.
+func decodeHeaderParam(value, key string) string {
+	key = strings.ToLower(key)
+
+	type segment struct {
+		index   int
+		encoded bool
+		value   string
+	}
+
+	var plain, extended *string
+	var segments []segment
+
+	for _, param := range splitHeaderParams(value) {
+		attr, val := param[0], param[1]
+
+		switch {
+		case attr == key:
+			v := val
+			plain = &v
+		case attr == key+"*":
+			v := val
+			extended = &v
+		case strings.HasPrefix(attr, key+"*"):
+			index := strings.TrimPrefix(attr, key+"*")
+			encoded := strings.HasSuffix(index, "*")
+			n, err := strconv.Atoi(strings.TrimSuffix(index, "*"))
+			if err != nil {
+				continue
+			}
+			segments = append(segments, segment{index: n, encoded: encoded, value: val})
+		}
+	}
+
+	if extended != nil {
+		charset, data := splitRFC2231Value(*extended)
+		return convertParamCharset(percentDecode(data), charset)
+	}
+
+	if len(segments) > 0 {
+		sort.Slice(segments, func(i, j int) bool {
+			return segments[i].index < segments[j].index
+		})
+
+		// only the first segment declares the charset
+		var charset string
+		var data []byte
+		for i, seg := range segments {
+			if !seg.encoded {
+				data = append(data, seg.value...)
+				continue
+			}
+
+			val := seg.value
+			if i == 0 {
+				charset, val = splitRFC2231Value(val)
+			}
+			data = append(data, percentDecode(val)...)
+		}
+
+		return convertParamCharset(data, charset)
+	}
+
+	if plain != nil {
+		return decodeMimeSentence(*plain)
+	}
+
+	return ""
+}
+
+// splitHeaderParams returns the lowercased attributes and the unquoted
+// values of the parameters following the first ";" of the header value
+func splitHeaderParams(value string) [][2]string {
+	var params [][2]string
+
+	ind := strings.Index(value, ";")
+	if ind == -1 {
+		return nil
+	}
+	value = value[ind+1:]
+
+	for value != "" {
+		// attribute
+		eq := strings.IndexAny(value, "=;")
+		if eq == -1 {
+			break
+		}
+		attr := strings.ToLower(strings.TrimSpace(value[:eq]))
+		if value[eq] == ';' {
+			value = value[eq+1:]
+			continue
+		}
+		value = strings.TrimLeft(value[eq+1:], " \t\r\n")
+
+		// value, quoted or up to the next ";"
+		var val strings.Builder
+		if strings.HasPrefix(value, `"`) {
+			i := 1
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				val.WriteByte(value[i])
+			}
+			value = value[i:]
+			if end := strings.Index(value, ";"); end != -1 {
+				value = value[end+1:]
+			} else {
+				value = ""
+			}
+		} else {
+			end := strings.Index(value, ";")
+			if end == -1 {
+				val.WriteString(strings.TrimSpace(value))
+				value = ""
+			} else {
+				val.WriteString(strings.TrimSpace(value[:end]))
+				value = value[end+1:]
+			}
+		}
+
+		if attr != "" {
+			params = append(params, [2]string{attr, val.String()})
+		}
+	}
+
+	return params
+}
+
+// splitRFC2231Value splits charset'language'data
+func splitRFC2231Value(value string) (charset, data string) {
+	parts := strings.SplitN(value, "'", 3)
+	if len(parts) != 3 {
+		return "", value
+	}
+
+	return parts[0], parts[2]
+}
+
+func percentDecode(s string) []byte {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(n))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+
+	return b
+}
+
+// convertParamCharset converts the decoded parameter to UTF-8, keeping the
+// bytes as they are when the charset is unknown and they are valid UTF-8
+func convertParamCharset(data []byte, charset string) string {
+	cs := strings.ToLower(charset)
+	if cs == "" || cs == "utf-8" || cs == "utf8" || cs == "us-ascii" {
+		return string(data)
+	}
+
+	r, err := convertToUtf8(bytes.NewReader(data), charset)
+	if err == nil {
+		if converted, err := ioutil.ReadAll(r); err == nil {
+			return string(converted)
+		}
+	}
+
+	if utf8.Valid(data) {
+		return string(data)
+	}
+
+	return strings.ToValidUTF8(string(data), "�")
+}
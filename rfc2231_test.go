@@ -0,0 +1,50 @@
+package smtpsrv
+
+import (
+	"net/textproto"
+	"testing"
+)
+
+func TestDecodeHeaderParam(t *testing.T) {
+	for _, c := range []struct {
+		name, value, want string
+	}{
+		{"plain", `attachment; filename="report.pdf"`, "report.pdf"},
+		{"token", `attachment; filename=report.pdf; size=42`, "report.pdf"},
+		{"quoted pair", `attachment; filename="a \"b\"; c.txt"`, `a "b"; c.txt`},
+		{"encoded word", `attachment; filename="=?UTF-8?B?w6l0w6kucGRm?="`, "été.pdf"},
+		{"extended", `attachment; filename*=UTF-8''%E2%82%AC%20rates.pdf`, "€ rates.pdf"},
+		{"extended language", `attachment; filename*=iso-8859-1'fr'r%E9sum%E9.txt`, "résumé.txt"},
+		{"extended charset", `attachment; filename*=windows-1251''%CF%F0%E8%E2%E5%F2.txt`, "Привет.txt"},
+		{"extended first", `attachment; filename="fallback.txt"; filename*=UTF-8''real.txt`, "real.txt"},
+		{"continuations", `attachment; filename*0="a very long "; filename*1="name.txt"`, "a very long name.txt"},
+		{"encoded continuations", `attachment; filename*1*=%E9.txt; filename*0*=iso-8859-1''r%E9sum`, "résumé.txt"},
+		{"mixed continuations", `attachment; filename*0*=utf-8''%C3%A9t%C3%A9; filename*1=" report.pdf"`, "été report.pdf"},
+		{"unknown charset", `attachment; filename*=x-unknown''%C3%A9.txt`, "é.txt"},
+		{"unknown charset invalid", `attachment; filename*=x-unknown''%E9.txt`, "�.txt"},
+		{"malformed parameters", `attachment; garbage; size=; filename=ok.txt`, "ok.txt"},
+		{"case", `attachment; FileName="upper.txt"`, "upper.txt"},
+		{"missing", `attachment; name="other.txt"`, ""},
+		{"no parameters", `attachment`, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := decodeHeaderParam(c.value, "filename"); got != c.want {
+				t.Errorf("decodeHeaderParam(%q) = %q, want %q", c.value, got, c.want)
+			}
+		})
+	}
+}
+
+func TestAttachmentFilename(t *testing.T) {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", `application/pdf; name*=UTF-8''%C3%A9t%C3%A9.pdf`)
+
+	if got := attachmentFilename(header); got != "été.pdf" {
+		t.Errorf("name = %q, want été.pdf", got)
+	}
+
+	header.Set("Content-Disposition", `attachment; filename="summer.pdf"`)
+	if got := attachmentFilename(header); got != "summer.pdf" {
+		t.Errorf("filename = %q, want summer.pdf", got)
+	}
+}
@@ -0,0 +1,268 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+	"sync"
+)
+
+// Router dispatches messages to handlers by recipient, patterns are either a
+// domain ("example.com", "*.example.com", "*") matching every mailbox of it,
+// or an address whose local part and domain may be wildcards ("support@*").
+type Router struct {
+	mu       sync.RWMutex
+	routes   []route
+	notFound HandlerFunc
+	failed   func(c *Context, err error)
+}
+
+type route struct {
+	local   string
+	domain  string
+	handler HandlerFunc
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle registers the handler for the pattern, when several patterns match a
+// recipient the most specific one wins.
+func (r *Router) Handle(pattern string, handler HandlerFunc) {
+	local, domain := "*", pattern
+	if ind := strings.LastIndex(pattern, "@"); ind != -1 {
+		local, domain = pattern[:ind], pattern[ind+1:]
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.routes = append(r.routes, route{
+		local:   strings.ToLower(local),
+		domain:  strings.ToLower(domain),
+		handler: handler,
+	})
+}
+
+// NotFound sets the handler for the recipients matching no pattern, by default
+// they are rejected with 550.
+func (r *Router) NotFound(handler HandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.notFound = handler
+}
+
+// Failed sets the function invoked for each route failing to handle a
+// message which another route accepted, see Handler, with Context.Recipients
+// and To narrowed to the recipients of the route, e.g. to queue or bounce the
+// message for them. The failures are otherwise only logged.
+func (r *Router) Failed(fn func(c *Context, err error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failed = fn
+}
+
+// Match returns the handler registered for the address, or nil. Sub-addresses
+// also match the routes of their canonical mailbox, and a domain pattern acts as
+// a catch-all for that domain. Match splits the sub-addresses at
+// DefaultSubaddressSeparator, Handler and RcptValidator at the
+// ServerConfig.SubaddressSeparator of the session.
+func (r *Router) Match(address string) HandlerFunc {
+	return r.matchHandler(address, DefaultSubaddressSeparator)
+}
+
+func (r *Router) matchHandler(address, separator string) HandlerFunc {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if i := r.route(address, separator); i >= 0 {
+		return r.routes[i].handler
+	}
+
+	return nil
+}
+
+// route returns the index of the route of the address, or -1
+func (r *Router) route(address, separator string) int {
+	address = strings.ToLower(address)
+
+	best, bestScore := r.match(address)
+	if mailbox, tag := SplitSubaddress(address, separator); tag != "" {
+		if i, score := r.match(mailbox); score > bestScore {
+			best = i
+		}
+	}
+
+	return best
+}
+
+func (r *Router) match(address string) (int, int) {
+	local, domain, err := SplitAddress(address)
+	if err != nil {
+		return -1, -1
+	}
+
+	best, bestScore := -1, -1
+	for i, rt := range r.routes {
+		localScore := matchPattern(rt.local, local)
+		domainScore := matchPattern(rt.domain, domain)
+		if localScore < 0 || domainScore < 0 {
+			continue
+		}
+
+		// an exact local part outweighs any domain pattern
+		if score := localScore*3 + domainScore; score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	return best, bestScore
+}
+
+// matchPattern returns -1 when s doesn't match, otherwise the specificity of
+// the pattern: 2 for an exact match, 1 for a "*.suffix" match, 0 for "*".
+func matchPattern(pattern, s string) int {
+	switch {
+	case pattern == "*":
+		return 0
+	case strings.HasPrefix(pattern, "*."):
+		if strings.HasSuffix(s, pattern[1:]) {
+			return 1
+		}
+	case pattern == s:
+		return 2
+	}
+
+	return -1
+}
+
+// Handler is a HandlerFunc dispatching the message to the handlers of its
+// recipients. When the recipients match several routes, the message is
+// buffered and each handler is invoked in turn, in the order of its first
+// recipient, with Context.Recipients and To narrowed to its recipients. The
+// message is accepted once a handler accepted it, as the client would
+// deliver it again to every route otherwise: the failures of the other
+// routes are then reported to the Failed function. The error of the first
+// handler is replied when they all failed. LMTP invokes the handler once per
+// recipient, which always has a single route.
+func (r *Router) Handler(c *Context) error {
+	rcpts := c.Recipients()
+	if c.session.config.LMTP {
+		rcpts = []*mail.Address{c.To()}
+	}
+
+	// the handlers, and the indexes of their recipients
+	var handlers []HandlerFunc
+	var groups [][]int
+	routeGroups := map[int]int{}
+
+	r.mu.RLock()
+	for i, rcpt := range rcpts {
+		route := -1
+		if rcpt != nil {
+			route = r.route(rcpt.Address, c.session.config.SubaddressSeparator)
+		}
+
+		group, ok := routeGroups[route]
+		if !ok {
+			handler := r.notFound
+			if route >= 0 {
+				handler = r.routes[route].handler
+			}
+
+			group = len(groups)
+			routeGroups[route] = group
+			handlers, groups = append(handlers, handler), append(groups, nil)
+		}
+		groups[group] = append(groups[group], i)
+	}
+	if len(handlers) == 0 {
+		handlers = []HandlerFunc{r.notFound}
+	}
+	failed := r.failed
+	r.mu.RUnlock()
+
+	// the recipients without a route reject the message, see RcptValidator
+	for _, handler := range handlers {
+		if handler == nil {
+			return ErrMailboxUnavailable
+		}
+	}
+
+	if len(handlers) == 1 {
+		return handlers[0](c)
+	}
+
+	raw, err := c.Raw()
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(handlers))
+	accepted := false
+	for i, handler := range handlers {
+		restore := c.session.narrowRecipients(groups[i])
+		c.session.body = bytes.NewReader(raw)
+		errs[i] = handler(c)
+		restore()
+		accepted = accepted || errs[i] == nil
+	}
+
+	if !accepted {
+		return errs[0]
+	}
+
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+
+		restore := c.session.narrowRecipients(groups[i])
+		c.session.log("route failed", "to", c.session.rcptTo, "err", err)
+		if failed != nil {
+			c.session.body = bytes.NewReader(raw)
+			failed(c, err)
+		}
+		restore()
+	}
+
+	return nil
+}
+
+// narrowRecipients restricts the recipients of the transaction to those of
+// the indexes, until restore is called
+func (s *Session) narrowRecipients(indexes []int) (restore func()) {
+	to, rcpts, rcptTo, rcptOpts := s.To, s.rcpts, s.rcptTo, s.rcptOpts
+
+	s.rcpts, s.rcptTo, s.rcptOpts = nil, nil, nil
+	for _, i := range indexes {
+		s.rcpts = append(s.rcpts, rcpts[i])
+		s.rcptTo = append(s.rcptTo, rcptTo[i])
+		s.rcptOpts = append(s.rcptOpts, rcptOpts[i])
+	}
+	s.To = s.rcpts[len(s.rcpts)-1]
+
+	return func() {
+		s.To, s.rcpts, s.rcptTo, s.rcptOpts = to, rcpts, rcptTo, rcptOpts
+	}
+}
+
+// RcptValidator is a RcptValidatorFunc rejecting the recipients without a
+// route during RCPT TO, unless a NotFound handler is set.
+func (r *Router) RcptValidator(c *Context, to *mail.Address) error {
+	if r.matchHandler(to.Address, c.session.config.SubaddressSeparator) != nil {
+		return nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.notFound != nil {
+		return nil
+	}
+
+	return ErrMailboxUnavailable
+}
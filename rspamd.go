@@ -0,0 +1,249 @@
+package smtpsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// the Context value holding the RspamdResult of the message
+const rspamdKey = "smtpsrv.rspamd"
+
+var (
+	errRspamdRejected = &Error{
+		Code:         554,
+		EnhancedCode: EnhancedCode{5, 7, 1},
+		Message:      "Message rejected as spam",
+	}
+	errRspamdGreylisted = &Error{
+		Code:         451,
+		EnhancedCode: EnhancedCode{4, 7, 1},
+		Message:      "Greylisted, try again later",
+	}
+)
+
+// The actions of the rspamd verdicts
+const (
+	RspamdNoAction       = "no action"
+	RspamdGreylist       = "greylist"
+	RspamdAddHeader      = "add header"
+	RspamdRewriteSubject = "rewrite subject"
+	RspamdSoftReject     = "soft reject"
+	RspamdReject         = "reject"
+)
+
+// RspamdConfig holds the rspamd settings
+type RspamdConfig struct {
+	// URL of the rspamd normal worker, defaults to http://localhost:11333
+	URL string
+
+	// Password of the controller, if the worker requires one
+	Password string
+
+	// Timeout of a check, defaults to 30 seconds
+	Timeout time.Duration
+
+	// HeaderOnly only adds the X-Spam headers, the messages rejected or
+	// greylisted by rspamd are accepted, e.g. while training it
+	HeaderOnly bool
+
+	// AcceptOnError accepts the messages rspamd could not check, they are
+	// replied as a temporary failure otherwise
+	AcceptOnError bool
+
+	// Client defaults to a client using Timeout
+	Client *http.Client
+}
+
+// RspamdSymbol is a rule matched by the message
+type RspamdSymbol struct {
+	Name        string   `json:"name"`
+	Score       float64  `json:"score"`
+	Description string   `json:"description,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// RspamdResult is the verdict of rspamd on a message
+type RspamdResult struct {
+	Action        string                  `json:"action"`
+	Score         float64                 `json:"score"`
+	RequiredScore float64                 `json:"required_score"`
+	Symbols       map[string]RspamdSymbol `json:"symbols"`
+	MessageID     string                  `json:"message-id"`
+
+	// Messages holds the replies suggested by rspamd, e.g. "smtp_message"
+	Messages map[string]string `json:"messages"`
+}
+
+// Spam reports whether rspamd asked for the message to be marked or rejected
+func (r *RspamdResult) Spam() bool {
+	switch r.Action {
+	case RspamdAddHeader, RspamdRewriteSubject, RspamdSoftReject, RspamdReject:
+		return true
+	}
+
+	return false
+}
+
+// SymbolNames returns the names of the matched rules, sorted
+func (r *RspamdResult) SymbolNames() []string {
+	names := make([]string, 0, len(r.Symbols))
+	for name := range r.Symbols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Rspamd checks the messages with rspamd's HTTP protocol
+type Rspamd struct {
+	config RspamdConfig
+}
+
+func NewRspamd(cfg RspamdConfig) *Rspamd {
+	if cfg.URL == "" {
+		cfg.URL = "http://localhost:11333"
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: cfg.Timeout}
+	}
+
+	return &Rspamd{
+		config: cfg,
+	}
+}
+
+// Policy returns a DataPolicy submitting every message to rspamd. The result
+// is available to the handler with Context.Rspamd, and the message is given
+// the X-Spam-Score, X-Spam-Symbols and, once marked as spam, X-Spam headers.
+// The reject action is replied 554 5.7.1, the soft reject and greylist
+// actions 451 4.7.1.
+func (r *Rspamd) Policy() DataPolicyFunc {
+	return func(c *Context, body io.Reader) error {
+		result, err := r.Check(c, body)
+		c.Set(rspamdKey, result)
+		if err != nil {
+			if r.config.AcceptOnError {
+				return nil
+			}
+			return ErrTemporaryFailure
+		}
+
+		c.AddHeader("X-Spam-Score", fmt.Sprintf("%.2f / %.2f", result.Score, result.RequiredScore))
+		if len(result.Symbols) > 0 {
+			c.AddHeader("X-Spam-Symbols", foldList(result.SymbolNames(), len("X-Spam-Symbols: ")))
+		}
+		if result.Spam() {
+			c.AddHeader("X-Spam", "Yes")
+		}
+
+		if r.config.HeaderOnly {
+			return nil
+		}
+
+		switch result.Action {
+		case RspamdReject:
+			return rspamdError(errRspamdRejected, result)
+		case RspamdSoftReject, RspamdGreylist:
+			return rspamdError(errRspamdGreylisted, result)
+		}
+
+		return nil
+	}
+}
+
+// Check submits the message to rspamd with the envelope of the transaction,
+// and returns its verdict
+func (r *Rspamd) Check(c *Context, body io.Reader) (*RspamdResult, error) {
+	req, err := http.NewRequestWithContext(c.Context(), http.MethodPost, strings.TrimSuffix(r.config.URL, "/")+"/checkv2", body)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := addrIP(c.RemoteAddr()); ip != nil {
+		req.Header.Set("IP", ip.String())
+	}
+	req.Header.Set("Helo", c.Helo())
+	req.Header.Set("Queue-Id", c.TransactionID())
+	if from := c.From(); from != nil {
+		req.Header.Set("From", from.Address)
+	}
+	for _, rcpt := range c.Recipients() {
+		req.Header.Add("Rcpt", rcpt.Address)
+	}
+	if user, _, err := c.User(); err == nil && user != "" {
+		req.Header.Set("User", user)
+	}
+	if r.config.Password != "" {
+		req.Header.Set("Password", r.config.Password)
+	}
+
+	resp, err := r.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("smtpsrv: rspamd replied %s", resp.Status)
+	}
+
+	result := &RspamdResult{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Rspamd returns the verdict of rspamd on the message, nil when it was not
+// checked
+func (c Context) Rspamd() *RspamdResult {
+	result, _ := c.Get(rspamdKey).(*RspamdResult)
+	return result
+}
+
+// rspamdError replies the message suggested by rspamd, if any
+func rspamdError(err *Error, result *RspamdResult) error {
+	if msg := result.Messages["smtp_message"]; msg != "" {
+		return &Error{Code: err.Code, EnhancedCode: err.EnhancedCode, Message: msg}
+	}
+
+	return err
+}
+
+// foldList joins the values with commas, folding the lines at 78 characters
+// after a header name of the given length
+func foldList(values []string, offset int) string {
+	var sb strings.Builder
+	n := offset
+	for i, value := range values {
+		if i > 0 {
+			sb.WriteByte(',')
+			n++
+			if n+1+len(value) > 78 {
+				sb.WriteString("\r\n\t")
+				n = 1
+			} else {
+				sb.WriteByte(' ')
+				n++
+			}
+		}
+		sb.WriteString(value)
+		n += len(value)
+	}
+
+	return sb.String()
+}
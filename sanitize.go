@@ -0,0 +1,280 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	reCSSComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	reCSSEscape  = regexp.MustCompile(`\\([0-9a-fA-F]{1,6}\s?|.)`)
+	reCSSDanger  = regexp.MustCompile(`(?i)@import|expression\s*\(|(java|vb)script\s*:|behavior\s*:|-moz-binding\s*:|</`)
+	reCSSURL     = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|((?:[^()'"]|\([^()]*\))*?))\s*\)`)
+)
+
+// the elements removed with their content
+var sanitizeDropped = map[atom.Atom]bool{
+	atom.Script: true, atom.Iframe: true, atom.Frame: true, atom.Frameset: true,
+	atom.Object: true, atom.Embed: true, atom.Applet: true, atom.Base: true,
+	atom.Meta: true, atom.Link: true, atom.Template: true, atom.Svg: true,
+	atom.Math: true, atom.Noscript: true, atom.Title: true,
+}
+
+// the attributes holding URLs
+var sanitizeURLAttrs = map[string]bool{
+	"href": true, "src": true, "action": true, "formaction": true,
+	"background": true, "poster": true, "cite": true, "longdesc": true,
+	"xlink:href": true, "lowsrc": true, "dynsrc": true,
+}
+
+// SanitizerConfig holds the HTML sanitizer settings
+type SanitizerConfig struct {
+	// ImageProxy, when set, rewrites the remote images URLs: "{url}" is
+	// replaced by the query escaped URL, e.g.
+	// "https://proxy.example.com/image?url={url}"
+	ImageProxy string
+
+	// BlockRemoteImages removes the remote images instead
+	BlockRemoteImages bool
+}
+
+// Sanitizer makes HTML bodies safe to display in a browser: it removes the
+// scripts, frames, plugins, event handlers, javascript URLs, remote form
+// actions and dangerous CSS, see ParseOptions.Sanitizer
+type Sanitizer struct {
+	config SanitizerConfig
+}
+
+func NewSanitizer(cfg SanitizerConfig) *Sanitizer {
+	return &Sanitizer{
+		config: cfg,
+	}
+}
+
+// Sanitize returns the sanitized content of the body element, preceded by
+// the style elements of the head
+func (s *Sanitizer) Sanitize(body string) string {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	s.node(doc)
+
+	var buf bytes.Buffer
+	var render func(n *html.Node)
+	render = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch {
+			case c.DataAtom == atom.Head:
+				for h := c.FirstChild; h != nil; h = h.NextSibling {
+					if h.DataAtom == atom.Style {
+						html.Render(&buf, h)
+					}
+				}
+			case c.DataAtom == atom.Html || c.DataAtom == atom.Body:
+				render(c)
+			case c.Type == html.DoctypeNode:
+			default:
+				html.Render(&buf, c)
+			}
+		}
+	}
+	render(doc)
+
+	return buf.String()
+}
+
+func (s *Sanitizer) node(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+
+		switch {
+		case c.Type == html.CommentNode:
+			// conditional comments hold markup for some clients
+			n.RemoveChild(c)
+		case c.Type == html.ElementNode && (sanitizeDropped[c.DataAtom] || c.Namespace != ""):
+			n.RemoveChild(c)
+		case c.Type == html.ElementNode && c.DataAtom == atom.Img && s.config.BlockRemoteImages && isRemoteURL(htmlAttr(c, "src")):
+			n.RemoveChild(c)
+		case c.Type == html.ElementNode:
+			s.element(c)
+			s.node(c)
+		}
+
+		c = next
+	}
+}
+
+func (s *Sanitizer) element(n *html.Node) {
+	if n.DataAtom == atom.Style {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.TextNode {
+				c.Data = s.css(c.Data)
+			}
+		}
+	}
+
+	attrs := n.Attr[:0]
+	for _, attr := range n.Attr {
+		key := strings.ToLower(attr.Key)
+		switch {
+		case strings.HasPrefix(key, "on"), key == "srcset", key == "formaction":
+			continue
+		case key == "style":
+			attr.Val = s.css(attr.Val)
+		case key == "action":
+			// the forms can not post the data of the reader elsewhere
+			continue
+		case sanitizeURLAttrs[key]:
+			if !safeURL(attr.Val, n.DataAtom == atom.Img && key == "src") {
+				continue
+			}
+			if isRemoteURL(attr.Val) && (key == "src" || key == "background") {
+				if s.config.BlockRemoteImages {
+					continue
+				}
+				attr.Val = s.proxy(attr.Val)
+			}
+		}
+		attrs = append(attrs, attr)
+	}
+	n.Attr = attrs
+
+	if n.DataAtom == atom.A && htmlAttr(n, "href") != "" {
+		n.Attr = append(n.Attr, html.Attribute{Key: "rel", Val: "noopener noreferrer"}, html.Attribute{Key: "target", Val: "_blank"})
+	}
+}
+
+// css removes the declarations and rules holding imports, expressions,
+// bindings, javascript URLs or the end of the style element, and rewrites the
+// remote URLs as images. The escapes are decoded to detect them only, the
+// kept text is written as is.
+func (s *Sanitizer) css(css string) string {
+	var buf strings.Builder
+	for _, segment := range cssSegments(reCSSComment.ReplaceAllString(css, "")) {
+		decoded := cssUnescape(segment)
+		if reCSSDanger.MatchString(decoded) {
+			continue
+		}
+
+		// an escaped URL would not be rewritten
+		if strings.Contains(segment, `\`) && strings.Contains(strings.ToLower(decoded), "url(") {
+			continue
+		}
+
+		buf.WriteString(reCSSURL.ReplaceAllStringFunc(segment, s.cssURL))
+	}
+
+	// the style text never ends the style element
+	return strings.Replace(buf.String(), "</", `<\/`, -1)
+}
+
+// cssURL rewrites the url() of the style text
+func (s *Sanitizer) cssURL(u string) string {
+	m := reCSSURL.FindStringSubmatch(u)
+	target := cssUnescape(m[1] + m[2] + m[3])
+
+	switch {
+	case isRemoteURL(target) && s.config.BlockRemoteImages:
+		return "none"
+	case isRemoteURL(target):
+		return `url("` + cssQuote(s.proxy(target)) + `")`
+	case safeURL(target, true):
+		return `url("` + cssQuote(target) + `")`
+	}
+
+	return "none"
+}
+
+// cssSegments splits the style text into its declarations, selectors and
+// at-rules, and the delimiters between them, outside of the strings and
+// parentheses
+func cssSegments(css string) []string {
+	var segments []string
+	var quote byte
+	depth, start := 0, 0
+
+	for i := 0; i < len(css); i++ {
+		switch c := css[i]; {
+		case c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case depth == 0 && (c == ';' || c == '{' || c == '}'):
+			segments = append(segments, css[start:i], css[i:i+1])
+			start = i + 1
+		}
+	}
+
+	return append(segments, css[start:])
+}
+
+// cssUnescape decodes the escapes of the style text
+func cssUnescape(css string) string {
+	return reCSSEscape.ReplaceAllStringFunc(css, func(escape string) string {
+		code := strings.TrimSpace(escape[1:])
+		if n, err := strconv.ParseUint(code, 16, 32); err == nil {
+			return string(rune(n))
+		}
+		return escape[1:]
+	})
+}
+
+func (s *Sanitizer) proxy(u string) string {
+	if s.config.ImageProxy == "" {
+		return u
+	}
+
+	return strings.Replace(s.config.ImageProxy, "{url}", url.QueryEscape(strings.TrimSpace(u)), -1)
+}
+
+// safeURL accepts the relative URLs and the http, https, mailto, tel and
+// cid schemes, and the data images when image is set
+func safeURL(u string, image bool) bool {
+	u = strings.ToLower(strings.Map(func(r rune) rune {
+		// browsers ignore the control characters and whitespace of the
+		// scheme, e.g. "java\tscript:"
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, u))
+
+	ind := strings.IndexAny(u, ":/?#")
+	if ind == -1 || u[ind] != ':' {
+		return true
+	}
+
+	switch u[:ind] {
+	case "http", "https", "mailto", "tel", "cid":
+		return true
+	case "data":
+		return image && strings.HasPrefix(u, "data:image/") && !strings.HasPrefix(u, "data:image/svg")
+	}
+
+	return false
+}
+
+func isRemoteURL(u string) bool {
+	u = strings.ToLower(strings.TrimSpace(u))
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "//")
+}
+
+func cssQuote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "<", `\3c `, "\n", "", "\r", "").Replace(s)
+}
@@ -0,0 +1,103 @@
+package smtpsrv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizerEscapedStyleEnd(t *testing.T) {
+	s := NewSanitizer(SanitizerConfig{})
+
+	out := s.Sanitize(`<style>p{color:red}\3c /style\3e \3c img src=x onerror=alert(1)\3e</style><p>hi</p>`)
+	if strings.Contains(out, "<img") || strings.Contains(out, "onerror") {
+		t.Fatalf("the escaped end of the style element was decoded: %q", out)
+	}
+	if strings.Count(out, "</style>") != 1 {
+		t.Fatalf("the style element was ended early: %q", out)
+	}
+	if !strings.Contains(out, "p{color:red}") {
+		t.Fatalf("the safe rule was removed: %q", out)
+	}
+}
+
+func TestSanitizerStyleEnd(t *testing.T) {
+	s := NewSanitizer(SanitizerConfig{})
+
+	// the comment is removed before the end is looked for
+	out := s.css(`p{color:red} </**/style><img src=x onerror=alert(1)>`)
+	if strings.Contains(out, "</") {
+		t.Fatalf("the style text holds the end of the element: %q", out)
+	}
+}
+
+func TestSanitizerExpression(t *testing.T) {
+	s := NewSanitizer(SanitizerConfig{})
+
+	for _, css := range []string{
+		`width: expression(alert(1)); color: red`,
+		`width: expr\65 ssion(alert(1)); color: red`,
+		`width: expression /**/ (alert(1)); color: red`,
+		`behavior: url(x.htc); color: red`,
+		`@import "http://example.com/x.css"; color: red`,
+	} {
+		out := s.css(css)
+		if strings.Contains(strings.ToLower(cssUnescape(out)), "expression") ||
+			strings.Contains(out, "behavior") || strings.Contains(out, "@import") {
+			t.Errorf("css(%q) = %q", css, out)
+		}
+		if !strings.Contains(out, "color: red") {
+			t.Errorf("css(%q) = %q, the safe declaration was removed", css, out)
+		}
+	}
+}
+
+func TestSanitizerJavascriptURL(t *testing.T) {
+	s := NewSanitizer(SanitizerConfig{})
+
+	for _, css := range []string{
+		`background: url(javascript:alert(1)); color: red`,
+		`background: url("javascript:alert(1)"); color: red`,
+		`background: url(j\61vascript:alert(1)); color: red`,
+		`background: url(data:text/html,x); color: red`,
+	} {
+		out := s.css(css)
+		if strings.Contains(out, "script") || strings.Contains(out, "data:") || strings.Contains(out, ")") {
+			t.Errorf("css(%q) = %q", css, out)
+		}
+		if !strings.Contains(out, "color: red") {
+			t.Errorf("css(%q) = %q, the safe declaration was removed", css, out)
+		}
+	}
+
+	out := s.Sanitize(`<a href="javascript:alert(1)">a</a><a href=" java&#9;script:alert(1)">b</a><img src="vbscript:x">`)
+	if strings.Contains(out, "script:") || strings.Contains(out, "href") || strings.Contains(out, "src") {
+		t.Fatalf("the javascript URLs were kept: %q", out)
+	}
+}
+
+func TestSanitizerURL(t *testing.T) {
+	s := NewSanitizer(SanitizerConfig{ImageProxy: "https://proxy.example.com/?url={url}"})
+
+	out := s.css(`background: url( 'http://example.com/a.png' ) no-repeat; list-style: url(cid:logo)`)
+	want := `background: url("https://proxy.example.com/?url=http%3A%2F%2Fexample.com%2Fa.png") no-repeat; list-style: url("cid:logo")`
+	if out != want {
+		t.Fatalf("css = %q, want %q", out, want)
+	}
+
+	s = NewSanitizer(SanitizerConfig{BlockRemoteImages: true})
+	if out := s.css(`background: url(http://example.com/a.png) red`); out != `background: none red` {
+		t.Fatalf("css = %q", out)
+	}
+}
+
+func TestSanitizerEventAttributes(t *testing.T) {
+	s := NewSanitizer(SanitizerConfig{})
+
+	out := s.Sanitize(`<p onclick="alert(1)" ONMOUSEOVER="alert(2)" class="x">hi</p><body onload="alert(3)"><img src="cid:a" onerror="alert(4)"><script>alert(5)</script>`)
+	if strings.Contains(out, "alert") || strings.Contains(strings.ToLower(out), " on") {
+		t.Fatalf("the event handlers were kept: %q", out)
+	}
+	if !strings.Contains(out, `<p class="x">hi</p>`) || !strings.Contains(out, `<img src="cid:a"/>`) {
+		t.Fatalf("the safe markup was removed: %q", out)
+	}
+}
@@ -1,8 +1,13 @@
 package smtpsrv
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-smtp"
@@ -15,44 +20,520 @@ type ServerConfig struct {
 	WriteTimeout    time.Duration
 	Handler         HandlerFunc
 	Auther          AuthFunc
-	MaxMessageBytes int64
+	MaxMessageBytes int64 // advertised with SIZE and enforced during DATA with 552, defaults to 2MB
 	TLSConfig       *tls.Config
-}
 
-func ListenAndServe(cfg *ServerConfig) error {
-	s := smtp.NewServer(NewBackend(cfg.Auther, cfg.Handler))
+	// HandlerFactory, when set, builds a handler per session instead of
+	// sharing Handler between them.
+	HandlerFactory HandlerFactoryFunc
+
+	// Certificates, when set, provides the server certificates instead of
+	// TLSConfig.Certificates, e.g. a FileCertificateSource picking up the
+	// renewed certificates or an AutocertSource obtaining them from Let's
+	// Encrypt. TLSConfig then defaults to an empty config.
+	Certificates CertificateSource
+
+	// CommandTimeout replaces ReadTimeout while waiting for the next command,
+	// DataTimeout limits the whole DATA transfer, TransactionTimeout the time
+	// from MAIL to the end of DATA and ConnectionTimeout the whole session.
+	// Their expiry is replied 421 and closes the connection, zero disables them.
+	CommandTimeout     time.Duration
+	DataTimeout        time.Duration
+	TransactionTimeout time.Duration
+	ConnectionTimeout  time.Duration
+
+	// Listeners are served by Server.ListenAndServe, each with its own
+	// policy profile, e.g. an MX port, a submission port and an smtps one.
+	// MaxConnections and MaxConnectionsPerIP apply to each of them.
+	Listeners []Listener
+
+	// Banner replaces the "ESMTP Service Ready" text of the greeting, which
+	// announces BannerDomain like the EHLO replies.
+	Banner string
+
+	// DisableExtensions removes the EHLO keywords listed, e.g. "PIPELINING",
+	// "CHUNKING" or "DSN", from the EHLO replies, the commands of AUTH,
+	// CHUNKING, STARTTLS and XCLIENT are then also refused with 502. The
+	// optional extensions are otherwise enabled by their own options.
+	DisableExtensions []string
+
+	// Verify and Expand, when set, answer the VRFY and EXPN commands, which
+	// are otherwise replied 252 and 502.
+	Verify VerifyFunc
+	Expand ExpandFunc
+
+	// XCLIENTProxies, when set, offers the XCLIENT extension (as implemented
+	// by Postfix) to the connections it accepts: trusted proxies
+	// can then supply the address, HELO and login of the original client,
+	// which the hooks, SPF and Context then see. ConnectionPolicy, the bans
+	// of AuthLockout and the connection rate limit are applied to it again,
+	// the client is disconnected when it is refused. The proxy must greet
+	// again after XCLIENT.
+	XCLIENTProxies *IPFilter
+
+	// ClientCAs, when set, verifies the TLS client certificates against
+	// these authorities, see Context.ClientCertificate. RequireClientCert
+	// additionally refuses the handshakes without a valid one, which most
+	// MTAs delivering to port 25 do not have.
+	ClientCAs         *x509.CertPool
+	RequireClientCert bool
+
+	// CertAuth, when set, authenticates the clients presenting a verified
+	// certificate instead of a username and password: with AUTH EXTERNAL
+	// (RFC 4422), or at their first MAIL command when they did not use AUTH.
+	// The certificates refused at MAIL leave the session unauthenticated,
+	// they neither reject the transaction nor count as AUTH failures.
+	CertAuth CertAuthFunc
+
+	// Usage, when set, records the accepted bytes and messages of every
+	// successfully handled message.
+	Usage *UsageMeter
+
+	// Archiver, when set, archives the raw copy of every accepted message,
+	// whatever the handler did with it.
+	Archiver *Archiver
+
+	// Dedup, when set, suppresses the messages already accepted with the
+	// same Message-ID and recipients.
+	Dedup *Dedup
+
+	// Metrics, when set, receives the server measurements.
+	Metrics Metrics
+
+	// Upgrader, when set, provides the listener and lets a new process take
+	// it over, the server then drains its sessions and returns.
+	Upgrader *Upgrader
+
+	// ConnectionPolicy, when set, is invoked for every new connection before
+	// the banner is sent.
+	ConnectionPolicy ConnectionPolicyFunc
+
+	// RateLimiter, when set, enforces per-IP connection, message and
+	// recipient limits. The connections over the limit are refused before
+	// the banner is sent.
+	RateLimiter *RateLimiter
+
+	// CheckSPF evaluates the SPF record of the sender domain during MAIL FROM,
+	// RejectSPFFail additionally rejects the senders failing it.
+	CheckSPF      bool
+	RejectSPFFail bool
+
+	// VerifyDKIM validates the DKIM signatures when the handler calls
+	// Context.Parse, the results are set on Email.DKIMResults.
+	VerifyDKIM bool
+
+	// EnforceDMARC evaluates the DMARC policy of every message before the
+	// handler and rejects the messages whose disposition is reject.
+	EnforceDMARC bool
+
+	// DataPolicy, when set, reads every message before the handler and may
+	// reject it, e.g. to scan it for viruses or filter keywords.
+	DataPolicy DataPolicyFunc
+
+	// RcptValidator, when set, accepts or rejects every recipient during RCPT TO.
+	RcptValidator RcptValidatorFunc
+
+	// MailValidator, when set, accepts or rejects every sender during MAIL FROM.
+	MailValidator MailValidatorFunc
+
+	// SubaddressSeparator separates the mailbox from the tag in recipient
+	// addresses, defaults to DefaultSubaddressSeparator.
+	SubaddressSeparator string
+
+	// MaxConnections and MaxConnectionsPerIP limit the concurrent connections,
+	// the exceeding ones are replied 421 and closed, zero is unlimited.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+
+	// Logger, when set, receives the session lifecycle and transaction events.
+	Logger Logger
+
+	// Tracer, when set, creates a span per transaction with child spans for
+	// RCPT, DATA, parsing and the handler, and an smtp.auth span per AUTH
+	// attempt.
+	Tracer Tracer
+
+	// Events, when set, receives the session events, see EventBus.
+	Events *EventBus
+
+	// OnConnect, when set, is invoked when a session starts, the values it
+	// stores with Context.Set are visible to the later hooks and the handler.
+	OnConnect ConnectFunc
 
+	// OnAuth, when set, is invoked after every AUTH attempt.
+	OnAuth AuthEventFunc
+
+	// OnReset, when set, is invoked when a mail transaction ends, e.g. to
+	// release its resources or record the aborted transactions.
+	OnReset ResetFunc
+
+	// OnDisconnect, when set, is invoked when a session ends.
+	OnDisconnect DisconnectFunc
+
+	// AuthLockout, when set, bans the IPs failing to authenticate too often,
+	// their connections are refused before the banner is sent.
+	AuthLockout *AuthLockout
+
+	// LMTP serves LMTP (RFC 2033) instead of SMTP, the handler is then invoked
+	// once per recipient and its result is replied as that recipient status.
+	// The DataPolicy and the other checks of the message run once.
+	// ListenAddr may be a unix socket in the form "unix:/path/to/socket".
+	LMTP bool
+
+	// RequireTLS rejects MAIL with 530 until the client used STARTTLS, or
+	// connected with TLS, and RequireAuth until it authenticated.
+	RequireTLS  bool
+	RequireAuth bool
+
+	// DisableInsecureAuth only offers AUTH over TLS, the plaintext attempts
+	// are replied 538. AUTH is otherwise offered to the plaintext sessions.
+	DisableInsecureAuth bool
+
+	// Submission runs a message submission service (RFC 6409, usually on port
+	// 587): it enables RequireTLS, RequireAuth and DisableInsecureAuth, and
+	// a Received header is prepended.
+	Submission bool
+
+	// AddReceived prepends the Received header of Context.ReceivedHeader to
+	// every message, as seen by the handler through Context.Read, Raw and
+	// Parse. It is always prepended in Submission mode.
+	AddReceived bool
+
+	// EnableBINARYMIME advertises BINARYMIME (RFC 3030), such messages can
+	// only be sent with BDAT. CHUNKING is always advertised and the chunks are
+	// delivered to the handler as a single stream.
+	EnableBINARYMIME bool
+
+	// EnableSMTPUTF8 advertises SMTPUTF8 (RFC 6531) for internationalized
+	// addresses, which are then refused in transactions not declared SMTPUTF8.
+	// 8BITMIME is always advertised.
+	EnableSMTPUTF8 bool
+
+	// EnableDSN advertises DSN (RFC 3461), the parameters are available
+	// through Context.DSN.
+	EnableDSN bool
+
+	// ParseOptions tunes Context.Parse, e.g. to offload the attachments to
+	// an object store.
+	ParseOptions ParseOptions
+
+	// KeepRaw keeps a copy of every message as it is read, Context.Raw then
+	// returns it even after the handler read the message with Read or Parse.
+	// Otherwise the message is only buffered once Raw is called.
+	KeepRaw bool
+}
+
+func newServer(cfg *ServerConfig) *smtp.Server {
 	SetDefaultServerConfig(cfg)
 
+	s := smtp.NewServer(newBackend(cfg))
+
 	s.Addr = cfg.ListenAddr
 	s.Domain = cfg.BannerDomain
 	s.ReadTimeout = cfg.ReadTimeout
 	s.WriteTimeout = cfg.WriteTimeout
 	s.MaxMessageBytes = cfg.MaxMessageBytes
+	// the plaintext AUTH attempts are replied by Session.Auth, see
+	// DisableInsecureAuth
 	s.AllowInsecureAuth = true
-	s.EnableSMTPUTF8 = false
+	s.EnableSMTPUTF8 = cfg.EnableSMTPUTF8
+	s.LMTP = cfg.LMTP
+	s.EnableBINARYMIME = cfg.EnableBINARYMIME
+	s.EnableDSN = cfg.EnableDSN
+	// advertises STARTTLS
+	s.TLSConfig = serverTLSConfig(cfg)
+
+	return s
+}
 
-	fmt.Println("⇨ smtp server started on", s.Addr)
+func ListenAndServe(cfg *ServerConfig) error {
+	srv := NewServer(cfg)
 
-	return s.ListenAndServe()
+	return srv.listenAndServe([]Listener{{Addr: cfg.ListenAddr}})
 }
 
 func ListenAndServeTLS(cfg *ServerConfig) error {
-	s := smtp.NewServer(NewBackend(cfg.Auther, cfg.Handler))
+	srv := NewServer(cfg)
+
+	return srv.listenAndServe([]Listener{{Addr: cfg.ListenAddr, TLS: true}})
+}
+
+// Listener is an address served by a Server with its own policy profile,
+// e.g. the submission port next to the MX one.
+type Listener struct {
+	// Addr is the address to listen on, "unix:/path" for unix sockets
+	Addr string
+
+	// TLS serves implicit TLS (smtps, usually on port 465)
+	TLS bool
+
+	// Submission, RequireTLS, RequireAuth and DisableInsecureAuth enable the
+	// ServerConfig policies of the same name for this listener only.
+	Submission          bool
+	RequireTLS          bool
+	RequireAuth         bool
+	DisableInsecureAuth bool
+
+	// ConnectionPolicy, when set, replaces ServerConfig.ConnectionPolicy
+	ConnectionPolicy ConnectionPolicyFunc
+}
+
+// Server serves several listeners from one ServerConfig, they share its
+// handler, hooks and metrics and are shut down together.
+type Server struct {
+	config *ServerConfig
+
+	// serveDefault is set when ServerConfig.ListenAddr is served next to
+	// ServerConfig.Listeners
+	serveDefault bool
+
+	mu      sync.Mutex
+	servers []*smtp.Server
+	closed  bool
+}
 
+// NewServer creates a server for ServerConfig.Listeners, ListenAddr is then
+// only served when it is set, otherwise it defaults like ListenAndServe.
+func NewServer(cfg *ServerConfig) *Server {
+	srv := &Server{
+		config:       cfg,
+		serveDefault: cfg.ListenAddr != "" || len(cfg.Listeners) == 0,
+	}
 	SetDefaultServerConfig(cfg)
 
-	s.Addr = cfg.ListenAddr
-	s.Domain = cfg.BannerDomain
-	s.ReadTimeout = cfg.ReadTimeout
-	s.WriteTimeout = cfg.WriteTimeout
-	s.MaxMessageBytes = cfg.MaxMessageBytes
-	s.AllowInsecureAuth = true
-	s.EnableSMTPUTF8 = false
-	s.EnableREQUIRETLS = true
-	s.TLSConfig = cfg.TLSConfig
+	return srv
+}
+
+// ListenAndServe listens on all the addresses and serves them until one of
+// them fails, which closes the others, or the server is shut down.
+func (srv *Server) ListenAndServe() error {
+	listeners := srv.config.Listeners
+	if srv.serveDefault {
+		listeners = append([]Listener{{Addr: srv.config.ListenAddr}}, listeners...)
+	}
+
+	return srv.listenAndServe(listeners)
+}
+
+func (srv *Server) listenAndServe(listeners []Listener) error {
+	servers := []*smtp.Server{}
+	netListeners := []net.Listener{}
+	for _, listener := range listeners {
+		s, cfg := srv.newServer(listener)
+
+		l, err := listen(s, cfg, listener.TLS)
+		if err != nil {
+			for _, l := range netListeners {
+				l.Close()
+			}
+			return err
+		}
+
+		fmt.Println("⇨ smtp server started on", s.Addr)
+
+		servers = append(servers, s)
+		netListeners = append(netListeners, l)
+	}
+
+	return srv.register(servers, netListeners)
+}
+
+// Serve serves a listener provided by the caller, e.g. one inherited with
+// systemd socket activation or an in-process test listener, with the
+// ServerConfig policies. It may be called concurrently for several listeners.
+func (srv *Server) Serve(l net.Listener) error {
+	return srv.ServeListener(l, Listener{Addr: l.Addr().String()})
+}
+
+// ServeListener is like Serve with the policy profile of listener, its Addr
+// is ignored.
+func (srv *Server) ServeListener(l net.Listener, listener Listener) error {
+	listener.Addr = l.Addr().String()
+	s, cfg := srv.newServer(listener)
+
+	return srv.register([]*smtp.Server{s}, []net.Listener{wrapListener(l, s, cfg, listener.TLS)})
+}
+
+func (srv *Server) newServer(listener Listener) (*smtp.Server, *ServerConfig) {
+	cfg := srv.listenerConfig(listener)
+	s := newServer(cfg)
+	if listener.TLS {
+		s.EnableREQUIRETLS = true
+	}
+
+	return s, cfg
+}
+
+// register adds the servers to those shut down together and serves them
+func (srv *Server) register(servers []*smtp.Server, listeners []net.Listener) error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		for _, l := range listeners {
+			l.Close()
+		}
+		return smtp.ErrServerClosed
+	}
+	srv.servers = append(srv.servers, servers...)
+	srv.mu.Unlock()
+
+	return srv.serve(servers, listeners)
+}
+
+// serve serves the listeners, once they all listen the upgrader, if any, is
+// made ready.
+func (srv *Server) serve(servers []*smtp.Server, listeners []net.Listener) error {
+	var drained chan error
+	upgrader := srv.config.Upgrader
+	if upgrader != nil {
+		if err := upgrader.Ready(); err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+
+		drained = make(chan error, 1)
+		go func() {
+			<-upgrader.Exit()
+			drained <- srv.Shutdown(context.Background())
+		}()
+	}
+
+	errc := make(chan error, len(servers))
+	for i := range servers {
+		go func(s *smtp.Server, l net.Listener) {
+			errc <- s.Serve(l)
+		}(servers[i], listeners[i])
+	}
+
+	var err error
+	for range servers {
+		if serveErr := <-errc; serveErr != nil && err == nil {
+			err = serveErr
+			srv.Close()
+		}
+	}
+
+	if err != nil || upgrader == nil {
+		return err
+	}
+
+	// the sessions are drained when a new process took over the listeners
+	select {
+	case <-upgrader.Exit():
+		return <-drained
+	default:
+		return nil
+	}
+}
+
+// listenerConfig returns a copy of the ServerConfig with the listener profile
+func (srv *Server) listenerConfig(listener Listener) *ServerConfig {
+	cfg := *srv.config
+	cfg.ListenAddr = listener.Addr
+	cfg.Submission = cfg.Submission || listener.Submission
+	cfg.RequireTLS = cfg.RequireTLS || listener.RequireTLS
+	cfg.RequireAuth = cfg.RequireAuth || listener.RequireAuth
+	cfg.DisableInsecureAuth = cfg.DisableInsecureAuth || listener.DisableInsecureAuth
+	if listener.ConnectionPolicy != nil {
+		cfg.ConnectionPolicy = listener.ConnectionPolicy
+	}
+
+	return &cfg
+}
+
+// Shutdown stops accepting on all the listeners and waits for the sessions
+// to end, or for ctx to be done.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	var err error
+	for _, s := range srv.stop() {
+		if shutdownErr := s.Shutdown(ctx); shutdownErr != nil && shutdownErr != smtp.ErrServerClosed && err == nil {
+			err = shutdownErr
+		}
+	}
+
+	return err
+}
+
+// Close immediately closes all the listeners and connections.
+func (srv *Server) Close() error {
+	var err error
+	for _, s := range srv.stop() {
+		if closeErr := s.Close(); closeErr != nil && closeErr != smtp.ErrServerClosed && err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+func (srv *Server) stop() []*smtp.Server {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.closed = true
+
+	return srv.servers
+}
+
+// listen opens the listener of the server address, wrapped with the
+// connection policies of cfg.
+func listen(s *smtp.Server, cfg *ServerConfig, useTLS bool) (net.Listener, error) {
+	var l net.Listener
+	var err error
+
+	network, addr := listenNetwork(s.Addr)
+	if cfg.Upgrader != nil {
+		l, err = cfg.Upgrader.Listen(network, addr)
+	} else {
+		l, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapListener(l, s, cfg, useTLS), nil
+}
+
+// wrapListener wraps l with the connection policies of cfg
+func wrapListener(l net.Listener, s *smtp.Server, cfg *ServerConfig, useTLS bool) net.Listener {
+	if cfg.ConnectionPolicy != nil {
+		l = &policyListener{Listener: l, policy: cfg.ConnectionPolicy, config: cfg}
+	}
+
+	if cfg.AuthLockout != nil {
+		l = &policyListener{Listener: l, policy: cfg.AuthLockout.connectionPolicy, config: cfg}
+	}
+
+	if cfg.RateLimiter != nil {
+		l = &policyListener{Listener: l, policy: cfg.RateLimiter.connectionPolicy(cfg.XCLIENTProxies), config: cfg}
+	}
+
+	if cfg.MaxConnections > 0 || cfg.MaxConnectionsPerIP > 0 {
+		l = newConnLimitListener(l, cfg)
+	}
+
+	if cfg.CommandTimeout > 0 || cfg.DataTimeout > 0 || cfg.TransactionTimeout > 0 || cfg.ConnectionTimeout > 0 {
+		l = &timeoutListener{Listener: l, config: cfg}
+	}
+
+	// go-smtp replaces the session of the connections it upgrades with
+	// STARTTLS, a protocolConn upgrades them keeping the session
+	if cfg.interceptsCommands() || (s.TLSConfig != nil && !useTLS) {
+		l = &protocolListener{Listener: l, config: cfg, tlsConfig: s.TLSConfig, useTLS: useTLS}
+	} else if useTLS {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
+
+	return l
+}
 
-	fmt.Println("⇨ smtp server started on", s.Addr)
+// listenNetwork splits "unix:/path" addresses, any other address is tcp
+func listenNetwork(addr string) (string, string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	}
 
-	return s.ListenAndServeTLS()
+	return "tcp", addr
 }
@@ -1,9 +1,16 @@
 package smtpsrv
 
 import (
-	"errors"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"io"
+	"io/ioutil"
 	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/emersion/go-smtp"
 )
@@ -11,6 +18,8 @@ import (
 // A Session is returned after successful login.
 type Session struct {
 	conn     *smtp.Conn
+	timeouts *timeoutConn
+	proto    *protocolConn
 	From     *mail.Address
 	To       *mail.Address
 	handler  HandlerFunc
@@ -18,6 +27,64 @@ type Session struct {
 	auther   AuthFunc
 	username *string
 	password *string
+	config   *ServerConfig
+
+	// sessionHandler is the handler built by ServerConfig.HandlerFactory
+	sessionHandler SessionHandler
+
+	// certAuthenticated is set once the client authenticated with its
+	// certificate, see ServerConfig.CertAuth, certAuthTried once its
+	// certificate was tried at MAIL
+	certAuthenticated bool
+	certAuthTried     bool
+
+	rcptCount int
+	spf       *spfCheck
+	dmarc     *DMARCResult
+
+	id           string
+	transactions int
+
+	// inTransaction is set once MAIL was accepted, dataDone once the message
+	// data of the transaction was transferred
+	inTransaction bool
+	dataDone      bool
+
+	ctx    context.Context
+	txSpan Span
+
+	// raw is the copy of the message, kept as it is read with KeepRaw or an
+	// Archiver and otherwise from the first call to Context.Raw. policyRead
+	// holds what the DataPolicy read, bodyConsumed is set once the handler
+	// read some of the message which was not kept.
+	raw          *bytes.Buffer
+	rawComplete  bool
+	policyRead   *bytes.Buffer
+	bodyConsumed bool
+
+	values map[string]interface{}
+
+	// addedHeaders are prepended to the message once the DataPolicy returned
+	addedHeaders []string
+
+	rcpts  []*mail.Address
+	rcptTo []string
+
+	// rcptErrs are the results of the handler for each recipient in LMTP
+	// mode, lmtpRcpt is set while it is invoked for To
+	rcptErrs []error
+	lmtpRcpt bool
+
+	// BDAT transfers run Data concurrently with the connection: dataMu is
+	// held while Data runs, an aborted transfer resets or closes the session
+	// once Data returned, its handler being cancelled with dataCancel
+	dataMu     sync.Mutex
+	cancelMu   sync.Mutex
+	dataCancel context.CancelFunc
+
+	utf8     bool
+	mailOpts *smtp.MailOptions
+	rcptOpts []*smtp.RcptOptions
 }
 
 // NewSession initialize a new session
@@ -26,15 +93,87 @@ func NewSession(conn *smtp.Conn, handler HandlerFunc, auther AuthFunc) *Session
 		conn:    conn,
 		handler: handler,
 		auther:  auther,
+		id:      newSessionID(),
+		config: &ServerConfig{
+			Handler: handler,
+			Auther:  auther,
+		},
 	}
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	s.transactions++
+	s.startTransaction()
+	if s.timeouts != nil {
+		s.timeouts.startTransaction(s.config.TransactionTimeout)
+	}
+
+	err := smtpError(s.mail(from, opts))
+	s.inTransaction, s.dataDone = err == nil, false
+	s.log("mail", "from", from, "err", err)
+	if err != nil {
+		s.txSpan.SetError(err)
+		s.emitRejected("MAIL", err)
+	} else {
+		s.emit(func(info EventInfo) Event {
+			return &MailAccepted{EventInfo: info, From: s.From.Address}
+		})
+	}
+
+	return err
+}
+
+func (s *Session) mail(from string, opts *smtp.MailOptions) error {
+	// the clients presenting a certificate need not use AUTH EXTERNAL
+	s.implicitCertAuthenticate()
+
+	if s.config.RequireTLS || s.config.Submission {
+		if _, isTLS := s.tlsState(); !isTLS {
+			return ErrTLSRequired
+		}
+	}
+
+	if (s.config.RequireAuth || s.config.Submission) && !s.authenticated() {
+		return ErrAuthRequired
+	}
+
+	if s.config.RateLimiter != nil {
+		if err := s.config.RateLimiter.allowMessage(s.conn.Conn().RemoteAddr()); err != nil {
+			return err
+		}
+	}
+
+	s.utf8 = opts != nil && opts.UTF8
+	s.mailOpts = opts
+	if s.config.EnableSMTPUTF8 && !s.utf8 && !isASCII(from) {
+		return errUTF8Required
+	}
+
 	var err error
-	s.From, err = mail.ParseAddress(from)
+	if from == "" {
+		// the null reverse-path used by bounces
+		s.From = &mail.Address{}
+	} else if s.From, err = parseEnvelopeAddress(from); err != nil {
+		return ErrBadSenderSyntax
+	}
+
+	if s.From.Address != "" && (s.config.CheckSPF || s.config.RejectSPFFail) {
+		s.spf = checkSPF(addrIP(s.conn.Conn().RemoteAddr()), s.From.Address)
+		if s.config.RejectSPFFail && s.spf.result == SPFFail {
+			return errSPFFail
+		}
+	}
+
+	if s.config.MailValidator != nil {
+		c := Context{session: s}
+		if err := s.config.MailValidator(&c, s.From, opts); err != nil {
+			s.From = nil
+			return rejectError(err, ErrPolicyRejected.Code, ErrPolicyRejected.EnhancedCode)
+		}
+	}
 
 	// Extract authentication information from MailOptions if available
-	if opts != nil && opts.Auth != nil {
+	if opts != nil && opts.Auth != nil && !s.authenticated() {
 		// The Auth field contains the authorization identity
 		// For now, we store it as username (password would need to be handled via AuthSession)
 		authIdentity := *opts.Auth
@@ -45,28 +184,572 @@ func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 }
 
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
-	var err error
-	s.To, err = mail.ParseAddress(to)
+	_, span := s.config.tracer().Start(s.context(), "smtp.rcpt", map[string]string{"smtp.rcpt_to": to})
+	err := smtpError(s.rcpt(to, opts))
+	endSpan(span, err)
+	s.log("rcpt", "to", to, "err", err)
+	s.emitRejected("RCPT", err)
+
 	return err
 }
 
+func (s *Session) rcpt(to string, opts *smtp.RcptOptions) error {
+	if s.config.RateLimiter != nil {
+		if err := s.config.RateLimiter.allowRecipient(s.rcptCount + 1); err != nil {
+			return err
+		}
+	}
+
+	if s.config.EnableSMTPUTF8 && !s.utf8 && !isASCII(to) {
+		return errUTF8Required
+	}
+
+	addr, err := parseEnvelopeAddress(to)
+	if err != nil {
+		return ErrBadRecipientSyntax
+	}
+
+	if s.config.RcptValidator != nil {
+		c := Context{session: s}
+		if err := s.config.RcptValidator(&c, addr); err != nil {
+			return rejectError(err, ErrMailboxUnavailable.Code, ErrMailboxUnavailable.EnhancedCode)
+		}
+	}
+
+	s.rcptCount++
+	s.To = addr
+	s.rcpts = append(s.rcpts, addr)
+	s.rcptTo = append(s.rcptTo, to)
+	s.rcptOpts = append(s.rcptOpts, opts)
+
+	return nil
+}
+
 func (s *Session) Data(r io.Reader) error {
-	if s.handler == nil {
-		return errors.New("internal error: no handler")
+	r, end, err := s.beginData(r)
+	if err != nil {
+		return err
 	}
+	defer end()
+	s.startData()
+
+	err = s.traceData(&countingReader{r: r})
+	s.dataDone = true
 
-	s.body = r
+	return s.dataTimeout(err)
+}
+
+// LMTPData checks the message once like Data, then delivers it to each
+// recipient separately, invoking the handler once per recipient and replying
+// its result as that recipient status.
+func (s *Session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	r, end, err := s.beginData(r)
+	if err != nil {
+		return err
+	}
+	defer end()
+	s.startData()
+
+	err = s.dataTimeout(s.traceData(&countingReader{r: r}))
+	s.dataDone = true
+
+	for i, rcptTo := range s.rcptTo {
+		rcptErr := err
+		if i < len(s.rcptErrs) && s.rcptErrs[i] != nil {
+			rcptErr = s.rcptErrs[i]
+		}
+		status.SetStatus(rcptTo, rcptErr)
+	}
+
+	return nil
+}
+
+// beginData takes the session for the transfer of the message until end is
+// called. go-smtp may start Data for a BDAT transfer reset before it ran,
+// whose reader fails with smtp.ErrDataReset: it returns before taking the
+// session, which may already serve the next transaction.
+func (s *Session) beginData(r io.Reader) (_ io.Reader, end func(), err error) {
+	br := bufio.NewReader(r)
+	if _, err := br.Peek(1); err == smtp.ErrDataReset {
+		return nil, nil, err
+	}
+
+	s.dataMu.Lock()
+
+	parent := s.ctx
+	ctx, cancel := context.WithCancel(s.context())
+	s.ctx = ctx
+
+	s.cancelMu.Lock()
+	s.dataCancel = cancel
+	s.cancelMu.Unlock()
+
+	return br, func() {
+		s.cancelMu.Lock()
+		s.dataCancel = nil
+		s.cancelMu.Unlock()
+
+		cancel()
+		s.ctx = parent
+		s.dataMu.Unlock()
+	}, nil
+}
+
+// waitData cancels the handler of an aborted BDAT transfer, and waits for
+// Data to return
+func (s *Session) waitData() {
+	s.cancelMu.Lock()
+	if s.dataCancel != nil {
+		s.dataCancel()
+	}
+	s.cancelMu.Unlock()
+
+	s.dataMu.Lock()
+	s.dataMu.Unlock()
+}
+
+func (s *Session) traceData(body *countingReader) error {
+	ctx, span := s.config.tracer().Start(s.context(), "smtp.data", nil)
+	parent := s.ctx
+	s.ctx = ctx
+	err := s.data(body)
+	s.ctx = parent
+	endSpan(span, err)
+	s.log("data", "bytes", body.n, "err", err)
+	if err != nil {
+		s.emitRejected("DATA", err)
+	} else {
+		s.emit(func(info EventInfo) Event {
+			c := Context{session: s}
+			return &MessageQueued{EventInfo: info, From: s.From.Address, To: c.deliveryRecipients(), Bytes: body.n}
+		})
+	}
+
+	return err
+}
+
+func (s *Session) data(body *countingReader) error {
+	if s.handler == nil {
+		return ErrTemporaryFailure
+	}
 
 	c := Context{
 		session: s,
 	}
 
-	return s.handler(&c)
+	var r io.Reader = body
+	if s.config.Submission || s.config.AddReceived {
+		r = io.MultiReader(strings.NewReader(c.ReceivedHeader()), body)
+	}
+
+	s.body, s.bodyConsumed = r, false
+	s.raw, s.rawComplete = nil, false
+	if s.config.KeepRaw || s.config.Archiver != nil {
+		// keep a copy of everything read so the raw message survives parsing
+		s.raw = &bytes.Buffer{}
+		s.body = io.TeeReader(r, s.raw)
+	}
+
+	// the handler is not invoked for the duplicates and quarantined messages,
+	// the duplicates are neither accounted nor archived again
+	drop, duplicate := false, false
+
+	dedupKey := ""
+	if s.config.Dedup != nil {
+		dedupKey = s.config.Dedup.key(&c)
+		release, seen, err := s.config.Dedup.reserve(dedupKey)
+		defer release()
+
+		if err == errDeliveryInProgress {
+			s.log("duplicate", "key", dedupKey, "err", err)
+			return smtpError(err)
+		} else if err != nil {
+			// the store failures never suppress a message
+			s.log("dedup", "err", err)
+		} else if seen {
+			s.log("duplicate", "key", dedupKey)
+			if s.config.Dedup.config.Reject {
+				return smtpError(errDuplicate)
+			}
+			drop, duplicate = true, true
+		}
+	}
+
+	if s.config.EnforceDMARC && !drop {
+		if err := s.enforceDMARC(&c); err != nil {
+			if body.tooLarge {
+				return smtp.ErrDataTooLarge
+			}
+			return err
+		}
+	}
+
+	if s.config.DataPolicy != nil && !drop {
+		if err := s.dataPolicy(&c); err == ErrQuarantined {
+			drop = true
+		} else if err != nil {
+			if body.tooLarge {
+				return smtp.ErrDataTooLarge
+			}
+			return err
+		}
+	}
+
+	var err error
+	if !drop {
+		err = s.handle(&c)
+	}
+
+	if err != nil {
+		if body.tooLarge {
+			return smtp.ErrDataTooLarge
+		}
+		return smtpError(err)
+	}
+
+	// the archiver needs the parts of the message the handler did not read,
+	// the read errors are those of the body
+	if s.config.Archiver != nil && !duplicate {
+		c.Raw()
+	}
+
+	// the message is only accepted once it was read entirely within the size limit
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return err
+	}
+
+	if body.tooLarge {
+		return smtp.ErrDataTooLarge
+	}
+
+	if s.config.Usage != nil && !duplicate {
+		s.config.Usage.record(&c, body.n)
+	}
+
+	// the message was accepted whatever the archiver does
+	if s.config.Archiver != nil && !duplicate {
+		if err := s.config.Archiver.archive(&c); err != nil {
+			s.log("archive", "err", err)
+		}
+	}
+
+	if s.config.Dedup != nil {
+		if err := s.config.Dedup.record(dedupKey); err != nil {
+			s.log("dedup", "err", err)
+		}
+	}
+
+	return nil
+}
+
+// handle invokes the handler, in LMTP mode once per recipient: their results
+// are the recipient statuses, the message fails when all of them failed
+func (s *Session) handle(c *Context) error {
+	if !s.config.LMTP {
+		return s.invokeHandler(c)
+	}
+
+	raw, err := c.Raw()
+	if err != nil {
+		return err
+	}
+
+	to := s.To
+	s.rcptErrs, s.lmtpRcpt = make([]error, len(s.rcpts)), true
+	defer func() {
+		s.To, s.lmtpRcpt = to, false
+	}()
+
+	accepted := false
+	for i, rcpt := range s.rcpts {
+		s.To, s.body = rcpt, bytes.NewReader(raw)
+		if s.rcptErrs[i] = s.invokeHandler(c); s.rcptErrs[i] == nil {
+			accepted = true
+		} else {
+			s.rcptErrs[i] = smtpError(s.rcptErrs[i])
+			err = s.rcptErrs[i]
+		}
+	}
+
+	if accepted {
+		return nil
+	}
+
+	return err
+}
+
+func (s *Session) invokeHandler(c *Context) error {
+	ctx, span := s.config.tracer().Start(s.context(), "smtp.handler", nil)
+	parent := s.ctx
+	s.ctx = ctx
+	err := s.handler(c)
+	s.ctx = parent
+	endSpan(span, err)
+
+	return err
+}
+
+// startData applies ServerConfig.DataTimeout to the DATA transfer
+func (s *Session) startData() {
+	if s.timeouts != nil {
+		s.timeouts.startData(s.config.DataTimeout)
+	}
+}
+
+// dataTimeout replies 421 to the transfers failed by a DATA, transaction or
+// connection timeout.
+func (s *Session) dataTimeout(err error) error {
+	if err != nil && s.timeouts != nil && s.timeouts.expire() {
+		s.log("timeout", "err", err)
+		return errDataTimeout
+	}
+
+	return err
+}
+
+// reportTLS emits the TLS parameters of the session when it starts, and once
+// it was upgraded with STARTTLS, which go-smtp handles with a new session.
+func (s *Session) reportTLS() {
+	c := Context{session: s}
+	s.config.metrics().IncCounter("smtp_tls_sessions_total", tlsLabels(c.TLSInfo()))
+}
+
+// enforceDMARC buffers the message to evaluate its DMARC policy, the handler
+// then reads the buffered copy. Only a reject disposition rejects the
+// message, those which can not be evaluated are left to the handler.
+func (s *Session) enforceDMARC(c *Context) error {
+	raw, err := c.Raw()
+	if err != nil {
+		return err
+	}
+	s.body = bytes.NewReader(raw)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		s.log("dmarc", "err", err)
+		return nil
+	}
+
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		s.log("dmarc", "err", err)
+		return nil
+	}
+
+	dkimResults, err := VerifyDKIM(raw)
+	if err != nil {
+		s.log("dmarc", "err", err)
+		return nil
+	}
+
+	s.dmarc, err = c.evaluateDMARC(from, dkimResults)
+	if err != nil {
+		// temporary lookup failures never reject
+		return nil
+	}
+
+	if s.dmarc.Disposition == DMARCPolicyReject {
+		return errDMARCReject
+	}
+
+	return nil
+}
+
+// dataPolicy lets ServerConfig.DataPolicy read the message, through r or the
+// Context, and hands what it read back to the handler.
+func (s *Session) dataPolicy(c *Context) error {
+	body, read := s.body, &bytes.Buffer{}
+	s.body, s.policyRead = io.TeeReader(body, read), read
+
+	ctx, span := s.config.tracer().Start(s.context(), "smtp.data_policy", nil)
+	parent := s.ctx
+	s.ctx = ctx
+	err := s.config.DataPolicy(c, s.body)
+	s.ctx = parent
+	endSpan(span, err)
+	s.body, s.policyRead = io.MultiReader(read, body), nil
+	s.prependHeaders()
+
+	if err == ErrQuarantined {
+		s.log("data policy", "quarantined", true)
+		return err
+	} else if err != nil {
+		s.log("data policy", "err", err)
+		return rejectError(err, ErrPolicyRejected.Code, ErrPolicyRejected.EnhancedCode)
+	}
+
+	return nil
+}
+
+// consumeBody records that the handler reads the message, those reads are
+// only kept with KeepRaw or within the DataPolicy
+func (s *Session) consumeBody() {
+	if s.policyRead == nil {
+		s.bodyConsumed = true
+	}
+}
+
+// messageID reads the Message-ID of the message, without its angle
+// brackets, the handler then reads the message from the start
+func (s *Session) messageID() string {
+	body, read := s.body, &bytes.Buffer{}
+	msg, err := mail.ReadMessage(bufio.NewReader(io.TeeReader(body, read)))
+	s.body = io.MultiReader(read, body)
+	if err != nil {
+		return ""
+	}
+
+	id := strings.TrimSpace(msg.Header.Get("Message-Id"))
+	return strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+}
+
+// prependHeaders prepends the header fields added with Context.AddHeader
+// to the message read by the handler and to the raw message
+func (s *Session) prependHeaders() {
+	if len(s.addedHeaders) == 0 {
+		return
+	}
+
+	header := strings.Join(s.addedHeaders, "")
+	s.addedHeaders = nil
+
+	if s.rawComplete {
+		s.raw = bytes.NewBuffer(append([]byte(header), s.raw.Bytes()...))
+	} else if s.raw != nil {
+		// the body keeps copying to the same buffer
+		raw := append([]byte(header), s.raw.Bytes()...)
+		s.raw.Reset()
+		s.raw.Write(raw)
+	}
+
+	s.body = io.MultiReader(strings.NewReader(header), s.body)
+}
+
+// startTransaction ends the previous transaction span, if any, and starts a new one
+func (s *Session) startTransaction() {
+	s.endTransaction()
+
+	attrs := map[string]string{
+		"smtp.session_id":     s.id,
+		"smtp.transaction_id": s.transactionID(),
+		"net.peer.addr":       s.conn.Conn().RemoteAddr().String(),
+	}
+	s.ctx, s.txSpan = s.config.tracer().Start(context.Background(), "smtp.transaction", attrs)
+}
+
+func (s *Session) endTransaction() {
+	if s.txSpan != nil {
+		s.txSpan.End()
+	}
+	s.ctx, s.txSpan = nil, nil
+}
+
+// context returns the context of the current transaction
+func (s *Session) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+
+	return s.ctx
 }
 
 func (s *Session) Reset() {
+	s.waitData()
+	s.resetHook()
+	s.endTransaction()
+	if s.timeouts != nil {
+		s.timeouts.startTransaction(0)
+	}
+	s.rcpts, s.rcptTo, s.rcptOpts = nil, nil, nil
+	s.mailOpts = nil
+	s.body, s.raw, s.rawComplete = nil, nil, false
+	s.policyRead, s.bodyConsumed = nil, false
+	s.rcptErrs, s.lmtpRcpt = nil, false
+	s.addedHeaders = nil
+	s.rcptCount = 0
+	s.spf = nil
+	s.dmarc = nil
 }
 
 func (s *Session) Logout() error {
+	s.waitData()
+	s.resetHook()
+	s.endTransaction()
+	s.log("session closed")
+
+	if s.config.OnDisconnect != nil {
+		c := Context{session: s}
+		s.config.OnDisconnect(&c)
+	}
+
+	if closer, ok := s.sessionHandler.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			s.log("handler close", "err", err)
+		}
+	}
+
+	s.emit(func(info EventInfo) Event {
+		return &ConnectionClosed{EventInfo: info}
+	})
+
 	return nil
 }
+
+// resetHook invokes OnReset once per transaction, when it ends
+func (s *Session) resetHook() {
+	if !s.inTransaction {
+		return
+	}
+	s.inTransaction = false
+
+	if s.config.OnReset != nil {
+		c := Context{session: s}
+		s.config.OnReset(&c, !s.dataDone)
+	}
+}
+
+// tlsState returns the TLS state of the connection, which go-smtp does not
+// know about when a protocolConn handles TLS
+func (s *Session) tlsState() (tls.ConnectionState, bool) {
+	if s.proto != nil {
+		return s.proto.tlsState()
+	}
+
+	return s.conn.TLSConnectionState()
+}
+
+// startTLS resets the session once a protocolConn upgraded the connection
+// with STARTTLS, as go-smtp replaces the sessions of the connections it
+// upgrades itself
+func (s *Session) startTLS() {
+	s.Reset()
+	s.From, s.To = nil, nil
+	s.username, s.password, s.certAuthenticated, s.certAuthTried = nil, nil, false, false
+	s.reportTLS()
+}
+
+// helo returns the HELO name of the client, as supplied by a proxy with
+// XCLIENT if any
+func (s *Session) helo() string {
+	if s.proto != nil {
+		if helo, _ := s.proto.client(); helo != "" {
+			return helo
+		}
+	}
+
+	return s.conn.Hostname()
+}
+
+// log writes an entry tagged with the session and transaction IDs
+func (s *Session) log(msg string, keyvals ...interface{}) {
+	keyvals = append([]interface{}{"session", s.id, "transaction", s.transactionID()}, keyvals...)
+	s.config.logger().Log(msg, keyvals...)
+}
+
+func (s *Session) transactionID() string {
+	if s.transactions == 0 {
+		return ""
+	}
+
+	return s.id + "-" + strconv.Itoa(s.transactions)
+}
@@ -0,0 +1,80 @@
+package smtpsrv
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-smtp"
+)
+
+// EnhancedCode is a RFC 3463 enhanced status code, e.g. EnhancedCode{5, 1, 1}
+type EnhancedCode = smtp.EnhancedCode
+
+// Common replies with their enhanced status codes, handlers and hooks may return them as is.
+var (
+	ErrMailboxUnavailable = &Error{Code: 550, EnhancedCode: EnhancedCode{5, 1, 1}, Message: "Mailbox unavailable"}
+	ErrBadSenderSyntax    = &Error{Code: 501, EnhancedCode: EnhancedCode{5, 1, 7}, Message: "Bad sender address syntax"}
+	ErrBadRecipientSyntax = &Error{Code: 501, EnhancedCode: EnhancedCode{5, 1, 3}, Message: "Bad recipient address syntax"}
+	ErrPolicyRejected     = &Error{Code: 550, EnhancedCode: EnhancedCode{5, 7, 1}, Message: "Rejected by policy"}
+	ErrMessageTooLarge    = &Error{Code: 552, EnhancedCode: EnhancedCode{5, 3, 4}, Message: "Maximum message size exceeded"}
+	ErrAuthRequired       = &Error{Code: 530, EnhancedCode: EnhancedCode{5, 7, 0}, Message: "Authentication required"}
+	ErrTLSRequired        = &Error{Code: 530, EnhancedCode: EnhancedCode{5, 7, 0}, Message: "Must issue a STARTTLS command first"}
+	ErrEncryptionRequired = &Error{Code: 538, EnhancedCode: EnhancedCode{5, 7, 11}, Message: "Encryption required for requested authentication mechanism"}
+	ErrTemporaryFailure   = &Error{Code: 451, EnhancedCode: EnhancedCode{4, 3, 0}, Message: "Temporary failure, try again later"}
+)
+
+// Error lets handlers and hooks control the reply sent to the client,
+// any other error is replied as a generic 554 transaction failure.
+type Error struct {
+	Code         int
+	EnhancedCode EnhancedCode
+	Message      string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %d.%d.%d %s", e.Code, e.EnhancedCode[0], e.EnhancedCode[1], e.EnhancedCode[2], e.Message)
+}
+
+// Temporary reports whether the error is a 4xx transient failure
+func (e *Error) Temporary() bool {
+	return e.Code/100 == 4
+}
+
+// smtpError converts the errors wrapping an *Error to the go-smtp error type,
+// which is the only one go-smtp replies with its own code.
+func smtpError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return &smtp.SMTPError{
+			Code:         e.Code,
+			EnhancedCode: e.EnhancedCode,
+			Message:      e.Message,
+		}
+	}
+
+	return err
+}
+
+// rejectError converts err like smtpError, replying the errors that don't
+// carry their own code with code and enhancedCode.
+func rejectError(err error, code int, enhancedCode EnhancedCode) error {
+	err = smtpError(err)
+	if _, ok := err.(*smtp.SMTPError); ok || err == nil {
+		return err
+	}
+
+	return &smtp.SMTPError{
+		Code:         code,
+		EnhancedCode: enhancedCode,
+		Message:      err.Error(),
+	}
+}
@@ -0,0 +1,68 @@
+package smtpsrv
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// the attribution of the quoted reply, e.g. "On Mon, 2 Jan 2006, Bob
+	// wrote:", in the languages of the common clients
+	reQuoteAttribution = regexp.MustCompile(`(?i)^(on|le|am|el|il|op)\s.+(wrote|a écrit|schrieb|escribió|ha scritto|schreef)\s*:\s*$`)
+
+	// the separators of the replies and forwards of Outlook and Gmail
+	reQuoteSeparator = regexp.MustCompile(`(?i)^(-{2,}\s*original message\s*-{2,}|_{10,}|-{5,}\s*forwarded message\s*-{5,})\s*$`)
+
+	reMobileSignature = regexp.MustCompile(`(?i)^sent from my \w+`)
+)
+
+// Snippet returns a preview of the body for the message lists: the text
+// body, rendered from the HTML one when there is none, without the quoted
+// reply and the signature, its whitespace collapsed. It holds at most n
+// characters, the truncated ones ending with an ellipsis.
+func (e *Email) Snippet(n int) string {
+	if n <= 0 {
+		return ""
+	}
+
+	var kept []string
+	for _, line := range strings.Split(e.Text(), "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		if trimmed == "--" || strings.TrimRight(line, "\r") == "-- " || reMobileSignature.MatchString(trimmed) ||
+			reQuoteSeparator.MatchString(trimmed) || reQuoteAttribution.MatchString(trimmed) {
+			// the rest is the signature or the quoted message
+			break
+		}
+
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+
+		kept = append(kept, trimmed)
+	}
+
+	snippet := strings.Join(strings.Fields(strings.Join(kept, " ")), " ")
+	if utf8.RuneCountInString(snippet) <= n {
+		return snippet
+	}
+
+	runes := []rune(snippet)[:n-1]
+	if ind := lastSpace(runes); ind > len(runes)/2 {
+		// cut between words
+		runes = runes[:ind]
+	}
+
+	return strings.TrimRight(string(runes), " ,;:.") + "…"
+}
+
+func lastSpace(runes []rune) int {
+	for i := len(runes) - 1; i >= 0; i-- {
+		if runes[i] == ' ' {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,32 @@
+package smtpsrv
+
+import (
+	"net"
+
+	"github.com/emersion/go-smtp"
+	"github.com/zaccone/spf"
+)
+
+var errSPFFail = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 23},
+	Message:      "SPF validation failed",
+}
+
+// spfCheck holds the SPF evaluation of the current MAIL FROM
+type spfCheck struct {
+	result      SPFResult
+	explanation string
+	err         error
+}
+
+func checkSPF(ip net.IP, sender string) *spfCheck {
+	_, host, err := SplitAddress(sender)
+	if err != nil {
+		return &spfCheck{result: spf.None, err: err}
+	}
+
+	result, explanation, err := spf.CheckHost(ip, host, sender)
+
+	return &spfCheck{result: result, explanation: explanation, err: err}
+}
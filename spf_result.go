@@ -3,3 +3,13 @@ package smtpsrv
 import "github.com/zaccone/spf"
 
 type SPFResult = spf.Result
+
+const (
+	SPFNone      = spf.None
+	SPFNeutral   = spf.Neutral
+	SPFPass      = spf.Pass
+	SPFFail      = spf.Fail
+	SPFSoftfail  = spf.Softfail
+	SPFTemperror = spf.Temperror
+	SPFPermerror = spf.Permerror
+)
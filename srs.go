@@ -0,0 +1,215 @@
+package smtpsrv
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+const srsTimestampChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+var (
+	errSRSInvalid = errors.New("smtpsrv: invalid SRS address")
+	errSRSHash    = errors.New("smtpsrv: SRS address hash mismatch")
+	errSRSExpired = errors.New("smtpsrv: expired SRS address")
+)
+
+// SRSConfig holds the Sender Rewriting Scheme settings
+type SRSConfig struct {
+	// Domain is the domain of the rewritten addresses, bounces sent to them
+	// must reach this server
+	Domain string
+
+	// Secret keys the hash authenticating the rewritten addresses
+	Secret []byte
+
+	// MaxAge limits the validity of the rewritten addresses, defaults to 21
+	// days
+	MaxAge time.Duration
+}
+
+// SRS rewrites the envelope sender of forwarded messages to an address of
+// the forwarding domain, so that they pass the SPF checks of the next hops,
+// and reverses the bounces sent to such addresses. Addresses are written in
+// the SRS0 and SRS1 formats of libsrs2, with "=" separators.
+type SRS struct {
+	config SRSConfig
+}
+
+func NewSRS(cfg SRSConfig) *SRS {
+	if cfg.MaxAge == 0 {
+		cfg.MaxAge = 21 * 24 * time.Hour
+	}
+
+	return &SRS{
+		config: cfg,
+	}
+}
+
+// IsSRS reports whether the address is a SRS0 or SRS1 rewritten address
+func IsSRS(address string) bool {
+	local := strings.ToUpper(address)
+	return strings.HasPrefix(local, "SRS0=") || strings.HasPrefix(local, "SRS1=")
+}
+
+// Forward rewrites the envelope sender of a forwarded message, the null
+// sender and the addresses of the SRS domain are left unchanged. An address
+// already rewritten by another forwarder becomes a SRS1 address pointing to
+// that forwarder.
+func (s *SRS) Forward(address string) (string, error) {
+	if address == "" {
+		return address, nil
+	}
+
+	local, domain, err := SplitAddress(address)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.EqualFold(domain, s.config.Domain) {
+		return address, nil
+	}
+
+	switch upper := strings.ToUpper(local); {
+	case strings.HasPrefix(upper, "SRS0="):
+		// SRS1=HHHH=forwarder==HHHH=TT=domain=local
+		rest := local[4:]
+		return "SRS1=" + s.hash(domain, rest) + "=" + domain + "=" + rest + "@" + s.config.Domain, nil
+	case strings.HasPrefix(upper, "SRS1="):
+		// only the hash of the first forwarder is replaced
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 {
+			return "", errSRSInvalid
+		}
+		return "SRS1=" + s.hash(parts[1], parts[2]) + "=" + parts[1] + "=" + parts[2] + "@" + s.config.Domain, nil
+	}
+
+	// SRS0=HHHH=TT=domain=local
+	timestamp := srsTimestamp(time.Now())
+	return "SRS0=" + s.hash(timestamp, domain, local) + "=" + timestamp + "=" + domain + "=" + local + "@" + s.config.Domain, nil
+}
+
+// Reverse returns the address a bounce sent to the rewritten address is
+// returned to: the original sender of a SRS0 address, or the SRS0 address of
+// the first forwarder of a SRS1 address. It fails when the hash does not
+// match or the address expired.
+func (s *SRS) Reverse(address string) (string, error) {
+	local, _, err := SplitAddress(address)
+	if err != nil {
+		return "", err
+	}
+
+	if !IsSRS(local) {
+		return "", errSRSInvalid
+	}
+
+	if strings.ToUpper(local[:4]) == "SRS1" {
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 || parts[1] == "" {
+			return "", errSRSInvalid
+		}
+
+		if !s.verify(parts[0], parts[1], parts[2]) {
+			return "", errSRSHash
+		}
+
+		return "SRS0" + parts[2] + "@" + parts[1], nil
+	}
+
+	parts := strings.SplitN(local[5:], "=", 4)
+	if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+		return "", errSRSInvalid
+	}
+
+	if !s.verify(parts[0], parts[1], parts[2], parts[3]) {
+		return "", errSRSHash
+	}
+
+	if !s.valid(parts[1]) {
+		return "", errSRSExpired
+	}
+
+	return parts[3] + "@" + parts[2], nil
+}
+
+// Deliver returns a DeliverFunc rewriting the envelope sender before handing
+// the messages to next, e.g. (*Relay).Send.
+func (s *SRS) Deliver(next DeliverFunc) DeliverFunc {
+	return func(from string, to []string, msg []byte) error {
+		from, err := s.Forward(from)
+		if err != nil {
+			return err
+		}
+
+		return next(from, to, msg)
+	}
+}
+
+// BounceHandler returns a handler delivering the messages sent to rewritten
+// addresses to their reversed addresses through deliver, keeping the
+// envelope sender. Recipients that can not be reversed are rejected.
+func (s *SRS) BounceHandler(deliver DeliverFunc) HandlerFunc {
+	return func(c *Context) error {
+		to := c.deliveryRecipients()
+		for i, rcpt := range to {
+			reversed, err := s.Reverse(rcpt)
+			if err != nil {
+				return ErrMailboxUnavailable
+			}
+			to[i] = reversed
+		}
+
+		raw, err := c.Raw()
+		if err != nil {
+			return err
+		}
+
+		return deliver(c.From().Address, to, raw)
+	}
+}
+
+// hash returns the first 4 characters of the base64 HMAC-SHA1 of the
+// lowercased values
+func (s *SRS) hash(values ...string) string {
+	mac := hmac.New(sha1.New, s.config.Secret)
+	for _, value := range values {
+		mac.Write([]byte(strings.ToLower(value)))
+	}
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:4]
+}
+
+func (s *SRS) verify(hash string, values ...string) bool {
+	// some MTAs change the case of local parts
+	return strings.EqualFold(hash, s.hash(values...))
+}
+
+// valid reports whether the SRS0 timestamp is within MaxAge
+func (s *SRS) valid(timestamp string) bool {
+	if len(timestamp) != 2 {
+		return false
+	}
+
+	then := 0
+	for _, c := range strings.ToUpper(timestamp) {
+		ind := strings.IndexRune(srsTimestampChars, c)
+		if ind == -1 {
+			return false
+		}
+		then = then<<5 | ind
+	}
+
+	today := int(time.Now().Unix() / 86400 % 1024)
+	age := (today - then + 1024) % 1024
+
+	return time.Duration(age)*24*time.Hour <= s.config.MaxAge
+}
+
+// srsTimestamp encodes the day, modulo 1024, in 2 base32 characters
+func srsTimestamp(t time.Time) string {
+	day := t.Unix() / 86400 % 1024
+	return string([]byte{srsTimestampChars[day>>5], srsTimestampChars[day&31]})
+}
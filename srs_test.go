@@ -0,0 +1,172 @@
+package smtpsrv
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSRS(domain string) *SRS {
+	return NewSRS(SRSConfig{Domain: domain, Secret: []byte("secret of " + domain)})
+}
+
+func TestSRSRoundTrip(t *testing.T) {
+	srs := newTestSRS("forwarder.example")
+
+	rewritten, err := srs.Forward("alice@origin.example")
+	if err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+
+	if !IsSRS(rewritten) || !strings.HasSuffix(rewritten, "@forwarder.example") {
+		t.Fatalf("forward = %q, want a SRS0 address of forwarder.example", rewritten)
+	}
+
+	// some MTAs change the case of the local parts
+	for _, address := range []string{rewritten, strings.ToLower(rewritten)} {
+		reversed, err := srs.Reverse(address)
+		if err != nil {
+			t.Fatalf("reverse %q: %v", address, err)
+		}
+
+		if !strings.EqualFold(reversed, "alice@origin.example") {
+			t.Errorf("reverse %q = %q, want alice@origin.example", address, reversed)
+		}
+	}
+}
+
+func TestSRSForwardUnchanged(t *testing.T) {
+	srs := newTestSRS("forwarder.example")
+
+	for _, address := range []string{"", "bob@forwarder.example", "bob@FORWARDER.example"} {
+		rewritten, err := srs.Forward(address)
+		if err != nil {
+			t.Fatalf("forward %q: %v", address, err)
+		}
+
+		if rewritten != address {
+			t.Errorf("forward %q = %q, want it unchanged", address, rewritten)
+		}
+	}
+}
+
+func TestSRS1(t *testing.T) {
+	first := newTestSRS("first.example")
+	second := newTestSRS("second.example")
+	third := newTestSRS("third.example")
+
+	srs0, err := first.Forward("alice@origin.example")
+	if err != nil {
+		t.Fatalf("first forward: %v", err)
+	}
+
+	srs1, err := second.Forward(srs0)
+	if err != nil {
+		t.Fatalf("second forward: %v", err)
+	}
+
+	if !strings.HasPrefix(srs1, "SRS1=") || !strings.HasSuffix(srs1, "@second.example") {
+		t.Fatalf("second forward = %q, want a SRS1 address of second.example", srs1)
+	}
+
+	// a third forwarder points to the first one as well
+	srs1Again, err := third.Forward(srs1)
+	if err != nil {
+		t.Fatalf("third forward: %v", err)
+	}
+
+	if !strings.HasPrefix(srs1Again, "SRS1=") || !strings.Contains(srs1Again, "=first.example==") {
+		t.Fatalf("third forward = %q, want a SRS1 address pointing to first.example", srs1Again)
+	}
+
+	for _, c := range []struct {
+		srs     *SRS
+		address string
+	}{
+		{second, srs1},
+		{third, srs1Again},
+	} {
+		reversed, err := c.srs.Reverse(c.address)
+		if err != nil {
+			t.Fatalf("reverse %q: %v", c.address, err)
+		}
+
+		if reversed != srs0 {
+			t.Fatalf("reverse %q = %q, want %q", c.address, reversed, srs0)
+		}
+	}
+
+	original, err := first.Reverse(srs0)
+	if err != nil {
+		t.Fatalf("reverse %q: %v", srs0, err)
+	}
+
+	if original != "alice@origin.example" {
+		t.Errorf("reverse %q = %q, want alice@origin.example", srs0, original)
+	}
+}
+
+func TestSRSBadHash(t *testing.T) {
+	srs := newTestSRS("forwarder.example")
+
+	srs0, err := srs.Forward("alice@origin.example")
+	if err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+
+	srs1, err := srs.Forward("SRS0=abcd=AB=origin.example=alice@first.example")
+	if err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+
+	other, err := NewSRS(SRSConfig{Domain: "forwarder.example", Secret: []byte("other")}).Forward("alice@origin.example")
+	if err != nil {
+		t.Fatalf("forward: %v", err)
+	}
+
+	for _, address := range []string{
+		// the hash of another secret
+		other,
+		// a tampered sender
+		strings.Replace(srs0, "=alice@", "=mallory@", 1),
+		strings.Replace(srs0, "=origin.example=", "=evil.example=", 1),
+		strings.Replace(srs1, "=first.example=", "=evil.example=", 1),
+	} {
+		if _, err := srs.Reverse(address); err != errSRSHash {
+			t.Errorf("reverse %q: err = %v, want %v", address, err, errSRSHash)
+		}
+	}
+
+	for _, address := range []string{
+		"alice@forwarder.example",
+		"SRS0=abcd@forwarder.example",
+		"SRS0=abcd=AB=origin.example=@forwarder.example",
+		"SRS1=abcd=first.example@forwarder.example",
+	} {
+		if _, err := srs.Reverse(address); err != errSRSInvalid {
+			t.Errorf("reverse %q: err = %v, want %v", address, err, errSRSInvalid)
+		}
+	}
+}
+
+func TestSRSExpired(t *testing.T) {
+	srs := NewSRS(SRSConfig{Domain: "forwarder.example", Secret: []byte("secret"), MaxAge: 7 * 24 * time.Hour})
+
+	address := func(age time.Duration) string {
+		timestamp := srsTimestamp(time.Now().Add(-age))
+		return "SRS0=" + srs.hash(timestamp, "origin.example", "alice") + "=" + timestamp + "=origin.example=alice@forwarder.example"
+	}
+
+	if _, err := srs.Reverse(address(6 * 24 * time.Hour)); err != nil {
+		t.Errorf("reverse of a 6 days old address: %v", err)
+	}
+
+	if _, err := srs.Reverse(address(8 * 24 * time.Hour)); err != errSRSExpired {
+		t.Errorf("reverse of a 8 days old address: err = %v, want %v", err, errSRSExpired)
+	}
+
+	// the timestamps wrap around after 1024 days
+	if _, err := srs.Reverse(address(1025 * 24 * time.Hour)); err != nil {
+		t.Errorf("reverse of a wrapped timestamp: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package smtpsrv
+
+import (
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// StreamPart describes a leaf part of a message parsed by ParseEmailStream
+type StreamPart struct {
+	Header textproto.MIMEHeader
+
+	// ContentType is the lowercased media type, Params its parameters
+	ContentType string
+	Params      map[string]string
+
+	Disposition string
+	Filename    string
+	ContentID   string
+
+	// Path numbers the part as Part.Path does
+	Path string
+}
+
+// StreamCallbacks are called by ParseEmailStream as the message is read, an
+// error returned by a callback stops the parsing and is returned. Nil
+// callbacks are skipped.
+type StreamCallbacks struct {
+	// OnHeader receives the email holding the header fields only
+	OnHeader func(email *Email) error
+
+	// OnTextPart receives the text/plain and text/html bodies, decoded and
+	// converted to UTF-8, and the text of the text/enriched ones
+	OnTextPart func(part *StreamPart, text string) error
+
+	// OnAttachment receives the other parts: attachments, embedded files,
+	// calendars and attached messages. r reads the decoded content, only
+	// until the callback returns.
+	OnAttachment func(part *StreamPart, r io.Reader) error
+}
+
+// ParseEmailStream parses the message in a single pass, handing the header
+// and the parts to the callbacks as they are read instead of building an
+// Email. The attachments are never held in memory.
+func ParseEmailStream(r io.Reader, callbacks StreamCallbacks) error {
+	msg, rawHeader, err := readMessage(r, ParseOptions{})
+	if err != nil {
+		return err
+	}
+
+	if callbacks.OnHeader != nil {
+		email, err := createEmailFromHeader(msg.Header)
+		if err != nil {
+			return err
+		}
+		email.RawHeader = rawHeader
+		if err := callbacks.OnHeader(email); err != nil {
+			return err
+		}
+	}
+
+	// the parts which can not be decoded are handed as they are
+	s := &streamParser{callbacks: callbacks, state: &parseState{ParseOptions: ParseOptions{Lenient: true}}}
+	return s.part(textproto.MIMEHeader(msg.Header), msg.Body, "", 0)
+}
+
+type streamParser struct {
+	callbacks StreamCallbacks
+	state     *parseState
+}
+
+func (s *streamParser) part(header textproto.MIMEHeader, body io.Reader, path string, depth int) error {
+	p := &StreamPart{
+		Header:      header,
+		Disposition: partDisposition(header),
+		Filename:    attachmentFilename(header),
+		ContentID:   strings.Trim(decodeMimeSentence(header.Get("Content-Id")), "<>"),
+		Path:        path,
+	}
+
+	var err error
+	p.ContentType, p.Params, err = parseContentType(header.Get("Content-Type"))
+	if err != nil {
+		p.ContentType = "application/octet-stream"
+	}
+
+	if strings.HasPrefix(p.ContentType, "multipart/") && p.Params["boundary"] != "" && depth < maxPartDepth {
+		return s.multipart(p, body, depth)
+	}
+
+	isText := p.ContentType == contentTypeTextPlain || p.ContentType == contentTypeTextHtml || p.ContentType == contentTypeTextEnriched
+	if isText && p.Disposition != dispositionAttachment && p.Filename == "" {
+		return s.text(p, body)
+	}
+
+	if s.callbacks.OnAttachment == nil {
+		return nil
+	}
+
+	decoded, err := decodingReader(body, header.Get("Content-Transfer-Encoding"), false)
+	if err != nil {
+		// kept as is
+		decoded = body
+	}
+
+	return s.callbacks.OnAttachment(p, decoded)
+}
+
+func (s *streamParser) multipart(p *StreamPart, body io.Reader, depth int) error {
+	prefix := p.Path
+	if prefix != "" {
+		prefix += "."
+	}
+
+	mr := multipart.NewReader(body, p.Params["boundary"])
+	for i := 1; ; i++ {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return &PartError{Path: p.Path, Err: err}
+		}
+
+		if p.ContentType == contentTypeMultipartDigest && part.Header.Get("Content-Type") == "" {
+			part.Header.Set("Content-Type", contentTypeMessageRFC822)
+		}
+
+		if err := s.part(part.Header, part, prefix+strconv.Itoa(i), depth+1); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *streamParser) text(p *StreamPart, body io.Reader) error {
+	if s.callbacks.OnTextPart == nil {
+		return nil
+	}
+
+	s.state.attachments = nil
+	decode := s.state.decodeText
+	if p.ContentType == contentTypeTextEnriched {
+		decode = s.state.decodeEnriched
+	}
+
+	text, err := decode(body, p.Header)
+	if err != nil {
+		return err
+	}
+
+	if err := s.callbacks.OnTextPart(p, text); err != nil {
+		return err
+	}
+
+	// the uuencoded files of the text
+	for _, a := range s.state.attachments {
+		if s.callbacks.OnAttachment == nil {
+			break
+		}
+
+		err := s.callbacks.OnAttachment(&StreamPart{
+			Header:      textproto.MIMEHeader{},
+			ContentType: a.ContentType,
+			Disposition: a.Disposition,
+			Filename:    a.Filename,
+			Path:        p.Path,
+		}, a.Data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,26 @@
+package smtpsrv
+
+import "strings"
+
+// DefaultSubaddressSeparator separates the mailbox from the tag, as in user+tag@example.com
+const DefaultSubaddressSeparator = "+"
+
+// SplitSubaddress splits a sub-address like user+tag@example.com into its
+// canonical mailbox (user@example.com) and tag (tag), sep defaults to "+".
+func SplitSubaddress(address, sep string) (mailbox, tag string) {
+	if sep == "" {
+		sep = DefaultSubaddressSeparator
+	}
+
+	local, domain, err := SplitAddress(address)
+	if err != nil {
+		return address, ""
+	}
+
+	ind := strings.Index(local, sep)
+	if ind < 1 {
+		return address, ""
+	}
+
+	return local[:ind] + "@" + domain, local[ind+len(sep):]
+}
@@ -0,0 +1,59 @@
+package smtpsrv
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// the first file descriptor passed by systemd socket activation
+const systemdFirstFD = 3
+
+// SystemdListeners returns the listeners passed by systemd socket activation
+// (sd_listen_fds), keyed by their FileDescriptorName, which defaults to the
+// socket unit name. It returns no listeners when the process wasn't
+// activated, each of them can then be served with Server.Serve.
+func SystemdListeners() (map[string][]net.Listener, error) {
+	listeners := map[string][]net.Listener{}
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", os.Getenv("LISTEN_FDS"))
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(systemdFirstFD+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, ls := range listeners {
+				for _, l := range ls {
+					l.Close()
+				}
+			}
+			return nil, fmt.Errorf("invalid listener %s: %v", name, err)
+		}
+
+		listeners[name] = append(listeners[name], l)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,139 @@
+package smtpsrv
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// threadIndexRootLen is the length of the header block of a Thread-Index,
+// a timestamp and the GUID of the conversation, each reply appends 5 bytes
+const threadIndexRootLen = 22
+
+// NormalizeMessageID returns the identifier of a Message-ID, without its
+// angle brackets, comments and whitespace, and its domain lowercased, as
+// the clients do not always keep its case
+func NormalizeMessageID(id string) string {
+	id = strings.Join(strings.Fields(stripComments(id)), "")
+	id = strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+
+	if ind := strings.LastIndexByte(id, '@'); ind != -1 {
+		id = id[:ind+1] + strings.ToLower(id[ind+1:])
+	}
+
+	return id
+}
+
+// ParseMessageIDs returns the normalized identifiers of a References or
+// In-Reply-To value, in order, see NormalizeMessageID
+func ParseMessageIDs(value string) []string {
+	ids := splitMessageIDs(value)
+	for i, id := range ids {
+		ids[i] = NormalizeMessageID(id)
+	}
+
+	return ids
+}
+
+// splitMessageIDs returns the identifiers of a References or In-Reply-To
+// value without their angle brackets. The identifiers missing them are
+// split on whitespace and commas.
+func splitMessageIDs(value string) []string {
+	value = stripComments(value)
+
+	var ids []string
+	for value != "" {
+		start := strings.IndexByte(value, '<')
+		if start == -1 {
+			ids = appendBareMessageIDs(ids, value)
+			break
+		}
+		ids = appendBareMessageIDs(ids, value[:start])
+
+		end := strings.IndexByte(value[start:], '>')
+		if end == -1 {
+			ids = appendBareMessageIDs(ids, value[start+1:])
+			break
+		}
+		if id := strings.Join(strings.Fields(value[start+1:start+end]), ""); id != "" {
+			ids = append(ids, id)
+		}
+		value = value[start+end+1:]
+	}
+
+	return ids
+}
+
+func appendBareMessageIDs(ids []string, s string) []string {
+	for _, id := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\r' || r == '\n' || r == ','
+	}) {
+		// the phrases of the obsolete In-Reply-To syntax are not identifiers
+		if strings.ContainsRune(id, '@') {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// ThreadParents returns the identifiers of the messages the email replies
+// to, from References and In-Reply-To, the root of the conversation first
+// and without duplicates
+func (e *Email) ThreadParents() []string {
+	seen := map[string]bool{}
+
+	var parents []string
+	for _, ids := range [][]string{e.References, e.InReplyTo} {
+		for _, id := range ids {
+			id = NormalizeMessageID(id)
+			if id == "" || seen[id] {
+				continue
+			}
+			seen[id] = true
+			parents = append(parents, id)
+		}
+	}
+
+	return parents
+}
+
+// ThreadIndexRoot returns the hex encoded conversation GUID of the
+// Thread-Index field Outlook adds, "" when it is missing or malformed. The
+// messages of a conversation share it.
+func (e *Email) ThreadIndexRoot() string {
+	value := strings.Join(strings.Fields(e.Header.Get("Thread-Index")), "")
+	if value == "" {
+		return ""
+	}
+
+	index, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(index) < threadIndexRootLen || (len(index)-threadIndexRootLen)%5 != 0 {
+		return ""
+	}
+
+	// the first 6 bytes are the time of the first message
+	return hex.EncodeToString(index[6:threadIndexRootLen])
+}
+
+// ThreadKey returns a stable identifier of the conversation of the email
+// for the threaded views: the root of its References, its In-Reply-To
+// parent, or its own Message-ID when it starts the conversation, so that
+// the whole conversation shares it. Without these fields it falls back to
+// the Thread-Index conversation, prefixed with "thread-index:", and is ""
+// otherwise.
+func (e *Email) ThreadKey() string {
+	if parents := e.ThreadParents(); len(parents) > 0 {
+		return parents[0]
+	}
+
+	if id := NormalizeMessageID(e.MessageID); id != "" {
+		return id
+	}
+
+	if root := e.ThreadIndexRoot(); root != "" {
+		return "thread-index:" + root
+	}
+
+	return ""
+}
@@ -0,0 +1,147 @@
+package smtpsrv
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+var errDataTimeout = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+	Message:      "Timeout exceeded, closing connection",
+}
+
+// timeoutListener enforces the command, DATA, transaction and connection
+// timeouts of its connections.
+type timeoutListener struct {
+	net.Listener
+	config *ServerConfig
+}
+
+func (l *timeoutListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &timeoutConn{Conn: conn, commandTimeout: l.config.CommandTimeout}
+	if l.config.ConnectionTimeout > 0 {
+		c.connDeadline = time.Now().Add(l.config.ConnectionTimeout)
+		c.Conn.SetReadDeadline(c.connDeadline)
+	}
+
+	return c, nil
+}
+
+// timeoutConn bounds the read deadlines set by go-smtp before every command
+// with the DATA, transaction and connection deadlines. Once a DATA transfer
+// timed out the reads return io.EOF, so the connection is closed quietly after
+// the 421 reply.
+type timeoutConn struct {
+	net.Conn
+	commandTimeout time.Duration
+	connDeadline   time.Time
+
+	mu           sync.Mutex
+	deadline     time.Time
+	dataDeadline time.Time
+	txDeadline   time.Time
+	expired      bool
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	expired := c.expired
+	c.mu.Unlock()
+
+	if expired {
+		return 0, io.EOF
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline is called by go-smtp before reading every command, the
+// CommandTimeout then replaces ReadTimeout.
+func (c *timeoutConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.commandTimeout > 0 {
+		t = time.Now().Add(c.commandTimeout)
+	}
+	c.deadline = t
+	c.dataDeadline = time.Time{}
+
+	return c.Conn.SetReadDeadline(c.effectiveDeadline())
+}
+
+// startData replaces the command deadline for the DATA transfer
+func (c *timeoutConn) startData(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if timeout > 0 {
+		c.dataDeadline = time.Now().Add(timeout)
+		c.deadline = time.Time{}
+	}
+	c.Conn.SetReadDeadline(c.effectiveDeadline())
+}
+
+// startTransaction sets the deadline of the transaction started by MAIL, a
+// zero timeout clears it.
+func (c *timeoutConn) startTransaction(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.txDeadline = time.Time{}
+	if timeout > 0 {
+		c.txDeadline = time.Now().Add(timeout)
+	}
+	c.Conn.SetReadDeadline(c.effectiveDeadline())
+}
+
+// expire reports whether the current read deadline passed, and if so stops
+// the reads of the connection.
+func (c *timeoutConn) expire() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deadline := c.effectiveDeadline()
+	if deadline.IsZero() || time.Now().Before(deadline) {
+		return false
+	}
+	c.expired = true
+
+	return true
+}
+
+// effectiveDeadline returns the earliest of the deadlines in effect
+func (c *timeoutConn) effectiveDeadline() time.Time {
+	deadline := c.deadline
+	for _, d := range []time.Time{c.dataDeadline, c.txDeadline, c.connDeadline} {
+		if !d.IsZero() && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+	}
+
+	return deadline
+}
+
+// sessionTimeoutConn returns the timeoutConn of a session connection, if any
+func sessionTimeoutConn(conn net.Conn) *timeoutConn {
+	c, _ := rawConn(conn).(*timeoutConn)
+	return c
+}
@@ -0,0 +1,69 @@
+package smtpsrv
+
+import (
+	"crypto/tls"
+	"strconv"
+)
+
+// TLSInfo describes the negotiated TLS parameters of a session
+type TLSInfo struct {
+	Version           string
+	CipherSuite       string
+	ALPN              string
+	Resumed           bool
+	ClientCertSubject string
+}
+
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	if state == nil {
+		return nil
+	}
+
+	info := &TLSInfo{
+		Version:     tlsVersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+		Resumed:     state.DidResume,
+	}
+
+	if len(state.PeerCertificates) > 0 {
+		info.ClientCertSubject = state.PeerCertificates[0].Subject.String()
+	}
+
+	return info
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	default:
+		return "0x" + strconv.FormatUint(uint64(version), 16)
+	}
+}
+
+// tlsLabels returns the metrics labels describing the TLS state of a session,
+// plaintext sessions are reported with the version "none".
+func tlsLabels(info *TLSInfo) map[string]string {
+	if info == nil {
+		return map[string]string{
+			"tls_version": "none",
+			"tls_cipher":  "",
+			"tls_alpn":    "",
+			"tls_resumed": "false",
+		}
+	}
+
+	return map[string]string{
+		"tls_version": info.Version,
+		"tls_cipher":  info.CipherSuite,
+		"tls_alpn":    info.ALPN,
+		"tls_resumed": strconv.FormatBool(info.Resumed),
+	}
+}
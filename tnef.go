@@ -0,0 +1,441 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"path"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const contentTypeMSTNEF = "application/ms-tnef"
+
+const tnefSignature = 0x223e9f78
+
+// TNEF attributes (MS-OXTNEF section 2.1.3.2)
+const (
+	tnefLevelMessage    = 1
+	tnefLevelAttachment = 2
+
+	tnefAttBody           = 0x2800c
+	tnefAttAttachData     = 0x6800f
+	tnefAttAttachTitle    = 0x18010
+	tnefAttAttachRendData = 0x69002
+	tnefAttMAPIProps      = 0x69003
+	tnefAttAttachment     = 0x69005
+)
+
+// MAPI properties
+const (
+	mapiBody               = 0x1000
+	mapiRTFCompressed      = 0x1009
+	mapiBodyHTML           = 0x1013
+	mapiAttachDataBin      = 0x3701
+	mapiAttachLongFilename = 0x3707
+	mapiAttachMIMETag      = 0x370e
+)
+
+// MAPI property types
+const (
+	mapiTypeString8 = 0x1e
+	mapiTypeUnicode = 0x1f
+	mapiTypeBinary  = 0x102
+	mapiTypeObject  = 0x0d
+	mapiTypeMulti   = 0x1000
+)
+
+var (
+	errTNEFSignature = errors.New("smtpsrv: not a TNEF stream")
+	errTNEFTruncated = errors.New("smtpsrv: truncated TNEF stream")
+	errRTFCompressed = errors.New("smtpsrv: invalid compressed RTF")
+)
+
+// TNEF is the content of an application/ms-tnef (winmail.dat) attachment
+// sent by Outlook
+type TNEF struct {
+	// TextBody, HTMLBody and RTFBody are the bodies found in the stream, the
+	// RTF one being decompressed
+	TextBody string
+	HTMLBody string
+	RTFBody  string
+
+	Attachments []Attachment
+}
+
+// DecodeTNEF decodes a TNEF stream (MS-OXTNEF), its MAPI properties are read
+// for the bodies and the attachments long filenames and MIME types.
+func DecodeTNEF(data []byte) (*TNEF, error) {
+	if len(data) < 6 || binary.LittleEndian.Uint32(data) != tnefSignature {
+		return nil, errTNEFSignature
+	}
+	data = data[6:]
+
+	tnef := &TNEF{}
+
+	type attachment struct {
+		title, filename, contentType string
+		data                         []byte
+	}
+	var attachments []*attachment
+
+	for len(data) > 0 {
+		if len(data) < 9 {
+			return nil, errTNEFTruncated
+		}
+
+		level := data[0]
+		id := binary.LittleEndian.Uint32(data[1:])
+		length := int(binary.LittleEndian.Uint32(data[5:]))
+		if length < 0 || len(data) < 9+length+2 {
+			return nil, errTNEFTruncated
+		}
+		value := data[9 : 9+length]
+		data = data[9+length+2:] // the checksum is not verified
+
+		if level == tnefLevelMessage {
+			switch id {
+			case tnefAttBody:
+				tnef.TextBody = tnefString(value)
+			case tnefAttMAPIProps:
+				props, err := decodeMAPIProps(value)
+				if err != nil {
+					continue
+				}
+
+				if body, ok := props[mapiBody]; ok && tnef.TextBody == "" {
+					tnef.TextBody = body.string()
+				}
+				if html, ok := props[mapiBodyHTML]; ok {
+					tnef.HTMLBody = html.string()
+				}
+				if rtf, ok := props[mapiRTFCompressed]; ok {
+					if decompressed, err := decompressRTF(rtf.data); err == nil {
+						tnef.RTFBody = string(decompressed)
+					}
+				}
+			}
+			continue
+		}
+
+		if level != tnefLevelAttachment {
+			continue
+		}
+
+		if id == tnefAttAttachRendData || len(attachments) == 0 {
+			// starts every attachment
+			attachments = append(attachments, &attachment{})
+		}
+		current := attachments[len(attachments)-1]
+
+		switch id {
+		case tnefAttAttachTitle:
+			current.title = tnefString(value)
+		case tnefAttAttachData:
+			current.data = value
+		case tnefAttAttachment:
+			props, err := decodeMAPIProps(value)
+			if err != nil {
+				continue
+			}
+
+			if filename, ok := props[mapiAttachLongFilename]; ok {
+				current.filename = filename.string()
+			}
+			if tag, ok := props[mapiAttachMIMETag]; ok {
+				current.contentType = tag.string()
+			}
+			if current.data == nil {
+				if bin, ok := props[mapiAttachDataBin]; ok && bin.typ == mapiTypeBinary {
+					current.data = bin.data
+				}
+			}
+		}
+	}
+
+	for _, a := range attachments {
+		if a.data == nil {
+			continue
+		}
+
+		filename := a.filename
+		if filename == "" {
+			filename = a.title
+		}
+
+		contentType := a.contentType
+		if contentType == "" {
+			contentType = mime.TypeByExtension(strings.ToLower(path.Ext(filename)))
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		tnef.Attachments = append(tnef.Attachments, Attachment{
+			Filename:    filename,
+			ContentType: strings.Split(contentType, ";")[0],
+			Data:        bytesReader(a.data),
+			Disposition: dispositionAttachment,
+		})
+	}
+
+	return tnef, nil
+}
+
+// expandTNEF replaces the TNEF attachments of the email by their content,
+// and sets the bodies missing from the MIME structure
+func (e *Email) expandTNEF() {
+	var attachments []Attachment
+	for _, a := range e.Attachments {
+		if a.Data == nil || (!strings.EqualFold(a.ContentType, contentTypeMSTNEF) && !strings.EqualFold(a.Filename, "winmail.dat")) {
+			attachments = append(attachments, a)
+			continue
+		}
+
+		data, err := readRewind(a.Data)
+		if err != nil {
+			attachments = append(attachments, a)
+			continue
+		}
+
+		tnef, err := DecodeTNEF(data)
+		if err != nil {
+			// kept as is
+			attachments = append(attachments, a)
+			continue
+		}
+
+		attachments = append(attachments, tnef.Attachments...)
+		if e.TextBody == "" {
+			e.TextBody = tnef.TextBody
+		}
+		if e.HTMLBody == "" {
+			e.HTMLBody = tnef.HTMLBody
+		}
+		if e.RTFBody == "" {
+			e.RTFBody = tnef.RTFBody
+		}
+	}
+
+	e.Attachments = attachments
+}
+
+type mapiValue struct {
+	typ  uint16
+	data []byte
+}
+
+// string decodes PT_STRING8 and PT_UNICODE values
+func (v mapiValue) string() string {
+	if v.typ == mapiTypeUnicode {
+		return utf16String(v.data)
+	}
+
+	return tnefString(v.data)
+}
+
+// decodeMAPIProps decodes the properties of attMAPIProps and attAttachment
+// (MS-OXTNEF section 2.1.3.4), keyed by property id. The named properties
+// and the multi-valued ones are skipped, only the first value is kept.
+func decodeMAPIProps(data []byte) (map[uint16]mapiValue, error) {
+	r := &tnefReader{data: data}
+
+	props := map[uint16]mapiValue{}
+	count := r.uint32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		tag := r.uint32()
+		typ, id := uint16(tag), uint16(tag>>16)
+
+		if id >= 0x8000 {
+			// named property: GUID, kind, then id or name
+			r.skip(16)
+			if r.uint32() == 1 {
+				r.skip(pad4(int(r.uint32())))
+			} else {
+				r.skip(4)
+			}
+		}
+
+		values := uint32(1)
+		multi := typ&mapiTypeMulti != 0
+		base := typ &^ mapiTypeMulti
+		variable := base == mapiTypeString8 || base == mapiTypeUnicode || base == mapiTypeBinary || base == mapiTypeObject
+		if multi || variable {
+			values = r.uint32()
+		}
+
+		for j := uint32(0); j < values && r.err == nil; j++ {
+			var value []byte
+			if variable {
+				length := int(r.uint32())
+				value = r.bytes(length)
+				r.skip(pad4(length) - length)
+			} else {
+				value = r.bytes(mapiFixedSize(base))
+			}
+
+			if _, ok := props[id]; !ok && j == 0 && !multi {
+				props[id] = mapiValue{typ: base, data: value}
+			}
+		}
+	}
+
+	return props, r.err
+}
+
+func mapiFixedSize(typ uint16) int {
+	switch typ {
+	case 0x05, 0x06, 0x07, 0x14, 0x40: // double, currency, apptime, int64, systime
+		return 8
+	case 0x48: // clsid
+		return 16
+	default: // int16, int32, float, error, boolean and null, padded to 4 bytes
+		return 4
+	}
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// tnefReader reads little endian values, keeping the first error
+type tnefReader struct {
+	data []byte
+	err  error
+}
+
+func (r *tnefReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || n > len(r.data) {
+		r.err = errTNEFTruncated
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tnefReader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *tnefReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint32(b)
+}
+
+// tnefString decodes a NUL terminated 8-bit string, assumed to be UTF-8 or
+// else Windows-1252
+func tnefString(data []byte) string {
+	if ind := bytes.IndexByte(data, 0); ind != -1 {
+		data = data[:ind]
+	}
+
+	if utf8.Valid(data) {
+		return string(data)
+	}
+
+	r, err := convertToUtf8(bytes.NewReader(data), "windows-1252")
+	if err != nil {
+		return string(data)
+	}
+
+	converted, err := ioutil.ReadAll(r)
+	if err != nil {
+		return string(data)
+	}
+
+	return string(converted)
+}
+
+// utf16String decodes a NUL terminated UTF-16LE string
+func utf16String(data []byte) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		unit := binary.LittleEndian.Uint16(data[i:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+
+	return string(utf16.Decode(units))
+}
+
+// the initial dictionary of compressed RTF (MS-OXRTFCP section 3.1.2.1)
+const rtfDictionary = `{\rtf1\ansi\mac\deff0\deftab720{\fonttbl;}{\f0\fnil \froman \fswiss \fmodern \fscript \fdecor MS Sans SerifSymbolArialTimes New RomanCourier{\colortbl\red0\green0\blue0` + "\r\n" + `\par \pard\plain\f0\fs20\b\i\u\tab\tx`
+
+// decompressRTF decompresses a PR_RTF_COMPRESSED value (MS-OXRTFCP)
+func decompressRTF(data []byte) ([]byte, error) {
+	if len(data) < 16 {
+		return nil, errRTFCompressed
+	}
+
+	rawSize := binary.LittleEndian.Uint32(data[4:])
+	compType := binary.LittleEndian.Uint32(data[8:])
+	data = data[16:]
+
+	switch compType {
+	case 0x414c454d: // "MELA", uncompressed
+		if int(rawSize) > len(data) {
+			return nil, errRTFCompressed
+		}
+		return data[:rawSize], nil
+	case 0x75465a4c: // "LZFu"
+	default:
+		return nil, errRTFCompressed
+	}
+
+	var dict [4096]byte
+	copy(dict[:], rtfDictionary)
+	write := len(rtfDictionary)
+
+	out := make([]byte, 0, rawSize)
+	for len(data) > 0 {
+		control := data[0]
+		data = data[1:]
+
+		for bit := uint(0); bit < 8 && len(data) > 0; bit++ {
+			if control&(1<<bit) == 0 {
+				// literal
+				out = append(out, data[0])
+				dict[write] = data[0]
+				write = (write + 1) % len(dict)
+				data = data[1:]
+				continue
+			}
+
+			if len(data) < 2 {
+				return nil, errRTFCompressed
+			}
+
+			ref := int(data[0])<<8 | int(data[1])
+			data = data[2:]
+
+			offset, length := ref>>4, ref&0xf+2
+			if offset == write {
+				return out, nil
+			}
+
+			for i := 0; i < length; i++ {
+				c := dict[(offset+i)%len(dict)]
+				out = append(out, c)
+				dict[write] = c
+				write = (write + 1) % len(dict)
+			}
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,154 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// testdata/winmail.dat holds a message with plain text, HTML and compressed
+// RTF bodies, a named property, and three attachments: a PDF described by
+// its attAttachment properties, a text file only described by its title and
+// an image whose data is a property.
+func readTNEFFixture(t *testing.T) []byte {
+	t.Helper()
+
+	data, err := ioutil.ReadFile("testdata/winmail.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+type tnefTestAttachment struct {
+	filename, contentType, data string
+}
+
+var tnefFixtureAttachments = []tnefTestAttachment{
+	{"Quarterly report.pdf", "application/pdf", "%PDF-1.4\n% quarterly report\n%%EOF\n"},
+	{"notes.txt", "text/plain", "Remember the milk.\r\n"},
+	{"logo.png", "image/png", "\x89PNG\r\n\x1a\n"},
+}
+
+func checkTNEFAttachments(t *testing.T, attachments []Attachment, want []tnefTestAttachment) {
+	t.Helper()
+
+	if len(attachments) != len(want) {
+		t.Fatalf("got %d attachments, want %d", len(attachments), len(want))
+	}
+
+	for i, a := range attachments {
+		data, err := readRewind(a.Data)
+		if err != nil {
+			t.Fatalf("attachment %d: %v", i, err)
+		}
+
+		got := tnefTestAttachment{a.Filename, a.ContentType, string(data)}
+		if got != want[i] {
+			t.Errorf("attachment %d = %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+func TestDecodeTNEF(t *testing.T) {
+	tnef, err := DecodeTNEF(readTNEFFixture(t))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if want := "Hello from Outlook, the report is attached."; tnef.TextBody != want {
+		t.Errorf("text body = %q, want %q", tnef.TextBody, want)
+	}
+
+	if want := "<p>Hello from Outlook, the report is attached.</p>"; tnef.HTMLBody != want {
+		t.Errorf("HTML body = %q, want %q", tnef.HTMLBody, want)
+	}
+
+	// the compressed RTF example of MS-OXRTFCP section 4.1.1
+	if want := "{\\rtf1\\ansi\\ansicpg1252\\pard hello world}\r\n"; tnef.RTFBody != want {
+		t.Errorf("RTF body = %q, want %q", tnef.RTFBody, want)
+	}
+
+	checkTNEFAttachments(t, tnef.Attachments, tnefFixtureAttachments)
+}
+
+func TestDecodeTNEFInvalid(t *testing.T) {
+	data := readTNEFFixture(t)
+
+	if _, err := DecodeTNEF([]byte("not a TNEF stream")); err != errTNEFSignature {
+		t.Errorf("err = %v, want %v", err, errTNEFSignature)
+	}
+
+	if _, err := DecodeTNEF(data[:len(data)-5]); err != errTNEFTruncated {
+		t.Errorf("err = %v, want %v", err, errTNEFTruncated)
+	}
+}
+
+func TestDecompressRTF(t *testing.T) {
+	// MS-OXRTFCP section 4.1.2, a run longer than the dictionary references
+	compressed := []byte("\x1a\x00\x00\x00\x1c\x00\x00\x00\x4c\x5a\x46\x75\xe2\xd4\x4b\x51" +
+		"\x41\x00\x04\x20\x57\x58\x59\x5a\x0d\x6e\x7d\x01\x0e\xb0")
+
+	decompressed, err := decompressRTF(compressed)
+	if err != nil {
+		t.Fatalf("decompress: %v", err)
+	}
+
+	if want := "{\\rtf1 WXYZWXYZWXYZWXYZWXYZ}"; string(decompressed) != want {
+		t.Errorf("decompressed = %q, want %q", decompressed, want)
+	}
+
+	uncompressed := append([]byte("\x10\x00\x00\x00\x04\x00\x00\x00MELA\x00\x00\x00\x00"), "{\\rtf1}"...)
+	if decompressed, err := decompressRTF(uncompressed); err != nil || string(decompressed) != "{\\rt" {
+		t.Errorf("uncompressed = %q, %v, want %q", decompressed, err, "{\\rt")
+	}
+}
+
+func TestParseEmailTNEF(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(readTNEFFixture(t))
+
+	var raw bytes.Buffer
+	raw.WriteString("From: alice@origin.example\r\n" +
+		"To: bob@example.com\r\n" +
+		"Subject: Quarterly report\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b\"\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=us-ascii\r\n" +
+		"\r\n" +
+		"See the attachments.\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/ms-tnef; name=\"winmail.dat\"\r\n" +
+		"Content-Disposition: attachment; filename=\"winmail.dat\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n")
+	for len(encoded) > 76 {
+		raw.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	raw.WriteString(encoded + "\r\n--b--\r\n")
+
+	email, err := ParseEmail(&raw)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	// the bodies of the MIME structure are kept
+	if !strings.HasPrefix(email.TextBody, "See the attachments.") {
+		t.Errorf("text body = %q", email.TextBody)
+	}
+
+	if email.HTMLBody != "<p>Hello from Outlook, the report is attached.</p>" {
+		t.Errorf("HTML body = %q", email.HTMLBody)
+	}
+
+	if !strings.Contains(email.RTFBody, "hello world") {
+		t.Errorf("RTF body = %q", email.RTFBody)
+	}
+
+	checkTNEFAttachments(t, email.Attachments, tnefFixtureAttachments)
+}
@@ -0,0 +1,51 @@
+package smtpsrv
+
+import "context"
+
+// Tracer starts the spans of the SMTP transactions, it maps directly onto an
+// OpenTelemetry tracer:
+//
+//	func (t otelTracer) Start(ctx context.Context, name string, attrs map[string]string) (context.Context, smtpsrv.Span) {
+//		ctx, span := t.tracer.Start(ctx, name)
+//		for k, v := range attrs {
+//			span.SetAttributes(attribute.String(k, v))
+//		}
+//		return ctx, otelSpan{span}
+//	}
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs map[string]string) (context.Context, Span)
+}
+
+// Span is a single traced operation
+type Span interface {
+	// SetError records the failure of the operation, it is never called with nil
+	SetError(err error)
+	End()
+}
+
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, _ string, _ map[string]string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetError(error) {}
+func (nopSpan) End()           {}
+
+func (cfg *ServerConfig) tracer() Tracer {
+	if cfg.Tracer == nil {
+		return nopTracer{}
+	}
+
+	return cfg.Tracer
+}
+
+// endSpan records err, if any, and ends the span
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.SetError(err)
+	}
+	span.End()
+}
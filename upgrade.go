@@ -0,0 +1,238 @@
+package smtpsrv
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const upgradeEnvFDs = "SMTPSRV_UPGRADE_FDS"
+
+// the first inherited file descriptor, after stdin, stdout and stderr
+const upgradeFirstFD = 3
+
+var (
+	ErrUpgradeInProgress = errors.New("upgrade already in progress")
+	ErrUpgradeTimeout    = errors.New("upgraded process didn't become ready in time")
+)
+
+// Upgrader hands the listening sockets over to a newly executed copy of the
+// binary, so it can be replaced without dropping connections.
+//
+// The old process calls Upgrade (usually on SIGHUP), the new process inherits
+// the listeners through Listen and calls Ready once it accepts connections,
+// then the old process stops accepting and drains its sessions.
+type Upgrader struct {
+	// ReadyTimeout is how long Upgrade waits for the new process to call Ready
+	ReadyTimeout time.Duration
+
+	mu        sync.Mutex
+	listeners []*net.TCPListener
+	inherited []*os.File
+	ready     *os.File
+	upgrading bool
+
+	exit     chan struct{}
+	exitOnce sync.Once
+}
+
+// NewUpgrader creates an upgrader, picking up the listeners inherited from
+// the parent process, if any.
+func NewUpgrader() (*Upgrader, error) {
+	u := &Upgrader{
+		ReadyTimeout: time.Minute,
+		exit:         make(chan struct{}),
+	}
+
+	env := os.Getenv(upgradeEnvFDs)
+	if env == "" {
+		return u, nil
+	}
+	os.Unsetenv(upgradeEnvFDs)
+
+	n, err := strconv.Atoi(env)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s: %q", upgradeEnvFDs, env)
+	}
+
+	for i := 0; i < n; i++ {
+		u.inherited = append(u.inherited, os.NewFile(uintptr(upgradeFirstFD+i), "listener"))
+	}
+	u.ready = os.NewFile(uintptr(upgradeFirstFD+n), "ready")
+
+	return u, nil
+}
+
+// Listen returns an inherited listener bound to addr, or a new one.
+func (u *Upgrader) Listen(network, addr string) (net.Listener, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for i, f := range u.inherited {
+		l, err := net.FileListener(f)
+		if err != nil {
+			continue
+		}
+
+		tl, ok := l.(*net.TCPListener)
+		if !ok || !sameAddr(tl.Addr(), network, addr) {
+			l.Close()
+			continue
+		}
+
+		f.Close()
+		u.inherited = append(u.inherited[:i], u.inherited[i+1:]...)
+		u.listeners = append(u.listeners, tl)
+
+		return tl, nil
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("upgrader only supports tcp listeners, got %s", network)
+	}
+	u.listeners = append(u.listeners, tl)
+
+	return tl, nil
+}
+
+func sameAddr(a net.Addr, network, addr string) bool {
+	want, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return false
+	}
+
+	got, ok := a.(*net.TCPAddr)
+	if !ok || got.Port != want.Port {
+		return false
+	}
+
+	return want.IP == nil || (want.IP.IsUnspecified() && got.IP.IsUnspecified()) || want.IP.Equal(got.IP)
+}
+
+// Ready notifies the parent process, if any, that the listeners are served,
+// it is called by the server once it listens and may be called more than once.
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.ready == nil {
+		return nil
+	}
+
+	_, err := u.ready.Write([]byte{1})
+	u.ready.Close()
+	u.ready = nil
+
+	return err
+}
+
+// Upgrade starts a new copy of the running binary with the current listeners,
+// and once it is ready, closes the channel returned by Exit.
+func (u *Upgrader) Upgrade() error {
+	u.mu.Lock()
+	if u.upgrading {
+		u.mu.Unlock()
+		return ErrUpgradeInProgress
+	}
+	u.upgrading = true
+	u.mu.Unlock()
+
+	defer func() {
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+	}()
+
+	files, err := u.listenerFiles()
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+
+	env := append(os.Environ(), upgradeEnvFDs+"="+strconv.Itoa(len(files)))
+	procFiles := append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...)
+	procFiles = append(procFiles, readyW)
+
+	proc, err := os.StartProcess(executable, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: procFiles,
+	})
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+
+	readyc := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := readyR.Read(b)
+		readyc <- err
+	}()
+
+	select {
+	case err := <-readyc:
+		if err != nil {
+			proc.Kill()
+			return fmt.Errorf("upgraded process exited before being ready: %v", err)
+		}
+	case <-time.After(u.ReadyTimeout):
+		proc.Kill()
+		return ErrUpgradeTimeout
+	}
+
+	proc.Release()
+	u.exitOnce.Do(func() {
+		close(u.exit)
+	})
+
+	return nil
+}
+
+func (u *Upgrader) listenerFiles() ([]*os.File, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	files := []*os.File{}
+	for _, l := range u.listeners {
+		f, err := l.File()
+		if err != nil {
+			return files, err
+		}
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+// Exit is closed once a new process took over the listeners, the servers
+// using this upgrader then stop accepting and drain their sessions.
+func (u *Upgrader) Exit() <-chan struct{} {
+	return u.exit
+}
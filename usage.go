@@ -0,0 +1,190 @@
+package smtpsrv
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// UsageEvent reports the traffic accepted for a single tenant/domain pair
+// during one metering period.
+type UsageEvent struct {
+	Tenant   string
+	Domain   string
+	Messages int64
+	Bytes    int64
+	Start    time.Time
+	End      time.Time
+}
+
+// UsageSinkFunc receives the usage events emitted at the end of every period,
+// a non-nil error keeps the events for the next period.
+type UsageSinkFunc func(events []UsageEvent) error
+
+// UsageTenantFunc maps a transaction to the tenant it is billed to.
+type UsageTenantFunc func(c *Context) string
+
+type usageKey struct {
+	tenant string
+	domain string
+}
+
+type usageCounter struct {
+	messages int64
+	bytes    int64
+}
+
+// UsageMeter aggregates accepted messages and bytes per tenant and recipient
+// domain, and periodically emits them to a sink. A message to several domains
+// counts for each of them.
+type UsageMeter struct {
+	tenant UsageTenantFunc
+	sink   UsageSinkFunc
+
+	mu       sync.Mutex
+	start    time.Time
+	counters map[usageKey]*usageCounter
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewUsageMeter creates a meter that flushes to sink every interval,
+// tenant may be nil in which case every event has an empty tenant.
+func NewUsageMeter(interval time.Duration, tenant UsageTenantFunc, sink UsageSinkFunc) *UsageMeter {
+	m := &UsageMeter{
+		tenant:   tenant,
+		sink:     sink,
+		start:    time.Now(),
+		counters: map[usageKey]*usageCounter{},
+		done:     make(chan struct{}),
+	}
+
+	if interval > 0 {
+		go m.loop(interval)
+	}
+
+	return m
+}
+
+func (m *UsageMeter) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.Flush()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// Record adds a single accepted message of n bytes.
+func (m *UsageMeter) Record(tenant, domain string, n int64) {
+	m.add(usageKey{tenant: tenant, domain: domain}, 1, n)
+}
+
+func (m *UsageMeter) add(key usageKey, messages, bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counter, ok := m.counters[key]
+	if !ok {
+		counter = &usageCounter{}
+		m.counters[key] = counter
+	}
+
+	counter.messages += messages
+	counter.bytes += bytes
+}
+
+// Flush emits the usage collected since the previous flush.
+func (m *UsageMeter) Flush() error {
+	m.mu.Lock()
+	start, counters := m.start, m.counters
+	m.start, m.counters = time.Now(), map[usageKey]*usageCounter{}
+	m.mu.Unlock()
+
+	if len(counters) == 0 || m.sink == nil {
+		return nil
+	}
+
+	end := time.Now()
+	events := make([]UsageEvent, 0, len(counters))
+	for key, counter := range counters {
+		events = append(events, UsageEvent{
+			Tenant:   key.tenant,
+			Domain:   key.domain,
+			Messages: counter.messages,
+			Bytes:    counter.bytes,
+			Start:    start,
+			End:      end,
+		})
+	}
+
+	if err := m.sink(events); err != nil {
+		m.mu.Lock()
+		m.start = start
+		m.mu.Unlock()
+
+		for key, counter := range counters {
+			m.add(key, counter.messages, counter.bytes)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Close stops the periodic flushing and emits the remaining usage.
+func (m *UsageMeter) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+
+	return m.Flush()
+}
+
+// record adds the message to the usage of each domain it is delivered to,
+// once per domain however many of its recipients it has
+func (m *UsageMeter) record(c *Context, n int64) {
+	tenant := ""
+	if m.tenant != nil {
+		tenant = m.tenant(c)
+	}
+
+	seen := map[string]bool{}
+	for _, rcpt := range c.deliveryRecipients() {
+		_, domain, _ := SplitAddress(rcpt)
+		domain = strings.ToLower(domain)
+		if seen[domain] {
+			continue
+		}
+		seen[domain] = true
+
+		m.Record(tenant, domain, n)
+	}
+}
+
+// countingReader counts the bytes read through it, and remembers whether the
+// message exceeded the maximum size even if the handler ignored the error.
+type countingReader struct {
+	r        io.Reader
+	n        int64
+	tooLarge bool
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	if err == smtp.ErrDataTooLarge {
+		cr.tooLarge = true
+	}
+	return n, err
+}
@@ -0,0 +1,115 @@
+package smtpsrv
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var errUUEncoding = errors.New("smtpsrv: invalid uuencoded data")
+
+// a uuencoded block within a text body, from its begin line to its end line
+var reUUEncodedBlock = regexp.MustCompile(`(?m)^begin [0-7]{3,4} ([^\r\n]+)\r?\n((?:[^\r\n]*\r?\n)*?)end\s*?(?:\r?\n|$)`)
+
+// uudecodingReader decodes the uuencoded content, with or without its begin
+// and end lines
+func uudecodingReader(content io.Reader) (io.Reader, error) {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := uudecode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(decoded), nil
+}
+
+func uudecode(data []byte) ([]byte, error) {
+	var out []byte
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, "begin ") || line == "" {
+			continue
+		}
+		if line == "end" {
+			break
+		}
+
+		// the first character encodes the length of the line
+		n := int(line[0]-' ') & 63
+		if n == 0 {
+			continue
+		}
+
+		chars := line[1:]
+		if len(chars) < (n+2)/3*4 {
+			// some encoders strip the trailing spaces
+			chars += strings.Repeat(" ", (n+2)/3*4-len(chars))
+		}
+
+		var decoded []byte
+		for i := 0; i+4 <= len(chars) && len(decoded) < n; i += 4 {
+			var c [4]byte
+			for j := range c {
+				if chars[i+j] < ' ' || chars[i+j] > '`' {
+					return nil, errUUEncoding
+				}
+				c[j] = (chars[i+j] - ' ') & 63
+			}
+
+			decoded = append(decoded, c[0]<<2|c[1]>>4, c[1]<<4|c[2]>>2, c[2]<<6|c[3])
+		}
+
+		if len(decoded) < n {
+			return nil, errUUEncoding
+		}
+		out = append(out, decoded[:n]...)
+	}
+
+	return out, scanner.Err()
+}
+
+// extractUUEncoded removes the uuencoded blocks of a text body and returns
+// them as attachments
+func extractUUEncoded(text string) (string, []Attachment) {
+	if !strings.Contains(text, "begin ") {
+		return text, nil
+	}
+
+	var attachments []Attachment
+	text = reUUEncodedBlock.ReplaceAllStringFunc(text, func(block string) string {
+		data, err := uudecode([]byte(block))
+		if err != nil {
+			// left in the text
+			return block
+		}
+
+		filename := strings.TrimSpace(reUUEncodedBlock.FindStringSubmatch(block)[1])
+		contentType := mime.TypeByExtension(strings.ToLower(path.Ext(filename)))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		attachments = append(attachments, Attachment{
+			Filename:    filename,
+			ContentType: strings.Split(contentType, ";")[0],
+			Data:        bytesReader(data),
+			Disposition: dispositionAttachment,
+		})
+
+		return ""
+	})
+
+	return text, attachments
+}
@@ -0,0 +1,85 @@
+package smtpsrv
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// handleVerify answers VRFY with ServerConfig.Verify
+func (c *protocolConn) handleVerify(arg string) {
+	if !c.queryAllowed(arg) {
+		return
+	}
+
+	addr, err := c.session.verify(arg)
+	if err != nil {
+		c.replyError(rejectError(err, 550, EnhancedCode{5, 1, 1}))
+		return
+	}
+
+	if addr == nil {
+		c.reply(252, EnhancedCode{2, 1, 5}, "Cannot VRFY user, but will accept message")
+		return
+	}
+
+	c.reply(250, EnhancedCode{2, 1, 5}, addr.String())
+}
+
+// handleExpand answers EXPN with ServerConfig.Expand
+func (c *protocolConn) handleExpand(arg string) {
+	if !c.queryAllowed(arg) {
+		return
+	}
+
+	members, err := c.session.expand(arg)
+	if err != nil {
+		c.replyError(rejectError(err, 550, EnhancedCode{5, 1, 1}))
+		return
+	}
+
+	if len(members) == 0 {
+		c.reply(550, EnhancedCode{5, 1, 1}, "Mailing list has no members")
+		return
+	}
+
+	var sb strings.Builder
+	for i, member := range members {
+		sep := "-"
+		if i == len(members)-1 {
+			sep = " "
+		}
+		sb.WriteString("250" + sep + "2.1.5 " + member.String() + "\r\n")
+	}
+	c.current().Write([]byte(sb.String()))
+}
+
+// queryAllowed replies the VRFY and EXPN queries which can't be answered
+func (c *protocolConn) queryAllowed(arg string) bool {
+	if c.session == nil {
+		c.reply(503, EnhancedCode{5, 5, 1}, "Send HELO/EHLO first")
+		return false
+	}
+
+	if strings.TrimSpace(arg) == "" {
+		c.reply(501, EnhancedCode{5, 5, 4}, "Missing argument")
+		return false
+	}
+
+	return true
+}
+
+func (s *Session) verify(query string) (*mail.Address, error) {
+	c := Context{session: s}
+	addr, err := s.config.Verify(&c, strings.TrimSpace(query))
+	s.log("vrfy", "query", query, "err", err)
+
+	return addr, err
+}
+
+func (s *Session) expand(list string) ([]*mail.Address, error) {
+	c := Context{session: s}
+	members, err := s.config.Expand(&c, strings.TrimSpace(list))
+	s.log("expn", "list", list, "err", err)
+
+	return members, err
+}
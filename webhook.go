@@ -0,0 +1,329 @@
+package smtpsrv
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// WebhookSignatureHeader holds the hex encoded HMAC-SHA256 of the request
+// body, keyed with the webhook secret, as "sha256=<hex>".
+const WebhookSignatureHeader = "X-Smtpsrv-Signature"
+
+var errWebhookRejected = &Error{
+	Code:         554,
+	EnhancedCode: EnhancedCode{5, 3, 0},
+	Message:      "Message rejected by the webhook",
+}
+
+// WebhookConfig holds the webhook settings
+type WebhookConfig struct {
+	URL string
+
+	// Secret signs every request when set, see WebhookSignatureHeader
+	Secret string
+
+	// Timeout of a single request, defaults to 10 seconds
+	Timeout time.Duration
+
+	// Attempts is the maximum number of requests per message, defaults to 3.
+	// Failed requests are retried after Backoff, doubled after every attempt,
+	// which defaults to 1 second.
+	Attempts int
+	Backoff  time.Duration
+
+	// Multipart uploads the attachments as multipart/form-data files next to
+	// the "payload" JSON field instead of inlining them as base64
+	Multipart bool
+
+	// Client defaults to a client using Timeout
+	Client *http.Client
+}
+
+// WebhookAddress is an address of the webhook payload
+type WebhookAddress struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+}
+
+// WebhookAttachment is an attachment or embedded file of the webhook payload,
+// Data is only set when the attachments are inlined, Part names the
+// multipart file otherwise.
+type WebhookAttachment struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	Data        []byte `json:"data,omitempty"`
+	Part        string `json:"part,omitempty"`
+
+	// Stored references the attachments offloaded while parsing
+	Stored *StoredObject `json:"stored,omitempty"`
+}
+
+// WebhookPayload is the JSON document posted for every message
+type WebhookPayload struct {
+	SessionID     string `json:"session_id"`
+	TransactionID string `json:"transaction_id"`
+	RemoteAddr    string `json:"remote_addr"`
+
+	MailFrom string   `json:"mail_from"`
+	RcptTo   []string `json:"rcpt_to"`
+
+	Headers   map[string][]string `json:"headers"`
+	Subject   string              `json:"subject"`
+	From      []WebhookAddress    `json:"from"`
+	To        []WebhookAddress    `json:"to"`
+	Cc        []WebhookAddress    `json:"cc,omitempty"`
+	ReplyTo   []WebhookAddress    `json:"reply_to,omitempty"`
+	Date      time.Time           `json:"date"`
+	MessageID string              `json:"message_id"`
+
+	TextBody string `json:"text_body"`
+	HTMLBody string `json:"html_body"`
+
+	Attachments   []WebhookAttachment `json:"attachments"`
+	EmbeddedFiles []WebhookAttachment `json:"embedded_files"`
+}
+
+// Webhook posts the parsed messages to an HTTP endpoint
+type Webhook struct {
+	config WebhookConfig
+}
+
+func NewWebhook(cfg WebhookConfig) *Webhook {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	if cfg.Attempts == 0 {
+		cfg.Attempts = 3
+	}
+
+	if cfg.Backoff == 0 {
+		cfg.Backoff = time.Second
+	}
+
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: cfg.Timeout}
+	}
+
+	return &Webhook{
+		config: cfg,
+	}
+}
+
+// Handler returns a handler posting each message, it is accepted once the
+// endpoint replied 2xx. A 4xx reply rejects the message, other failures are
+// retried and then replied as a temporary failure.
+func (w *Webhook) Handler() HandlerFunc {
+	return func(c *Context) error {
+		email, err := c.Parse()
+		if err != nil {
+			return err
+		}
+
+		payload, files, err := newWebhookPayload(c, email, w.config.Multipart)
+		if err != nil {
+			return err
+		}
+
+		body, contentType, err := w.encode(payload, files)
+		if err != nil {
+			return err
+		}
+
+		return w.post(body, contentType)
+	}
+}
+
+type webhookFile struct {
+	part string
+	name string
+	data []byte
+}
+
+// newWebhookPayload builds the payload of the message, the attachments are
+// returned apart instead of being inlined when upload is set
+func newWebhookPayload(c *Context, email *Email, upload bool) (*WebhookPayload, []webhookFile, error) {
+	payload := &WebhookPayload{
+		SessionID:     c.SessionID(),
+		TransactionID: c.TransactionID(),
+		RemoteAddr:    c.RemoteAddr().String(),
+		MailFrom:      c.From().Address,
+		RcptTo:        c.deliveryRecipients(),
+		Headers:       email.Header,
+		Subject:       email.Subject,
+		From:          webhookAddresses(email.From),
+		To:            webhookAddresses(email.To),
+		Cc:            webhookAddresses(email.Cc),
+		ReplyTo:       webhookAddresses(email.ReplyTo),
+		Date:          email.Date,
+		MessageID:     email.MessageID,
+		TextBody:      email.TextBody,
+		HTMLBody:      email.HTMLBody,
+	}
+
+	var files []webhookFile
+	file := func(name, contentType, cid string, r io.Reader) (WebhookAttachment, error) {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return WebhookAttachment{}, err
+		}
+
+		a := WebhookAttachment{
+			Filename:    name,
+			ContentID:   cid,
+			ContentType: contentType,
+			Size:        len(data),
+		}
+
+		if upload {
+			a.Part = "file" + strconv.Itoa(len(files))
+			files = append(files, webhookFile{part: a.Part, name: name, data: data})
+		} else {
+			a.Data = data
+		}
+
+		return a, nil
+	}
+
+	for _, attachment := range email.Attachments {
+		if attachment.Stored != nil {
+			payload.Attachments = append(payload.Attachments, WebhookAttachment{
+				Filename:    attachment.Filename,
+				ContentType: attachment.ContentType,
+				Size:        int(attachment.Stored.Size),
+				Stored:      attachment.Stored,
+			})
+			continue
+		}
+
+		a, err := file(attachment.Filename, attachment.ContentType, attachment.ContentID, attachment.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+		payload.Attachments = append(payload.Attachments, a)
+	}
+
+	for _, embedded := range email.EmbeddedFiles {
+		a, err := file(embedded.CID, embedded.ContentType, embedded.CID, embedded.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+		payload.EmbeddedFiles = append(payload.EmbeddedFiles, a)
+	}
+
+	return payload, files, nil
+}
+
+// encode returns the request body, a JSON document or a multipart form
+// holding it and the attachments
+func (w *Webhook) encode(payload *WebhookPayload, files []webhookFile) ([]byte, string, error) {
+	doc, err := json.Marshal(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !w.config.Multipart {
+		return doc, "application/json", nil
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="payload"`)
+	header.Set("Content-Type", "application/json")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return nil, "", err
+	}
+	part.Write(doc)
+
+	for _, f := range files {
+		part, err := mw.CreateFormFile(f.part, f.name)
+		if err != nil {
+			return nil, "", err
+		}
+		part.Write(f.data)
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return body.Bytes(), mw.FormDataContentType(), nil
+}
+
+func (w *Webhook) post(body []byte, contentType string) error {
+	backoff := w.config.Backoff
+	for attempt := 0; attempt < w.config.Attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		status, err := w.request(body, contentType)
+		if err != nil {
+			continue
+		}
+
+		if status/100 == 2 {
+			return nil
+		}
+
+		// timeouts and rate limiting are worth retrying, other client errors are not
+		if status/100 == 4 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests {
+			return errWebhookRejected
+		}
+	}
+
+	return ErrTemporaryFailure
+}
+
+func (w *Webhook) request(body []byte, contentType string) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	if w.config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.config.Secret))
+		mac.Write(body)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.config.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return resp.StatusCode, nil
+}
+
+func webhookAddresses(addrs []*mail.Address) []WebhookAddress {
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	out := make([]WebhookAddress, len(addrs))
+	for i, addr := range addrs {
+		out[i] = WebhookAddress{Name: addr.Name, Address: addr.Address}
+	}
+
+	return out
+}
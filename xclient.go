@@ -0,0 +1,175 @@
+package smtpsrv
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// the XCLIENT attributes advertised, NAME and PROTO are accepted and ignored
+const xclientAttrs = "ADDR PORT HELO LOGIN NAME PROTO"
+
+var (
+	errXCLIENTSyntax = &smtp.SMTPError{
+		Code:         501,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+		Message:      "Bad XCLIENT attribute syntax",
+	}
+	errXCLIENTTransaction = &smtp.SMTPError{
+		Code:         503,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+		Message:      "XCLIENT not permitted in a mail transaction",
+	}
+)
+
+// handleXCLIENT applies the XCLIENT attributes of a trusted proxy, and greets
+// the client again
+func (c *protocolConn) handleXCLIENT(arg string) error {
+	if c.transaction {
+		c.replyError(errXCLIENTTransaction)
+		return nil
+	}
+
+	ip, port := addrIP(c.RemoteAddr()), 0
+	if tcpAddr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		port = tcpAddr.Port
+	}
+
+	var helo, login string
+	for _, attr := range strings.Fields(arg) {
+		i := strings.IndexByte(attr, '=')
+		if i < 0 {
+			c.replyError(errXCLIENTSyntax)
+			return nil
+		}
+
+		name := strings.ToUpper(attr[:i])
+		value, err := decodeXtext(attr[i+1:])
+		if err != nil {
+			c.replyError(errXCLIENTSyntax)
+			return nil
+		}
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			continue
+		}
+
+		switch name {
+		case "ADDR":
+			if ip = net.ParseIP(strings.TrimPrefix(strings.ToUpper(value), "IPV6:")); ip == nil {
+				c.replyError(errXCLIENTSyntax)
+				return nil
+			}
+		case "PORT":
+			if port, err = strconv.Atoi(value); err != nil {
+				c.replyError(errXCLIENTSyntax)
+				return nil
+			}
+		case "HELO":
+			helo = value
+		case "LOGIN":
+			login = value
+		case "NAME", "PROTO":
+		default:
+			c.replyError(errXCLIENTSyntax)
+			return nil
+		}
+	}
+
+	c.mu.Lock()
+	c.addr = &net.TCPAddr{IP: ip, Port: port}
+	c.helo, c.login = helo, login
+	c.mu.Unlock()
+
+	if err := c.clientPolicy(); err != nil {
+		return c.refuse(err)
+	}
+
+	// the hooks apply to the original client
+	if c.session != nil {
+		if err := c.session.connect(); err != nil {
+			c.replyError(rejectError(err, 550, EnhancedCode{5, 7, 1}))
+			return nil
+		}
+	}
+
+	// as with Postfix, the client must greet again, go-smtp then resets the
+	// session
+	c.heloRequired = true
+
+	return c.greet()
+}
+
+// clientPolicy applies the connection policies of the accept time to the
+// client supplied by the proxy
+func (c *protocolConn) clientPolicy() error {
+	addr := c.RemoteAddr()
+
+	if c.config.ConnectionPolicy != nil {
+		if err := c.config.ConnectionPolicy(addr); err != nil {
+			return err
+		}
+	}
+
+	if c.config.AuthLockout != nil {
+		if err := c.config.AuthLockout.connectionPolicy(addr); err != nil {
+			return err
+		}
+	}
+
+	// the connection of the proxy was not charged, see connectionPolicy
+	if c.config.RateLimiter != nil {
+		return c.config.RateLimiter.allowConnection(addr)
+	}
+
+	return nil
+}
+
+// refuse replies the refusal of the client supplied by the proxy, the
+// returned io.EOF closes the connection
+func (c *protocolConn) refuse(err error) error {
+	c.config.logger().Log("session refused", "remote_addr", c.RemoteAddr(), "err", err)
+
+	smtpErr := rejectError(err, 554, EnhancedCode{5, 7, 1})
+	c.config.emitRejectedConn(c.RemoteAddr(), smtpErr.(*smtp.SMTPError))
+	c.replyError(smtpErr)
+
+	return io.EOF
+}
+
+// client returns the HELO and LOGIN values supplied by the proxy
+func (c *protocolConn) client() (helo, login string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.helo, c.login
+}
+
+// decodeXtext decodes the xtext encoding (RFC 3461) of the XCLIENT values
+func decodeXtext(s string) (string, error) {
+	if !strings.Contains(s, "+") {
+		return s, nil
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			sb.WriteByte(s[i])
+			continue
+		}
+
+		if i+2 >= len(s) {
+			return "", errXCLIENTSyntax
+		}
+		b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", errXCLIENTSyntax
+		}
+		sb.WriteByte(byte(b))
+		i += 2
+	}
+
+	return sb.String(), nil
+}